@@ -0,0 +1,131 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// CertificateReference references a Certificate in a specific namespace
+type CertificateReference struct {
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MinLength=1
+	Name string `json:"name"`
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MinLength=1
+	Namespace string `json:"namespace"`
+}
+
+// ConfigMapRef for specific config map details
+type ConfigMapRef struct {
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MinLength=1
+	Name string `json:"name"`
+}
+
+// BundleSource selects the certificates added to a Bundle
+// +kubebuilder:validation:XValidation:rule="has(self.certificate) != has(self.issuer)",message="exactly one of certificate or issuer should be set"
+type BundleSource struct {
+	// Certificate whose issuing certificate is added to the Bundle. The issuing
+	// certificate of a self-signed Certificate is the certificate itself.
+	// +optional
+	Certificate *CertificateReference `json:"certificate,omitempty"`
+	// Issuer of type ca whose root certificate is added to the Bundle.
+	// +optional
+	Issuer *IssuerReference `json:"issuer,omitempty"`
+}
+
+// KeystoreFormat configures an additional keystore encoding of a Bundle
+type KeystoreFormat struct {
+	// Password protecting the keystore.
+	//
+	// If unset, this defaults to `changeit`.
+	// +optional
+	Password string `json:"password,omitempty"`
+}
+
+// BundleFormats lists the additional encodings written next to the PEM bundle
+type BundleFormats struct {
+	// Write the Bundle as a JKS trust store under the `ca-bundle.jks` key.
+	// +optional
+	JKS *KeystoreFormat `json:"jks,omitempty"`
+	// Write the Bundle as a PKCS#12 trust store under the `ca-bundle.p12` key.
+	// +optional
+	PKCS12 *KeystoreFormat `json:"pkcs12,omitempty"`
+}
+
+// BundleTarget defines where a Bundle is distributed
+type BundleTarget struct {
+	// ConfigMap written in every selected namespace. The PEM bundle is stored
+	// under the `ca-bundle.crt` key.
+	// +kubebuilder:validation:Required
+	ConfigMapRef ConfigMapRef `json:"configMapRef"`
+
+	// Selects the namespaces the ConfigMap is written to. An empty selector
+	// selects all namespaces.
+	// +optional
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+
+	// Additional keystore encodings of the Bundle.
+	// +optional
+	AdditionalFormats *BundleFormats `json:"additionalFormats,omitempty"`
+}
+
+// BundleSpec defines the desired state of Bundle
+type BundleSpec struct {
+	// Sources of the certificates collected into the Bundle.
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MinItems=1
+	Sources []BundleSource `json:"sources"`
+
+	// Target the Bundle is distributed to.
+	// +kubebuilder:validation:Required
+	Target BundleTarget `json:"target"`
+}
+
+// BundleStatus defines the observed state of Bundle
+type BundleStatus struct {
+	ObservedGeneration int64       `json:"observedGeneration,omitempty"`
+	SyncedAt           metav1.Time `json:"syncedAt,omitempty"`
+	Namespaces         []string    `json:"namespaces,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:resource:scope=Cluster
+
+// Bundle is the Schema for the bundles API
+type Bundle struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   BundleSpec   `json:"spec,omitempty"`
+	Status BundleStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// BundleList contains a list of Bundle
+type BundleList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []Bundle `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&Bundle{}, &BundleList{})
+}
@@ -20,6 +20,59 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+// RenewRequestedAtAnnotation requests a one time reissue of a Certificate when set
+// to an RFC 3339 timestamp newer than the last honoured request.
+const RenewRequestedAtAnnotation = "certs.k8c.io/renew-requested-at"
+
+// RevokeAnnotation requests the revocation of the current certificate of a
+// Certificate issued by a CA Issuer, followed by a reissue. The value is the
+// revocation reason, e.g: keyCompromise. The annotation is removed once the
+// serial number is recorded by the Issuer.
+const RevokeAnnotation = "certs.k8c.io/revoke"
+
+// KeyUsage is a key usage or extended key usage of a certificate
+// +kubebuilder:validation:Enum="digital signature";"key encipherment";"server auth";"client auth";"code signing";"email protection"
+type KeyUsage string
+
+// Supported key usages
+const (
+	UsageDigitalSignature KeyUsage = "digital signature"
+	UsageKeyEncipherment  KeyUsage = "key encipherment"
+	UsageServerAuth       KeyUsage = "server auth"
+	UsageClientAuth       KeyUsage = "client auth"
+	UsageCodeSigning      KeyUsage = "code signing"
+	UsageEmailProtection  KeyUsage = "email protection"
+)
+
+// IssuerReference references a cluster scoped Issuer
+type IssuerReference struct {
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MinLength=1
+	Name string `json:"name"`
+}
+
+// SecretKeySelector selects a key of a Secret in the namespace of the Certificate
+type SecretKeySelector struct {
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MinLength=1
+	Name string `json:"name"`
+	// Key of the Secret, defaults to `tls.csr`.
+	// +optional
+	Key string `json:"key,omitempty"`
+}
+
+// CSRSource provides a PEM encoded certificate signing request generated
+// outside the cluster
+// +kubebuilder:validation:XValidation:rule="has(self.request) != has(self.secretRef)",message="exactly one of request or secretRef should be set"
+type CSRSource struct {
+	// Inline PEM encoded PKCS#10 certificate signing request.
+	// +optional
+	Request string `json:"request,omitempty"`
+	// Secret key holding the PEM encoded PKCS#10 certificate signing request.
+	// +optional
+	SecretRef *SecretKeySelector `json:"secretRef,omitempty"`
+}
+
 // SecretRef for specific secrets details
 type SecretRef struct {
 	// +kubebuilder:validation:Required
@@ -30,23 +83,31 @@ type SecretRef struct {
 // X509PkixSubject Full X509 name specification as per: https://pkg.go.dev/crypto/x509/pkix#Name
 type X509PkixSubject struct {
 	// Country to be used on the Certificate.
+	// +kubebuilder:validation:items:MinLength=1
 	// +optional
 	Country []string `json:"country,omitempty"`
 	// Organization to be used on the Certificate.
+	// +kubebuilder:validation:items:MinLength=1
 	// +optional
 	Organization []string `json:"organization,omitempty"`
 	// Organizational Unit to be used on the Certificate.
+	// +kubebuilder:validation:items:MinLength=1
 	// +optional
 	OrganizationalUnit []string `json:"organizationalUnit,omitempty"`
 	// Common Name to be used on the Certificate
 	// +optional
 	CommonName string `json:"commonName,omitempty"`
-	// Serial number to be used on the Certificate.
+	// SerialNumber attribute of the subject distinguished name. The serial
+	// number of the issued certificate is always chosen randomly.
 	// +optional
 	SerialNumber string `json:"serialNumber,omitempty"`
 }
 
 // CertificateSpec defines the desired state of Certificate
+// +kubebuilder:validation:XValidation:rule="(self.validity.endsWith('y') ? int(self.validity.substring(0, size(self.validity) - 1)) * 8760 : (self.validity.endsWith('d') ? int(self.validity.substring(0, size(self.validity) - 1)) * 24 : int(self.validity.substring(0, size(self.validity) - 1)))) >= 1 && (self.validity.endsWith('y') ? int(self.validity.substring(0, size(self.validity) - 1)) * 8760 : (self.validity.endsWith('d') ? int(self.validity.substring(0, size(self.validity) - 1)) * 24 : int(self.validity.substring(0, size(self.validity) - 1)))) <= 87600",message="validity should be between 1h and 10y"
+// +kubebuilder:validation:XValidation:rule="!has(self.renewBefore) || (self.renewBefore.endsWith('h') ? int(self.renewBefore.substring(0, size(self.renewBefore) - 1)) * 60 : int(self.renewBefore.substring(0, size(self.renewBefore) - 1))) >= 5",message="renewBefore minimum value should be 5m"
+// +kubebuilder:validation:XValidation:rule="!has(self.csr) || has(self.issuerRef)",message="a certificate signing request can only be signed by an issuer"
+// +kubebuilder:validation:XValidation:rule="!has(self.renewBefore) || (self.renewBefore.endsWith('h') ? int(self.renewBefore.substring(0, size(self.renewBefore) - 1)) * 60 : int(self.renewBefore.substring(0, size(self.renewBefore) - 1))) < (self.validity.endsWith('y') ? int(self.validity.substring(0, size(self.validity) - 1)) * 8760 : (self.validity.endsWith('d') ? int(self.validity.substring(0, size(self.validity) - 1)) * 24 : int(self.validity.substring(0, size(self.validity) - 1)))) * 60",message="renewBefore should be less than validity"
 type CertificateSpec struct {
 	// Requested set of X509 certificate subject attributes.
 	// More info: https://pkg.go.dev/crypto/x509/pkix#Name
@@ -56,19 +117,35 @@ type CertificateSpec struct {
 	Subject *X509PkixSubject `json:"subject,omitempty"`
 
 	// Requested DNS subject alternative names.
+	// Internationalized names are stored in their punycode form and a wildcard
+	// is only allowed as the complete leftmost label e.g: *.example.com
 	// +kubebuilder:validation:Required
 	// +kubebuilder:validation:MinLength=1
+	// +kubebuilder:validation:MaxLength=253
+	// +kubebuilder:validation:XValidation:rule="self.matches('^([*][.])?[a-z0-9]([-a-z0-9]*[a-z0-9])?([.][a-z0-9]([-a-z0-9]*[a-z0-9])?)*$')",message="dnsName should be a lower case RFC 1123 name with a wildcard only as the complete leftmost label"
+	// +kubebuilder:validation:XValidation:rule="!self.startsWith('*.') || self.substring(2).contains('.')",message="wildcard should be followed by at least two labels"
 	DNSName string `json:"dnsName,omitempty"`
 
+	// Additional requested DNS subject alternative names, the same rules as for
+	// dnsName apply to each entry.
+	// +kubebuilder:validation:MaxItems=100
+	// +kubebuilder:validation:items:MaxLength=253
+	// +kubebuilder:validation:items:Pattern=`^([*][.][a-z0-9]([-a-z0-9]*[a-z0-9])?([.][a-z0-9]([-a-z0-9]*[a-z0-9])?)+|[a-z0-9]([-a-z0-9]*[a-z0-9])?([.][a-z0-9]([-a-z0-9]*[a-z0-9])?)*)$`
+	// +optional
+	DNSNames []string `json:"dnsNames,omitempty"`
+
 	// Requested email subject alternative names.
+	// +kubebuilder:validation:items:MaxLength=254
+	// +kubebuilder:validation:items:Pattern=`^[^@\s<>*]+@[a-zA-Z0-9]([-a-zA-Z0-9]*[a-zA-Z0-9])?(\.[a-zA-Z0-9]([-a-zA-Z0-9]*[a-zA-Z0-9])?)*$`
 	// +optional
 	EmailAddresses []string `json:"emailAddresses,omitempty"`
 
 	// Requested 'validity' (i.e. lifetime) of the Certificate.
 	//
 	// If unset, this defaults to 360 days.
-	// Minimum accepted duration is 1 hour.
+	// Minimum accepted duration is 1 hour and maximum accepted duration is 10 years.
 	// +kubebuilder:validation:Pattern=`^\d+[hdy]$`
+	// +kubebuilder:validation:MaxLength=10
 	// +kubebuilder:validation:Required
 	Validity string `json:"validity,omitempty"`
 
@@ -87,9 +164,40 @@ type CertificateSpec struct {
 	// Value must be in units accepted by Go time.ParseDuration https://golang.org/pkg/time/#ParseDuration.
 	// Cannot be set if the `renewBeforePercentage` field is set.
 	// +kubebuilder:validation:Pattern=`^\d+[mh]$`
+	// +kubebuilder:validation:MaxLength=10
 	// +optional
 	RenewBefore string `json:"renewBefore,omitempty"`
 
+	// Size in bits of the RSA private key generated for the Certificate.
+	//
+	// If unset, this defaults to 2048.
+	// +kubebuilder:validation:Enum=2048;3072;4096
+	// +optional
+	KeySize int `json:"keySize,omitempty"`
+
+	// Key usages and extended key usages of the issued certificate.
+	//
+	// If unset, the certificate carries no key usage extensions.
+	// +listType=set
+	// +optional
+	Usages []KeyUsage `json:"usages,omitempty"`
+
+	// Mark the certificate as a certificate authority which may sign other
+	// certificates, e.g: for an Issuer of type ca.
+	// +optional
+	IsCA bool `json:"isCA,omitempty"`
+
+	// Issuer signing the certificate. If unset, the certificate is self-signed.
+	// +optional
+	IssuerRef *IssuerReference `json:"issuerRef,omitempty"`
+
+	// Certificate signing request generated outside the cluster, e.g: with a
+	// key kept in an HSM. No private key is generated and the Secret only holds
+	// `tls.crt` and `ca.crt`. The requested subject alternative names have to be
+	// part of the spec. Requires issuerRef.
+	// +optional
+	CSR *CSRSource `json:"csr,omitempty"`
+
 	// Name of the Secret resource that will be automatically created and
 	// managed by this Certificate resource. It will be populated with a
 	// private key and certificate, signed by the denoted issuer. The Secret
@@ -98,12 +206,37 @@ type CertificateSpec struct {
 	SecretRef SecretRef `json:"secretRef"`
 }
 
+// RestartedWorkload is a workload restarted after a renewal of the Certificate
+type RestartedWorkload struct {
+	// Kind of the workload, one of Deployment, StatefulSet or DaemonSet.
+	Kind string `json:"kind"`
+	// Name of the workload in the namespace of the Certificate.
+	Name string `json:"name"`
+	// SHA-256 fingerprint of the certificate the workload was restarted for.
+	Fingerprint string `json:"fingerprint"`
+	// Time the pod template of the workload was updated at.
+	RestartedAt metav1.Time `json:"restartedAt"`
+}
+
 // CertificateStatus defines the observed state of Certificate
 type CertificateStatus struct {
 	ExpiryDate         metav1.Time `json:"expiryDate,omitempty"`
 	RenewedAt          metav1.Time `json:"renewedAt,omitempty"`
 	ObservedGeneration int64       `json:"observedGeneration,omitempty"`
 	SecretRef          string      `json:"secretRef,omitempty"`
+	// LastManualRenewal is the timestamp of the last honoured
+	// certs.k8c.io/renew-requested-at annotation.
+	// +optional
+	LastManualRenewal *metav1.Time `json:"lastManualRenewal,omitempty"`
+	// Revision counts the certificates issued for the Certificate. The
+	// CertificateRequest of the next issuance is named after Revision+1.
+	// +optional
+	Revision int64 `json:"revision,omitempty"`
+	// RestartedWorkloads lists the workloads labeled with
+	// certs.k8c.io/restart-on-renew and the last time their pods were
+	// restarted for a new certificate.
+	// +optional
+	RestartedWorkloads []RestartedWorkload `json:"restartedWorkloads,omitempty"`
 }
 
 // +kubebuilder:object:root=true
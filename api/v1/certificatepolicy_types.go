@@ -0,0 +1,136 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// PolicySubject restricts the subject attributes a Certificate may request. The
+// values are path.Match patterns, e.g: `Team *`. An unset list is not restricted.
+type PolicySubject struct {
+	// +optional
+	Countries []string `json:"countries,omitempty"`
+	// +optional
+	Organizations []string `json:"organizations,omitempty"`
+	// +optional
+	OrganizationalUnits []string `json:"organizationalUnits,omitempty"`
+	// +optional
+	CommonNames []string `json:"commonNames,omitempty"`
+}
+
+// CertificatePolicySpec defines the restrictions a Certificate has to satisfy
+type CertificatePolicySpec struct {
+	// DNS names the Certificate may request. A `*` label in a pattern matches
+	// exactly one label, e.g: `*.team-a.example.com` matches `web.team-a.example.com`
+	// and `*.team-a.example.com` but not `a.web.team-a.example.com`.
+	// An unset list allows all DNS names.
+	// +optional
+	AllowedDNSNames []string `json:"allowedDNSNames,omitempty"`
+
+	// Email addresses the Certificate may request, as path.Match patterns,
+	// e.g: `*@team-a.example.com`. An unset list allows all email addresses.
+	// +optional
+	AllowedEmailAddresses []string `json:"allowedEmailAddresses,omitempty"`
+
+	// Subject attribute values the Certificate may request.
+	// +optional
+	AllowedSubject *PolicySubject `json:"allowedSubject,omitempty"`
+
+	// Longest validity the Certificate may request, in the format of the
+	// Certificate validity e.g: 90d.
+	// +kubebuilder:validation:Pattern=`^\d+[hdy]$`
+	// +optional
+	MaxValidity string `json:"maxValidity,omitempty"`
+
+	// Smallest RSA key size the Certificate may request.
+	// +kubebuilder:validation:Enum=1024;2048;3072;4096
+	// +optional
+	MinKeySize int `json:"minKeySize,omitempty"`
+
+	// Key usages the Certificate may request. An unset list allows all usages.
+	// +optional
+	AllowedUsages []KeyUsage `json:"allowedUsages,omitempty"`
+
+	// Names of the Issuers the Certificate may be signed by, as path.Match
+	// patterns. An unset list allows all Issuers.
+	// +optional
+	AllowedIssuers []string `json:"allowedIssuers,omitempty"`
+}
+
+// ClusterCertificatePolicySpec defines the restrictions a Certificate in the
+// selected namespaces has to satisfy
+type ClusterCertificatePolicySpec struct {
+	CertificatePolicySpec `json:",inline"`
+
+	// Selects the namespaces the policy applies to. An empty selector selects
+	// all namespaces.
+	// +optional
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+
+	// Allows the Certificates of the selected namespaces to request a CA
+	// certificate signed by an Issuer. Such a Certificate is refused unless
+	// every ClusterCertificatePolicy selecting its namespace allows it.
+	// +optional
+	AllowCA bool `json:"allowCA,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// CertificatePolicy is the Schema for the certificatepolicies API. It restricts
+// the Certificates of its namespace.
+type CertificatePolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec CertificatePolicySpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// CertificatePolicyList contains a list of CertificatePolicy
+type CertificatePolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []CertificatePolicy `json:"items"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:scope=Cluster
+
+// ClusterCertificatePolicy is the Schema for the clustercertificatepolicies API.
+// It restricts the Certificates of the selected namespaces.
+type ClusterCertificatePolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec ClusterCertificatePolicySpec `json:"spec,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// ClusterCertificatePolicyList contains a list of ClusterCertificatePolicy
+type ClusterCertificatePolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ClusterCertificatePolicy `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&CertificatePolicy{}, &CertificatePolicyList{})
+	SchemeBuilder.Register(&ClusterCertificatePolicy{}, &ClusterCertificatePolicyList{})
+}
@@ -0,0 +1,136 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// RequireApprovalLabel marks a namespace whose CertificateRequests have to be
+// approved by a principal with the `approve` verb before they are signed. In
+// other namespaces the controller approves its own requests.
+const RequireApprovalLabel = "certs.k8c.io/require-approval"
+
+// CertificateRequestCertificateLabel holds the name of the Certificate a
+// CertificateRequest was created for.
+const CertificateRequestCertificateLabel = "certs.k8c.io/certificate"
+
+// CertificateRequest condition types
+const (
+	// CertificateRequestApproved is set when the request may be signed
+	CertificateRequestApproved = "Approved"
+	// CertificateRequestDenied is set when the request must not be signed
+	CertificateRequestDenied = "Denied"
+	// CertificateRequestReady is set once the request has been signed
+	CertificateRequestReady = "Ready"
+	// CertificateRequestFailed is set when the issuer refused to sign the request
+	CertificateRequestFailed = "Failed"
+)
+
+// CertificateRequestSpec defines the desired state of CertificateRequest
+// +kubebuilder:validation:XValidation:rule="self == oldSelf",message="spec is immutable"
+type CertificateRequestSpec struct {
+	// Name of the Certificate the request was generated for.
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MinLength=1
+	CertificateName string `json:"certificateName"`
+
+	// PEM encoded PKCS#10 certificate signing request.
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MinLength=1
+	Request []byte `json:"request"`
+
+	// Requested lifetime of the signed certificate.
+	// +optional
+	Duration *metav1.Duration `json:"duration,omitempty"`
+
+	// Requested key usages of the signed certificate.
+	// +optional
+	Usages []KeyUsage `json:"usages,omitempty"`
+
+	// Request a certificate authority certificate.
+	// +optional
+	IsCA bool `json:"isCA,omitempty"`
+
+	// Issuer signing the request. If unset, the request is self-signed with the
+	// private key generated for it.
+	// +optional
+	IssuerRef *IssuerReference `json:"issuerRef,omitempty"`
+}
+
+// CertificateRequestStatus defines the observed state of CertificateRequest
+type CertificateRequestStatus struct {
+	// Conditions of the request. The Approved and Denied conditions can only be
+	// set by principals allowed to `approve` certificaterequests and can not be
+	// changed once set.
+	// +listType=map
+	// +listMapKey=type
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty"`
+
+	// PEM encoded certificate signed for the request.
+	// +optional
+	Certificate []byte `json:"certificate,omitempty"`
+
+	// URL of the order placed for the request with an ACME issuer.
+	// +optional
+	ACMEOrderURL string `json:"acmeOrderURL,omitempty"`
+
+	// TXT records presented for the DNS-01 challenges of the ACME order. They
+	// are removed once the order completes.
+	// +optional
+	ACMEDNS01Records []ACMEDNS01Record `json:"acmeDNS01Records,omitempty"`
+}
+
+// ACMEDNS01Record is a TXT record presented for a DNS-01 challenge
+type ACMEDNS01Record struct {
+	// Fully qualified name of the record, e.g: _acme-challenge.example.com.
+	FQDN string `json:"fqdn"`
+	// Value of the record
+	Value string `json:"value"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="Certificate",type=string,JSONPath=`.spec.certificateName`
+// +kubebuilder:printcolumn:name="Approved",type=string,JSONPath=`.status.conditions[?(@.type=="Approved")].status`
+// +kubebuilder:printcolumn:name="Denied",type=string,JSONPath=`.status.conditions[?(@.type=="Denied")].status`
+// +kubebuilder:printcolumn:name="Ready",type=string,JSONPath=`.status.conditions[?(@.type=="Ready")].status`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// CertificateRequest is the Schema for the certificaterequests API. It holds
+// the CSR generated by the controller for one issuance of a Certificate.
+type CertificateRequest struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   CertificateRequestSpec   `json:"spec,omitempty"`
+	Status CertificateRequestStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// CertificateRequestList contains a list of CertificateRequest
+type CertificateRequestList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []CertificateRequest `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&CertificateRequest{}, &CertificateRequestList{})
+}
@@ -0,0 +1,310 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// SecretReference references a Secret in a specific namespace
+type SecretReference struct {
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MinLength=1
+	Name string `json:"name"`
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MinLength=1
+	Namespace string `json:"namespace"`
+}
+
+// CAIssuer signs certificates with a CA certificate and private key
+type CAIssuer struct {
+	// Secret holding the PEM encoded CA certificate under `tls.crt` and its
+	// private key under `tls.key`, e.g: the Secret of a Certificate with isCA set.
+	// +kubebuilder:validation:Required
+	SecretRef SecretReference `json:"secretRef"`
+}
+
+// ACMEIssuer obtains certificates from an ACME server such as Let's Encrypt
+type ACMEIssuer struct {
+	// URL of the ACME directory, e.g: https://acme-v02.api.letsencrypt.org/directory
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:Pattern=`^https://`
+	Server string `json:"server"`
+
+	// Email address registered with the ACME account.
+	// +optional
+	Email string `json:"email,omitempty"`
+
+	// Secret storing the private key of the ACME account under `tls.key`. A key
+	// is generated and stored when the Secret does not exist. It has to be in
+	// the namespace of the manager.
+	// +kubebuilder:validation:Required
+	PrivateKeySecretRef SecretReference `json:"privateKeySecretRef"`
+
+	// PEM encoded CA certificates trusted for the ACME server in addition to the
+	// system roots, e.g: the certificate of a local Pebble instance.
+	// +optional
+	CABundle []byte `json:"caBundle,omitempty"`
+
+	// Solver of the challenges proving the control of the DNS names.
+	// +kubebuilder:validation:Required
+	Solver ACMESolver `json:"solver"`
+}
+
+// ACMESolver solves the challenges of the authorizations of an ACME order. When
+// both solvers are set, HTTP-01 is used unless the server only offers DNS-01,
+// e.g. for wildcard names.
+// +kubebuilder:validation:XValidation:rule="has(self.http01) || has(self.dns01)",message="a solver type should be set"
+type ACMESolver struct {
+	// HTTP01 solves HTTP-01 challenges with a temporary Pod, Service and Ingress
+	// in the namespace of the Certificate.
+	// +optional
+	HTTP01 *ACMEHTTP01Solver `json:"http01,omitempty"`
+
+	// DNS01 solves DNS-01 challenges with a TXT record at
+	// _acme-challenge.<dnsName>.
+	// +optional
+	DNS01 *ACMEDNS01Solver `json:"dns01,omitempty"`
+}
+
+// ACMEHTTP01Solver serves the HTTP-01 challenge responses through an Ingress
+type ACMEHTTP01Solver struct {
+	// IngressClassName of the Ingress routing the challenge requests to the
+	// solver. The default IngressClass is used when unset.
+	// +optional
+	IngressClassName *string `json:"ingressClassName,omitempty"`
+
+	// Image of the solver Pod, which serves the challenge response with the
+	// busybox httpd.
+	// +kubebuilder:default="busybox:1.36"
+	// +optional
+	Image string `json:"image,omitempty"`
+}
+
+// ACMEDNS01Solver presents the TXT records of DNS-01 challenges with a DNS provider
+// +kubebuilder:validation:XValidation:rule="has(self.rfc2136)",message="a DNS provider should be set"
+type ACMEDNS01Solver struct {
+	// RFC2136 updates the records with TSIG authenticated dynamic updates.
+	// +optional
+	RFC2136 *ACMERFC2136Provider `json:"rfc2136,omitempty"`
+
+	// Nameservers, as host or host:port, which have to serve the TXT record
+	// before the challenge is accepted. Defaults to the nameserver of the
+	// provider.
+	// +optional
+	PropagationNameservers []string `json:"propagationNameservers,omitempty"`
+}
+
+// ACMERFC2136Provider updates the records of a zone with dynamic updates (RFC 2136)
+type ACMERFC2136Provider struct {
+	// Nameserver receiving the updates, as host or host:port. The zone of a
+	// record is the zone this nameserver is authoritative for.
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MinLength=1
+	Nameserver string `json:"nameserver"`
+
+	// Name of the TSIG key authenticating the updates.
+	// +optional
+	TSIGKeyName string `json:"tsigKeyName,omitempty"`
+
+	// Algorithm of the TSIG key.
+	// +kubebuilder:validation:Enum=hmac-sha1;hmac-sha256;hmac-sha512
+	// +kubebuilder:default=hmac-sha256
+	// +optional
+	TSIGAlgorithm string `json:"tsigAlgorithm,omitempty"`
+
+	// Secret holding the base64 encoded TSIG secret under the `tsig-secret` key.
+	// It has to be in the namespace of the manager.
+	// +optional
+	TSIGSecretRef *SecretReference `json:"tsigSecretRef,omitempty"`
+}
+
+// VaultIssuer signs certificates with the PKI secrets engine of HashiCorp Vault
+type VaultIssuer struct {
+	// URL of the Vault server, e.g: https://vault.vault.svc:8200
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:Pattern=`^https://`
+	Server string `json:"server"`
+
+	// Path of the sign endpoint of the PKI role, e.g: pki/sign/k8c-io
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:Pattern=`^[^/].*/sign/[^/]+$`
+	Path string `json:"path"`
+
+	// Vault Enterprise namespace of the PKI secrets engine and auth method.
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+
+	// PEM encoded CA certificates trusted for the Vault server in addition to
+	// the system roots.
+	// +optional
+	CABundle []byte `json:"caBundle,omitempty"`
+
+	// Auth method the controller logs in with.
+	// +kubebuilder:validation:Required
+	Auth VaultAuth `json:"auth"`
+}
+
+// VaultAuth configures the auth method used to obtain a Vault token
+// +kubebuilder:validation:XValidation:rule="has(self.kubernetes) != has(self.appRole)",message="exactly one auth method should be set"
+type VaultAuth struct {
+	// Kubernetes logs in with a token requested for a ServiceAccount.
+	// +optional
+	Kubernetes *VaultKubernetesAuth `json:"kubernetes,omitempty"`
+
+	// AppRole logs in with a role ID and the secret ID stored in a Secret.
+	// +optional
+	AppRole *VaultAppRoleAuth `json:"appRole,omitempty"`
+}
+
+// VaultKubernetesAuth logs in with the Kubernetes auth method
+type VaultKubernetesAuth struct {
+	// Mount path of the Kubernetes auth method.
+	// +kubebuilder:default=kubernetes
+	// +optional
+	MountPath string `json:"mountPath,omitempty"`
+
+	// Vault role bound to the ServiceAccount.
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MinLength=1
+	Role string `json:"role"`
+
+	// ServiceAccount the login token is requested for. It has to be in the
+	// namespace of the manager.
+	// +kubebuilder:validation:Required
+	ServiceAccountRef ServiceAccountReference `json:"serviceAccountRef"`
+
+	// Audiences of the requested token. Defaults to the audience of the API
+	// server.
+	// +optional
+	Audiences []string `json:"audiences,omitempty"`
+}
+
+// ServiceAccountReference references a ServiceAccount in a specific namespace
+type ServiceAccountReference struct {
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MinLength=1
+	Name string `json:"name"`
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MinLength=1
+	Namespace string `json:"namespace"`
+}
+
+// VaultAppRoleAuth logs in with the AppRole auth method
+type VaultAppRoleAuth struct {
+	// Mount path of the AppRole auth method.
+	// +kubebuilder:default=approle
+	// +optional
+	MountPath string `json:"mountPath,omitempty"`
+
+	// Role ID of the AppRole.
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MinLength=1
+	RoleID string `json:"roleID"`
+
+	// Secret holding the secret ID of the AppRole under the `secret-id` key. It
+	// has to be in the namespace of the manager.
+	// +kubebuilder:validation:Required
+	SecretRef SecretReference `json:"secretRef"`
+}
+
+// IssuerSpec defines the desired state of Issuer
+// +kubebuilder:validation:XValidation:rule="(has(self.ca) ? 1 : 0) + (has(self.acme) ? 1 : 0) + (has(self.vault) ? 1 : 0) == 1",message="exactly one issuer type should be set"
+type IssuerSpec struct {
+	// CA signs certificates with a CA stored in a Secret.
+	// +optional
+	CA *CAIssuer `json:"ca,omitempty"`
+
+	// ACME obtains certificates from an ACME server.
+	// +optional
+	ACME *ACMEIssuer `json:"acme,omitempty"`
+
+	// Vault signs certificates with a Vault PKI role.
+	// +optional
+	Vault *VaultIssuer `json:"vault,omitempty"`
+}
+
+// RevocationReason is the reason code of a revoked certificate (RFC 5280, 5.3.1)
+// +kubebuilder:validation:Enum=unspecified;keyCompromise;caCompromise;affiliationChanged;superseded;cessationOfOperation;privilegeWithdrawn
+type RevocationReason string
+
+// RevocationReasons lists the supported revocation reasons
+var RevocationReasons = []RevocationReason{
+	"unspecified", "keyCompromise", "caCompromise", "affiliationChanged",
+	"superseded", "cessationOfOperation", "privilegeWithdrawn",
+}
+
+// RevokedCertificate is a certificate revoked by an Issuer
+type RevokedCertificate struct {
+	// Serial number of the certificate as a hexadecimal string.
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:Pattern=`^[0-9a-f]+$`
+	SerialNumber string `json:"serialNumber"`
+
+	// Reason of the revocation.
+	// +kubebuilder:default=unspecified
+	// +optional
+	Reason RevocationReason `json:"reason,omitempty"`
+
+	// Time of the revocation.
+	// +kubebuilder:validation:Required
+	RevokedAt metav1.Time `json:"revokedAt"`
+
+	// Expiry of the revoked certificate. The entry is removed once a CRL signed
+	// after the expiry listed it. Entries without expiry are kept.
+	// +optional
+	NotAfter *metav1.Time `json:"notAfter,omitempty"`
+
+	// Certificate the revoked certificate was issued for, as namespace/name.
+	// +optional
+	Certificate string `json:"certificate,omitempty"`
+}
+
+// IssuerStatus defines the observed state of Issuer
+type IssuerStatus struct {
+	// Certificates revoked by an Issuer of type ca. They are listed in the CRL
+	// published by the Issuer.
+	// +optional
+	RevokedCertificates []RevokedCertificate `json:"revokedCertificates,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:resource:scope=Cluster
+// +kubebuilder:subresource:status
+
+// Issuer is the Schema for the issuers API. Certificates referencing it through
+// their issuerRef are signed by it instead of being self-signed.
+type Issuer struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   IssuerSpec   `json:"spec,omitempty"`
+	Status IssuerStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// IssuerList contains a list of Issuer
+type IssuerList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []Issuer `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&Issuer{}, &IssuerList{})
+}
@@ -0,0 +1,91 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// WorkloadIdentitySpec defines the desired state of WorkloadIdentity
+type WorkloadIdentitySpec struct {
+	// ServiceAccount in the namespace of the WorkloadIdentity the SVID
+	// identifies, as spiffe://<trust-domain>/ns/<namespace>/sa/<serviceAccountName>
+	// with the --trust-domain of the manager.
+	// +kubebuilder:validation:Required
+	// +kubebuilder:validation:MinLength=1
+	// +kubebuilder:validation:MaxLength=253
+	ServiceAccountName string `json:"serviceAccountName"`
+
+	// Requested 'validity' (i.e. lifetime) of the SVID, between 1h and 30d. It
+	// is renewed once a third of it is left.
+	// +kubebuilder:validation:Pattern=`^(([1-9]|[1-9][0-9]|[1-6][0-9]{2}|7[01][0-9]|720)h|([1-9]|[12][0-9]|30)d)$`
+	// +kubebuilder:validation:MaxLength=10
+	// +kubebuilder:default="1h"
+	// +optional
+	Validity string `json:"validity,omitempty"`
+
+	// Issuer of type ca signing the SVID.
+	// +kubebuilder:validation:Required
+	IssuerRef IssuerReference `json:"issuerRef"`
+
+	// Name of the Secret the SVID is stored in, in the namespace of the
+	// WorkloadIdentity, with `tls.crt`, `tls.key` and `ca.crt` keys.
+	// +kubebuilder:validation:Required
+	SecretRef SecretRef `json:"secretRef"`
+}
+
+// WorkloadIdentityStatus defines the observed state of WorkloadIdentity
+type WorkloadIdentityStatus struct {
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+	// SPIFFE ID of the current SVID.
+	// +optional
+	SPIFFEID string `json:"spiffeID,omitempty"`
+	// Expiry of the current SVID.
+	// +optional
+	ExpiryDate metav1.Time `json:"expiryDate,omitempty"`
+	// Time the current SVID was issued at.
+	// +optional
+	RenewedAt metav1.Time `json:"renewedAt,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:printcolumn:name="SPIFFE ID",type=string,JSONPath=`.status.spiffeID`
+// +kubebuilder:printcolumn:name="Expiry",type=date,JSONPath=`.status.expiryDate`
+
+// WorkloadIdentity is the Schema for the workloadidentities API. It issues
+// short-lived X.509 SVIDs for a ServiceAccount.
+type WorkloadIdentity struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   WorkloadIdentitySpec   `json:"spec,omitempty"`
+	Status WorkloadIdentityStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// WorkloadIdentityList contains a list of WorkloadIdentity
+type WorkloadIdentityList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []WorkloadIdentity `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&WorkloadIdentity{}, &WorkloadIdentityList{})
+}
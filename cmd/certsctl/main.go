@@ -0,0 +1,223 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// certsctl issues certificates from Certificate manifests without a cluster. It
+// applies the same defaulting, validation and issuing code as the controller.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilyaml "k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/yaml"
+
+	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
+	"github.com/PNarode/k8c-certs-manager/internal/helper"
+	"github.com/PNarode/k8c-certs-manager/internal/validation"
+)
+
+// readCertificate reads the Certificate from a manifest, which may contain other
+// objects. The name selects a Certificate when the manifest contains several.
+func readCertificate(path, name string) (*certsv1.Certificate, error) {
+	var in io.Reader = os.Stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		in = file
+	}
+
+	var found []*certsv1.Certificate
+	decoder := utilyaml.NewYAMLOrJSONDecoder(in, 4096)
+	for {
+		var typeMeta metav1.TypeMeta
+		var raw map[string]interface{}
+		err := decoder.Decode(&raw)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		data, err := yaml.Marshal(raw)
+		if err != nil {
+			return nil, err
+		}
+		err = yaml.Unmarshal(data, &typeMeta)
+		if err != nil {
+			return nil, err
+		}
+		if typeMeta.GroupVersionKind() != certsv1.GroupVersion.WithKind("Certificate") {
+			continue
+		}
+		certificate := &certsv1.Certificate{}
+		err = yaml.UnmarshalStrict(data, certificate)
+		if err != nil {
+			return nil, err
+		}
+		if name == "" || certificate.Name == name {
+			found = append(found, certificate)
+		}
+	}
+
+	switch {
+	case len(found) == 0 && name != "":
+		return nil, fmt.Errorf("no Certificate %s found in %s", name, path)
+	case len(found) == 0:
+		return nil, fmt.Errorf("no Certificate found in %s", path)
+	case len(found) > 1:
+		return nil, fmt.Errorf("%d Certificates found in %s, select one with --name", len(found), path)
+	}
+	return found[0], nil
+}
+
+// prepareCertificate defaults and validates a Certificate like the admission webhooks
+func prepareCertificate(ctx context.Context, certificate *certsv1.Certificate, stderr io.Writer) error {
+	err := validation.DefaultCertificate(ctx, certificate)
+	if err != nil {
+		return err
+	}
+	allErrs := validation.ValidateCertificate(certificate)
+	if len(allErrs) != 0 {
+		return allErrs.ToAggregate()
+	}
+	for _, warning := range validation.CertificateWarnings(certificate) {
+		fmt.Fprintln(stderr, "Warning:", warning)
+	}
+	return nil
+}
+
+func newValidateCommand() *cobra.Command {
+	var filename, name string
+	cmd := &cobra.Command{
+		Use:   "validate",
+		Short: "Default and validate a Certificate manifest and print the result",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			certificate, err := readCertificate(filename, name)
+			if err != nil {
+				return err
+			}
+			err = prepareCertificate(cmd.Context(), certificate, cmd.ErrOrStderr())
+			if err != nil {
+				return err
+			}
+			data, err := yaml.Marshal(certificate)
+			if err != nil {
+				return err
+			}
+			_, err = cmd.OutOrStdout().Write(data)
+			return err
+		},
+	}
+	cmd.Flags().StringVarP(&filename, "filename", "f", "-", "The manifest containing the Certificate, - for stdin")
+	cmd.Flags().StringVar(&name, "name", "", "The name of the Certificate, when the manifest contains several")
+	return cmd
+}
+
+func newIssueCommand() *cobra.Command {
+	var filename, name, outDir string
+	var secretManifest bool
+	cmd := &cobra.Command{
+		Use:   "issue",
+		Short: "Issue the certificate requested by a Certificate manifest",
+		Long: "Issue the certificate requested by a Certificate manifest and write tls.crt, tls.key and ca.crt " +
+			"to the output directory, or print the Secret the controller would create with --secret.",
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			certificate, err := readCertificate(filename, name)
+			if err != nil {
+				return err
+			}
+			err = prepareCertificate(cmd.Context(), certificate, cmd.ErrOrStderr())
+			if err != nil {
+				return err
+			}
+			if certificate.Spec.IssuerRef != nil || certificate.Spec.CSR != nil {
+				return fmt.Errorf("certsctl only issues self-signed certificates, certificate %s references an issuer", certificate.Name)
+			}
+			cert, key, err := helper.GenerateSelfSignedCertificate(*certificate)
+			if err != nil {
+				return err
+			}
+			data := helper.SecretData(cert, key)
+
+			if secretManifest {
+				secret := &corev1.Secret{
+					TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      certificate.Spec.SecretRef.Name,
+						Namespace: certificate.Namespace,
+					},
+					Data: data,
+					Type: corev1.SecretTypeTLS,
+				}
+				manifest, err := yaml.Marshal(secret)
+				if err != nil {
+					return err
+				}
+				_, err = cmd.OutOrStdout().Write(manifest)
+				return err
+			}
+
+			err = os.MkdirAll(outDir, 0o755)
+			if err != nil {
+				return err
+			}
+			for _, file := range []string{"tls.crt", "ca.crt", "tls.key"} {
+				mode := os.FileMode(0o644)
+				if file == "tls.key" {
+					mode = 0o600
+				}
+				err = os.WriteFile(filepath.Join(outDir, file), data[file], mode)
+				if err != nil {
+					return err
+				}
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "certificate %s issued to %s\n", certificate.Name, outDir)
+			return nil
+		},
+	}
+	cmd.Flags().StringVarP(&filename, "filename", "f", "-", "The manifest containing the Certificate, - for stdin")
+	cmd.Flags().StringVar(&name, "name", "", "The name of the Certificate, when the manifest contains several")
+	cmd.Flags().StringVarP(&outDir, "out-dir", "o", ".", "The directory tls.crt, tls.key and ca.crt are written to")
+	cmd.Flags().BoolVar(&secretManifest, "secret", false, "Print the Secret manifest instead of writing files")
+	return cmd
+}
+
+func main() {
+	root := &cobra.Command{
+		Use:           "certsctl",
+		Short:         "Issue certificates from Certificate manifests without a cluster",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	}
+	root.AddCommand(newIssueCommand(), newValidateCommand())
+	if err := root.Execute(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+}
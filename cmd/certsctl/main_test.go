@@ -0,0 +1,169 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+
+	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
+	"github.com/PNarode/k8c-certs-manager/internal/helper"
+)
+
+const webManifest = `apiVersion: certs.k8c.io/v1
+kind: Certificate
+metadata:
+  name: web
+  namespace: shop
+spec:
+  dnsName: web.k8c.io
+  validity: 30d
+  secretRef:
+    name: web-tls
+`
+
+const apiManifest = `apiVersion: certs.k8c.io/v1
+kind: Certificate
+metadata:
+  name: api
+  namespace: shop
+spec:
+  dnsName: api.k8c.io
+  validity: 500d
+  usages: [server auth]
+  secretRef:
+    name: api-tls
+`
+
+const serviceManifest = `apiVersion: v1
+kind: Service
+metadata:
+  name: web
+`
+
+var _ = Describe("certsctl", func() {
+	// writeManifest writes the documents to a manifest file and returns its path
+	writeManifest := func(documents ...string) string {
+		path := filepath.Join(GinkgoT().TempDir(), "manifest.yaml")
+		var data []byte
+		for _, document := range documents {
+			data = append(data, "---\n"+document...)
+		}
+		Expect(os.WriteFile(path, data, 0o600)).To(Succeed())
+		return path
+	}
+	run := func(cmd *cobra.Command, args ...string) (string, string, error) {
+		stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+		cmd.SetOut(stdout)
+		cmd.SetErr(stderr)
+		cmd.SetArgs(args)
+		cmd.SilenceUsage = true
+		cmd.SilenceErrors = true
+		err := cmd.ExecuteContext(context.Background())
+		return stdout.String(), stderr.String(), err
+	}
+
+	DescribeTable("readCertificate",
+		func(documents []string, name, expected, expectedErr string) {
+			certificate, err := readCertificate(writeManifest(documents...), name)
+			if expectedErr != "" {
+				Expect(err).To(MatchError(ContainSubstring(expectedErr)))
+				return
+			}
+			Expect(err).NotTo(HaveOccurred())
+			Expect(certificate.Name).To(Equal(expected))
+		},
+		Entry("single Certificate among other objects", []string{serviceManifest, webManifest}, "", "web", ""),
+		Entry("Certificate selected by name", []string{webManifest, apiManifest}, "api", "api", ""),
+		Entry("several Certificates", []string{webManifest, apiManifest}, "", "", "2 Certificates found"),
+		Entry("unknown name", []string{webManifest}, "api", "", "no Certificate api found"),
+		Entry("no Certificate", []string{serviceManifest}, "", "", "no Certificate found"),
+		Entry("unknown field", []string{webManifest + "  dnsNmes: [www.k8c.io]\n"}, "", "", "unknown field"),
+	)
+
+	It("should default and validate like the admission webhooks", func() {
+		certificate, err := readCertificate(writeManifest(apiManifest), "")
+		Expect(err).NotTo(HaveOccurred())
+		stderr := &bytes.Buffer{}
+		Expect(prepareCertificate(context.Background(), certificate, stderr)).To(Succeed())
+		Expect(certificate.Spec.Subject).To(Equal(&certsv1.X509PkixSubject{CommonName: "api.k8c.io"}))
+		Expect(certificate.Spec.RenewBefore).To(Equal("5m"))
+		Expect(certificate.Annotations).To(HaveKeyWithValue("validityInHours", "12000h"))
+		Expect(stderr.String()).To(ContainSubstring("Warning: spec.validity: 500d is above 398 days"))
+
+		certificate.Spec.DNSName = "api..k8c.io"
+		Expect(prepareCertificate(context.Background(), certificate, stderr)).To(MatchError(ContainSubstring("spec.dnsName")))
+	})
+
+	It("should print the defaulted Certificate", func() {
+		stdout, _, err := run(newValidateCommand(), "-f", writeManifest(webManifest))
+		Expect(err).NotTo(HaveOccurred())
+		certificate := &certsv1.Certificate{}
+		Expect(yaml.UnmarshalStrict([]byte(stdout), certificate)).To(Succeed())
+		Expect(certificate.Spec.RenewBefore).To(Equal("5m"))
+		Expect(certificate.Annotations).To(HaveKeyWithValue("validityInHours", "720h"))
+	})
+
+	It("should write the issued certificate to the output directory", func() {
+		outDir := filepath.Join(GinkgoT().TempDir(), "web")
+		stdout, _, err := run(newIssueCommand(), "-f", writeManifest(webManifest), "-o", outDir)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(stdout).To(Equal("certificate web issued to " + outDir + "\n"))
+
+		certPEM, err := os.ReadFile(filepath.Join(outDir, "tls.crt"))
+		Expect(err).NotTo(HaveOccurred())
+		keyPEM, err := os.ReadFile(filepath.Join(outDir, "tls.key"))
+		Expect(err).NotTo(HaveOccurred())
+		_, err = tls.X509KeyPair(certPEM, keyPEM)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(filepath.Join(outDir, "ca.crt")).To(BeARegularFile())
+		info, err := os.Stat(filepath.Join(outDir, "tls.key"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(info.Mode().Perm()).To(Equal(os.FileMode(0o600)))
+
+		chain, err := helper.ParseCertificatesPEM(certPEM)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(chain[0].DNSNames).To(Equal([]string{"web.k8c.io"}))
+	})
+
+	It("should print the Secret the controller would create", func() {
+		stdout, _, err := run(newIssueCommand(), "-f", writeManifest(webManifest), "--secret")
+		Expect(err).NotTo(HaveOccurred())
+		secret := &corev1.Secret{}
+		Expect(yaml.UnmarshalStrict([]byte(stdout), secret)).To(Succeed())
+		Expect(secret.Name).To(Equal("web-tls"))
+		Expect(secret.Namespace).To(Equal("shop"))
+		Expect(secret.Type).To(Equal(corev1.SecretTypeTLS))
+		Expect(secret.Data).To(HaveKey("tls.crt"))
+		Expect(secret.Data).To(HaveKey("tls.key"))
+	})
+
+	It("should refuse Certificates of an issuer", func() {
+		manifest := webManifest + "  issuerRef:\n    name: internal-ca\n"
+		_, _, err := run(newIssueCommand(), "-f", writeManifest(manifest), "--secret")
+		Expect(err).To(MatchError(ContainSubstring("only issues self-signed certificates")))
+	})
+})
@@ -0,0 +1,83 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
+)
+
+func newApproveCommand(o *options) *cobra.Command {
+	return newDecisionCommand(o, "approve", certsv1.CertificateRequestApproved, "Approve CertificateRequests so that they are signed")
+}
+
+func newDenyCommand(o *options) *cobra.Command {
+	return newDecisionCommand(o, "deny", certsv1.CertificateRequestDenied, "Deny CertificateRequests so that they are never signed")
+}
+
+// newDecisionCommand returns a command setting the Approved or Denied condition
+// of CertificateRequests. The API server only admits it for users holding the
+// approve verb on certificaterequests.
+func newDecisionCommand(o *options, use, conditionType, short string) *cobra.Command {
+	var reason, message string
+	cmd := &cobra.Command{
+		Use:   use + " CERTIFICATEREQUEST...",
+		Short: short,
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, namespace, err := o.client()
+			if err != nil {
+				return err
+			}
+			for _, name := range args {
+				request := &certsv1.CertificateRequest{}
+				err = c.Get(cmd.Context(), types.NamespacedName{Name: name, Namespace: namespace}, request)
+				if err != nil {
+					return err
+				}
+				for _, decided := range []string{certsv1.CertificateRequestApproved, certsv1.CertificateRequestDenied} {
+					if meta.IsStatusConditionTrue(request.Status.Conditions, decided) {
+						return fmt.Errorf("certificaterequest %s/%s is already %s", namespace, name, decided)
+					}
+				}
+				patch := client.MergeFrom(request.DeepCopy())
+				meta.SetStatusCondition(&request.Status.Conditions, metav1.Condition{
+					Type:    conditionType,
+					Status:  metav1.ConditionTrue,
+					Reason:  reason,
+					Message: message,
+				})
+				err = c.Status().Patch(cmd.Context(), request, patch)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(cmd.OutOrStdout(), "certificaterequest.certs.k8c.io/%s %s\n", name, conditionType)
+			}
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&reason, "reason", "KubectlCerts", "The reason recorded in the condition, in CamelCase")
+	cmd.Flags().StringVar(&message, "message", "", "The message recorded in the condition")
+	return cmd
+}
@@ -0,0 +1,72 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
+)
+
+var _ = Describe("approve and deny", func() {
+	newRequest := func(conditions ...metav1.Condition) *certsv1.CertificateRequest {
+		return &certsv1.CertificateRequest{
+			ObjectMeta: metav1.ObjectMeta{Name: "web-1", Namespace: "default"},
+			Status:     certsv1.CertificateRequestStatus{Conditions: conditions},
+		}
+	}
+	decided := func(conditionType string) metav1.Condition {
+		return metav1.Condition{Type: conditionType, Status: metav1.ConditionTrue, Reason: "Test"}
+	}
+
+	DescribeTable("deciding a CertificateRequest",
+		func(request *certsv1.CertificateRequest, approve bool, args []string, expected *metav1.Condition, expectedErr string) {
+			o := newOptions(request)
+			command := newDenyCommand(o)
+			if approve {
+				command = newApproveCommand(o)
+			}
+			out, err := run(command, args...)
+			found := &certsv1.CertificateRequest{}
+			Expect(o.cluster.Get(ctx(), types.NamespacedName{Name: "web-1", Namespace: "default"}, found)).To(Succeed())
+			if expectedErr != "" {
+				Expect(err).To(MatchError(ContainSubstring(expectedErr)))
+				Expect(found.Status.Conditions).To(Equal(request.Status.Conditions))
+				return
+			}
+			Expect(err).NotTo(HaveOccurred())
+			Expect(out).To(Equal("certificaterequest.certs.k8c.io/web-1 " + expected.Type + "\n"))
+			condition := meta.FindStatusCondition(found.Status.Conditions, expected.Type)
+			Expect(condition).NotTo(BeNil())
+			Expect(condition.Status).To(Equal(metav1.ConditionTrue))
+			Expect(condition.Reason).To(Equal(expected.Reason))
+			Expect(condition.Message).To(Equal(expected.Message))
+		},
+		Entry("approve", newRequest(), true, []string{"web-1"},
+			&metav1.Condition{Type: certsv1.CertificateRequestApproved, Reason: "KubectlCerts"}, ""),
+		Entry("deny with a reason", newRequest(), false, []string{"web-1", "--reason", "Unknown", "--message", "not ours"},
+			&metav1.Condition{Type: certsv1.CertificateRequestDenied, Reason: "Unknown", Message: "not ours"}, ""),
+		Entry("approve a denied request", newRequest(decided(certsv1.CertificateRequestDenied)), true, []string{"web-1"},
+			nil, "is already Denied"),
+		Entry("deny an approved request", newRequest(decided(certsv1.CertificateRequestApproved)), false, []string{"web-1"},
+			nil, "is already Approved"),
+	)
+})
@@ -0,0 +1,76 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/PNarode/k8c-certs-manager/internal/helper"
+)
+
+func newCheckCommand(o *options) *cobra.Command {
+	return &cobra.Command{
+		Use:   "check CERTIFICATE",
+		Short: "Verify that the private key matches the issued certificate and the certificate matches the spec",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, namespace, err := o.client()
+			if err != nil {
+				return err
+			}
+			certificate, secret, err := getCertificateSecret(cmd.Context(), c, namespace, args[0])
+			if err != nil {
+				return err
+			}
+
+			var problems []string
+			// the private key of a supplied CSR never reaches the Secret
+			if certificate.Spec.CSR == nil {
+				_, err = tls.X509KeyPair(secret.Data["tls.crt"], secret.Data["tls.key"])
+				if err != nil {
+					problems = append(problems, fmt.Sprintf("key pair: %v", err))
+				}
+			}
+			chain, err := helper.ParseCertificatesPEM(secret.Data["tls.crt"])
+			switch {
+			case err != nil:
+				problems = append(problems, fmt.Sprintf("certificate: %v", err))
+			case len(chain) == 0:
+				problems = append(problems, "certificate: no certificate in tls.crt")
+			default:
+				if time.Now().After(chain[0].NotAfter) {
+					problems = append(problems, fmt.Sprintf("certificate: expired at %s", chain[0].NotAfter.Format(time.RFC3339)))
+				}
+				problems = append(problems, helper.SpecMismatches(*certificate, chain[0])...)
+			}
+
+			out := cmd.OutOrStdout()
+			if len(problems) == 0 {
+				fmt.Fprintf(out, "certificate.certs.k8c.io/%s is valid\n", certificate.Name)
+				return nil
+			}
+			for _, problem := range problems {
+				fmt.Fprintf(out, "  - %s\n", problem)
+			}
+			return fmt.Errorf("certificate %s/%s has %d problem(s)", namespace, certificate.Name, len(problems))
+		},
+	}
+}
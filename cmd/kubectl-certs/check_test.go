@@ -0,0 +1,63 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+
+	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
+	"github.com/PNarode/k8c-certs-manager/internal/helper"
+)
+
+var _ = Describe("check", func() {
+	DescribeTable("checking a Certificate",
+		func(modify func(*certsv1.Certificate, *corev1.Secret), expected ...string) {
+			certificate := newCertificate("web")
+			secret := issue(certificate)
+			modify(certificate, secret)
+
+			out, err := run(newCheckCommand(newOptions(certificate, secret)), "web")
+			if len(expected) == 0 {
+				Expect(err).NotTo(HaveOccurred())
+				Expect(out).To(Equal("certificate.certs.k8c.io/web is valid\n"))
+				return
+			}
+			Expect(err).To(MatchError(ContainSubstring("has %d problem(s)", len(expected))))
+			for _, problem := range expected {
+				Expect(out).To(ContainSubstring("  - " + problem))
+			}
+		},
+		Entry("valid", func(*certsv1.Certificate, *corev1.Secret) {}),
+		Entry("spec changed after issuance", func(certificate *certsv1.Certificate, _ *corev1.Secret) {
+			certificate.Spec.DNSNames = []string{"www.k8c.io"}
+		}, "dnsNames: expected [web.k8c.io www.k8c.io], got [web.k8c.io]"),
+		Entry("mismatched private key", func(_ *certsv1.Certificate, secret *corev1.Secret) {
+			_, keyPEM, err := helper.GeneratePrivateKey(certsv1.Certificate{})
+			Expect(err).NotTo(HaveOccurred())
+			secret.Data["tls.key"] = keyPEM
+		}, "key pair: "),
+		Entry("missing certificate", func(_ *certsv1.Certificate, secret *corev1.Secret) {
+			delete(secret.Data, "tls.crt")
+		}, "key pair: ", "certificate: no certificate in tls.crt"),
+		Entry("supplied CSR without private key", func(certificate *certsv1.Certificate, secret *corev1.Secret) {
+			certificate.Spec.CSR = &certsv1.CSRSource{SecretRef: &certsv1.SecretKeySelector{Name: "web-csr"}}
+			delete(secret.Data, "tls.key")
+		}),
+	)
+})
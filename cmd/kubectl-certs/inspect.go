@@ -0,0 +1,101 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/PNarode/k8c-certs-manager/internal/helper"
+)
+
+func newInspectCommand(o *options) *cobra.Command {
+	return &cobra.Command{
+		Use:   "inspect CERTIFICATE",
+		Short: "Decode the Secret of a Certificate and print the issued certificate and its chain",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, namespace, err := o.client()
+			if err != nil {
+				return err
+			}
+			_, secret, err := getCertificateSecret(cmd.Context(), c, namespace, args[0])
+			if err != nil {
+				return err
+			}
+			chain, err := helper.ParseCertificatesPEM(secret.Data["tls.crt"])
+			if err != nil {
+				return err
+			}
+			if len(chain) == 0 {
+				return fmt.Errorf("secret %s/%s holds no certificate", namespace, secret.Name)
+			}
+			cas, err := helper.ParseCertificatesPEM(secret.Data["ca.crt"])
+			if err != nil {
+				return err
+			}
+
+			out := cmd.OutOrStdout()
+			fmt.Fprintf(out, "Secret: %s/%s\n", namespace, secret.Name)
+			printCertificate(out, chain[0])
+			fmt.Fprintln(out, "Chain:")
+			for i, cert := range chain {
+				fmt.Fprintf(out, "  %d: %s\n", i, cert.Subject)
+				fmt.Fprintf(out, "     issued by %s\n", cert.Issuer)
+			}
+			for _, cert := range cas {
+				fmt.Fprintf(out, "  ca: %s\n", cert.Subject)
+				fmt.Fprintf(out, "      expires %s\n", cert.NotAfter.Format(time.RFC3339))
+			}
+			return nil
+		},
+	}
+}
+
+func printCertificate(out io.Writer, cert *x509.Certificate) {
+	fmt.Fprintf(out, "Subject: %s\n", cert.Subject)
+	fmt.Fprintf(out, "Issuer: %s\n", cert.Issuer)
+	fmt.Fprintf(out, "Serial Number: %s\n", fingerprint(cert.SerialNumber.Bytes()))
+	fmt.Fprintf(out, "Not Before: %s\n", cert.NotBefore.Format(time.RFC3339))
+	fmt.Fprintf(out, "Not After: %s\n", cert.NotAfter.Format(time.RFC3339))
+	fmt.Fprintf(out, "DNS Names: %s\n", strings.Join(cert.DNSNames, ", "))
+	if len(cert.EmailAddresses) > 0 {
+		fmt.Fprintf(out, "Email Addresses: %s\n", strings.Join(cert.EmailAddresses, ", "))
+	}
+	fmt.Fprintf(out, "Public Key: %s\n", cert.PublicKeyAlgorithm)
+	fmt.Fprintf(out, "Signature Algorithm: %s\n", cert.SignatureAlgorithm)
+	sha256Sum := sha256.Sum256(cert.Raw)
+	sha1Sum := sha1.Sum(cert.Raw)
+	fmt.Fprintf(out, "SHA-256 Fingerprint: %s\n", fingerprint(sha256Sum[:]))
+	fmt.Fprintf(out, "SHA-1 Fingerprint: %s\n", fingerprint(sha1Sum[:]))
+}
+
+// fingerprint formats bytes as colon separated hexadecimal pairs
+func fingerprint(data []byte) string {
+	pairs := make([]string, len(data))
+	for i, b := range data {
+		pairs[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(pairs, ":")
+}
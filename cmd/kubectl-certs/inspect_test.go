@@ -0,0 +1,53 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("inspect", func() {
+	It("should print the issued certificate and its chain", func() {
+		certificate := newCertificate("web")
+		certificate.Spec.DNSNames = []string{"www.k8c.io"}
+		o := newOptions(certificate, issue(certificate))
+
+		out, err := run(newInspectCommand(o), "web")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(out).To(ContainSubstring("Secret: default/web\n"))
+		Expect(out).To(ContainSubstring("Subject: CN=web.k8c.io\n"))
+		Expect(out).To(ContainSubstring("DNS Names: web.k8c.io, www.k8c.io\n"))
+		Expect(out).To(ContainSubstring("  0: CN=web.k8c.io\n"))
+		Expect(out).To(ContainSubstring("  ca: CN=web.k8c.io\n"))
+		Expect(out).To(MatchRegexp(`SHA-256 Fingerprint: ([0-9A-F]{2}:){31}[0-9A-F]{2}\n`))
+	})
+
+	It("should fail for a Certificate which has not been issued", func() {
+		_, err := run(newInspectCommand(newOptions(newCertificate("web"))), "web")
+		Expect(err).To(MatchError(ContainSubstring("has not been issued")))
+	})
+
+	DescribeTable("fingerprint",
+		func(data []byte, expected string) {
+			Expect(fingerprint(data)).To(Equal(expected))
+		},
+		Entry("empty", []byte{}, ""),
+		Entry("single byte", []byte{0x0a}, "0A"),
+		Entry("several bytes", []byte{0xde, 0xad, 0x01}, "DE:AD:01"),
+	)
+})
@@ -0,0 +1,123 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// kubectl-certs is a kubectl plugin to inspect, renew and diagnose Certificates.
+// Installed in the PATH it is invoked as `kubectl certs <command>`.
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
+	_ "k8s.io/client-go/plugin/pkg/client/auth"
+
+	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
+)
+
+var scheme = runtime.NewScheme()
+
+func init() {
+	utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+	utilruntime.Must(certsv1.AddToScheme(scheme))
+}
+
+// options holds the connection flags shared by all commands
+type options struct {
+	configFlags clientcmd.ConfigOverrides
+	kubeconfig  string
+	namespace   string
+	// cluster is used instead of the kubeconfig when set
+	cluster client.Client
+}
+
+// client returns a client for the cluster and the namespace selected by the flags
+func (o *options) client() (client.Client, string, error) {
+	if o.cluster != nil {
+		return o.cluster, o.namespace, nil
+	}
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	loadingRules.ExplicitPath = o.kubeconfig
+	overrides := o.configFlags
+	overrides.Context.Namespace = o.namespace
+	clientConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, &overrides)
+
+	namespace, _, err := clientConfig.Namespace()
+	if err != nil {
+		return nil, "", err
+	}
+	config, err := clientConfig.ClientConfig()
+	if err != nil {
+		return nil, "", err
+	}
+	c, err := client.New(config, client.Options{Scheme: scheme})
+	if err != nil {
+		return nil, "", err
+	}
+	return c, namespace, nil
+}
+
+// getCertificateSecret returns a Certificate and the Secret it is stored in
+func getCertificateSecret(ctx context.Context, c client.Client, namespace, name string) (*certsv1.Certificate, *corev1.Secret, error) {
+	certificate := &certsv1.Certificate{}
+	err := c.Get(ctx, types.NamespacedName{Name: name, Namespace: namespace}, certificate)
+	if err != nil {
+		return nil, nil, err
+	}
+	secret := &corev1.Secret{}
+	err = c.Get(ctx, types.NamespacedName{Name: certificate.Spec.SecretRef.Name, Namespace: namespace}, secret)
+	if err != nil {
+		return certificate, nil, fmt.Errorf("certificate %s/%s has not been issued: %w", namespace, name, err)
+	}
+	return certificate, secret, nil
+}
+
+func main() {
+	o := &options{}
+	root := &cobra.Command{
+		Use:           "kubectl-certs",
+		Short:         "Inspect, renew and diagnose k8c Certificates",
+		SilenceUsage:  true,
+		SilenceErrors: true,
+	}
+	root.PersistentFlags().StringVar(&o.kubeconfig, "kubeconfig", "", "Path to the kubeconfig file to use")
+	root.PersistentFlags().StringVar(&o.configFlags.CurrentContext, "context", "", "The name of the kubeconfig context to use")
+	root.PersistentFlags().StringVarP(&o.namespace, "namespace", "n", "", "The namespace of the Certificates")
+
+	root.AddCommand(
+		newStatusCommand(o),
+		newInspectCommand(o),
+		newRenewCommand(o),
+		newRevokeCommand(o),
+		newCheckCommand(o),
+		newApproveCommand(o),
+		newDenyCommand(o),
+	)
+	if err := root.Execute(); err != nil {
+		fmt.Fprintln(os.Stderr, "Error:", err)
+		os.Exit(1)
+	}
+}
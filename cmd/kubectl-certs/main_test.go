@@ -0,0 +1,40 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("getCertificateSecret", func() {
+	It("should return a Certificate and its Secret", func() {
+		certificate := newCertificate("web")
+		o := newOptions(certificate, issue(certificate))
+		found, secret, err := getCertificateSecret(ctx(), o.cluster, "default", "web")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(found.Spec.DNSName).To(Equal("web.k8c.io"))
+		Expect(secret.Data).To(HaveKey("tls.crt"))
+	})
+
+	It("should report a Certificate which has not been issued", func() {
+		o := newOptions(newCertificate("web"))
+		found, _, err := getCertificateSecret(ctx(), o.cluster, "default", "web")
+		Expect(err).To(MatchError(ContainSubstring("certificate default/web has not been issued")))
+		Expect(found).NotTo(BeNil())
+	})
+})
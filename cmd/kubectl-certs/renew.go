@@ -0,0 +1,61 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
+)
+
+func newRenewCommand(o *options) *cobra.Command {
+	return &cobra.Command{
+		Use:   "renew CERTIFICATE...",
+		Short: "Request the reissue of Certificates through the renew-requested-at annotation",
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			c, namespace, err := o.client()
+			if err != nil {
+				return err
+			}
+			requestedAt := time.Now().UTC().Format(time.RFC3339)
+			for _, name := range args {
+				certificate := &certsv1.Certificate{}
+				err = c.Get(cmd.Context(), types.NamespacedName{Name: name, Namespace: namespace}, certificate)
+				if err != nil {
+					return err
+				}
+				patch := client.MergeFrom(certificate.DeepCopy())
+				if certificate.Annotations == nil {
+					certificate.Annotations = map[string]string{}
+				}
+				certificate.Annotations[certsv1.RenewRequestedAtAnnotation] = requestedAt
+				err = c.Patch(cmd.Context(), certificate, patch)
+				if err != nil {
+					return err
+				}
+				fmt.Fprintf(cmd.OutOrStdout(), "certificate.certs.k8c.io/%s renewal requested\n", name)
+			}
+			return nil
+		},
+	}
+}
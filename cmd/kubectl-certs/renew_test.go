@@ -0,0 +1,51 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/types"
+
+	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
+)
+
+var _ = Describe("renew", func() {
+	It("should set the renew-requested-at annotation of every Certificate", func() {
+		o := newOptions(newCertificate("web"), newCertificate("api"))
+
+		out, err := run(newRenewCommand(o), "web", "api")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(out).To(Equal("certificate.certs.k8c.io/web renewal requested\n" +
+			"certificate.certs.k8c.io/api renewal requested\n"))
+		for _, name := range []string{"web", "api"} {
+			certificate := &certsv1.Certificate{}
+			Expect(o.cluster.Get(ctx(), types.NamespacedName{Name: name, Namespace: "default"}, certificate)).To(Succeed())
+			requestedAt, err := time.Parse(time.RFC3339, certificate.Annotations[certsv1.RenewRequestedAtAnnotation])
+			Expect(err).NotTo(HaveOccurred())
+			Expect(requestedAt).To(BeTemporally("~", time.Now(), time.Minute))
+			Expect(certificate.Annotations).To(HaveKey("validityInHours"))
+		}
+	})
+
+	It("should fail for an unknown Certificate", func() {
+		_, err := run(newRenewCommand(newOptions()), "web")
+		Expect(err).To(MatchError(ContainSubstring("not found")))
+	})
+})
@@ -0,0 +1,52 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/types"
+
+	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
+)
+
+var _ = Describe("revoke", func() {
+	caIssued := func(name string) *certsv1.Certificate {
+		certificate := newCertificate(name)
+		certificate.Spec.IssuerRef = &certsv1.IssuerReference{Name: "internal-ca"}
+		return certificate
+	}
+
+	DescribeTable("revoking a Certificate",
+		func(certificate *certsv1.Certificate, args []string, expectedReason, expectedErr string) {
+			o := newOptions(certificate)
+			_, err := run(newRevokeCommand(o), args...)
+			found := &certsv1.Certificate{}
+			Expect(o.cluster.Get(ctx(), types.NamespacedName{Name: certificate.Name, Namespace: "default"}, found)).To(Succeed())
+			if expectedErr != "" {
+				Expect(err).To(MatchError(ContainSubstring(expectedErr)))
+				Expect(found.Annotations).NotTo(HaveKey(certsv1.RevokeAnnotation))
+				return
+			}
+			Expect(err).NotTo(HaveOccurred())
+			Expect(found.Annotations).To(HaveKeyWithValue(certsv1.RevokeAnnotation, expectedReason))
+		},
+		Entry("with the default reason", caIssued("web"), []string{"web"}, "unspecified", ""),
+		Entry("with a reason", caIssued("web"), []string{"web", "--reason", "keyCompromise"}, "keyCompromise", ""),
+		Entry("self-signed", newCertificate("web"), []string{"web"}, "", "only certificates of CA issuers can be revoked"),
+	)
+})
@@ -0,0 +1,98 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/util/duration"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
+)
+
+func newStatusCommand(o *options) *cobra.Command {
+	var allNamespaces bool
+	cmd := &cobra.Command{
+		Use:   "status",
+		Short: "List the Certificates with their expiry, ready state and Secret",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, _ []string) error {
+			c, namespace, err := o.client()
+			if err != nil {
+				return err
+			}
+			var listOptions []client.ListOption
+			if !allNamespaces {
+				listOptions = append(listOptions, client.InNamespace(namespace))
+			}
+			certificates := &certsv1.CertificateList{}
+			err = c.List(cmd.Context(), certificates, listOptions...)
+			if err != nil {
+				return err
+			}
+			if len(certificates.Items) == 0 {
+				fmt.Fprintln(cmd.ErrOrStderr(), "No certificates found")
+				return nil
+			}
+
+			w := tabwriter.NewWriter(cmd.OutOrStdout(), 0, 0, 3, ' ', 0)
+			fmt.Fprintln(w, "NAMESPACE\tNAME\tREADY\tSECRET\tEXPIRES\tRENEWED")
+			now := time.Now()
+			for _, certificate := range certificates.Items {
+				fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n",
+					certificate.Namespace,
+					certificate.Name,
+					certificateReady(certificate, now),
+					certificate.Spec.SecretRef.Name,
+					relativeTime(certificate.Status.ExpiryDate.Time, now),
+					relativeTime(certificate.Status.RenewedAt.Time, now),
+				)
+			}
+			return w.Flush()
+		},
+	}
+	cmd.Flags().BoolVarP(&allNamespaces, "all-namespaces", "A", false, "List the Certificates of all namespaces")
+	return cmd
+}
+
+// certificateReady reports whether the current spec of a Certificate has been
+// issued and the issued certificate has not expired
+func certificateReady(certificate certsv1.Certificate, now time.Time) string {
+	switch {
+	case certificate.Status.SecretRef == "":
+		return "False (Pending)"
+	case certificate.Status.ObservedGeneration != certificate.Generation:
+		return "False (Updating)"
+	case !certificate.Status.ExpiryDate.After(now):
+		return "False (Expired)"
+	}
+	return "True"
+}
+
+func relativeTime(t time.Time, now time.Time) string {
+	if t.IsZero() {
+		return "<none>"
+	}
+	if t.After(now) {
+		return "in " + duration.HumanDuration(t.Sub(now))
+	}
+	return duration.HumanDuration(now.Sub(t)) + " ago"
+}
@@ -0,0 +1,80 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
+)
+
+var _ = Describe("status", func() {
+	now := time.Now()
+	withStatus := func(generation, observed int64, secretRef string, expiry time.Time) certsv1.Certificate {
+		certificate := newCertificate("web")
+		certificate.Generation = generation
+		certificate.Status.ObservedGeneration = observed
+		certificate.Status.SecretRef = secretRef
+		certificate.Status.ExpiryDate = metav1.NewTime(expiry)
+		return *certificate
+	}
+
+	DescribeTable("certificateReady",
+		func(certificate certsv1.Certificate, expected string) {
+			Expect(certificateReady(certificate, now)).To(Equal(expected))
+		},
+		Entry("pending", withStatus(1, 0, "", time.Time{}), "False (Pending)"),
+		Entry("updating", withStatus(2, 1, "web", now.Add(time.Hour)), "False (Updating)"),
+		Entry("expired", withStatus(1, 1, "web", now.Add(-time.Hour)), "False (Expired)"),
+		Entry("ready", withStatus(1, 1, "web", now.Add(time.Hour)), "True"),
+	)
+
+	DescribeTable("relativeTime",
+		func(t time.Time, expected string) {
+			Expect(relativeTime(t, now)).To(Equal(expected))
+		},
+		Entry("unset", time.Time{}, "<none>"),
+		Entry("future", now.Add(48*time.Hour), "in 2d"),
+		Entry("past", now.Add(-3*time.Hour), "3h ago"),
+	)
+
+	It("should list the Certificates of the namespace", func() {
+		other := newCertificate("api")
+		other.Namespace = "shop"
+		o := newOptions(newCertificate("web"), other)
+
+		out, err := run(newStatusCommand(o))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(out).To(ContainSubstring("NAMESPACE"))
+		Expect(out).To(MatchRegexp(`default\s+web\s+False \(Pending\)\s+web`))
+		Expect(out).NotTo(ContainSubstring("api"))
+
+		out, err = run(newStatusCommand(o), "--all-namespaces")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(out).To(MatchRegexp(`shop\s+api`))
+	})
+
+	It("should report an empty namespace", func() {
+		out, err := run(newStatusCommand(newOptions()))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(out).To(Equal("No certificates found\n"))
+	})
+})
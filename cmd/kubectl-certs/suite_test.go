@@ -0,0 +1,91 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/spf13/cobra"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
+	"github.com/PNarode/k8c-certs-manager/internal/helper"
+)
+
+func TestKubectlCerts(t *testing.T) {
+	RegisterFailHandler(Fail)
+
+	RunSpecs(t, "kubectl-certs Suite")
+}
+
+// newOptions returns the options of a command run against a fake cluster
+// holding the objects, in the default namespace
+func newOptions(objs ...client.Object) *options {
+	cluster := fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).
+		WithStatusSubresource(&certsv1.Certificate{}, &certsv1.CertificateRequest{}).Build()
+	return &options{namespace: "default", cluster: cluster}
+}
+
+func ctx() context.Context {
+	return context.Background()
+}
+
+// run executes a command with the arguments and returns its output
+func run(cmd *cobra.Command, args ...string) (string, error) {
+	out := &bytes.Buffer{}
+	cmd.SetOut(out)
+	cmd.SetErr(out)
+	cmd.SetArgs(args)
+	cmd.SilenceUsage = true
+	cmd.SilenceErrors = true
+	err := cmd.ExecuteContext(ctx())
+	return out.String(), err
+}
+
+// newCertificate returns a Certificate of the default namespace stored in the
+// Secret of the same name
+func newCertificate(name string) *certsv1.Certificate {
+	return &certsv1.Certificate{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   "default",
+			Annotations: map[string]string{"validityInHours": "24h"},
+		},
+		Spec: certsv1.CertificateSpec{
+			DNSName:   name + ".k8c.io",
+			Validity:  "1d",
+			SecretRef: certsv1.SecretRef{Name: name},
+		},
+	}
+}
+
+// issue returns the Secret of a self-signed certificate issued for the Certificate
+func issue(certificate *certsv1.Certificate) *corev1.Secret {
+	certPEM, keyPEM, err := helper.GenerateSelfSignedCertificate(*certificate)
+	Expect(err).NotTo(HaveOccurred())
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: certificate.Spec.SecretRef.Name, Namespace: certificate.Namespace},
+		Data:       helper.SecretData(certPEM, keyPEM),
+	}
+}
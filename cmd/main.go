@@ -22,15 +22,19 @@ import (
 	"github.com/PNarode/k8c-certs-manager/internal/controller"
 	"os"
 	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 	"sigs.k8s.io/controller-runtime/pkg/metrics/filters"
@@ -59,6 +63,23 @@ func main() {
 	var probeAddr string
 	var secureMetrics bool
 	var enableHTTP2 bool
+	var enableWebhooks bool
+	var enableGatewayAPI bool
+	var manageWebhookCert bool
+	var webhookCertDir string
+	var webhookNamespace string
+	var webhookNamePrefix string
+	var enableCSRSigner bool
+	var csrSignerDomain string
+	var selfSignedCASecret string
+	var crlAddr string
+	var crlBaseURL string
+	var crlValidity time.Duration
+	var ocspAddr string
+	var ocspBaseURL string
+	var clusterDomain string
+	var trustDomain string
+	var servingCertIssuer string
 	var tlsOpts []func(*tls.Config)
 	flag.StringVar(&metricsAddr, "metrics-bind-address", "0", "The address the metrics endpoint binds to. "+
 		"Use :8443 for HTTPS or :8080 for HTTP, or leave as 0 to disable the metrics service.")
@@ -70,6 +91,55 @@ func main() {
 		"If set, the metrics endpoint is served securely via HTTPS. Use --metrics-secure=false to use HTTP instead.")
 	flag.BoolVar(&enableHTTP2, "enable-http2", false,
 		"If set, HTTP/2 will be enabled for the metrics and webhook servers")
+	flag.BoolVar(&enableWebhooks, "enable-webhooks", true,
+		"If set, the Certificate admission webhooks are served. Use --enable-webhooks=false to rely on "+
+			"the CRD validation rules and the controller-side defaulting only. Namespaces requiring an approval "+
+			"are then not served, as the approvers can not be checked.")
+	flag.BoolVar(&enableGatewayAPI, "enable-gateway-api", false,
+		"If set, Certificates are created for the HTTPS and TLS listeners of Gateways. "+
+			"Requires the gateway.networking.k8s.io CRDs to be installed.")
+	flag.BoolVar(&manageWebhookCert, "manage-webhook-cert", true,
+		"If set, the manager issues and rotates the serving certificate of its webhook server and patches "+
+			"the caBundle of its webhook configurations. Use --manage-webhook-cert=false to provide the certificate "+
+			"in the webhook-cert-dir yourself.")
+	flag.StringVar(&webhookCertDir, "webhook-cert-dir", "/tmp/k8s-webhook-server/serving-certs",
+		"The directory the webhook server loads tls.crt and tls.key from.")
+	flag.StringVar(&webhookNamespace, "webhook-namespace", "k8c-certs-manager-system",
+		"The namespace of the webhook Service, of the Secret storing its serving certificate, of the "+
+			"self-signed signer CA and of the ServiceAccounts and Secrets Vault Issuers log in with.")
+	flag.StringVar(&webhookNamePrefix, "webhook-name-prefix", "k8c-certs-manager-",
+		"The name prefix of the webhook Service, serving certificate Secret and webhook configurations, "+
+			"as set by the kustomize namePrefix.")
+	flag.BoolVar(&enableCSRSigner, "enable-csr-signer", false,
+		"If set, approved certificates.k8s.io CertificateSigningRequests for the signer names "+
+			"<csr-signer-domain>/self-signed and <csr-signer-domain>/ca-<issuer> are signed.")
+	flag.StringVar(&csrSignerDomain, "csr-signer-domain", "certs.k8c.io",
+		"The domain of the signer names of the CertificateSigningRequest signer. The manager has to be allowed "+
+			"to sign for <domain>/* through the signers resource.")
+	flag.StringVar(&selfSignedCASecret, "self-signed-ca-secret", "k8c-certs-manager-self-signed-ca",
+		"The name of the Secret, in the webhook-namespace, storing the CA of the self-signed "+
+			"CertificateSigningRequest signer. It is created on first use.")
+	flag.StringVar(&crlAddr, "crl-bind-address", "0", "The address the CRLs of the CA Issuers are served on at "+
+		"/crl/<issuer>.crl, e.g. :8082, or 0 to disable the CRL server.")
+	flag.StringVar(&crlBaseURL, "crl-base-url", "", "The URL the CRL server is reachable at, e.g. "+
+		"http://k8c-certs-manager-crl.k8c-certs-manager-system.svc:8082. When set, certificates signed by CA Issuers "+
+		"carry <crl-base-url>/crl/<issuer>.crl as CRL distribution point.")
+	flag.DurationVar(&crlValidity, "crl-validity", controller.DefaultCRLValidity,
+		"The time until the next update of the CRLs of the CA Issuers. CRLs are signed again once half of it has passed.")
+	flag.StringVar(&ocspAddr, "ocsp-bind-address", "0", "The address the OCSP responder for the CA Issuers listens "+
+		"on at /ocsp/<issuer>, e.g. :8083, or 0 to disable the OCSP responder.")
+	flag.StringVar(&ocspBaseURL, "ocsp-base-url", "", "The URL the OCSP responder is reachable at, e.g. "+
+		"http://k8c-certs-manager-ocsp.k8c-certs-manager-system.svc:8083. When set, certificates signed by CA Issuers "+
+		"carry <ocsp-base-url>/ocsp/<issuer> as OCSP server.")
+	flag.StringVar(&clusterDomain, "cluster-domain", controller.DefaultClusterDomain,
+		"The DNS domain of the cluster, used for the fully qualified Service names of injected Pod certificates "+
+			"and Service serving certificates.")
+	flag.StringVar(&servingCertIssuer, "serving-cert-issuer", "",
+		"The Issuer signing the serving certificates of annotated Services. If empty, they are self-signed. "+
+			"The certs.k8c.io/serving-cert-issuer annotation may only name Issuers listed in the allowedIssuers "+
+			"of a certificate policy of the namespace.")
+	flag.StringVar(&trustDomain, "trust-domain", controller.DefaultTrustDomain,
+		"The SPIFFE trust domain of the SVIDs of all WorkloadIdentities.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -94,8 +164,8 @@ func main() {
 	}
 
 	webhookServer := webhook.NewServer(webhook.Options{
-		//Host:    "127.0.0.1",     // UnComment these lines when
-		//CertDir: "webhook-certs", // you have to test your webhook locally
+		//Host:    "127.0.0.1", // UnComment this line when you have to test your webhook locally
+		CertDir: webhookCertDir,
 		TLSOpts: tlsOpts,
 	})
 
@@ -130,6 +200,8 @@ func main() {
 		HealthProbeBindAddress: probeAddr,
 		LeaderElection:         enableLeaderElection,
 		LeaderElectionID:       "certs-manager.k8c.io",
+		// Only the workloads labeled for restarts on renewals are cached
+		Cache: cache.Options{ByObject: controller.RolloutCacheOptions()},
 		// LeaderElectionReleaseOnCancel defines if the leader should step down voluntarily
 		// when the Manager ends. This requires the binary to immediately end when the
 		// Manager is stopped, otherwise, this setting is unsafe. Setting this significantly
@@ -148,23 +220,188 @@ func main() {
 	}
 
 	if err = (&controller.CertificateReconciler{
+		Client:             mgr.GetClient(),
+		Scheme:             mgr.GetScheme(),
+		Recorder:           mgr.GetEventRecorderFor("certs-manager"),
+		CRLBaseURL:         crlBaseURL,
+		OCSPBaseURL:        ocspBaseURL,
+		ManagerNamespace:   webhookNamespace,
+		ApprovalUnenforced: !enableWebhooks,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "Certificate")
+		os.Exit(1)
+	}
+
+	if err = (&controller.IssuerReconciler{
+		Client:      mgr.GetClient(),
+		Scheme:      mgr.GetScheme(),
+		CRLValidity: crlValidity,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "Issuer")
+		os.Exit(1)
+	}
+
+	if crlAddr != "0" {
+		if err := mgr.Add(&controller.CRLServer{Client: mgr.GetClient(), BindAddress: crlAddr}); err != nil {
+			setupLog.Error(err, "unable to set up CRL server")
+			os.Exit(1)
+		}
+	}
+
+	if ocspAddr != "0" {
+		if err := mgr.Add(&controller.OCSPServer{Client: mgr.GetClient(), BindAddress: ocspAddr}); err != nil {
+			setupLog.Error(err, "unable to set up OCSP responder")
+			os.Exit(1)
+		}
+	}
+
+	if err = (&controller.IngressReconciler{
+		Client:   mgr.GetClient(),
+		Scheme:   mgr.GetScheme(),
+		Recorder: mgr.GetEventRecorderFor("certs-manager"),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "Ingress")
+		os.Exit(1)
+	}
+
+	if err = (&controller.PodReconciler{
+		Client:        mgr.GetClient(),
+		Scheme:        mgr.GetScheme(),
+		Recorder:      mgr.GetEventRecorderFor("certs-manager"),
+		ClusterDomain: clusterDomain,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "Pod")
+		os.Exit(1)
+	}
+
+	if err = (&controller.ServiceReconciler{
+		Client:        mgr.GetClient(),
+		Scheme:        mgr.GetScheme(),
+		Recorder:      mgr.GetEventRecorderFor("certs-manager"),
+		ClusterDomain: clusterDomain,
+		Issuer:        servingCertIssuer,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "Service")
+		os.Exit(1)
+	}
+	if err = (&controller.RolloutReconciler{
+		Client: mgr.GetClient(),
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "Rollout")
+		os.Exit(1)
+	}
+
+	if err = (&controller.WorkloadIdentityReconciler{
+		Client:             mgr.GetClient(),
+		Scheme:             mgr.GetScheme(),
+		Recorder:           mgr.GetEventRecorderFor("certs-manager"),
+		TrustDomain:        trustDomain,
+		ApprovalUnenforced: !enableWebhooks,
+	}).SetupWithManager(mgr); err != nil {
+		setupLog.Error(err, "unable to create controller", "controller", "WorkloadIdentity")
+		os.Exit(1)
+	}
+
+	if err = (&controller.BundleReconciler{
 		Client: mgr.GetClient(),
 		Scheme: mgr.GetScheme(),
 	}).SetupWithManager(mgr); err != nil {
-		setupLog.Error(err, "unable to create controller", "controller", "Certificate")
+		setupLog.Error(err, "unable to create controller", "controller", "Bundle")
 		os.Exit(1)
 	}
 
-	if err := builder.WebhookManagedBy(mgr).
-		For(&certsv1.Certificate{}).
-		WithDefaulter(&controller.CertificateAnnotator{
+	for _, target := range controller.CAInjectorTargets {
+		if err = (&controller.CAInjectorReconciler{
 			Client: mgr.GetClient(),
-		}).
-		WithValidator(&controller.CertificateValidator{
-			Client: mgr.GetClient(),
-		}).Complete(); err != nil {
-		setupLog.Error(err, "unable to create webhook", "webhook", "Pod")
-		os.Exit(1)
+			Target: target,
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "CAInjector", "kind", target.GVK.Kind)
+			os.Exit(1)
+		}
+	}
+
+	if enableCSRSigner {
+		if err = (&controller.CertificateSigningRequestReconciler{
+			Client:       mgr.GetClient(),
+			Scheme:       mgr.GetScheme(),
+			SignerDomain: csrSignerDomain,
+			SelfSignedCA: types.NamespacedName{Name: selfSignedCASecret, Namespace: webhookNamespace},
+			CRLBaseURL:   crlBaseURL,
+			OCSPBaseURL:  ocspBaseURL,
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "CertificateSigningRequest")
+			os.Exit(1)
+		}
+	}
+
+	if enableGatewayAPI {
+		if err = (&controller.GatewayReconciler{
+			Client:   mgr.GetClient(),
+			Scheme:   mgr.GetScheme(),
+			Recorder: mgr.GetEventRecorderFor("certs-manager"),
+		}).SetupWithManager(mgr); err != nil {
+			setupLog.Error(err, "unable to create controller", "controller", "Gateway")
+			os.Exit(1)
+		}
+	}
+
+	ctx := ctrl.SetupSignalHandler()
+
+	if enableWebhooks && manageWebhookCert {
+		rotator := &controller.WebhookCertRotator{
+			Client:    mgr.GetClient(),
+			APIReader: mgr.GetAPIReader(),
+			Secret: types.NamespacedName{
+				Name:      webhookNamePrefix + "webhook-server-cert",
+				Namespace: webhookNamespace,
+			},
+			Service: types.NamespacedName{
+				Name:      webhookNamePrefix + "webhook-service",
+				Namespace: webhookNamespace,
+			},
+			CertDir:                        webhookCertDir,
+			MutatingWebhookConfiguration:   webhookNamePrefix + "mutating-webhook-configuration",
+			ValidatingWebhookConfiguration: webhookNamePrefix + "validating-webhook-configuration",
+		}
+		// The serving certificate has to be in place before the webhook server starts
+		if err := rotator.Ensure(ctx); err != nil {
+			setupLog.Error(err, "unable to provision webhook serving certificate")
+			os.Exit(1)
+		}
+		if err := mgr.Add(rotator); err != nil {
+			setupLog.Error(err, "unable to set up webhook serving certificate rotation")
+			os.Exit(1)
+		}
+	}
+
+	if enableWebhooks {
+		if err := builder.WebhookManagedBy(mgr).
+			For(&certsv1.Certificate{}).
+			WithDefaulter(&controller.CertificateAnnotator{
+				Client: mgr.GetClient(),
+			}).
+			WithValidator(&controller.CertificateValidator{
+				Client: mgr.GetClient(),
+			}).Complete(); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "Certificate")
+			os.Exit(1)
+		}
+		if err := builder.WebhookManagedBy(mgr).
+			For(&certsv1.CertificateRequest{}).
+			WithValidator(&controller.CertificateRequestValidator{
+				Client: mgr.GetClient(),
+			}).Complete(); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "CertificateRequest")
+			os.Exit(1)
+		}
+		if err := builder.WebhookManagedBy(mgr).
+			For(&corev1.Pod{}).
+			WithDefaulter(&controller.PodInjector{}).Complete(); err != nil {
+			setupLog.Error(err, "unable to create webhook", "webhook", "Pod")
+			os.Exit(1)
+		}
+	} else {
+		setupLog.Info("admission webhooks are disabled")
 	}
 	// +kubebuilder:scaffold:builder
 
@@ -178,7 +415,7 @@ func main() {
 	}
 
 	setupLog.Info("starting manager")
-	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
+	if err := mgr.Start(ctx); err != nil {
 		setupLog.Error(err, "problem running manager")
 		os.Exit(1)
 	}
@@ -0,0 +1,488 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/utils/ptr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
+	"github.com/PNarode/k8c-certs-manager/internal/helper"
+)
+
+// +kubebuilder:rbac:groups="",resources=pods;services,verbs=get;list;watch;create;delete
+// +kubebuilder:rbac:groups=networking.k8s.io,resources=ingresses,verbs=get;list;watch;create;delete
+
+const (
+	// acmeSolverLabel holds the acmeSolverID of the CertificateRequest an ACME
+	// solver resource was created for
+	acmeSolverLabel = "certs.k8c.io/acme-solver"
+	// acmeSolverNameLabel selects the Pod of an HTTP-01 solver
+	acmeSolverNameLabel = "certs.k8c.io/acme-solver-name"
+	// acmeAccountURIAnnotation holds the URI of the ACME account registered for
+	// the key of an account key Secret
+	acmeAccountURIAnnotation = "certs.k8c.io/acme-account-uri"
+	// acmeServerAnnotation holds the directory URL the ACME account of an
+	// account key Secret is registered with
+	acmeServerAnnotation = "certs.k8c.io/acme-server"
+	// acmeSolverPort is the port the HTTP-01 solver Pod serves on
+	acmeSolverPort = 8089
+	// defaultACMESolverImage is the image of the HTTP-01 solver Pod
+	defaultACMESolverImage = "busybox:1.36"
+	// acmeTimeout limits the requests to an ACME server
+	acmeTimeout = 30 * time.Second
+)
+
+// http01SolverScript writes the key authorization of the challenge into the
+// document root of the busybox httpd and serves it
+const http01SolverScript = `mkdir -p /tmp/www/.well-known/acme-challenge && ` +
+	`printf '%s' "$KEY_AUTHORIZATION" > "/tmp/www/.well-known/acme-challenge/$TOKEN" && ` +
+	`exec httpd -f -p 8089 -h /tmp/www`
+
+// acmeClient returns a client for the ACME server of an issuer. The account of
+// the issuer is registered once, its URI is kept in the account key Secret.
+func (r *CertificateReconciler) acmeClient(ctx context.Context, issuer *certsv1.ACMEIssuer) (*acme.Client, error) {
+	key, secret, err := r.acmeAccountKey(ctx, issuer.PrivateKeySecretRef)
+	if err != nil {
+		return nil, err
+	}
+	httpClient, err := issuerHTTPClient(issuer.CABundle, acmeTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("ACME issuer: %w", err)
+	}
+
+	ac := &acme.Client{
+		Key:          key,
+		DirectoryURL: issuer.Server,
+		HTTPClient:   httpClient,
+		UserAgent:    "k8c-certs-manager",
+	}
+	// The account URI is only valid for the server it was registered with
+	if uri := secret.Annotations[acmeAccountURIAnnotation]; uri != "" && secret.Annotations[acmeServerAnnotation] == issuer.Server {
+		ac.KID = acme.KeyID(uri)
+		return ac, nil
+	}
+
+	account := &acme.Account{}
+	if issuer.Email != "" {
+		account.Contact = []string{"mailto:" + issuer.Email}
+	}
+	account, err = ac.Register(ctx, account, acme.AcceptTOS)
+	if errors.Is(err, acme.ErrAccountAlreadyExists) {
+		account, err = ac.GetReg(ctx, "")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("registering ACME account: %w", err)
+	}
+	patch := client.MergeFrom(secret.DeepCopy())
+	if secret.Annotations == nil {
+		secret.Annotations = map[string]string{}
+	}
+	secret.Annotations[acmeServerAnnotation] = issuer.Server
+	secret.Annotations[acmeAccountURIAnnotation] = account.URI
+	err = r.Patch(ctx, secret, patch)
+	if err != nil {
+		return nil, err
+	}
+	log.FromContext(ctx).Info("Reconcile Event: ACME account registered", "Server", issuer.Server, "Account", account.URI)
+	return ac, nil
+}
+
+// acmeAccountKey returns the private key of an ACME account and the Secret
+// storing it, generating an ECDSA P-256 key when the Secret does not exist. The
+// key is only taken from the namespace of the manager.
+func (r *CertificateReconciler) acmeAccountKey(ctx context.Context, ref certsv1.SecretReference) (crypto.Signer, *corev1.Secret, error) {
+	if ref.Namespace != r.ManagerNamespace {
+		return nil, nil, fmt.Errorf("secret %s/%s is not in the namespace of the manager", ref.Namespace, ref.Name)
+	}
+	secret := &corev1.Secret{}
+	err := r.Get(ctx, types.NamespacedName{Name: ref.Name, Namespace: ref.Namespace}, secret)
+	if err == nil {
+		key, err := helper.ParseSignerPEM(secret.Data["tls.key"])
+		if err != nil {
+			return nil, nil, fmt.Errorf("ACME account key in secret %s/%s: %w", ref.Namespace, ref.Name, err)
+		}
+		return key, secret, nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return nil, nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	secret = &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: ref.Name, Namespace: ref.Namespace},
+		Data:       map[string][]byte{"tls.key": pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})},
+	}
+	err = r.Create(ctx, secret)
+	if err != nil {
+		return nil, nil, err
+	}
+	log.FromContext(ctx).Info("Reconcile Event: ACME account key generated", "Secret", ref)
+	return key, secret, nil
+}
+
+// signACME advances the ACME order of an approved CertificateRequest and returns
+// the tls.crt and ca.crt data once the certificate is issued. While the order is
+// in progress errIssuanceInProgress is returned.
+func (r *CertificateReconciler) signACME(ctx context.Context, issuer *certsv1.Issuer, request *certsv1.CertificateRequest, csr *x509.CertificateRequest) (map[string][]byte, error) {
+	logger := log.FromContext(ctx)
+	solver := issuer.Spec.ACME.Solver
+	ctx, cancel := context.WithTimeout(ctx, 2*acmeTimeout)
+	defer cancel()
+	ac, err := r.acmeClient(ctx, issuer.Spec.ACME)
+	if err != nil {
+		return nil, err
+	}
+
+	var order *acme.Order
+	if request.Status.ACMEOrderURL == "" {
+		order, err = ac.AuthorizeOrder(ctx, acme.DomainIDs(acmeIdentifiers(csr)...))
+		if acmeRefused(err) {
+			return nil, r.failACME(ctx, solver, request, "OrderRejected", err.Error())
+		}
+		if err != nil {
+			return nil, err
+		}
+		request.Status.ACMEOrderURL = order.URI
+		err = r.Status().Update(ctx, request)
+		if err != nil {
+			return nil, err
+		}
+		logger.Info("Reconcile Event: ACME order placed", "CertificateRequest", request.Name, "Order", order.URI)
+	} else {
+		order, err = ac.GetOrder(ctx, request.Status.ACMEOrderURL)
+		if acmeRefused(err) {
+			return nil, r.failACME(ctx, solver, request, "OrderNotFound", err.Error())
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var chain [][]byte
+	switch order.Status {
+	case acme.StatusPending:
+		return nil, r.solveACMEAuthorizations(ctx, ac, solver, request, order)
+	case acme.StatusProcessing:
+		return nil, errIssuanceInProgress
+	case acme.StatusReady:
+		chain, _, err = ac.CreateOrderCert(ctx, order.FinalizeURL, csr.Raw, true)
+		if acmeRefused(err) {
+			return nil, r.failACME(ctx, solver, request, "OrderInvalid", err.Error())
+		}
+		if err != nil {
+			return nil, err
+		}
+	case acme.StatusValid:
+		chain, err = ac.FetchCert(ctx, order.CertURL, true)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		message := fmt.Sprintf("order %s is %s", order.URI, order.Status)
+		if order.Error != nil {
+			message += ": " + order.Error.Error()
+		}
+		return nil, r.failACME(ctx, solver, request, "OrderInvalid", message)
+	}
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("ACME order %s returned no certificate", order.URI)
+	}
+	err = r.cleanupACMESolvers(ctx, solver, request)
+	if err != nil {
+		return nil, err
+	}
+
+	var certPEM []byte
+	for _, der := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	return map[string][]byte{
+		"tls.crt": certPEM,
+		"ca.crt":  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: chain[len(chain)-1]}),
+	}, nil
+}
+
+// acmeIdentifiers returns the DNS names requested by a CSR, which an order has to
+// list exactly
+func acmeIdentifiers(csr *x509.CertificateRequest) []string {
+	names := slices.Clone(csr.DNSNames)
+	if csr.Subject.CommonName != "" && !slices.Contains(names, csr.Subject.CommonName) {
+		names = append(names, csr.Subject.CommonName)
+	}
+	return names
+}
+
+// acmeRefused reports whether the ACME server refused a request for good. Server
+// errors and rate limits are retried.
+func acmeRefused(err error) bool {
+	var orderErr *acme.OrderError
+	var acmeErr *acme.Error
+	switch {
+	case errors.As(err, &orderErr):
+		return true
+	case errors.As(err, &acmeErr):
+		return acmeErr.StatusCode < http.StatusInternalServerError && acmeErr.StatusCode != http.StatusTooManyRequests
+	}
+	return false
+}
+
+// failACME marks a CertificateRequest the ACME server refused as Failed and
+// removes its solvers
+func (r *CertificateReconciler) failACME(ctx context.Context, solver certsv1.ACMESolver, request *certsv1.CertificateRequest, reason, message string) error {
+	log.FromContext(ctx).Info("Reconcile Event: ACME server refused the CertificateRequest", "CertificateRequest", request.Name, "Reason", message)
+	err := r.cleanupACMESolvers(ctx, solver, request)
+	if err != nil {
+		return err
+	}
+	err = decide(ctx, r.Client, request, certsv1.CertificateRequestFailed, reason, message)
+	if err != nil {
+		return err
+	}
+	return errIssuanceFailed
+}
+
+// solveACMEAuthorizations presents the challenges of the pending authorizations
+// of an order and accepts them once their solvers are ready
+func (r *CertificateReconciler) solveACMEAuthorizations(ctx context.Context, ac *acme.Client, solver certsv1.ACMESolver, request *certsv1.CertificateRequest, order *acme.Order) error {
+	for _, url := range order.AuthzURLs {
+		authz, err := ac.GetAuthorization(ctx, url)
+		if err != nil {
+			return err
+		}
+		if authz.Status != acme.StatusPending {
+			continue
+		}
+		challenge := selectACMEChallenge(solver, authz)
+		if challenge == nil {
+			return r.failACME(ctx, solver, request, "NoSolver", fmt.Sprintf("no configured solver supports the challenges offered for %s", authz.Identifier.Value))
+		}
+		if challenge.Status != acme.StatusPending {
+			continue
+		}
+
+		var ready bool
+		switch challenge.Type {
+		case "http-01":
+			ready, err = r.presentHTTP01(ctx, ac, solver.HTTP01, request, authz.Identifier.Value, challenge.Token)
+		case "dns-01":
+			ready, err = r.presentDNS01(ctx, ac, solver.DNS01, request, authz.Identifier.Value, challenge.Token)
+		}
+		if err != nil {
+			return err
+		}
+		if !ready {
+			continue
+		}
+		_, err = ac.Accept(ctx, challenge)
+		if err != nil {
+			return err
+		}
+		log.FromContext(ctx).Info("Reconcile Event: ACME challenge accepted", "CertificateRequest", request.Name, "DNSName", authz.Identifier.Value, "Type", challenge.Type)
+	}
+	return errIssuanceInProgress
+}
+
+// selectACMEChallenge returns the challenge of an authorization solved with the
+// configured solvers, preferring HTTP-01
+func selectACMEChallenge(solver certsv1.ACMESolver, authz *acme.Authorization) *acme.Challenge {
+	var selected *acme.Challenge
+	for _, challenge := range authz.Challenges {
+		switch {
+		case challenge.Type == "http-01" && solver.HTTP01 != nil:
+			return challenge
+		case challenge.Type == "dns-01" && solver.DNS01 != nil:
+			selected = challenge
+		}
+	}
+	return selected
+}
+
+// presentHTTP01 creates the Pod, Service and Ingress serving the response to an
+// HTTP-01 challenge and reports whether the solver Pod is ready
+func (r *CertificateReconciler) presentHTTP01(ctx context.Context, ac *acme.Client, solver *certsv1.ACMEHTTP01Solver, request *certsv1.CertificateRequest, dnsName, token string) (bool, error) {
+	keyAuthorization, err := ac.HTTP01ChallengeResponse(token)
+	if err != nil {
+		return false, err
+	}
+	sum := sha256.Sum256([]byte(request.Name + "/" + token))
+	name := "acme-http01-" + hex.EncodeToString(sum[:8])
+	image := solver.Image
+	if image == "" {
+		image = defaultACMESolverImage
+	}
+	objectMeta := metav1.ObjectMeta{
+		Name:      name,
+		Namespace: request.Namespace,
+		Labels:    map[string]string{acmeSolverLabel: acmeSolverID(request), acmeSolverNameLabel: name},
+	}
+	pathType := networkingv1.PathTypeExact
+	objects := []client.Object{
+		&corev1.Pod{
+			ObjectMeta: *objectMeta.DeepCopy(),
+			Spec: corev1.PodSpec{
+				RestartPolicy: corev1.RestartPolicyOnFailure,
+				SecurityContext: &corev1.PodSecurityContext{
+					RunAsNonRoot: ptr.To(true),
+					RunAsUser:    ptr.To(int64(65534)),
+				},
+				Containers: []corev1.Container{{
+					Name:    "http01-solver",
+					Image:   image,
+					Command: []string{"sh", "-c", http01SolverScript},
+					Env: []corev1.EnvVar{
+						{Name: "TOKEN", Value: token},
+						{Name: "KEY_AUTHORIZATION", Value: keyAuthorization},
+					},
+					Ports: []corev1.ContainerPort{{Name: "http", ContainerPort: acmeSolverPort}},
+					ReadinessProbe: &corev1.Probe{
+						ProbeHandler: corev1.ProbeHandler{HTTPGet: &corev1.HTTPGetAction{
+							Path: ac.HTTP01ChallengePath(token),
+							Port: intstr.FromInt32(acmeSolverPort),
+						}},
+					},
+				}},
+			},
+		},
+		&corev1.Service{
+			ObjectMeta: *objectMeta.DeepCopy(),
+			Spec: corev1.ServiceSpec{
+				Selector: map[string]string{acmeSolverNameLabel: name},
+				Ports:    []corev1.ServicePort{{Name: "http", Port: acmeSolverPort, TargetPort: intstr.FromInt32(acmeSolverPort)}},
+			},
+		},
+		&networkingv1.Ingress{
+			ObjectMeta: *objectMeta.DeepCopy(),
+			Spec: networkingv1.IngressSpec{
+				IngressClassName: solver.IngressClassName,
+				Rules: []networkingv1.IngressRule{{
+					Host: dnsName,
+					IngressRuleValue: networkingv1.IngressRuleValue{HTTP: &networkingv1.HTTPIngressRuleValue{
+						Paths: []networkingv1.HTTPIngressPath{{
+							Path:     ac.HTTP01ChallengePath(token),
+							PathType: &pathType,
+							Backend: networkingv1.IngressBackend{Service: &networkingv1.IngressServiceBackend{
+								Name: name,
+								Port: networkingv1.ServiceBackendPort{Number: acmeSolverPort},
+							}},
+						}},
+					}},
+				}},
+			},
+		},
+	}
+	for _, obj := range objects {
+		err = ctrl.SetControllerReference(request, obj, r.Scheme)
+		if err != nil {
+			return false, err
+		}
+		err = r.Create(ctx, obj)
+		if client.IgnoreAlreadyExists(err) != nil {
+			return false, err
+		}
+	}
+
+	pod := &corev1.Pod{}
+	err = r.Get(ctx, types.NamespacedName{Name: name, Namespace: request.Namespace}, pod)
+	if err != nil {
+		return false, client.IgnoreNotFound(err)
+	}
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			return condition.Status == corev1.ConditionTrue, nil
+		}
+	}
+	return false, nil
+}
+
+// acmeSolverID returns the value of the acmeSolverLabel of the solvers of a
+// CertificateRequest. The name is hashed as it may exceed the 63 characters of
+// a label value.
+func acmeSolverID(request *certsv1.CertificateRequest) string {
+	sum := sha256.Sum256([]byte(request.Name))
+	return hex.EncodeToString(sum[:16])
+}
+
+// cleanupACMESolvers deletes the HTTP-01 solver resources created for a
+// CertificateRequest and removes its DNS-01 records
+func (r *CertificateReconciler) cleanupACMESolvers(ctx context.Context, solver certsv1.ACMESolver, request *certsv1.CertificateRequest) error {
+	err := r.cleanupDNS01(ctx, solver.DNS01, request)
+	if err != nil {
+		return err
+	}
+	selector := client.MatchingLabels{acmeSolverLabel: acmeSolverID(request)}
+	lists := []client.ObjectList{&corev1.PodList{}, &corev1.ServiceList{}, &networkingv1.IngressList{}}
+	for _, list := range lists {
+		err := r.List(ctx, list, client.InNamespace(request.Namespace), selector)
+		if err != nil {
+			return err
+		}
+		var items []client.Object
+		switch list := list.(type) {
+		case *corev1.PodList:
+			for i := range list.Items {
+				items = append(items, &list.Items[i])
+			}
+		case *corev1.ServiceList:
+			for i := range list.Items {
+				items = append(items, &list.Items[i])
+			}
+		case *networkingv1.IngressList:
+			for i := range list.Items {
+				items = append(items, &list.Items[i])
+			}
+		}
+		for _, item := range items {
+			err = r.Delete(ctx, item)
+			if client.IgnoreNotFound(err) != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
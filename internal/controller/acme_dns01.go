@@ -0,0 +1,266 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/acme"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
+)
+
+const (
+	// dns01RecordTTL is the TTL of the TXT records of DNS-01 challenges
+	dns01RecordTTL = 60
+	// dnsTimeout limits the queries and updates sent to a nameserver
+	dnsTimeout = 10 * time.Second
+	// tsigSecretKey is the key of the TSIG secret in the Secret of an RFC 2136 provider
+	tsigSecretKey = "tsig-secret"
+)
+
+// tsigAlgorithms maps the TSIG algorithms of an RFC 2136 provider to their names
+var tsigAlgorithms = map[string]string{
+	"hmac-sha1":   dns.HmacSHA1,
+	"hmac-sha256": dns.HmacSHA256,
+	"hmac-sha512": dns.HmacSHA512,
+}
+
+// dns01Provider presents and removes the TXT records of DNS-01 challenges
+type dns01Provider interface {
+	// Present adds the TXT record with the value, keeping other values of the name
+	Present(ctx context.Context, fqdn, value string) error
+	// CleanUp removes the TXT record with the value
+	CleanUp(ctx context.Context, fqdn, value string) error
+	// Nameserver returns the nameserver the records are published on, as host:port
+	Nameserver() string
+}
+
+// newDNS01Provider returns the provider configured for a DNS-01 solver. The
+// credentials of the provider are only taken from the namespace of the manager.
+func newDNS01Provider(ctx context.Context, c client.Reader, solver *certsv1.ACMEDNS01Solver, managerNamespace string) (dns01Provider, error) {
+	if solver.RFC2136 != nil {
+		return newRFC2136Provider(ctx, c, solver.RFC2136, managerNamespace)
+	}
+	return nil, fmt.Errorf("no DNS provider configured")
+}
+
+// rfc2136Provider updates TXT records with TSIG authenticated dynamic updates
+type rfc2136Provider struct {
+	nameserver string
+	keyName    string
+	algorithm  string
+	secret     string
+}
+
+func newRFC2136Provider(ctx context.Context, c client.Reader, config *certsv1.ACMERFC2136Provider, managerNamespace string) (*rfc2136Provider, error) {
+	provider := &rfc2136Provider{nameserver: withDefaultPort(config.Nameserver)}
+	if config.TSIGKeyName == "" {
+		return provider, nil
+	}
+	if config.TSIGSecretRef == nil {
+		return nil, fmt.Errorf("tsigSecretRef is required with tsigKeyName")
+	}
+	algorithm := config.TSIGAlgorithm
+	if algorithm == "" {
+		algorithm = "hmac-sha256"
+	}
+	provider.algorithm = tsigAlgorithms[algorithm]
+	if provider.algorithm == "" {
+		return nil, fmt.Errorf("unsupported TSIG algorithm %s", algorithm)
+	}
+	ref := config.TSIGSecretRef
+	if ref.Namespace != managerNamespace {
+		return nil, fmt.Errorf("secret %s/%s is not in the namespace of the manager", ref.Namespace, ref.Name)
+	}
+	secret := &corev1.Secret{}
+	err := c.Get(ctx, types.NamespacedName{Name: ref.Name, Namespace: ref.Namespace}, secret)
+	if err != nil {
+		return nil, err
+	}
+	if len(secret.Data[tsigSecretKey]) == 0 {
+		return nil, fmt.Errorf("secret %s/%s has no %s key", ref.Namespace, ref.Name, tsigSecretKey)
+	}
+	provider.keyName = dns.Fqdn(config.TSIGKeyName)
+	provider.secret = string(secret.Data[tsigSecretKey])
+	return provider, nil
+}
+
+func (p *rfc2136Provider) Nameserver() string {
+	return p.nameserver
+}
+
+func (p *rfc2136Provider) Present(ctx context.Context, fqdn, value string) error {
+	return p.update(ctx, fqdn, value, true)
+}
+
+func (p *rfc2136Provider) CleanUp(ctx context.Context, fqdn, value string) error {
+	return p.update(ctx, fqdn, value, false)
+}
+
+// update adds or removes a TXT record in the zone of its name
+func (p *rfc2136Provider) update(ctx context.Context, fqdn, value string, add bool) error {
+	zone, err := findZone(ctx, p.nameserver, fqdn)
+	if err != nil {
+		return err
+	}
+	record := &dns.TXT{
+		Hdr: dns.RR_Header{Name: fqdn, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: dns01RecordTTL},
+		Txt: []string{value},
+	}
+	msg := new(dns.Msg)
+	msg.SetUpdate(zone)
+	if add {
+		msg.Insert([]dns.RR{record})
+	} else {
+		msg.Remove([]dns.RR{record})
+	}
+	c := &dns.Client{Timeout: dnsTimeout}
+	if p.keyName != "" {
+		msg.SetTsig(p.keyName, p.algorithm, 300, time.Now().Unix())
+		c.TsigSecret = map[string]string{p.keyName: p.secret}
+	}
+	resp, _, err := c.ExchangeContext(ctx, msg, p.nameserver)
+	if err != nil {
+		return fmt.Errorf("updating %s on %s: %w", fqdn, p.nameserver, err)
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("updating %s on %s: %s", fqdn, p.nameserver, dns.RcodeToString[resp.Rcode])
+	}
+	return nil
+}
+
+// findZone returns the zone of a name from the SOA record the nameserver answers
+// with, either for the name itself or in the authority section
+func findZone(ctx context.Context, nameserver, fqdn string) (string, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(fqdn, dns.TypeSOA)
+	c := &dns.Client{Timeout: dnsTimeout}
+	resp, _, err := c.ExchangeContext(ctx, msg, nameserver)
+	if err != nil {
+		return "", fmt.Errorf("finding the zone of %s on %s: %w", fqdn, nameserver, err)
+	}
+	for _, rr := range append(resp.Answer, resp.Ns...) {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Hdr.Name, nil
+		}
+	}
+	return "", fmt.Errorf("nameserver %s is not authoritative for %s", nameserver, fqdn)
+}
+
+// txtPropagated reports whether all nameservers serve the TXT record with the value
+func txtPropagated(ctx context.Context, nameservers []string, fqdn, value string) (bool, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(fqdn, dns.TypeTXT)
+	c := &dns.Client{Timeout: dnsTimeout}
+	for _, nameserver := range nameservers {
+		resp, _, err := c.ExchangeContext(ctx, msg, withDefaultPort(nameserver))
+		if err != nil {
+			return false, fmt.Errorf("checking %s on %s: %w", fqdn, nameserver, err)
+		}
+		found := false
+		for _, rr := range resp.Answer {
+			if txt, ok := rr.(*dns.TXT); ok && slices.Contains(txt.Txt, value) {
+				found = true
+			}
+		}
+		if !found {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// withDefaultPort adds the DNS port to a nameserver given without one
+func withDefaultPort(nameserver string) string {
+	if _, _, err := net.SplitHostPort(nameserver); err == nil {
+		return nameserver
+	}
+	return net.JoinHostPort(nameserver, "53")
+}
+
+// presentDNS01 publishes the TXT record of a DNS-01 challenge and reports whether
+// it is served by the propagation nameservers. The record is kept in the status
+// of the CertificateRequest to be removed once the order completes.
+func (r *CertificateReconciler) presentDNS01(ctx context.Context, ac *acme.Client, solver *certsv1.ACMEDNS01Solver, request *certsv1.CertificateRequest, dnsName, token string) (bool, error) {
+	value, err := ac.DNS01ChallengeRecord(token)
+	if err != nil {
+		return false, err
+	}
+	record := certsv1.ACMEDNS01Record{FQDN: "_acme-challenge." + dns.Fqdn(dnsName), Value: value}
+	provider, err := newDNS01Provider(ctx, r.Client, solver, r.ManagerNamespace)
+	if err != nil {
+		return false, err
+	}
+	if !slices.Contains(request.Status.ACMEDNS01Records, record) {
+		request.Status.ACMEDNS01Records = append(request.Status.ACMEDNS01Records, record)
+		err = r.Status().Update(ctx, request)
+		if err != nil {
+			return false, err
+		}
+	}
+	err = provider.Present(ctx, record.FQDN, record.Value)
+	if err != nil {
+		return false, err
+	}
+
+	nameservers := solver.PropagationNameservers
+	if len(nameservers) == 0 {
+		nameservers = []string{provider.Nameserver()}
+	}
+	propagated, err := txtPropagated(ctx, nameservers, record.FQDN, record.Value)
+	if err != nil {
+		return false, err
+	}
+	if !propagated {
+		log.FromContext(ctx).Info("Reconcile Event: Waiting for the DNS-01 record to propagate", "CertificateRequest", request.Name, "Record", record.FQDN)
+	}
+	return propagated, nil
+}
+
+// cleanupDNS01 removes the TXT records presented for a CertificateRequest
+func (r *CertificateReconciler) cleanupDNS01(ctx context.Context, solver *certsv1.ACMEDNS01Solver, request *certsv1.CertificateRequest) error {
+	if len(request.Status.ACMEDNS01Records) == 0 {
+		return nil
+	}
+	if solver == nil {
+		log.FromContext(ctx).Info("Reconcile Event: Leaving DNS-01 records of an issuer without DNS-01 solver", "CertificateRequest", request.Name)
+		request.Status.ACMEDNS01Records = nil
+		return nil
+	}
+	provider, err := newDNS01Provider(ctx, r.Client, solver, r.ManagerNamespace)
+	if err != nil {
+		return err
+	}
+	for _, record := range request.Status.ACMEDNS01Records {
+		err = provider.CleanUp(ctx, record.FQDN, record.Value)
+		if err != nil {
+			return err
+		}
+	}
+	request.Status.ACMEDNS01Records = nil
+	return nil
+}
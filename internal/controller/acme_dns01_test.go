@@ -0,0 +1,220 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/pem"
+	"net"
+	"slices"
+	"sync"
+
+	"github.com/miekg/dns"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
+	"github.com/PNarode/k8c-certs-manager/internal/helper"
+	"github.com/PNarode/k8c-certs-manager/internal/validation"
+)
+
+// fakeDNSServer is an authoritative nameserver for the k8c.io zone accepting
+// TSIG signed dynamic updates of TXT records
+type fakeDNSServer struct {
+	*dns.Server
+	mu      sync.Mutex
+	records map[string][]string
+	updates int
+}
+
+func newFakeDNSServer(keyName, secret string) *fakeDNSServer {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	Expect(err).NotTo(HaveOccurred())
+	s := &fakeDNSServer{records: map[string][]string{}}
+	started := make(chan struct{})
+	s.Server = &dns.Server{
+		PacketConn:        conn,
+		Handler:           dns.HandlerFunc(s.serve),
+		TsigSecret:        map[string]string{keyName: secret},
+		NotifyStartedFunc: func() { close(started) },
+		MsgAcceptFunc:     func(dns.Header) dns.MsgAcceptAction { return dns.MsgAccept },
+	}
+	go func() {
+		defer GinkgoRecover()
+		_ = s.ActivateAndServe()
+	}()
+	<-started
+	return s
+}
+
+func (s *fakeDNSServer) Addr() string {
+	return s.PacketConn.LocalAddr().String()
+}
+
+func (s *fakeDNSServer) serve(w dns.ResponseWriter, req *dns.Msg) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	soa := &dns.SOA{
+		Hdr: dns.RR_Header{Name: "k8c.io.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 60},
+		Ns:  "ns.k8c.io.", Mbox: "hostmaster.k8c.io.", Serial: 1, Refresh: 60, Retry: 60, Expire: 60, Minttl: 60,
+	}
+	question := req.Question[0]
+	switch {
+	case req.Opcode == dns.OpcodeUpdate:
+		if req.IsTsig() == nil || w.TsigStatus() != nil {
+			resp.Rcode = dns.RcodeRefused
+			break
+		}
+		s.updates++
+		for _, rr := range req.Ns {
+			txt, ok := rr.(*dns.TXT)
+			if !ok {
+				continue
+			}
+			name := txt.Hdr.Name
+			if txt.Hdr.Class == dns.ClassNONE {
+				s.records[name] = slices.DeleteFunc(s.records[name], func(value string) bool { return value == txt.Txt[0] })
+			} else {
+				s.records[name] = append(s.records[name], txt.Txt[0])
+			}
+		}
+	case question.Qtype == dns.TypeSOA && question.Name == "k8c.io.":
+		resp.Answer = append(resp.Answer, soa)
+	case question.Qtype == dns.TypeSOA:
+		resp.Ns = append(resp.Ns, soa)
+	case question.Qtype == dns.TypeTXT:
+		for _, value := range s.records[question.Name] {
+			resp.Answer = append(resp.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: question.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 60},
+				Txt: []string{value},
+			})
+		}
+	}
+	if req.IsTsig() != nil {
+		resp.SetTsig(req.IsTsig().Hdr.Name, req.IsTsig().Algorithm, 300, int64(req.IsTsig().TimeSigned))
+	}
+	_ = w.WriteMsg(resp)
+}
+
+func (s *fakeDNSServer) txt(name string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.records[name])
+}
+
+var _ = Describe("ACME DNS-01 solver", func() {
+	It("should publish the TXT record with RFC 2136 updates and remove it once issued", func() {
+		ctx := context.Background()
+		server := newFakeACMEServer("dns-01")
+		defer server.Close()
+		nameserver := newFakeDNSServer("certs.k8c.io.", "c2VjcmV0")
+		defer func() { _ = nameserver.Shutdown() }()
+
+		scheme := runtime.NewScheme()
+		utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+		utilruntime.Must(certsv1.AddToScheme(scheme))
+		issuer := &certsv1.Issuer{
+			ObjectMeta: metav1.ObjectMeta{Name: "pebble"},
+			Spec: certsv1.IssuerSpec{ACME: &certsv1.ACMEIssuer{
+				Server:              server.URL + "/directory",
+				PrivateKeySecretRef: certsv1.SecretReference{Name: "pebble-account", Namespace: "certs-system"},
+				CABundle:            pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}),
+				Solver: certsv1.ACMESolver{DNS01: &certsv1.ACMEDNS01Solver{RFC2136: &certsv1.ACMERFC2136Provider{
+					Nameserver:    nameserver.Addr(),
+					TSIGKeyName:   "certs.k8c.io",
+					TSIGSecretRef: &certsv1.SecretReference{Name: "tsig", Namespace: "certs-system"},
+				}}},
+			}},
+		}
+		tsig := &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "tsig", Namespace: "certs-system"},
+			Data:       map[string][]byte{tsigSecretKey: []byte("c2VjcmV0")},
+		}
+		certificate := &certsv1.Certificate{
+			ObjectMeta: metav1.ObjectMeta{Name: "shop", Namespace: "default", Generation: 1, UID: "shop-uid"},
+			Spec: certsv1.CertificateSpec{
+				DNSName:   "*.shop.k8c.io",
+				Validity:  "90d",
+				SecretRef: certsv1.SecretRef{Name: "shop-tls"},
+				IssuerRef: &certsv1.IssuerReference{Name: "pebble"},
+			},
+		}
+		Expect(validation.DefaultCertificate(ctx, certificate)).To(Succeed())
+		fakeClient := fake.NewClientBuilder().WithScheme(scheme).
+			WithObjects(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}, issuer, tsig, certificate).
+			WithStatusSubresource(&certsv1.CertificateRequest{}).Build()
+		r := &CertificateReconciler{Client: fakeClient, Scheme: scheme, ManagerNamespace: "certs-system"}
+
+		By("publishing the TXT record and accepting the challenge once it is served")
+		_, err := r.issue(ctx, certificate)
+		Expect(err).To(MatchError(errIssuanceInProgress))
+		Expect(server.accepted).To(BeTrue())
+		Expect(nameserver.txt("_acme-challenge.shop.k8c.io.")).To(HaveLen(1))
+		request := &certsv1.CertificateRequest{}
+		Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "shop-1", Namespace: "default"}, request)).To(Succeed())
+		Expect(request.Status.ACMEDNS01Records).To(HaveLen(1))
+		Expect(request.Status.ACMEDNS01Records[0].FQDN).To(Equal("_acme-challenge.shop.k8c.io."))
+
+		By("finalizing the order and removing the record")
+		data, err := r.issue(ctx, certificate)
+		Expect(err).NotTo(HaveOccurred())
+		chain, err := helper.ParseCertificatesPEM(data["tls.crt"])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(chain[0].DNSNames).To(Equal([]string{"*.shop.k8c.io"}))
+		Expect(nameserver.txt("_acme-challenge.shop.k8c.io.")).To(BeEmpty())
+		Expect(nameserver.updates).To(Equal(2))
+		Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "shop-1", Namespace: "default"}, request)).To(Succeed())
+		Expect(request.Status.ACMEDNS01Records).To(BeEmpty())
+		Expect(meta.IsStatusConditionTrue(request.Status.Conditions, certsv1.CertificateRequestReady)).To(BeTrue())
+	})
+
+	It("should reject updates without a valid TSIG signature", func() {
+		ctx := context.Background()
+		nameserver := newFakeDNSServer("certs.k8c.io.", "c2VjcmV0")
+		defer func() { _ = nameserver.Shutdown() }()
+
+		provider := &rfc2136Provider{nameserver: nameserver.Addr()}
+		Expect(provider.Present(ctx, "_acme-challenge.shop.k8c.io.", "value")).To(MatchError(ContainSubstring("REFUSED")))
+		provider = &rfc2136Provider{nameserver: nameserver.Addr(), keyName: "certs.k8c.io.", algorithm: dns.HmacSHA256, secret: "b3RoZXI="}
+		Expect(provider.Present(ctx, "_acme-challenge.shop.k8c.io.", "value")).NotTo(Succeed())
+		Expect(nameserver.txt("_acme-challenge.shop.k8c.io.")).To(BeEmpty())
+	})
+
+	It("should only read the TSIG secret from the namespace of the manager", func() {
+		config := &certsv1.ACMERFC2136Provider{
+			Nameserver:    "203.0.113.53",
+			TSIGKeyName:   "certs.k8c.io",
+			TSIGSecretRef: &certsv1.SecretReference{Name: "tsig", Namespace: "default"},
+		}
+		fakeClient := fake.NewClientBuilder().WithObjects(&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "tsig", Namespace: "default"},
+			Data:       map[string][]byte{tsigSecretKey: []byte("c2VjcmV0")},
+		}).Build()
+		_, err := newRFC2136Provider(context.Background(), fakeClient, config, "certs-system")
+		Expect(err).To(MatchError(ContainSubstring("is not in the namespace of the manager")))
+	})
+})
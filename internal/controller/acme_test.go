@@ -0,0 +1,276 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/acme"
+	corev1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
+	"github.com/PNarode/k8c-certs-manager/internal/helper"
+	"github.com/PNarode/k8c-certs-manager/internal/validation"
+)
+
+// fakeACMEServer implements the subset of RFC 8555 used by the ACME issuer for a
+// single order with one authorization. Signatures of the requests are not verified.
+type fakeACMEServer struct {
+	*httptest.Server
+	mu            sync.Mutex
+	challengeType string
+	authzStatus   string
+	orderStatus   string
+	accepted      bool
+	registrations int
+	chain         []byte
+	caCert        *x509.Certificate
+}
+
+func newFakeACMEServer(challengeType string) *fakeACMEServer {
+	ca := certsv1.Certificate{Spec: certsv1.CertificateSpec{DNSName: "acme.k8c.io", Validity: "1y", IsCA: true}}
+	Expect(validation.DefaultCertificate(context.Background(), &ca)).To(Succeed())
+	caPEM, caKeyPEM, err := helper.GenerateSelfSignedCertificate(ca)
+	Expect(err).NotTo(HaveOccurred())
+	caCert, caKey, err := helper.ParseCA(caPEM, caKeyPEM)
+	Expect(err).NotTo(HaveOccurred())
+
+	s := &fakeACMEServer{challengeType: challengeType, authzStatus: "pending", orderStatus: "pending", caCert: caCert}
+	mux := http.NewServeMux()
+	s.Server = httptest.NewTLSServer(mux)
+	mux.HandleFunc("/directory", func(w http.ResponseWriter, _ *http.Request) {
+		s.reply(w, http.StatusOK, map[string]string{
+			"newNonce":   s.URL + "/nonce",
+			"newAccount": s.URL + "/account",
+			"newOrder":   s.URL + "/order",
+		})
+	})
+	mux.HandleFunc("/nonce", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Replay-Nonce", "nonce")
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/account", func(w http.ResponseWriter, _ *http.Request) {
+		s.mu.Lock()
+		s.registrations++
+		s.mu.Unlock()
+		w.Header().Set("Location", s.URL+"/account/1")
+		s.reply(w, http.StatusCreated, map[string]string{"status": "valid"})
+	})
+	mux.HandleFunc("/order", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Location", s.URL+"/order/1")
+		s.reply(w, http.StatusCreated, s.order())
+	})
+	mux.HandleFunc("/order/1", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Location", s.URL+"/order/1")
+		s.reply(w, http.StatusOK, s.order())
+	})
+	mux.HandleFunc("/authz/1", func(w http.ResponseWriter, _ *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.reply(w, http.StatusOK, map[string]any{
+			"status":     s.authzStatus,
+			"identifier": map[string]string{"type": "dns", "value": "shop.k8c.io"},
+			"challenges": []map[string]string{s.challenge()},
+		})
+	})
+	mux.HandleFunc("/challenge/1", func(w http.ResponseWriter, _ *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.accepted = true
+		s.authzStatus = "valid"
+		s.orderStatus = "ready"
+		s.reply(w, http.StatusOK, s.challenge())
+	})
+	mux.HandleFunc("/finalize/1", func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			CSR string `json:"csr"`
+		}
+		s.payload(r, &body)
+		der, err := base64.RawURLEncoding.DecodeString(body.CSR)
+		Expect(err).NotTo(HaveOccurred())
+		csr, err := x509.ParseCertificateRequest(der)
+		Expect(err).NotTo(HaveOccurred())
+		leaf, err := helper.SignWithCA(helper.CSRTemplate(csr, 90*24*time.Hour), csr.PublicKey, s.caCert, caKey)
+		Expect(err).NotTo(HaveOccurred())
+		s.mu.Lock()
+		s.chain = append(leaf, caPEM...)
+		s.orderStatus = "valid"
+		s.mu.Unlock()
+		w.Header().Set("Location", s.URL+"/order/1")
+		s.reply(w, http.StatusOK, s.order())
+	})
+	mux.HandleFunc("/cert/1", func(w http.ResponseWriter, _ *http.Request) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		w.Header().Set("Replay-Nonce", "nonce")
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		_, _ = w.Write(s.chain)
+	})
+	return s
+}
+
+func (s *fakeACMEServer) order() map[string]any {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return map[string]any{
+		"status":         s.orderStatus,
+		"identifiers":    []map[string]string{{"type": "dns", "value": "shop.k8c.io"}},
+		"authorizations": []string{s.URL + "/authz/1"},
+		"finalize":       s.URL + "/finalize/1",
+		"certificate":    s.URL + "/cert/1",
+	}
+}
+
+func (s *fakeACMEServer) challenge() map[string]string {
+	status := "pending"
+	if s.accepted {
+		status = "valid"
+	}
+	return map[string]string{"type": s.challengeType, "url": s.URL + "/challenge/1", "token": "token-1", "status": status}
+}
+
+// payload decodes the payload of a JWS request body
+func (s *fakeACMEServer) payload(r *http.Request, v any) {
+	var jws struct {
+		Payload string `json:"payload"`
+	}
+	data, err := io.ReadAll(r.Body)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(json.Unmarshal(data, &jws)).To(Succeed())
+	payload, err := base64.RawURLEncoding.DecodeString(jws.Payload)
+	Expect(err).NotTo(HaveOccurred())
+	Expect(json.Unmarshal(payload, v)).To(Succeed())
+}
+
+func (s *fakeACMEServer) reply(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Replay-Nonce", "nonce")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+var _ = Describe("ACME Issuer", func() {
+	It("should solve the HTTP-01 challenge and store the issued chain", func() {
+		ctx := context.Background()
+		server := newFakeACMEServer("http-01")
+		defer server.Close()
+
+		scheme := runtime.NewScheme()
+		utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+		utilruntime.Must(certsv1.AddToScheme(scheme))
+		ingressClass := "nginx"
+		issuer := &certsv1.Issuer{
+			ObjectMeta: metav1.ObjectMeta{Name: "pebble"},
+			Spec: certsv1.IssuerSpec{ACME: &certsv1.ACMEIssuer{
+				Server:              server.URL + "/directory",
+				PrivateKeySecretRef: certsv1.SecretReference{Name: "pebble-account", Namespace: "certs-system"},
+				CABundle:            pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}),
+				Solver: certsv1.ACMESolver{HTTP01: &certsv1.ACMEHTTP01Solver{
+					IngressClassName: &ingressClass,
+				}},
+			}},
+		}
+		certificate := &certsv1.Certificate{
+			ObjectMeta: metav1.ObjectMeta{Name: "shop", Namespace: "default", Generation: 1, UID: "shop-uid"},
+			Spec: certsv1.CertificateSpec{
+				DNSName:   "shop.k8c.io",
+				Validity:  "90d",
+				SecretRef: certsv1.SecretRef{Name: "shop-tls"},
+				IssuerRef: &certsv1.IssuerReference{Name: "pebble"},
+			},
+		}
+		Expect(validation.DefaultCertificate(ctx, certificate)).To(Succeed())
+		fakeClient := fake.NewClientBuilder().WithScheme(scheme).
+			WithObjects(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}, issuer, certificate).
+			WithStatusSubresource(&certsv1.CertificateRequest{}, &corev1.Pod{}).Build()
+		r := &CertificateReconciler{Client: fakeClient, Scheme: scheme, ManagerNamespace: "certs-system"}
+
+		By("placing the order and starting the solver")
+		_, err := r.issue(ctx, certificate)
+		Expect(err).To(MatchError(errIssuanceInProgress))
+		request := &certsv1.CertificateRequest{}
+		Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "shop-1", Namespace: "default"}, request)).To(Succeed())
+		Expect(request.Status.ACMEOrderURL).To(Equal(server.URL + "/order/1"))
+		account := &corev1.Secret{}
+		Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "pebble-account", Namespace: "certs-system"}, account)).To(Succeed())
+		Expect(account.Annotations).To(HaveKeyWithValue(acmeAccountURIAnnotation, server.URL+"/account/1"))
+
+		ingresses := &networkingv1.IngressList{}
+		Expect(fakeClient.List(ctx, ingresses, client.MatchingLabels{acmeSolverLabel: acmeSolverID(request)})).To(Succeed())
+		Expect(ingresses.Items).To(HaveLen(1))
+		ingress := ingresses.Items[0]
+		Expect(ingress.Spec.IngressClassName).To(Equal(&ingressClass))
+		Expect(ingress.Spec.Rules[0].Host).To(Equal("shop.k8c.io"))
+		Expect(ingress.Spec.Rules[0].HTTP.Paths[0].Path).To(Equal("/.well-known/acme-challenge/token-1"))
+		pod := &corev1.Pod{}
+		Expect(fakeClient.Get(ctx, types.NamespacedName{Name: ingress.Name, Namespace: "default"}, pod)).To(Succeed())
+		Expect(pod.Spec.Containers[0].Image).To(Equal(defaultACMESolverImage))
+		Expect(server.accepted).To(BeFalse())
+
+		By("accepting the challenge once the solver is ready")
+		pod.Status.Conditions = []corev1.PodCondition{{Type: corev1.PodReady, Status: corev1.ConditionTrue}}
+		Expect(fakeClient.Status().Update(ctx, pod)).To(Succeed())
+		_, err = r.issue(ctx, certificate)
+		Expect(err).To(MatchError(errIssuanceInProgress))
+		Expect(server.accepted).To(BeTrue())
+
+		By("finalizing the order")
+		data, err := r.issue(ctx, certificate)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(HaveKey("tls.key"))
+		chain, err := helper.ParseCertificatesPEM(data["tls.crt"])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(chain).To(HaveLen(2))
+		Expect(chain[0].DNSNames).To(Equal([]string{"shop.k8c.io"}))
+		roots, err := helper.ParseCertificatesPEM(data["ca.crt"])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(roots[0].Equal(server.caCert)).To(BeTrue())
+		Expect(fakeClient.List(ctx, ingresses, client.MatchingLabels{acmeSolverLabel: acmeSolverID(request)})).To(Succeed())
+		Expect(ingresses.Items).To(BeEmpty())
+		Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "shop-1", Namespace: "default"}, request)).To(Succeed())
+		Expect(meta.IsStatusConditionTrue(request.Status.Conditions, certsv1.CertificateRequestReady)).To(BeTrue())
+		Expect(server.registrations).To(Equal(1))
+	})
+
+	It("should only fail requests the ACME server refuses for good", func() {
+		Expect(acmeRefused(&acme.Error{StatusCode: http.StatusBadRequest})).To(BeTrue())
+		Expect(acmeRefused(&acme.OrderError{Status: acme.StatusInvalid})).To(BeTrue())
+		Expect(acmeRefused(&acme.Error{StatusCode: http.StatusTooManyRequests})).To(BeFalse())
+		Expect(acmeRefused(&acme.Error{StatusCode: http.StatusServiceUnavailable})).To(BeFalse())
+		Expect(acmeRefused(io.ErrUnexpectedEOF)).To(BeFalse())
+	})
+})
@@ -0,0 +1,147 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
+)
+
+// The approval is enforced by this webhook only, it therefore fails closed.
+// +kubebuilder:webhook:path=/validate-certs-k8c-io-v1-certificaterequest,mutating=false,failurePolicy=fail,sideEffects=None,groups="certs.k8c.io",resources=certificaterequests/status,verbs=update,versions=v1,name=vcertificaterequest.kb.io,admissionReviewVersions=v1
+// +kubebuilder:rbac:groups=authorization.k8s.io,resources=subjectaccessreviews,verbs=create
+
+// approvalConditions are the CertificateRequest conditions reserved to approvers
+var approvalConditions = []string{certsv1.CertificateRequestApproved, certsv1.CertificateRequestDenied}
+
+// CertificateRequestValidator only admits Approved and Denied conditions on a
+// CertificateRequest set by principals allowed to approve it
+type CertificateRequestValidator struct {
+	client.Client
+}
+
+func (v *CertificateRequestValidator) ValidateCreate(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	return nil, nil
+}
+
+func (v *CertificateRequestValidator) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) (admission.Warnings, error) {
+	logger := logf.FromContext(ctx)
+	oldRequest, ok := oldObj.(*certsv1.CertificateRequest)
+	if !ok {
+		return nil, fmt.Errorf("expected a CertificateRequest but got a %T", oldObj)
+	}
+	request, ok := newObj.(*certsv1.CertificateRequest)
+	if !ok {
+		return nil, fmt.Errorf("expected a CertificateRequest but got a %T", newObj)
+	}
+
+	allErrs, changed := validateApproval(oldRequest, request)
+	if len(allErrs) != 0 {
+		return nil, apierrors.NewInvalid(certsv1.GroupVersion.WithKind("CertificateRequest").GroupKind(), request.Name, allErrs)
+	}
+	if !changed {
+		return nil, nil
+	}
+
+	req, err := admission.RequestFromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	allowed, err := v.canApprove(ctx, req, request)
+	if err != nil {
+		return nil, err
+	}
+	if !allowed {
+		logger.Info("Approval of CertificateRequest refused", "user", req.UserInfo.Username)
+		return nil, apierrors.NewForbidden(certsv1.GroupVersion.WithResource("certificaterequests").GroupResource(), request.Name,
+			fmt.Errorf("user %q is not allowed to approve certificaterequests in namespace %q", req.UserInfo.Username, request.Namespace))
+	}
+	logger.Info("Approval of CertificateRequest admitted", "user", req.UserInfo.Username)
+	return nil, nil
+}
+
+func (v *CertificateRequestValidator) ValidateDelete(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
+	return nil, nil
+}
+
+// validateApproval checks that the Approved and Denied conditions are exclusive,
+// only set to True and never changed once set. It also reports whether one of
+// them is being set.
+func validateApproval(oldRequest, request *certsv1.CertificateRequest) (field.ErrorList, bool) {
+	allErrs := field.ErrorList{}
+	conditionsPath := field.NewPath("status", "conditions")
+	changed := false
+	for _, conditionType := range approvalConditions {
+		oldCondition := meta.FindStatusCondition(oldRequest.Status.Conditions, conditionType)
+		condition := meta.FindStatusCondition(request.Status.Conditions, conditionType)
+		switch {
+		case oldCondition != nil && (condition == nil || condition.Status != oldCondition.Status ||
+			condition.Reason != oldCondition.Reason || condition.Message != oldCondition.Message):
+			allErrs = append(allErrs, field.Forbidden(conditionsPath, fmt.Sprintf("%s condition can not be changed once set", conditionType)))
+		case condition != nil && condition.Status != metav1.ConditionTrue:
+			allErrs = append(allErrs, field.Invalid(conditionsPath, condition.Status, fmt.Sprintf("%s condition can only be set to True", conditionType)))
+		case oldCondition == nil && condition != nil:
+			changed = true
+		}
+	}
+	if meta.FindStatusCondition(request.Status.Conditions, certsv1.CertificateRequestApproved) != nil &&
+		meta.FindStatusCondition(request.Status.Conditions, certsv1.CertificateRequestDenied) != nil {
+		allErrs = append(allErrs, field.Forbidden(conditionsPath, "Approved and Denied conditions are mutually exclusive"))
+	}
+	return allErrs, changed
+}
+
+// canApprove asks the API server through a SubjectAccessReview whether the
+// requesting user holds the approve verb on the CertificateRequest
+func (v *CertificateRequestValidator) canApprove(ctx context.Context, req admission.Request, request *certsv1.CertificateRequest) (bool, error) {
+	extra := map[string]authorizationv1.ExtraValue{}
+	for key, value := range req.UserInfo.Extra {
+		extra[key] = authorizationv1.ExtraValue(value)
+	}
+	review := &authorizationv1.SubjectAccessReview{
+		Spec: authorizationv1.SubjectAccessReviewSpec{
+			User:   req.UserInfo.Username,
+			UID:    req.UserInfo.UID,
+			Groups: req.UserInfo.Groups,
+			Extra:  extra,
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Group:     certsv1.GroupVersion.Group,
+				Resource:  "certificaterequests",
+				Verb:      "approve",
+				Namespace: request.Namespace,
+				Name:      request.Name,
+			},
+		},
+	}
+	err := v.Create(ctx, review)
+	if err != nil {
+		return false, err
+	}
+	return review.Status.Allowed, nil
+}
@@ -0,0 +1,374 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
+	"github.com/PNarode/k8c-certs-manager/internal/helper"
+)
+
+const (
+	// BundleLabel marks the ConfigMaps written for a Bundle with the Bundle name
+	BundleLabel = "certs.k8c.io/bundle"
+	// BundleHashAnnotation records the content a ConfigMap was last written with
+	BundleHashAnnotation = "certs.k8c.io/bundle-hash"
+
+	bundlePEMKey    = "ca-bundle.crt"
+	bundleJKSKey    = "ca-bundle.jks"
+	bundlePKCS12Key = "ca-bundle.p12"
+)
+
+// BundleReconciler distributes trust bundles to namespaces through ConfigMaps
+type BundleReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+}
+
+// bundleContent is the content written to the ConfigMaps of a Bundle
+type bundleContent struct {
+	data       map[string]string
+	binaryData map[string][]byte
+	hash       string
+}
+
+// +kubebuilder:rbac:groups=certs.k8c.io,resources=bundles,verbs=get;list;watch
+// +kubebuilder:rbac:groups=certs.k8c.io,resources=bundles/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups=certs.k8c.io,resources=issuers,verbs=get;list;watch
+
+// Reconcile collects the issuing certificates of the Bundle sources and writes
+// them to the target ConfigMap in every selected namespace. ConfigMaps of
+// namespaces which are no longer selected are deleted.
+func (r *BundleReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+	logger.Info("Reconcile Event: Bundle Reconcilation Started")
+	bundle := &certsv1.Bundle{}
+	err := r.Get(ctx, req.NamespacedName, bundle)
+	if err != nil {
+		// Owned ConfigMaps are garbage collected with the Bundle
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	certs, err := r.collectCertificates(ctx, bundle)
+	if err != nil {
+		logger.Error(err, "Reconcile Event: Failed to collect bundle certificates")
+		return ctrl.Result{}, err
+	}
+	content, err := buildBundleContent(certs, bundle.Spec.Target.AdditionalFormats)
+	if err != nil {
+		logger.Error(err, "Reconcile Event: Failed to encode bundle")
+		return ctrl.Result{}, nil
+	}
+
+	namespaces, err := r.selectNamespaces(ctx, bundle)
+	if err != nil {
+		logger.Error(err, "Reconcile Event: Failed to select bundle namespaces")
+		return ctrl.Result{}, err
+	}
+
+	synced := []string{}
+	for _, namespace := range namespaces {
+		err = r.applyConfigMap(ctx, bundle, namespace, content)
+		if err != nil {
+			logger.Error(err, "Reconcile Event: Failed to write bundle", "Namespace", namespace)
+			continue
+		}
+		synced = append(synced, namespace)
+	}
+
+	err = r.deleteStaleConfigMaps(ctx, bundle, synced)
+	if err != nil {
+		logger.Error(err, "Reconcile Event: Failed to delete stale bundle config maps")
+		return ctrl.Result{}, err
+	}
+
+	bundle.Status.ObservedGeneration = bundle.Generation
+	bundle.Status.SyncedAt = metav1.NewTime(time.Now())
+	bundle.Status.Namespaces = synced
+	err = r.Status().Update(ctx, bundle)
+	if err != nil {
+		logger.Error(err, "Reconcile Event: Failed to update bundle status")
+		return ctrl.Result{}, err
+	}
+	if len(synced) != len(namespaces) {
+		return ctrl.Result{}, fmt.Errorf("bundle %s was written to %d of %d namespaces", bundle.Name, len(synced), len(namespaces))
+	}
+	logger.Info("Reconcile Event: Bundle Reconcilation Ended")
+	return ctrl.Result{}, nil
+}
+
+// collectCertificates returns the deduplicated issuing certificates of the Bundle
+// sources. Sources which have not been issued yet are skipped, the Bundle is
+// reconciled again once they are.
+func (r *BundleReconciler) collectCertificates(ctx context.Context, bundle *certsv1.Bundle) ([]*x509.Certificate, error) {
+	logger := log.FromContext(ctx)
+	var certs []*x509.Certificate
+	for _, source := range bundle.Spec.Sources {
+		data, err := r.sourceCertificates(ctx, source)
+		if err != nil {
+			if client.IgnoreNotFound(err) == nil {
+				logger.Info("Reconcile Event: Skipping bundle source not issued yet", "Source", source)
+				continue
+			}
+			return nil, err
+		}
+		parsed, err := helper.ParseCertificatesPEM(data)
+		if err != nil {
+			logger.Error(err, "Reconcile Event: Skipping invalid bundle source", "Source", source)
+			continue
+		}
+		for _, cert := range parsed {
+			if !slices.ContainsFunc(certs, cert.Equal) {
+				certs = append(certs, cert)
+			}
+		}
+	}
+	return certs, nil
+}
+
+// sourceCertificates returns the PEM encoded certificates of a Bundle source: the
+// issuing certificate of a Certificate, or the root certificate of an Issuer.
+func (r *BundleReconciler) sourceCertificates(ctx context.Context, source certsv1.BundleSource) ([]byte, error) {
+	switch {
+	case source.Certificate != nil:
+		ref := types.NamespacedName{Name: source.Certificate.Name, Namespace: source.Certificate.Namespace}
+		return issuingCertificate(ctx, r.Client, ref)
+	case source.Issuer != nil:
+		ca, err := loadIssuerCA(ctx, r.Client, source.Issuer.Name)
+		if err != nil {
+			return nil, err
+		}
+		return ca.root, nil
+	}
+	return nil, nil
+}
+
+// buildBundleContent encodes the certificates into the PEM bundle and the
+// requested additional formats. The hash covers the certificates and the format
+// settings, as the PKCS#12 encoding differs on every call.
+func buildBundleContent(certs []*x509.Certificate, formats *certsv1.BundleFormats) (*bundleContent, error) {
+	pemData := helper.EncodeCertificatesPEM(certs)
+	digest := sha256.New()
+	digest.Write(pemData)
+	content := &bundleContent{
+		data:       map[string]string{bundlePEMKey: string(pemData)},
+		binaryData: map[string][]byte{},
+	}
+	if formats != nil && formats.JKS != nil {
+		password := keystorePassword(formats.JKS)
+		jks, err := helper.EncodeJKSTrustStore(certs, password)
+		if err != nil {
+			return nil, err
+		}
+		content.binaryData[bundleJKSKey] = jks
+		fmt.Fprintf(digest, "\x00%s\x00%s", bundleJKSKey, password)
+	}
+	if formats != nil && formats.PKCS12 != nil {
+		password := keystorePassword(formats.PKCS12)
+		p12, err := helper.EncodePKCS12TrustStore(certs, password)
+		if err != nil {
+			return nil, err
+		}
+		content.binaryData[bundlePKCS12Key] = p12
+		fmt.Fprintf(digest, "\x00%s\x00%s", bundlePKCS12Key, password)
+	}
+	if len(content.binaryData) == 0 {
+		content.binaryData = nil
+	}
+	content.hash = hex.EncodeToString(digest.Sum(nil))
+	return content, nil
+}
+
+func keystorePassword(format *certsv1.KeystoreFormat) string {
+	if format.Password == "" {
+		return helper.DefaultKeystorePassword
+	}
+	return format.Password
+}
+
+// selectNamespaces returns the sorted names of the active namespaces matching the
+// namespace selector of the Bundle target.
+func (r *BundleReconciler) selectNamespaces(ctx context.Context, bundle *certsv1.Bundle) ([]string, error) {
+	selector := labels.Everything()
+	if bundle.Spec.Target.NamespaceSelector != nil {
+		var err error
+		selector, err = metav1.LabelSelectorAsSelector(bundle.Spec.Target.NamespaceSelector)
+		if err != nil {
+			return nil, err
+		}
+	}
+	namespaces := &corev1.NamespaceList{}
+	err := r.List(ctx, namespaces, client.MatchingLabelsSelector{Selector: selector})
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, namespace := range namespaces.Items {
+		if namespace.Status.Phase == corev1.NamespaceTerminating || namespace.DeletionTimestamp != nil {
+			continue
+		}
+		names = append(names, namespace.Name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// applyConfigMap writes the Bundle content to the target ConfigMap of the
+// namespace. ConfigMaps not created for the Bundle are left untouched.
+func (r *BundleReconciler) applyConfigMap(ctx context.Context, bundle *certsv1.Bundle, namespace string, content *bundleContent) error {
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      bundle.Spec.Target.ConfigMapRef.Name,
+			Namespace: namespace,
+		},
+	}
+	_, err := controllerutil.CreateOrUpdate(ctx, r.Client, configMap, func() error {
+		if !configMap.CreationTimestamp.IsZero() && !metav1.IsControlledBy(configMap, bundle) {
+			return fmt.Errorf("config map %s/%s is not managed by bundle %s", namespace, configMap.Name, bundle.Name)
+		}
+		if configMap.Labels == nil {
+			configMap.Labels = map[string]string{}
+		}
+		configMap.Labels[BundleLabel] = bundle.Name
+		if configMap.Annotations[BundleHashAnnotation] != content.hash {
+			if configMap.Annotations == nil {
+				configMap.Annotations = map[string]string{}
+			}
+			configMap.Annotations[BundleHashAnnotation] = content.hash
+			configMap.Data = content.data
+			configMap.BinaryData = content.binaryData
+		}
+		return controllerutil.SetControllerReference(bundle, configMap, r.Scheme)
+	})
+	return err
+}
+
+// deleteStaleConfigMaps deletes the ConfigMaps written for the Bundle outside of
+// the synced namespaces, or under a previous target name.
+func (r *BundleReconciler) deleteStaleConfigMaps(ctx context.Context, bundle *certsv1.Bundle, synced []string) error {
+	logger := log.FromContext(ctx)
+	configMaps := &corev1.ConfigMapList{}
+	err := r.List(ctx, configMaps, client.MatchingLabels{BundleLabel: bundle.Name})
+	if err != nil {
+		return err
+	}
+	for i := range configMaps.Items {
+		configMap := &configMaps.Items[i]
+		if !metav1.IsControlledBy(configMap, bundle) {
+			continue
+		}
+		if configMap.Name == bundle.Spec.Target.ConfigMapRef.Name && slices.Contains(synced, configMap.Namespace) {
+			continue
+		}
+		logger.Info("Reconcile Event: Deleting bundle config map no longer requested", "Namespace", configMap.Namespace, "ConfigMap", configMap.Name)
+		err = r.Delete(ctx, configMap)
+		if client.IgnoreNotFound(err) != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bundlesForNamespace enqueues all Bundles, as any of them may select the namespace
+func (r *BundleReconciler) bundlesForNamespace(ctx context.Context, _ client.Object) []reconcile.Request {
+	bundles := &certsv1.BundleList{}
+	err := r.List(ctx, bundles)
+	if err != nil {
+		log.FromContext(ctx).Error(err, "Failed to list bundles")
+		return nil
+	}
+	requests := make([]reconcile.Request, 0, len(bundles.Items))
+	for _, bundle := range bundles.Items {
+		requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: bundle.Name}})
+	}
+	return requests
+}
+
+// bundlesForCertificate enqueues the Bundles sourcing the Certificate
+func (r *BundleReconciler) bundlesForCertificate(ctx context.Context, obj client.Object) []reconcile.Request {
+	bundles := &certsv1.BundleList{}
+	err := r.List(ctx, bundles)
+	if err != nil {
+		log.FromContext(ctx).Error(err, "Failed to list bundles")
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, bundle := range bundles.Items {
+		for _, source := range bundle.Spec.Sources {
+			if source.Certificate != nil && source.Certificate.Name == obj.GetName() && source.Certificate.Namespace == obj.GetNamespace() {
+				requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: bundle.Name}})
+				break
+			}
+		}
+	}
+	return requests
+}
+
+// bundlesForIssuer enqueues the Bundles sourcing the Issuer
+func (r *BundleReconciler) bundlesForIssuer(ctx context.Context, obj client.Object) []reconcile.Request {
+	bundles := &certsv1.BundleList{}
+	err := r.List(ctx, bundles)
+	if err != nil {
+		log.FromContext(ctx).Error(err, "Failed to list bundles")
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, bundle := range bundles.Items {
+		for _, source := range bundle.Spec.Sources {
+			if source.Issuer != nil && source.Issuer.Name == obj.GetName() {
+				requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: bundle.Name}})
+				break
+			}
+		}
+	}
+	return requests
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *BundleReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&certsv1.Bundle{}, builder.WithPredicates(predicate.GenerationChangedPredicate{})).
+		Owns(&corev1.ConfigMap{}).
+		Watches(&corev1.Namespace{}, handler.EnqueueRequestsFromMapFunc(r.bundlesForNamespace)).
+		Watches(&certsv1.Certificate{}, handler.EnqueueRequestsFromMapFunc(r.bundlesForCertificate)).
+		Watches(&certsv1.Issuer{}, handler.EnqueueRequestsFromMapFunc(r.bundlesForIssuer)).
+		Complete(r)
+}
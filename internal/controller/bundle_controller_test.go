@@ -0,0 +1,123 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
+	"github.com/PNarode/k8c-certs-manager/internal/helper"
+	"github.com/PNarode/k8c-certs-manager/internal/validation"
+)
+
+var _ = Describe("Bundle Controller", func() {
+	It("should encode the bundle in the requested formats", func() {
+		first, _, err := helper.GenerateSelfSignedCertificate(certsv1.Certificate{
+			Spec: certsv1.CertificateSpec{DNSName: "first.k8c.io", Validity: "1d"},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		second, _, err := helper.GenerateSelfSignedCertificate(certsv1.Certificate{
+			Spec: certsv1.CertificateSpec{DNSName: "second.k8c.io", Validity: "1d"},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		certs, err := helper.ParseCertificatesPEM(append(first, second...))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(certs).To(HaveLen(2))
+
+		content, err := buildBundleContent(certs, nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(content.data).To(HaveKeyWithValue(bundlePEMKey, string(first)+string(second)))
+		Expect(content.binaryData).To(BeNil())
+
+		formats := &certsv1.BundleFormats{JKS: &certsv1.KeystoreFormat{}, PKCS12: &certsv1.KeystoreFormat{}}
+		withFormats, err := buildBundleContent(certs, formats)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(withFormats.hash).NotTo(Equal(content.hash))
+		Expect(withFormats.binaryData).To(HaveKey(bundlePKCS12Key))
+		jks := withFormats.binaryData[bundleJKSKey]
+		Expect(binary.BigEndian.Uint32(jks[0:4])).To(Equal(uint32(0xFEEDFEED)))
+		Expect(binary.BigEndian.Uint32(jks[8:12])).To(Equal(uint32(2)))
+		Expect(bytes.Contains(jks, certs[1].Raw)).To(BeTrue())
+
+		again, err := buildBundleContent(certs, formats)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(again.hash).To(Equal(withFormats.hash))
+		Expect(again.binaryData[bundleJKSKey]).To(Equal(jks))
+	})
+
+	It("should collect the root certificates of Issuer sources", func() {
+		ctx := context.Background()
+		scheme := runtime.NewScheme()
+		utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+		utilruntime.Must(certsv1.AddToScheme(scheme))
+
+		ca := certsv1.Certificate{Spec: certsv1.CertificateSpec{
+			DNSName: "ca.k8c.io", Validity: "1y", IsCA: true, SecretRef: certsv1.SecretRef{Name: "ca-tls"},
+		}}
+		Expect(validation.DefaultCertificate(ctx, &ca)).To(Succeed())
+		caCert, caKey, err := helper.GenerateSelfSignedCertificate(ca)
+		Expect(err).NotTo(HaveOccurred())
+		bundle := &certsv1.Bundle{
+			ObjectMeta: metav1.ObjectMeta{Name: "trust", UID: "trust-uid"},
+			Spec: certsv1.BundleSpec{
+				Sources: []certsv1.BundleSource{
+					{Issuer: &certsv1.IssuerReference{Name: "internal-ca"}},
+					{Issuer: &certsv1.IssuerReference{Name: "missing-ca"}},
+				},
+				Target: certsv1.BundleTarget{ConfigMapRef: certsv1.ConfigMapRef{Name: "trust-bundle"}},
+			},
+		}
+		fakeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "shop"}},
+			&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "ca-tls", Namespace: "certs-system"},
+				Data:       helper.SecretData(caCert, caKey),
+			},
+			&certsv1.Issuer{
+				ObjectMeta: metav1.ObjectMeta{Name: "internal-ca"},
+				Spec: certsv1.IssuerSpec{CA: &certsv1.CAIssuer{
+					SecretRef: certsv1.SecretReference{Name: "ca-tls", Namespace: "certs-system"},
+				}},
+			},
+			bundle,
+		).WithStatusSubresource(&certsv1.Bundle{}).Build()
+		r := &BundleReconciler{Client: fakeClient, Scheme: scheme}
+
+		_, err = r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: "trust"}})
+		Expect(err).NotTo(HaveOccurred())
+		configMap := &corev1.ConfigMap{}
+		Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "trust-bundle", Namespace: "shop"}, configMap)).To(Succeed())
+		Expect(configMap.Data).To(HaveKeyWithValue(bundlePEMKey, string(caCert)))
+
+		By("enqueueing the Bundles sourcing an Issuer")
+		requests := r.bundlesForIssuer(ctx, &certsv1.Issuer{ObjectMeta: metav1.ObjectMeta{Name: "internal-ca"}})
+		Expect(requests).To(ConsistOf(ctrl.Request{NamespacedName: types.NamespacedName{Name: "trust"}}))
+	})
+})
@@ -0,0 +1,276 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
+)
+
+// InjectCAFromAnnotation references the Certificate, as <namespace>/<name>, whose
+// issuing certificate is injected into the caBundle fields of the annotated object
+const InjectCAFromAnnotation = "certs.k8c.io/inject-ca-from"
+
+// CAInjectorTarget is a kind whose caBundle fields are injected by the CAInjectorReconciler
+type CAInjectorTarget struct {
+	GVK schema.GroupVersionKind
+	// inject sets the caBundle fields of the object and reports whether it changed
+	inject func(obj *unstructured.Unstructured, caBundle string) (bool, error)
+}
+
+var (
+	mutatingWebhookTarget = CAInjectorTarget{
+		GVK:    schema.GroupVersionKind{Group: "admissionregistration.k8s.io", Version: "v1", Kind: "MutatingWebhookConfiguration"},
+		inject: injectWebhooksCABundle,
+	}
+	validatingWebhookTarget = CAInjectorTarget{
+		GVK:    schema.GroupVersionKind{Group: "admissionregistration.k8s.io", Version: "v1", Kind: "ValidatingWebhookConfiguration"},
+		inject: injectWebhooksCABundle,
+	}
+	customResourceDefinitionTarget = CAInjectorTarget{
+		GVK:    schema.GroupVersionKind{Group: "apiextensions.k8s.io", Version: "v1", Kind: "CustomResourceDefinition"},
+		inject: injectConversionCABundle,
+	}
+	apiServiceTarget = CAInjectorTarget{
+		GVK:    schema.GroupVersionKind{Group: "apiregistration.k8s.io", Version: "v1", Kind: "APIService"},
+		inject: injectAPIServiceCABundle,
+	}
+)
+
+// CAInjectorTargets are the kinds supported by the CA injector. They are handled
+// as unstructured objects so that no client library is needed for APIServices.
+var CAInjectorTargets = []CAInjectorTarget{
+	mutatingWebhookTarget,
+	validatingWebhookTarget,
+	customResourceDefinitionTarget,
+	apiServiceTarget,
+}
+
+// CAInjectorReconciler injects the issuing certificate of a Certificate into the
+// caBundle fields of the objects of one target kind
+type CAInjectorReconciler struct {
+	client.Client
+	Target CAInjectorTarget
+}
+
+// +kubebuilder:rbac:groups=admissionregistration.k8s.io,resources=mutatingwebhookconfigurations;validatingwebhookconfigurations,verbs=get;list;watch;update;patch
+// +kubebuilder:rbac:groups=apiextensions.k8s.io,resources=customresourcedefinitions,verbs=get;list;watch;update;patch
+// +kubebuilder:rbac:groups=apiregistration.k8s.io,resources=apiservices,verbs=get;list;watch;update;patch
+
+// Reconcile writes the current issuing certificate of the Certificate referenced
+// by the inject-ca-from annotation into the caBundle fields of the object.
+func (r *CAInjectorReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+	logger.Info("Reconcile Event: CA Injection Started", "Kind", r.Target.GVK.Kind)
+	obj := &unstructured.Unstructured{}
+	obj.SetGroupVersionKind(r.Target.GVK)
+	err := r.Get(ctx, req.NamespacedName, obj)
+	if err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	value, found := obj.GetAnnotations()[InjectCAFromAnnotation]
+	if !found {
+		return ctrl.Result{}, nil
+	}
+	ref, err := parseInjectCAFrom(value)
+	if err != nil {
+		logger.Error(err, "Reconcile Event: Ignoring invalid CA injection annotation")
+		return ctrl.Result{}, nil
+	}
+	ca, err := issuingCertificate(ctx, r.Client, ref)
+	if err != nil {
+		if client.IgnoreNotFound(err) == nil {
+			// The object is reconciled again once the Certificate is issued
+			logger.Info("Reconcile Event: Skipping CA injection of a certificate not issued yet", "Certificate", ref)
+			return ctrl.Result{}, nil
+		}
+		return ctrl.Result{}, err
+	}
+	if len(ca) == 0 {
+		logger.Info("Reconcile Event: Skipping CA injection of an empty certificate", "Certificate", ref)
+		return ctrl.Result{}, nil
+	}
+
+	changed, err := r.Target.inject(obj, base64.StdEncoding.EncodeToString(ca))
+	if err != nil {
+		logger.Error(err, "Reconcile Event: Failed to inject CA bundle")
+		return ctrl.Result{}, nil
+	}
+	if changed {
+		err = r.Update(ctx, obj)
+		if err != nil {
+			logger.Error(err, "Reconcile Event: Failed to update CA bundle")
+			return ctrl.Result{}, err
+		}
+		logger.Info("Reconcile Event: CA bundle injected", "Certificate", ref)
+	}
+	logger.Info("Reconcile Event: CA Injection Ended", "Kind", r.Target.GVK.Kind)
+	return ctrl.Result{}, nil
+}
+
+// parseInjectCAFrom parses the <namespace>/<name> value of the inject-ca-from annotation
+func parseInjectCAFrom(value string) (types.NamespacedName, error) {
+	namespace, name, found := strings.Cut(value, "/")
+	if !found || namespace == "" || name == "" || strings.Contains(name, "/") {
+		return types.NamespacedName{}, fmt.Errorf("%s should be <namespace>/<certificate>, got %q", InjectCAFromAnnotation, value)
+	}
+	return types.NamespacedName{Namespace: namespace, Name: name}, nil
+}
+
+// issuingCertificate returns the PEM encoded issuing certificate of a Certificate.
+// Secrets written before the ca.crt key was introduced hold a self-signed
+// certificate, which is its own issuer.
+func issuingCertificate(ctx context.Context, c client.Client, ref types.NamespacedName) ([]byte, error) {
+	certificate := &certsv1.Certificate{}
+	err := c.Get(ctx, ref, certificate)
+	if err != nil {
+		return nil, err
+	}
+	secret := &corev1.Secret{}
+	err = c.Get(ctx, types.NamespacedName{Name: certificate.Spec.SecretRef.Name, Namespace: ref.Namespace}, secret)
+	if err != nil {
+		return nil, err
+	}
+	if data, found := secret.Data["ca.crt"]; found {
+		return data, nil
+	}
+	return secret.Data["tls.crt"], nil
+}
+
+// setCABundle sets the caBundle field at the path and reports whether it changed
+func setCABundle(obj map[string]interface{}, caBundle string, path ...string) (bool, error) {
+	current, _, err := unstructured.NestedString(obj, path...)
+	if err != nil {
+		return false, err
+	}
+	if current == caBundle {
+		return false, nil
+	}
+	return true, unstructured.SetNestedField(obj, caBundle, path...)
+}
+
+func injectWebhooksCABundle(obj *unstructured.Unstructured, caBundle string) (bool, error) {
+	webhooks, _, err := unstructured.NestedSlice(obj.Object, "webhooks")
+	if err != nil {
+		return false, err
+	}
+	changed := false
+	for i := range webhooks {
+		webhook, ok := webhooks[i].(map[string]interface{})
+		if !ok {
+			return false, fmt.Errorf("webhooks[%d] is not an object", i)
+		}
+		set, err := setCABundle(webhook, caBundle, "clientConfig", "caBundle")
+		if err != nil {
+			return false, err
+		}
+		changed = changed || set
+	}
+	if !changed {
+		return false, nil
+	}
+	return true, unstructured.SetNestedSlice(obj.Object, webhooks, "webhooks")
+}
+
+func injectConversionCABundle(obj *unstructured.Unstructured, caBundle string) (bool, error) {
+	strategy, _, err := unstructured.NestedString(obj.Object, "spec", "conversion", "strategy")
+	if err != nil || strategy != "Webhook" {
+		return false, err
+	}
+	return setCABundle(obj.Object, caBundle, "spec", "conversion", "webhook", "clientConfig", "caBundle")
+}
+
+func injectAPIServiceCABundle(obj *unstructured.Unstructured, caBundle string) (bool, error) {
+	insecure, _, err := unstructured.NestedBool(obj.Object, "spec", "insecureSkipTLSVerify")
+	if err != nil {
+		return false, err
+	}
+	if insecure {
+		return false, fmt.Errorf("a caBundle can not be set on an APIService with insecureSkipTLSVerify")
+	}
+	if _, found, _ := unstructured.NestedMap(obj.Object, "spec", "service"); !found {
+		// Local APIServices are served by the kube-apiserver itself
+		return false, nil
+	}
+	return setCABundle(obj.Object, caBundle, "spec", "caBundle")
+}
+
+// objectsForCertificate enqueues the target objects injected from the Certificate
+func (r *CAInjectorReconciler) objectsForCertificate(ctx context.Context, certificate types.NamespacedName) []reconcile.Request {
+	objs := &unstructured.UnstructuredList{}
+	objs.SetGroupVersionKind(r.Target.GVK.GroupVersion().WithKind(r.Target.GVK.Kind + "List"))
+	err := r.List(ctx, objs)
+	if err != nil {
+		log.FromContext(ctx).Error(err, "Failed to list CA injection targets", "Kind", r.Target.GVK.Kind)
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, obj := range objs.Items {
+		ref, err := parseInjectCAFrom(obj.GetAnnotations()[InjectCAFromAnnotation])
+		if err == nil && ref == certificate {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: obj.GetName(), Namespace: obj.GetNamespace()}})
+		}
+	}
+	return requests
+}
+
+// objectsForSecret enqueues the target objects injected from the Certificates
+// stored in the Secret, so that renewals are picked up as soon as they are written
+func (r *CAInjectorReconciler) objectsForSecret(ctx context.Context, secret client.Object) []reconcile.Request {
+	certificates := &certsv1.CertificateList{}
+	err := r.List(ctx, certificates, client.InNamespace(secret.GetNamespace()))
+	if err != nil {
+		log.FromContext(ctx).Error(err, "Failed to list certificates")
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, certificate := range certificates.Items {
+		if certificate.Spec.SecretRef.Name == secret.GetName() {
+			requests = append(requests, r.objectsForCertificate(ctx, client.ObjectKeyFromObject(&certificate))...)
+		}
+	}
+	return requests
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *CAInjectorReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	obj := &unstructured.Unstructured{}
+	obj.SetGroupVersionKind(r.Target.GVK)
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("cainjector-"+strings.ToLower(r.Target.GVK.Kind)).
+		For(obj).
+		Watches(&certsv1.Certificate{}, handler.EnqueueRequestsFromMapFunc(func(ctx context.Context, certificate client.Object) []reconcile.Request {
+			return r.objectsForCertificate(ctx, client.ObjectKeyFromObject(certificate))
+		})).
+		Watches(&corev1.Secret{}, handler.EnqueueRequestsFromMapFunc(r.objectsForSecret)).
+		Complete(r)
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+var _ = Describe("CA Injector", func() {
+	It("should parse the inject-ca-from annotation", func() {
+		ref, err := parseInjectCAFrom("k8c-certs-manager-system/serving-cert")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(ref).To(Equal(types.NamespacedName{Namespace: "k8c-certs-manager-system", Name: "serving-cert"}))
+		for _, value := range []string{"", "serving-cert", "/serving-cert", "ns/", "ns/a/b"} {
+			_, err = parseInjectCAFrom(value)
+			Expect(err).To(HaveOccurred(), value)
+		}
+	})
+
+	It("should inject the CA into every webhook", func() {
+		obj := &unstructured.Unstructured{Object: map[string]interface{}{
+			"webhooks": []interface{}{
+				map[string]interface{}{"name": "first", "clientConfig": map[string]interface{}{"caBundle": "b2xk"}},
+				map[string]interface{}{"name": "second", "clientConfig": map[string]interface{}{}},
+			},
+		}}
+		changed, err := injectWebhooksCABundle(obj, "bmV3")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(changed).To(BeTrue())
+		webhooks, _, _ := unstructured.NestedSlice(obj.Object, "webhooks")
+		for _, webhook := range webhooks {
+			caBundle, _, _ := unstructured.NestedString(webhook.(map[string]interface{}), "clientConfig", "caBundle")
+			Expect(caBundle).To(Equal("bmV3"))
+		}
+
+		changed, err = injectWebhooksCABundle(obj, "bmV3")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(changed).To(BeFalse())
+	})
+
+	It("should only inject the CA into conversion webhooks", func() {
+		crd := &unstructured.Unstructured{Object: map[string]interface{}{
+			"spec": map[string]interface{}{"conversion": map[string]interface{}{"strategy": "None"}},
+		}}
+		changed, err := injectConversionCABundle(crd, "bmV3")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(changed).To(BeFalse())
+
+		Expect(unstructured.SetNestedField(crd.Object, "Webhook", "spec", "conversion", "strategy")).To(Succeed())
+		changed, err = injectConversionCABundle(crd, "bmV3")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(changed).To(BeTrue())
+		caBundle, _, _ := unstructured.NestedString(crd.Object, "spec", "conversion", "webhook", "clientConfig", "caBundle")
+		Expect(caBundle).To(Equal("bmV3"))
+	})
+
+	It("should inject the CA into service backed APIServices", func() {
+		local := &unstructured.Unstructured{Object: map[string]interface{}{"spec": map[string]interface{}{}}}
+		changed, err := injectAPIServiceCABundle(local, "bmV3")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(changed).To(BeFalse())
+
+		apiService := &unstructured.Unstructured{Object: map[string]interface{}{
+			"spec": map[string]interface{}{"service": map[string]interface{}{"name": "api", "namespace": "default"}},
+		}}
+		changed, err = injectAPIServiceCABundle(apiService, "bmV3")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(changed).To(BeTrue())
+		Expect(apiService.Object["spec"]).To(HaveKeyWithValue("caBundle", "bmV3"))
+
+		Expect(unstructured.SetNestedField(apiService.Object, true, "spec", "insecureSkipTLSVerify")).To(Succeed())
+		_, err = injectAPIServiceCABundle(apiService, "bmV3")
+		Expect(err).To(HaveOccurred())
+	})
+})
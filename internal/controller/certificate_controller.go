@@ -18,10 +18,15 @@ package controller
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/PNarode/k8c-certs-manager/internal/helper"
+	"github.com/PNarode/k8c-certs-manager/internal/validation"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
 	"reflect"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/event"
 	"sigs.k8s.io/controller-runtime/pkg/predicate"
 	"time"
@@ -38,7 +43,20 @@ import (
 // CertificateReconciler reconciles a Certificate object
 type CertificateReconciler struct {
 	client.Client
-	Scheme *runtime.Scheme
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+	// CRLBaseURL is the URL of the CRL server embedded as CRL distribution point
+	// in the certificates signed by CA Issuers. None is embedded when empty.
+	CRLBaseURL string
+	// OCSPBaseURL is the URL of the OCSP responder embedded in the authority
+	// information access of the certificates signed by CA Issuers.
+	OCSPBaseURL string
+	// ManagerNamespace is the namespace of the manager. Vault Issuers may only
+	// log in with the ServiceAccounts and Secrets of this namespace.
+	ManagerNamespace string
+	// ApprovalUnenforced is set when the CertificateRequest admission webhook is not
+	// served. The requests of namespaces requiring an approval are then not signed.
+	ApprovalUnenforced bool
 }
 
 // +kubebuilder:rbac:groups=certs.k8c.io,resources=certificates,verbs=get;list;watch;create;update;patch;delete
@@ -55,6 +73,29 @@ type CertificateReconciler struct {
 // For more details, check Reconcile and its Result here:
 // - https://pkg.go.dev/sigs.k8s.io/controller-runtime@v0.19.0/pkg/reconcile
 func (r *CertificateReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	result, err := r.reconcile(ctx, req)
+	// Changes to the owned CertificateRequests trigger the next reconcile
+	switch {
+	case errors.Is(err, errIssuancePending):
+		log.FromContext(ctx).Info("Reconcile Event: Waiting for the CertificateRequest to be approved")
+		return ctrl.Result{}, nil
+	case errors.Is(err, errIssuanceDenied):
+		log.FromContext(ctx).Info("Reconcile Event: CertificateRequest was denied, delete it or change the Certificate to request again")
+		return ctrl.Result{}, nil
+	case errors.Is(err, errIssuanceInProgress):
+		log.FromContext(ctx).Info("Reconcile Event: Waiting for the issuer to sign the CertificateRequest")
+		return ctrl.Result{RequeueAfter: issuancePollInterval}, nil
+	case errors.Is(err, errIssuanceFailed):
+		log.FromContext(ctx).Info("Reconcile Event: CertificateRequest failed, delete it or change the Certificate to request again")
+		return ctrl.Result{}, nil
+	case errors.Is(err, errApprovalUnenforced):
+		log.FromContext(ctx).Info("Reconcile Event: Refusing to sign in a namespace requiring an approval while the admission webhooks are disabled")
+		return ctrl.Result{}, nil
+	}
+	return result, err
+}
+
+func (r *CertificateReconciler) reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	logger := log.FromContext(ctx)
 	logger.Info("Reconcile Event: Certificate Reconcilation Started")
 	// Fetch the Certificate instance
@@ -65,8 +106,19 @@ func (r *CertificateReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
 
+	// Apply the defaults here as the mutating webhook is optional
+	err = r.applyDefaults(ctx, certificate)
+	if err != nil {
+		logger.Error(err, "Reconcile Event: Failed to apply certificate defaults")
+		return ctrl.Result{}, err
+	}
+
 	// Fetch Request Type annotation from Certificate Request Object
 	requestType, found := certificate.Annotations["requestType"]
+	// Without the mutating webhook spec changes are only visible through the generation
+	if !found && certificate.Status.ObservedGeneration != 0 && certificate.Status.ObservedGeneration != certificate.Generation {
+		requestType, found = "UpdateRequest", true
+	}
 	// No Request Type Annotation found. So perform normal Controller Reconcilation logic
 	if !found {
 		logger.Info("Reconcile Event: Attempting to check if Certificate Exists")
@@ -78,21 +130,50 @@ func (r *CertificateReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 			logger.Info("Reconcile Event: Attempting to bring resource to desired state")
 			err = r.createCertificate(ctx, *certificate, nil, req, "ReconileRequest")
 			if err != nil {
-				logger.Error(err, "Reconcile Event: Failed to bring resource to desired state")
+				if !issuanceBlocked(err) {
+					logger.Error(err, "Reconcile Event: Failed to bring resource to desired state")
+				}
 				return ctrl.Result{}, client.IgnoreAlreadyExists(err)
 			}
 			return ctrl.Result{RequeueAfter: time.Minute * 5}, nil
 		}
+		err = checkSecretManaged(certificate, secret)
+		if err != nil {
+			logger.Error(err, "Reconcile Event: Refusing to manage the certificate TLS secret", "Secret", certificate.Spec.SecretRef)
+			return ctrl.Result{}, err
+		}
 
 		// Reconcile and Check if Certificate Renewal is Required
 		expiryDate := certificate.Status.ExpiryDate.Time
 		renewBefore, _ := time.ParseDuration(certificate.Spec.RenewBefore)
+		requestedAt, manualRenewal := manualRenewalRequest(ctx, certificate)
+		if manualRenewal {
+			logger.Info("Reconcile Event: Manual renewal requested", "RequestedAt", requestedAt)
+		}
+
+		// A revoked certificate is replaced right away
+		if _, found := certificate.Annotations[certsv1.RevokeAnnotation]; found {
+			err = r.revokeCertificate(ctx, certificate, secret)
+			if err != nil {
+				logger.Error(err, "Reconcile Event: Failed to revoke certificate")
+				return ctrl.Result{}, err
+			}
+		}
+		revoked, err := r.certificateRevoked(ctx, certificate, secret)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if revoked {
+			logger.Info("Reconcile Event: Certificate was revoked by its issuer")
+		}
 
-		if time.Until(expiryDate) <= renewBefore {
+		if manualRenewal || revoked || time.Until(expiryDate) <= renewBefore {
 			logger.Info("Reconcile Event: Renewing the certificate")
 			err = r.renewCertificate(ctx, *certificate, secret, req)
 			if err != nil {
-				logger.Error(err, "Reconcile Event: Failed to renew certificate")
+				if !issuanceBlocked(err) {
+					logger.Error(err, "Reconcile Event: Failed to renew certificate")
+				}
 				return ctrl.Result{}, err
 			}
 			return ctrl.Result{RequeueAfter: time.Minute * 5}, nil
@@ -144,7 +225,7 @@ func (r *CertificateReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 			logger.Info("Reconcile Update Event: Certificate Desired State Achived")
 			if olderSecret != "" {
 				err = r.Get(ctx, types.NamespacedName{Name: olderSecret, Namespace: req.Namespace}, secret)
-				if err == nil {
+				if err == nil && metav1.IsControlledBy(secret, certificate) {
 					logger.Info("Reconcile Update Event: cleanup of older secret")
 					err = r.Delete(ctx, secret)
 					if err != nil {
@@ -167,6 +248,9 @@ func (r *CertificateReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 			logger.Info("Reconcile Update Event: Attempting to bring resource to desired state")
 			err = r.createCertificate(ctx, *certificate, secret, req, "UpdateRequest")
 			if err != nil {
+				if issuanceBlocked(err) {
+					return ctrl.Result{}, err
+				}
 				logger.Error(err, "Reconcile Update Event: Failed to bring resource to desired state")
 				if client.IgnoreAlreadyExists(err) != nil {
 					return ctrl.Result{}, err
@@ -182,7 +266,7 @@ func (r *CertificateReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 		deleteSecret, found := certificate.Annotations["deleteSecret"]
 		if found {
 			err = r.Get(ctx, types.NamespacedName{Name: deleteSecret, Namespace: req.Namespace}, secret)
-			if err == nil {
+			if err == nil && metav1.IsControlledBy(secret, certificate) {
 				logger.Info("Reconcile Cleanup Event: cleanup of older secret")
 				err = r.Delete(ctx, secret)
 				if err != nil {
@@ -213,23 +297,67 @@ func (r *CertificateReconciler) SetupWithManager(mgr ctrl.Manager) error {
 		UpdateFunc: func(e event.UpdateEvent) bool {
 			oldCert := e.ObjectOld.DeepCopyObject().(*certsv1.Certificate)
 			newCert := e.ObjectNew.DeepCopyObject().(*certsv1.Certificate)
-			ret := !reflect.DeepEqual(oldCert.Spec, newCert.Spec)
+			ret := !reflect.DeepEqual(oldCert.Spec, newCert.Spec) ||
+				oldCert.Annotations[certsv1.RenewRequestedAtAnnotation] != newCert.Annotations[certsv1.RenewRequestedAtAnnotation] ||
+				oldCert.Annotations[certsv1.RevokeAnnotation] != newCert.Annotations[certsv1.RevokeAnnotation]
 			return ret
 		},
 	}
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&certsv1.Certificate{}).
-		WithEventFilter(p).
+		For(&certsv1.Certificate{}, builder.WithPredicates(p)).
+		Owns(&certsv1.CertificateRequest{}).
 		Complete(r)
 }
 
+// applyDefaults defaults the Certificate in case the mutating webhook did not run.
+// Spec defaults are persisted so that the spec read by users and policies is the
+// one the certificate is issued for.
+func (r *CertificateReconciler) applyDefaults(ctx context.Context, certificate *certsv1.Certificate) error {
+	defaulted := certificate.DeepCopy()
+	err := validation.DefaultCertificate(ctx, defaulted)
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(defaulted.Spec, certificate.Spec) {
+		patch := client.MergeFrom(certificate.DeepCopy())
+		certificate.Spec = defaulted.Spec
+		err = r.Patch(ctx, certificate, patch)
+		if err != nil {
+			return err
+		}
+	}
+	certificate.Annotations = defaulted.Annotations
+	return nil
+}
+
+// checkSecretManaged refuses to write a Secret the Certificate does not control.
+// Secrets issued before the controller reference was set are adopted when the
+// status of the Certificate records them.
+func checkSecretManaged(certificate *certsv1.Certificate, secret *corev1.Secret) error {
+	if metav1.IsControlledBy(secret, certificate) {
+		return nil
+	}
+	if metav1.GetControllerOf(secret) == nil && certificate.Status.SecretRef == secret.Name {
+		return nil
+	}
+	return fmt.Errorf("secret %s/%s is not managed by Certificate %s", secret.Namespace, secret.Name, certificate.Name)
+}
+
 func (r *CertificateReconciler) createCertificate(ctx context.Context, certificate certsv1.Certificate, secret *corev1.Secret, req ctrl.Request, reason string) error {
 	logger := log.FromContext(ctx)
+	if secret != nil {
+		err := checkSecretManaged(&certificate, secret)
+		if err != nil {
+			return err
+		}
+	}
 
-	// Generate a new self-signed certificate
-	cert, key, err := helper.GenerateSelfSignedCertificate(certificate)
+	// Issue a new certificate once its request is approved
+	data, err := r.issue(ctx, &certificate)
 	if err != nil {
-		logger.Error(err, "Failed to generate self-signed certificate")
+		if !issuanceBlocked(err) {
+			logger.Error(err, "Failed to issue certificate")
+		}
 		return err
 	}
 
@@ -240,12 +368,17 @@ func (r *CertificateReconciler) createCertificate(ctx context.Context, certifica
 				Name:      certificate.Spec.SecretRef.Name,
 				Namespace: req.Namespace,
 			},
-			Data: map[string][]byte{
-				"tls.crt": cert,
-				"tls.key": key,
-			},
+			Data: data,
 			Type: corev1.SecretTypeTLS,
 		}
+		// Certificates signed for a CSR generated outside the cluster have no private key
+		if _, found := data["tls.key"]; !found {
+			secret.Type = corev1.SecretTypeOpaque
+		}
+		err = ctrl.SetControllerReference(&certificate, secret, r.Scheme)
+		if err != nil {
+			return err
+		}
 
 		// Create the secret in Kubernetes
 		if err := r.Create(ctx, secret); err != nil {
@@ -253,22 +386,23 @@ func (r *CertificateReconciler) createCertificate(ctx context.Context, certifica
 			return err
 		}
 		logger.Info("TLS Certificate Issued Successfully", "Secret", certificate.Spec.SecretRef)
-		err = r.updateStatus(ctx, &certificate, false)
+		err = r.updateStatus(ctx, &certificate, data["tls.crt"], false)
 		if err != nil {
 			logger.Error(err, "Failed to update certificate status")
 			return err
 		}
 	} else {
-		secret.Data = map[string][]byte{
-			"tls.crt": cert,
-			"tls.key": key,
+		secret.Data = data
+		err = ctrl.SetControllerReference(&certificate, secret, r.Scheme)
+		if err != nil {
+			return err
 		}
 		if err := r.Update(ctx, secret); err != nil {
 			logger.Error(err, "Failed to update secret from updated TLS certificate")
 			return err
 		}
 		logger.Info("TLS Certificate Updated Successfully", "Secret", certificate.Spec.SecretRef)
-		err = r.updateStatus(ctx, &certificate, false)
+		err = r.updateStatus(ctx, &certificate, data["tls.crt"], false)
 		if err != nil {
 			logger.Error(err, "Failed to update certificate status")
 			return err
@@ -279,17 +413,24 @@ func (r *CertificateReconciler) createCertificate(ctx context.Context, certifica
 
 func (r *CertificateReconciler) renewCertificate(ctx context.Context, certificate certsv1.Certificate, secret *corev1.Secret, req ctrl.Request) error {
 	logger := log.FromContext(ctx)
+	err := checkSecretManaged(&certificate, secret)
+	if err != nil {
+		return err
+	}
 
-	// Generate a new self-signed certificate
-	cert, key, err := helper.GenerateSelfSignedCertificate(certificate)
+	// Issue a new certificate once its request is approved
+	data, err := r.issue(ctx, &certificate)
 	if err != nil {
-		logger.Error(err, "Failed to renew self-signed certificate")
+		if !issuanceBlocked(err) {
+			logger.Error(err, "Failed to renew certificate")
+		}
 		return err
 	}
 
-	secret.Data = map[string][]byte{
-		"tls.crt": cert,
-		"tls.key": key,
+	secret.Data = data
+	err = ctrl.SetControllerReference(&certificate, secret, r.Scheme)
+	if err != nil {
+		return err
 	}
 
 	if err := r.Update(ctx, secret); err != nil {
@@ -297,7 +438,7 @@ func (r *CertificateReconciler) renewCertificate(ctx context.Context, certificat
 		return err
 	}
 	logger.Info("TLS Certificate Renewed Successfully", "Secret", certificate.Spec.SecretRef)
-	err = r.updateStatus(ctx, &certificate, true)
+	err = r.updateStatus(ctx, &certificate, data["tls.crt"], true)
 	if err != nil {
 		logger.Error(err, "Failed to update certificate status")
 		return err
@@ -305,20 +446,35 @@ func (r *CertificateReconciler) renewCertificate(ctx context.Context, certificat
 	return nil
 }
 
-func (r *CertificateReconciler) updateStatus(ctx context.Context, certificate *certsv1.Certificate, renewed bool) error {
+func (r *CertificateReconciler) updateStatus(ctx context.Context, certificate *certsv1.Certificate, certPEM []byte, renewed bool) error {
 	logger := log.FromContext(ctx)
 	validity, _ := time.ParseDuration(certificate.Annotations["validityInHours"])
 	certificate.Status.ExpiryDate = metav1.NewTime(time.Now().Add(validity))
+	// An issuer may shorten the validity, e.g: to the validity of its CA
+	if chain, err := helper.ParseCertificatesPEM(certPEM); err == nil && len(chain) > 0 {
+		certificate.Status.ExpiryDate = metav1.NewTime(chain[0].NotAfter)
+	}
 	certificate.Status.SecretRef = certificate.Spec.SecretRef.Name
 	certificate.Status.ObservedGeneration = certificate.Generation
+	certificate.Status.Revision++
 	if renewed {
 		certificate.Status.RenewedAt = metav1.NewTime(time.Now())
 	}
+	// Any issuance satisfies a pending manual renewal request
+	if requestedAt, found := manualRenewalRequest(ctx, certificate); found {
+		lastManualRenewal := metav1.NewTime(requestedAt)
+		certificate.Status.LastManualRenewal = &lastManualRenewal
+	}
 	err := r.Status().Update(ctx, certificate)
 	if err != nil {
 		logger.Error(err, "Reconcile Update Event: Failed to update certificate status")
 		return err
 	}
+	// Leftovers are owned by the Certificate and garbage collected with it
+	err = r.cleanupRequests(ctx, certificate)
+	if err != nil {
+		logger.Error(err, "Reconcile Event: Failed to clean up certificate requests")
+	}
 	return nil
 }
 
@@ -334,3 +490,33 @@ func (r *CertificateReconciler) updateAnnotations(ctx context.Context, certifica
 	latestCert.Annotations = certificate.GetAnnotations()
 	return r.Patch(ctx, latestCert, patch)
 }
+
+// manualRenewalClockSkew is how far in the future a renew-requested-at timestamp
+// may be, for clients whose clock is ahead of the controller
+const manualRenewalClockSkew = time.Minute
+
+// manualRenewalRequest returns the time of a manual renewal requested through the
+// renew-requested-at annotation which has not been honoured yet.
+func manualRenewalRequest(ctx context.Context, certificate *certsv1.Certificate) (time.Time, bool) {
+	logger := log.FromContext(ctx)
+	value, found := certificate.Annotations[certsv1.RenewRequestedAtAnnotation]
+	if !found {
+		return time.Time{}, false
+	}
+	requestedAt, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		logger.Error(err, "Reconcile Event: Ignoring invalid manual renewal request", "Annotation", certsv1.RenewRequestedAtAnnotation)
+		return time.Time{}, false
+	}
+	// A request in the future would block every later request until that time
+	if time.Until(requestedAt) > manualRenewalClockSkew {
+		logger.Info("Reconcile Event: Ignoring manual renewal request in the future", "Annotation", certsv1.RenewRequestedAtAnnotation, "RequestedAt", value)
+		return time.Time{}, false
+	}
+	// Status timestamps are stored with a second precision
+	requestedAt = requestedAt.Truncate(time.Second)
+	if certificate.Status.LastManualRenewal != nil && !requestedAt.After(certificate.Status.LastManualRenewal.Time) {
+		return time.Time{}, false
+	}
+	return requestedAt, true
+}
@@ -18,11 +18,17 @@ package controller
 
 import (
 	"context"
+	"time"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
 	"sigs.k8s.io/controller-runtime/pkg/reconcile"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -81,4 +87,81 @@ var _ = Describe("Certificate Controller", func() {
 			// Example: If you expect a certain status condition after reconciliation, verify it here.
 		})
 	})
+
+	Context("When the Secret of a Certificate exists", func() {
+		ctx := context.Background()
+
+		It("should only write a Secret controlled by the Certificate", func() {
+			scheme := runtime.NewScheme()
+			utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+			utilruntime.Must(certsv1.AddToScheme(scheme))
+			newCertificate := func(name, secretName string) *certsv1.Certificate {
+				return &certsv1.Certificate{
+					ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default", UID: types.UID(name + "-uid")},
+					Spec: certsv1.CertificateSpec{
+						DNSName: name + ".k8c.io", Validity: "30d", SecretRef: certsv1.SecretRef{Name: secretName},
+					},
+				}
+			}
+			foreign := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "other-tls", Namespace: "default"},
+				Data:       map[string][]byte{"tls.crt": []byte("other")},
+			}
+			fakeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+				&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}},
+				newCertificate("web", "web-tls"),
+				newCertificate("thief", "other-tls"),
+				foreign,
+			).WithStatusSubresource(&certsv1.Certificate{}, &certsv1.CertificateRequest{}).Build()
+			r := &CertificateReconciler{Client: fakeClient, Scheme: scheme}
+
+			By("setting the controller reference of a created Secret")
+			_, err := r.Reconcile(ctx, reconcile.Request{NamespacedName: types.NamespacedName{Name: "web", Namespace: "default"}})
+			Expect(err).NotTo(HaveOccurred())
+			secret := &corev1.Secret{}
+			Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "web-tls", Namespace: "default"}, secret)).To(Succeed())
+			Expect(secret.OwnerReferences).To(ConsistOf(HaveField("Name", "web")))
+
+			By("refusing to overwrite a Secret it does not control")
+			_, err = r.Reconcile(ctx, reconcile.Request{NamespacedName: types.NamespacedName{Name: "thief", Namespace: "default"}})
+			Expect(err).To(MatchError(ContainSubstring("is not managed by Certificate thief")))
+			Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "other-tls", Namespace: "default"}, secret)).To(Succeed())
+			Expect(secret.Data).To(Equal(foreign.Data))
+		})
+	})
+
+	Context("When a manual renewal is requested", func() {
+		ctx := context.Background()
+
+		It("should only honour a request newer than the last one", func() {
+			certificate := &certsv1.Certificate{
+				ObjectMeta: metav1.ObjectMeta{
+					Annotations: map[string]string{certsv1.RenewRequestedAtAnnotation: "2024-05-01T10:00:00Z"},
+				},
+			}
+			requestedAt, found := manualRenewalRequest(ctx, certificate)
+			Expect(found).To(BeTrue())
+
+			lastManualRenewal := metav1.NewTime(requestedAt)
+			certificate.Status.LastManualRenewal = &lastManualRenewal
+			_, found = manualRenewalRequest(ctx, certificate)
+			Expect(found).To(BeFalse())
+
+			certificate.Annotations[certsv1.RenewRequestedAtAnnotation] = "2024-05-02T10:00:00Z"
+			_, found = manualRenewalRequest(ctx, certificate)
+			Expect(found).To(BeTrue())
+
+			certificate.Annotations[certsv1.RenewRequestedAtAnnotation] = "now"
+			_, found = manualRenewalRequest(ctx, certificate)
+			Expect(found).To(BeFalse())
+
+			By("ignoring a request in the future")
+			certificate.Annotations[certsv1.RenewRequestedAtAnnotation] = time.Now().Add(time.Hour).Format(time.RFC3339)
+			_, found = manualRenewalRequest(ctx, certificate)
+			Expect(found).To(BeFalse())
+			certificate.Annotations[certsv1.RenewRequestedAtAnnotation] = time.Now().Add(10 * time.Second).Format(time.RFC3339)
+			_, found = manualRenewalRequest(ctx, certificate)
+			Expect(found).To(BeTrue())
+		})
+	})
 })
@@ -0,0 +1,134 @@
+package controller
+
+import (
+	"context"
+	"errors"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
+)
+
+const (
+	// IssueAnnotation opts a resource into having Certificates created for its TLS configuration
+	IssueAnnotation = "certs.k8c.io/issue"
+	// ValidityAnnotation overrides the validity of the Certificates created for a resource
+	ValidityAnnotation = "certs.k8c.io/validity"
+	// DefaultValidity is the validity of the Certificates created for a resource
+	DefaultValidity = "360d"
+)
+
+// errCertificateNotOwned is returned when a Certificate of the requested name
+// exists but is not controlled by the owner
+var errCertificateNotOwned = errors.New("certificate is not managed by the owner")
+
+// shimCertificateSpec builds the spec of a Certificate created for a resource
+// from the requested hosts and the validity annotation of the owner. The subject
+// is the one defaulted for the first host, so that it follows the hosts.
+func shimCertificateSpec(owner client.Object, hosts []string, secretName string) certsv1.CertificateSpec {
+	validity := DefaultValidity
+	if value, found := owner.GetAnnotations()[ValidityAnnotation]; found {
+		validity = value
+	}
+	var dnsNames []string
+	if len(hosts) > 1 {
+		dnsNames = hosts[1:]
+	}
+	return certsv1.CertificateSpec{
+		DNSName:   hosts[0],
+		DNSNames:  dnsNames,
+		Subject:   &certsv1.X509PkixSubject{CommonName: hosts[0]},
+		Validity:  validity,
+		SecretRef: certsv1.SecretRef{Name: secretName},
+	}
+}
+
+// provisionedElsewhere reports whether a Secret referenced by the owner already
+// exists without a Certificate of the owner, e.g. because it is managed by hand
+// or by another tool, in which case it is not replaced by an issued certificate.
+func provisionedElsewhere(ctx context.Context, c client.Reader, owner client.Object, secretName string) (bool, error) {
+	key := types.NamespacedName{Name: secretName, Namespace: owner.GetNamespace()}
+	certificate := &certsv1.Certificate{}
+	err := c.Get(ctx, key, certificate)
+	if err == nil {
+		return !metav1.IsControlledBy(certificate, owner), nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return false, err
+	}
+	err = c.Get(ctx, key, &corev1.Secret{})
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// applyOwnedCertificate creates or updates a Certificate controlled by the owner.
+// The names and the subject are rewritten together, other fields defaulted on the
+// Certificate, like renewBefore, are preserved. Existing
+// Certificates not controlled by the owner are left untouched and a warning event
+// is recorded on the owner, so that names taken from annotations can not take
+// them over.
+func applyOwnedCertificate(ctx context.Context, c client.Client, scheme *runtime.Scheme, recorder record.EventRecorder, owner client.Object, name string, spec certsv1.CertificateSpec) error {
+	logger := log.FromContext(ctx)
+	certificate := &certsv1.Certificate{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: owner.GetNamespace(),
+		},
+	}
+	result, err := controllerutil.CreateOrUpdate(ctx, c, certificate, func() error {
+		if certificate.ResourceVersion != "" && !metav1.IsControlledBy(certificate, owner) {
+			return errCertificateNotOwned
+		}
+		certificate.Spec.DNSName = spec.DNSName
+		certificate.Spec.DNSNames = spec.DNSNames
+		certificate.Spec.Subject = spec.Subject
+		certificate.Spec.Validity = spec.Validity
+		certificate.Spec.SecretRef = spec.SecretRef
+		certificate.Spec.IssuerRef = spec.IssuerRef
+		return controllerutil.SetControllerReference(owner, certificate, scheme)
+	})
+	if errors.Is(err, errCertificateNotOwned) {
+		logger.Info("Reconcile Event: Skipping certificate not managed by the owner", "Certificate", name)
+		recorder.Eventf(owner, corev1.EventTypeWarning, "CertificateNotOwned",
+			"Certificate %s already exists and is not managed by %s", name, owner.GetName())
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	logger.Info("Reconcile Event: Owned certificate applied", "Certificate", name, "Result", result)
+	return nil
+}
+
+// deleteStaleCertificates deletes the Certificates controlled by the owner which
+// are not part of the desired set anymore.
+func deleteStaleCertificates(ctx context.Context, c client.Client, owner client.Object, desired map[string]certsv1.CertificateSpec) error {
+	logger := log.FromContext(ctx)
+	certificates := &certsv1.CertificateList{}
+	err := c.List(ctx, certificates, client.InNamespace(owner.GetNamespace()))
+	if err != nil {
+		return err
+	}
+	for i := range certificates.Items {
+		certificate := &certificates.Items[i]
+		if _, found := desired[certificate.Name]; found || !metav1.IsControlledBy(certificate, owner) {
+			continue
+		}
+		logger.Info("Reconcile Event: Deleting certificate no longer requested", "Certificate", certificate.Name)
+		err = c.Delete(ctx, certificate)
+		if client.IgnoreNotFound(err) != nil {
+			return err
+		}
+	}
+	return nil
+}
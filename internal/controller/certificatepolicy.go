@@ -0,0 +1,271 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
+	"github.com/PNarode/k8c-certs-manager/internal/helper"
+	"github.com/PNarode/k8c-certs-manager/internal/validation"
+)
+
+// +kubebuilder:rbac:groups=certs.k8c.io,resources=certificatepolicies;clustercertificatepolicies,verbs=get;list;watch
+
+// PolicyViolation reports the policy which refused a Certificate
+type PolicyViolation struct {
+	// Policy is the kind and name of the policy, e.g: ClusterCertificatePolicy/team-a
+	Policy string
+	Errors field.ErrorList
+}
+
+func (v *PolicyViolation) Error() string {
+	return fmt.Sprintf("denied by %s: %s", v.Policy, v.Errors.ToAggregate().Error())
+}
+
+// CheckCertificatePolicies evaluates the ClusterCertificatePolicies selecting the
+// namespace of a Certificate and the CertificatePolicies of that namespace, in
+// name order. Every policy has to admit the Certificate, the first one refusing
+// it is returned. A CA certificate signed by an Issuer is only admitted if a
+// ClusterCertificatePolicy selects the namespace and all of them allow it.
+func CheckCertificatePolicies(ctx context.Context, c client.Reader, cert *certsv1.Certificate) (*PolicyViolation, error) {
+	clusterPolicies := &certsv1.ClusterCertificatePolicyList{}
+	err := c.List(ctx, clusterPolicies)
+	if err != nil {
+		return nil, err
+	}
+	selected := 0
+	if len(clusterPolicies.Items) > 0 {
+		namespace := &corev1.Namespace{}
+		err = c.Get(ctx, types.NamespacedName{Name: cert.Namespace}, namespace)
+		if err != nil {
+			return nil, err
+		}
+		slices.SortFunc(clusterPolicies.Items, func(a, b certsv1.ClusterCertificatePolicy) int {
+			return strings.Compare(a.Name, b.Name)
+		})
+		for _, policy := range clusterPolicies.Items {
+			selector := labels.Everything()
+			if policy.Spec.NamespaceSelector != nil {
+				selector, err = metav1.LabelSelectorAsSelector(policy.Spec.NamespaceSelector)
+				if err != nil {
+					return nil, fmt.Errorf("invalid namespaceSelector in ClusterCertificatePolicy %s: %w", policy.Name, err)
+				}
+			}
+			if !selector.Matches(labels.Set(namespace.Labels)) {
+				continue
+			}
+			selected++
+			allErrs := ValidateCertificatePolicy(policy.Spec.CertificatePolicySpec, cert)
+			if requestsCA(cert) && !policy.Spec.AllowCA {
+				allErrs = append(allErrs, field.Forbidden(field.NewPath("spec", "isCA"), "CA certificates are not allowed"))
+			}
+			if len(allErrs) != 0 {
+				return &PolicyViolation{Policy: "ClusterCertificatePolicy/" + policy.Name, Errors: allErrs}, nil
+			}
+		}
+	}
+
+	if requestsCA(cert) && selected == 0 {
+		return &PolicyViolation{Policy: "default policy", Errors: field.ErrorList{
+			field.Forbidden(field.NewPath("spec", "isCA"), "CA certificates require a ClusterCertificatePolicy with allowCA"),
+		}}, nil
+	}
+
+	policies := &certsv1.CertificatePolicyList{}
+	err = c.List(ctx, policies, client.InNamespace(cert.Namespace))
+	if err != nil {
+		return nil, err
+	}
+	slices.SortFunc(policies.Items, func(a, b certsv1.CertificatePolicy) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+	for _, policy := range policies.Items {
+		if allErrs := ValidateCertificatePolicy(policy.Spec, cert); len(allErrs) != 0 {
+			return &PolicyViolation{Policy: "CertificatePolicy/" + policy.Name, Errors: allErrs}, nil
+		}
+	}
+	return nil, nil
+}
+
+// issuerGrantedByPolicy reports whether a CertificatePolicy of the namespace, or a
+// ClusterCertificatePolicy selecting it, explicitly lists the Issuer in its
+// allowedIssuers. Unlike CheckCertificatePolicies, an unset list grants nothing.
+func issuerGrantedByPolicy(ctx context.Context, c client.Reader, namespace, issuer string) (bool, error) {
+	policies := &certsv1.CertificatePolicyList{}
+	err := c.List(ctx, policies, client.InNamespace(namespace))
+	if err != nil {
+		return false, err
+	}
+	for _, policy := range policies.Items {
+		if matchesAny(policy.Spec.AllowedIssuers, issuer, path.Match) {
+			return true, nil
+		}
+	}
+
+	clusterPolicies := &certsv1.ClusterCertificatePolicyList{}
+	err = c.List(ctx, clusterPolicies)
+	if err != nil || len(clusterPolicies.Items) == 0 {
+		return false, err
+	}
+	ns := &corev1.Namespace{}
+	err = c.Get(ctx, types.NamespacedName{Name: namespace}, ns)
+	if err != nil {
+		return false, err
+	}
+	for _, policy := range clusterPolicies.Items {
+		selector := labels.Everything()
+		if policy.Spec.NamespaceSelector != nil {
+			selector, err = metav1.LabelSelectorAsSelector(policy.Spec.NamespaceSelector)
+			if err != nil {
+				return false, fmt.Errorf("invalid namespaceSelector in ClusterCertificatePolicy %s: %w", policy.Name, err)
+			}
+		}
+		if selector.Matches(labels.Set(ns.Labels)) && matchesAny(policy.Spec.AllowedIssuers, issuer, path.Match) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ValidateCertificatePolicy collects the requests of a defaulted Certificate
+// which the policy does not allow
+func ValidateCertificatePolicy(policy certsv1.CertificatePolicySpec, cert *certsv1.Certificate) field.ErrorList {
+	allErrs := field.ErrorList{}
+	specPath := field.NewPath("spec")
+
+	if len(policy.AllowedDNSNames) > 0 {
+		if cert.Spec.DNSName != "" && !matchesAny(policy.AllowedDNSNames, cert.Spec.DNSName, matchDNSName) {
+			allErrs = append(allErrs, field.Forbidden(specPath.Child("dnsName"), fmt.Sprintf("%s is not allowed", cert.Spec.DNSName)))
+		}
+		for i, name := range cert.Spec.DNSNames {
+			if !matchesAny(policy.AllowedDNSNames, name, matchDNSName) {
+				allErrs = append(allErrs, field.Forbidden(specPath.Child("dnsNames").Index(i), fmt.Sprintf("%s is not allowed", name)))
+			}
+		}
+	}
+	if len(policy.AllowedEmailAddresses) > 0 {
+		for i, email := range cert.Spec.EmailAddresses {
+			if !matchesAny(policy.AllowedEmailAddresses, email, path.Match) {
+				allErrs = append(allErrs, field.Forbidden(specPath.Child("emailAddresses").Index(i), fmt.Sprintf("%s is not allowed", email)))
+			}
+		}
+	}
+
+	if policy.AllowedSubject != nil && cert.Spec.Subject != nil {
+		subjectPath := specPath.Child("subject")
+		attributes := []struct {
+			name    string
+			allowed []string
+			values  []string
+		}{
+			{"country", policy.AllowedSubject.Countries, cert.Spec.Subject.Country},
+			{"organization", policy.AllowedSubject.Organizations, cert.Spec.Subject.Organization},
+			{"organizationalUnit", policy.AllowedSubject.OrganizationalUnits, cert.Spec.Subject.OrganizationalUnit},
+			{"commonName", policy.AllowedSubject.CommonNames, []string{cert.Spec.Subject.CommonName}},
+		}
+		for _, attribute := range attributes {
+			if attribute.allowed == nil {
+				continue
+			}
+			for i, value := range attribute.values {
+				if value != "" && !matchesAny(attribute.allowed, value, path.Match) {
+					fldPath := subjectPath.Child(attribute.name)
+					if attribute.name != "commonName" {
+						fldPath = fldPath.Index(i)
+					}
+					allErrs = append(allErrs, field.Forbidden(fldPath, fmt.Sprintf("%s is not allowed", value)))
+				}
+			}
+		}
+	}
+
+	if policy.MaxValidity != "" {
+		maxValidity, err := validation.ParseValidity(policy.MaxValidity)
+		validity, _ := time.ParseDuration(cert.Annotations["validityInHours"])
+		if err == nil && validity > maxValidity {
+			allErrs = append(allErrs, field.Forbidden(specPath.Child("validity"), fmt.Sprintf("maximum allowed validity is %s", policy.MaxValidity)))
+		}
+	}
+
+	keySize := cert.Spec.KeySize
+	if keySize == 0 {
+		keySize = helper.DefaultKeySize
+	}
+	if keySize < policy.MinKeySize {
+		allErrs = append(allErrs, field.Forbidden(specPath.Child("keySize"), fmt.Sprintf("minimum allowed key size is %d", policy.MinKeySize)))
+	}
+
+	if len(policy.AllowedUsages) > 0 {
+		for i, usage := range cert.Spec.Usages {
+			if !slices.Contains(policy.AllowedUsages, usage) {
+				allErrs = append(allErrs, field.Forbidden(specPath.Child("usages").Index(i), fmt.Sprintf("%s is not allowed", usage)))
+			}
+		}
+	}
+	if len(policy.AllowedIssuers) > 0 && cert.Spec.IssuerRef != nil {
+		if !matchesAny(policy.AllowedIssuers, cert.Spec.IssuerRef.Name, path.Match) {
+			allErrs = append(allErrs, field.Forbidden(specPath.Child("issuerRef", "name"), fmt.Sprintf("%s is not allowed", cert.Spec.IssuerRef.Name)))
+		}
+	}
+	return allErrs
+}
+
+// requestsCA reports whether a Certificate requests a CA certificate from an
+// Issuer. Self-signed CA certificates are not trusted by anything else and are
+// not restricted.
+func requestsCA(cert *certsv1.Certificate) bool {
+	return cert.Spec.IsCA && cert.Spec.IssuerRef != nil
+}
+
+// matchesAny reports whether the value matches one of the patterns
+func matchesAny(patterns []string, value string, match func(pattern, value string) (bool, error)) bool {
+	for _, pattern := range patterns {
+		if matched, _ := match(pattern, value); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// matchDNSName matches a DNS name against a pattern whose `*` labels match
+// exactly one label, including the wildcard label of a wildcard name
+func matchDNSName(pattern, name string) (bool, error) {
+	patternLabels := strings.Split(strings.ToLower(pattern), ".")
+	nameLabels := strings.Split(name, ".")
+	if len(patternLabels) != len(nameLabels) {
+		return false, nil
+	}
+	for i, label := range patternLabels {
+		if label != "*" && label != nameLabels[i] {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,206 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
+	"github.com/PNarode/k8c-certs-manager/internal/validation"
+)
+
+var _ = Describe("Certificate Policy", func() {
+	ctx := context.Background()
+
+	newCertificate := func(spec certsv1.CertificateSpec) *certsv1.Certificate {
+		certificate := &certsv1.Certificate{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "team-a", Generation: 1, UID: "web-uid"},
+			Spec:       spec,
+		}
+		certificate.Spec.SecretRef = certsv1.SecretRef{Name: "web-tls"}
+		Expect(validation.DefaultCertificate(ctx, certificate)).To(Succeed())
+		return certificate
+	}
+
+	policy := certsv1.CertificatePolicySpec{
+		AllowedDNSNames:       []string{"team-a.example.com", "*.team-a.example.com"},
+		AllowedEmailAddresses: []string{"*@team-a.example.com"},
+		AllowedSubject:        &certsv1.PolicySubject{Organizations: []string{"Team A*"}},
+		MaxValidity:           "90d",
+		MinKeySize:            2048,
+		AllowedUsages:         []certsv1.KeyUsage{certsv1.UsageServerAuth, certsv1.UsageDigitalSignature},
+	}
+
+	It("should admit Certificates within the policy", func() {
+		certificate := newCertificate(certsv1.CertificateSpec{
+			DNSName:        "web.team-a.example.com",
+			DNSNames:       []string{"team-a.example.com", "*.team-a.example.com"},
+			EmailAddresses: []string{"admin@team-a.example.com"},
+			Subject:        &certsv1.X509PkixSubject{Organization: []string{"Team A Platform"}},
+			Validity:       "90d",
+			Usages:         []certsv1.KeyUsage{certsv1.UsageServerAuth},
+		})
+		Expect(ValidateCertificatePolicy(policy, certificate)).To(BeEmpty())
+	})
+
+	It("should report every request outside the policy", func() {
+		certificate := newCertificate(certsv1.CertificateSpec{
+			DNSName:        "web.team-b.example.com",
+			DNSNames:       []string{"a.web.team-a.example.com"},
+			EmailAddresses: []string{"admin@team-b.example.com"},
+			Subject:        &certsv1.X509PkixSubject{Organization: []string{"Team B"}},
+			Validity:       "1y",
+			KeySize:        1024,
+			Usages:         []certsv1.KeyUsage{certsv1.UsageClientAuth},
+		})
+		fields := []string{}
+		for _, err := range ValidateCertificatePolicy(policy, certificate) {
+			fields = append(fields, err.Field)
+		}
+		Expect(fields).To(ConsistOf(
+			"spec.dnsName", "spec.dnsNames[0]", "spec.emailAddresses[0]", "spec.subject.organization[0]",
+			"spec.validity", "spec.keySize", "spec.usages[0]",
+		))
+	})
+
+	It("should report the policy which denied a request", func() {
+		scheme := runtime.NewScheme()
+		utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+		utilruntime.Must(certsv1.AddToScheme(scheme))
+		namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a", Labels: map[string]string{"team": "team-a"}}}
+		teamB := &certsv1.ClusterCertificatePolicy{
+			ObjectMeta: metav1.ObjectMeta{Name: "team-b"},
+			Spec: certsv1.ClusterCertificatePolicySpec{
+				NamespaceSelector:     &metav1.LabelSelector{MatchLabels: map[string]string{"team": "team-b"}},
+				CertificatePolicySpec: certsv1.CertificatePolicySpec{AllowedDNSNames: []string{"*.team-b.example.com"}},
+			},
+		}
+		teamA := &certsv1.ClusterCertificatePolicy{
+			ObjectMeta: metav1.ObjectMeta{Name: "team-a"},
+			Spec: certsv1.ClusterCertificatePolicySpec{
+				NamespaceSelector:     &metav1.LabelSelector{MatchLabels: map[string]string{"team": "team-a"}},
+				CertificatePolicySpec: certsv1.CertificatePolicySpec{AllowedDNSNames: []string{"*.team-a.example.com"}},
+			},
+		}
+		shortLived := &certsv1.CertificatePolicy{
+			ObjectMeta: metav1.ObjectMeta{Name: "short-lived", Namespace: "team-a"},
+			Spec:       certsv1.CertificatePolicySpec{MaxValidity: "30d"},
+		}
+		fakeClient := fake.NewClientBuilder().WithScheme(scheme).
+			WithObjects(namespace, teamA, teamB, shortLived).
+			WithStatusSubresource(&certsv1.CertificateRequest{}, &certsv1.Issuer{}).Build()
+
+		violation, err := CheckCertificatePolicies(ctx, fakeClient, newCertificate(certsv1.CertificateSpec{
+			DNSName: "web.team-a.example.com", Validity: "30d",
+		}))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(violation).To(BeNil())
+
+		violation, err = CheckCertificatePolicies(ctx, fakeClient, newCertificate(certsv1.CertificateSpec{
+			DNSName: "web.team-b.example.com", Validity: "30d",
+		}))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(violation.Policy).To(Equal("ClusterCertificatePolicy/team-a"))
+
+		violation, err = CheckCertificatePolicies(ctx, fakeClient, newCertificate(certsv1.CertificateSpec{
+			DNSName: "web.team-a.example.com", Validity: "1y",
+		}))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(violation.Policy).To(Equal("CertificatePolicy/short-lived"))
+
+		By("denying the CertificateRequest of a refused Certificate")
+		certificate := newCertificate(certsv1.CertificateSpec{DNSName: "web.team-b.example.com", Validity: "30d"})
+		Expect(fakeClient.Create(ctx, certificate)).To(Succeed())
+		r := &CertificateReconciler{Client: fakeClient, Scheme: fakeClient.Scheme()}
+		_, err = r.issue(ctx, certificate)
+		Expect(err).To(MatchError(errIssuanceDenied))
+		request := &certsv1.CertificateRequest{}
+		Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "web-1", Namespace: "team-a"}, request)).To(Succeed())
+		denied := meta.FindStatusCondition(request.Status.Conditions, certsv1.CertificateRequestDenied)
+		Expect(denied).NotTo(BeNil())
+		Expect(denied.Reason).To(Equal("PolicyViolation"))
+		Expect(denied.Message).To(ContainSubstring("ClusterCertificatePolicy/team-a"))
+	})
+
+	It("should only admit CA certificates of an Issuer allowed by every ClusterCertificatePolicy", func() {
+		scheme := runtime.NewScheme()
+		utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+		utilruntime.Must(certsv1.AddToScheme(scheme))
+		namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a", Labels: map[string]string{"team": "team-a"}}}
+		intermediate := newCertificate(certsv1.CertificateSpec{
+			DNSName: "ca.team-a.example.com", Validity: "1y", IsCA: true,
+			IssuerRef: &certsv1.IssuerReference{Name: "internal-ca"},
+		})
+
+		fakeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(namespace).Build()
+		violation, err := CheckCertificatePolicies(ctx, fakeClient, intermediate)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(violation.Policy).To(Equal("default policy"))
+		Expect(violation.Errors[0].Field).To(Equal("spec.isCA"))
+
+		By("admitting self-signed CA certificates")
+		violation, err = CheckCertificatePolicies(ctx, fakeClient, newCertificate(certsv1.CertificateSpec{
+			DNSName: "ca.team-a.example.com", Validity: "1y", IsCA: true,
+		}))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(violation).To(BeNil())
+
+		allowCA := &certsv1.ClusterCertificatePolicy{
+			ObjectMeta: metav1.ObjectMeta{Name: "allow-ca"},
+			Spec: certsv1.ClusterCertificatePolicySpec{
+				AllowCA:               true,
+				CertificatePolicySpec: certsv1.CertificatePolicySpec{AllowedIssuers: []string{"internal-*"}},
+			},
+		}
+		fakeClient = fake.NewClientBuilder().WithScheme(scheme).WithObjects(namespace, allowCA).Build()
+		violation, err = CheckCertificatePolicies(ctx, fakeClient, intermediate)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(violation).To(BeNil())
+
+		By("refusing the Issuers outside the policy")
+		violation, err = CheckCertificatePolicies(ctx, fakeClient, newCertificate(certsv1.CertificateSpec{
+			DNSName: "web.team-a.example.com", Validity: "30d", IssuerRef: &certsv1.IssuerReference{Name: "public-ca"},
+		}))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(violation.Policy).To(Equal("ClusterCertificatePolicy/allow-ca"))
+		Expect(violation.Errors[0].Field).To(Equal("spec.issuerRef.name"))
+
+		By("refusing CA certificates when another ClusterCertificatePolicy does not allow them")
+		teamA := &certsv1.ClusterCertificatePolicy{
+			ObjectMeta: metav1.ObjectMeta{Name: "team-a"},
+			Spec: certsv1.ClusterCertificatePolicySpec{
+				NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"team": "team-a"}},
+			},
+		}
+		fakeClient = fake.NewClientBuilder().WithScheme(scheme).WithObjects(namespace, allowCA, teamA).Build()
+		violation, err = CheckCertificatePolicies(ctx, fakeClient, intermediate)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(violation.Policy).To(Equal("ClusterCertificatePolicy/team-a"))
+		Expect(violation.Errors[0].Field).To(Equal("spec.isCA"))
+	})
+})
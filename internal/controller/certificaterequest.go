@@ -0,0 +1,463 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"cmp"
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
+	"github.com/PNarode/k8c-certs-manager/internal/helper"
+)
+
+// +kubebuilder:rbac:groups=certs.k8c.io,resources=certificaterequests,verbs=get;list;watch;create;delete;approve
+// +kubebuilder:rbac:groups=certs.k8c.io,resources=certificaterequests/status,verbs=get;update;patch
+
+// certificateGenerationAnnotation records the generation of the Certificate a
+// CertificateRequest was created for
+const certificateGenerationAnnotation = "certs.k8c.io/certificate-generation"
+
+// requestHistoryLimit is the number of CertificateRequests kept per Certificate
+const requestHistoryLimit = 3
+
+// issuancePollInterval is the interval an issuer signing a CertificateRequest,
+// e.g. an ACME order in progress, is checked at
+const issuancePollInterval = 10 * time.Second
+
+var (
+	// errIssuancePending is returned while the CertificateRequest of an issuance is not approved
+	errIssuancePending = errors.New("certificate request is waiting for approval")
+	// errIssuanceDenied is returned when the CertificateRequest of an issuance is denied
+	errIssuanceDenied = errors.New("certificate request was denied")
+	// errIssuanceInProgress is returned while the issuer of an approved CertificateRequest is signing it
+	errIssuanceInProgress = errors.New("certificate request is being signed")
+	// errIssuanceFailed is returned when the issuer refused to sign the CertificateRequest of an issuance
+	errIssuanceFailed = errors.New("certificate request failed")
+	// errApprovalUnenforced is returned for the approved CertificateRequests of namespaces
+	// requiring an approval while the approvers are not checked by the admission webhook
+	errApprovalUnenforced = errors.New("approvals are not enforced without the CertificateRequest admission webhook")
+)
+
+// issuanceBlocked reports whether an issuance is waiting for, or was refused, approval
+// or signing
+func issuanceBlocked(err error) bool {
+	return errors.Is(err, errIssuancePending) || errors.Is(err, errIssuanceDenied) ||
+		errors.Is(err, errIssuanceInProgress) || errors.Is(err, errIssuanceFailed) ||
+		errors.Is(err, errApprovalUnenforced)
+}
+
+// certificateRequestName returns the name of the CertificateRequest of the next issuance
+func certificateRequestName(certificate *certsv1.Certificate) string {
+	return fmt.Sprintf("%s-%d", certificate.Name, certificate.Status.Revision+1)
+}
+
+// privateKeySecretName returns the name of the Secret holding the private key of
+// a CertificateRequest until its certificate is stored in the Certificate Secret
+func privateKeySecretName(requestName string) string {
+	return requestName + "-private-key"
+}
+
+// issue returns the Secret data of the next issuance of a Certificate. The CSR
+// is recorded in a CertificateRequest which is only signed once approved. In
+// namespaces which do not require an approval the controller approves the
+// request itself.
+func (r *CertificateReconciler) issue(ctx context.Context, certificate *certsv1.Certificate) (map[string][]byte, error) {
+	logger := log.FromContext(ctx)
+	name := certificateRequestName(certificate)
+	request := &certsv1.CertificateRequest{}
+	err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: certificate.Namespace}, request)
+	if client.IgnoreNotFound(err) != nil {
+		return nil, err
+	}
+	if apierrors.IsNotFound(err) {
+		request, err = r.createRequest(ctx, certificate, name)
+		if err != nil {
+			return nil, err
+		}
+	} else if !metav1.IsControlledBy(request, certificate) {
+		return nil, fmt.Errorf("CertificateRequest %s/%s is not managed by Certificate %s", request.Namespace, request.Name, certificate.Name)
+	} else if request.Annotations[certificateGenerationAnnotation] != strconv.FormatInt(certificate.Generation, 10) {
+		// The request was created for an earlier spec and has to be approved again
+		logger.Info("Reconcile Event: Replacing CertificateRequest of an outdated spec", "CertificateRequest", name)
+		return nil, r.deleteRequest(ctx, request)
+	}
+
+	approved := meta.IsStatusConditionTrue(request.Status.Conditions, certsv1.CertificateRequestApproved)
+	denied := meta.IsStatusConditionTrue(request.Status.Conditions, certsv1.CertificateRequestDenied)
+	if !approved && !denied {
+		// A CSR generated outside the cluster may only request what the spec covers
+		if certificate.Spec.CSR != nil {
+			var mismatches []string
+			csr, err := helper.ParseCertificateRequestPEM(request.Spec.Request)
+			if err != nil {
+				mismatches = []string{err.Error()}
+			} else {
+				mismatches = helper.CSRMismatches(*certificate, csr)
+			}
+			if len(mismatches) > 0 {
+				logger.Info("Reconcile Event: CertificateRequest does not match the Certificate", "CertificateRequest", name)
+				err = decide(ctx, r.Client, request, certsv1.CertificateRequestDenied, "InvalidRequest", strings.Join(mismatches, "; "))
+				if err != nil {
+					return nil, err
+				}
+				return nil, errIssuanceDenied
+			}
+		}
+		// Requests refused by a policy are denied before they reach an approver
+		violation, err := CheckCertificatePolicies(ctx, r.Client, certificate)
+		if err != nil {
+			return nil, err
+		}
+		if violation != nil {
+			logger.Info("Reconcile Event: CertificateRequest refused by policy", "CertificateRequest", name, "Policy", violation.Policy)
+			err = decide(ctx, r.Client, request, certsv1.CertificateRequestDenied, "PolicyViolation", violation.Error())
+			if err != nil {
+				return nil, err
+			}
+			return nil, errIssuanceDenied
+		}
+		required, err := approvalRequired(ctx, r.Client, certificate.Namespace)
+		if err != nil {
+			return nil, err
+		}
+		if required {
+			return nil, errIssuancePending
+		}
+		err = decide(ctx, r.Client, request, certsv1.CertificateRequestApproved, "AutoApproved",
+			fmt.Sprintf("Namespace %s does not require an approval", certificate.Namespace))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if denied {
+		return nil, errIssuanceDenied
+	}
+	err = refuseUnenforcedApproval(ctx, r.Client, certificate.Namespace, r.ApprovalUnenforced)
+	if err != nil {
+		return nil, err
+	}
+	if meta.IsStatusConditionTrue(request.Status.Conditions, certsv1.CertificateRequestFailed) {
+		return nil, errIssuanceFailed
+	}
+
+	csr, err := helper.ParseCertificateRequestPEM(request.Spec.Request)
+	if err != nil {
+		return nil, err
+	}
+	// Requests generated by the controller are signed for the private key kept aside for them
+	var keyPEM []byte
+	var priv *rsa.PrivateKey
+	if certificate.Spec.CSR == nil {
+		secret := &corev1.Secret{}
+		err = r.Get(ctx, types.NamespacedName{Name: privateKeySecretName(name), Namespace: certificate.Namespace}, secret)
+		if client.IgnoreNotFound(err) != nil {
+			return nil, err
+		}
+		if err == nil {
+			keyPEM = secret.Data["tls.key"]
+			priv, err = helper.ParsePrivateKeyPEM(keyPEM)
+		}
+		if err == nil && !priv.PublicKey.Equal(csr.PublicKey) {
+			err = fmt.Errorf("private key does not match the certificate request")
+		}
+		if err != nil {
+			// The request can not be completed without its private key, start over
+			logger.Info("Reconcile Event: Replacing CertificateRequest without a usable private key", "CertificateRequest", name, "Reason", err.Error())
+			return nil, r.deleteRequest(ctx, request)
+		}
+	}
+
+	data, err := r.sign(ctx, certificate, request, csr, priv)
+	if err != nil {
+		return nil, err
+	}
+	if keyPEM != nil {
+		data["tls.key"] = keyPEM
+	}
+	request.Status.Certificate = data["tls.crt"]
+	meta.SetStatusCondition(&request.Status.Conditions, metav1.Condition{
+		Type:    certsv1.CertificateRequestReady,
+		Status:  metav1.ConditionTrue,
+		Reason:  "Issued",
+		Message: "Certificate has been signed",
+	})
+	err = r.Status().Update(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// createRequest records the CSR of a Certificate in a new CertificateRequest.
+// Unless the CSR is provided by the Certificate, a private key is generated for
+// it and kept aside until the request is signed.
+func (r *CertificateReconciler) createRequest(ctx context.Context, certificate *certsv1.Certificate, name string) (*certsv1.CertificateRequest, error) {
+	var csrPEM []byte
+	var err error
+	if certificate.Spec.CSR != nil {
+		csrPEM, err = r.certificateSigningRequest(ctx, certificate)
+	} else {
+		csrPEM, err = r.generatePrivateKey(ctx, certificate, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	validity, _ := time.ParseDuration(certificate.Annotations["validityInHours"])
+	request := &certsv1.CertificateRequest{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   certificate.Namespace,
+			Annotations: map[string]string{certificateGenerationAnnotation: strconv.FormatInt(certificate.Generation, 10)},
+		},
+		Spec: certsv1.CertificateRequestSpec{
+			CertificateName: certificate.Name,
+			Request:         csrPEM,
+			Duration:        &metav1.Duration{Duration: validity},
+			Usages:          certificate.Spec.Usages,
+			IsCA:            certificate.Spec.IsCA,
+			IssuerRef:       certificate.Spec.IssuerRef,
+		},
+	}
+	err = ctrl.SetControllerReference(certificate, request, r.Scheme)
+	if err != nil {
+		return nil, err
+	}
+	err = r.Create(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	log.FromContext(ctx).Info("Reconcile Event: CertificateRequest created", "CertificateRequest", name)
+	return request, nil
+}
+
+// generatePrivateKey generates the private key of a CertificateRequest, keeps it
+// in a Secret and returns the CSR for it
+func (r *CertificateReconciler) generatePrivateKey(ctx context.Context, certificate *certsv1.Certificate, name string) ([]byte, error) {
+	priv, keyPEM, err := helper.GeneratePrivateKey(*certificate)
+	if err != nil {
+		return nil, err
+	}
+	csrPEM, err := helper.GenerateCertificateRequest(*certificate, priv)
+	if err != nil {
+		return nil, err
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: privateKeySecretName(name), Namespace: certificate.Namespace},
+	}
+	_, err = ctrl.CreateOrUpdate(ctx, r.Client, secret, func() error {
+		if !secret.CreationTimestamp.IsZero() && !metav1.IsControlledBy(secret, certificate) {
+			return fmt.Errorf("secret %s/%s is not managed by Certificate %s", secret.Namespace, secret.Name, certificate.Name)
+		}
+		secret.Data = map[string][]byte{"tls.key": keyPEM}
+		return ctrl.SetControllerReference(certificate, secret, r.Scheme)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return csrPEM, nil
+}
+
+// certificateSigningRequest returns the CSR provided inline or in a Secret by a Certificate
+func (r *CertificateReconciler) certificateSigningRequest(ctx context.Context, certificate *certsv1.Certificate) ([]byte, error) {
+	source := certificate.Spec.CSR
+	if source.SecretRef == nil {
+		return []byte(source.Request), nil
+	}
+	key := source.SecretRef.Key
+	if key == "" {
+		key = "tls.csr"
+	}
+	secret := &corev1.Secret{}
+	err := r.Get(ctx, types.NamespacedName{Name: source.SecretRef.Name, Namespace: certificate.Namespace}, secret)
+	if err != nil {
+		return nil, err
+	}
+	if len(secret.Data[key]) == 0 {
+		return nil, fmt.Errorf("secret %s/%s has no %s key", secret.Namespace, secret.Name, key)
+	}
+	return secret.Data[key], nil
+}
+
+// deleteRequest deletes a CertificateRequest and its private key. The next
+// reconcile, triggered by the deletion, creates a new request.
+func (r *CertificateReconciler) deleteRequest(ctx context.Context, request *certsv1.CertificateRequest) error {
+	err := r.Delete(ctx, request)
+	if client.IgnoreNotFound(err) != nil {
+		return err
+	}
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: privateKeySecretName(request.Name), Namespace: request.Namespace}}
+	err = r.Delete(ctx, secret)
+	if client.IgnoreNotFound(err) != nil {
+		return err
+	}
+	return errIssuancePending
+}
+
+// decide sets the Approved, Denied or Failed condition of a CertificateRequest
+func decide(ctx context.Context, c client.Client, request *certsv1.CertificateRequest, conditionType, reason, message string) error {
+	meta.SetStatusCondition(&request.Status.Conditions, metav1.Condition{
+		Type:    conditionType,
+		Status:  metav1.ConditionTrue,
+		Reason:  reason,
+		Message: message,
+	})
+	return c.Status().Update(ctx, request)
+}
+
+// approvalRequired reports whether the namespace requires CertificateRequests to be
+// approved by a principal with the approve verb
+func approvalRequired(ctx context.Context, c client.Reader, namespace string) (bool, error) {
+	ns := &corev1.Namespace{}
+	err := c.Get(ctx, types.NamespacedName{Name: namespace}, ns)
+	if err != nil {
+		return false, err
+	}
+	return ns.Labels[certsv1.RequireApprovalLabel] == "true", nil
+}
+
+// refuseUnenforcedApproval returns errApprovalUnenforced in namespaces requiring an
+// approval when the approvers are not checked, anyone allowed to update the status
+// of a CertificateRequest could approve it otherwise
+func refuseUnenforcedApproval(ctx context.Context, c client.Reader, namespace string, unenforced bool) error {
+	if !unenforced {
+		return nil
+	}
+	required, err := approvalRequired(ctx, c, namespace)
+	if err != nil {
+		return err
+	}
+	if required {
+		return errApprovalUnenforced
+	}
+	return nil
+}
+
+// sign signs an approved CertificateRequest with its issuer, or with its own
+// private key when it has no issuer, and returns the tls.crt and ca.crt data
+func (r *CertificateReconciler) sign(ctx context.Context, certificate *certsv1.Certificate, request *certsv1.CertificateRequest, csr *x509.CertificateRequest, priv *rsa.PrivateKey) (map[string][]byte, error) {
+	validity, _ := time.ParseDuration(certificate.Annotations["validityInHours"])
+	if request.Spec.Duration != nil {
+		validity = request.Spec.Duration.Duration
+	}
+	if request.Spec.IssuerRef != nil {
+		issuer := &certsv1.Issuer{}
+		err := r.Get(ctx, types.NamespacedName{Name: request.Spec.IssuerRef.Name}, issuer)
+		if err != nil {
+			return nil, err
+		}
+		// ACME servers issue certificates for the names of the CSR
+		if issuer.Spec.ACME != nil {
+			return r.signACME(ctx, issuer, request, csr)
+		}
+		if issuer.Spec.Vault != nil {
+			return r.signVault(ctx, issuer, certificate, request, csr, validity)
+		}
+	}
+	template := helper.CertificateTemplate(*certificate, validity)
+	if request.Spec.IssuerRef == nil {
+		if priv == nil {
+			return nil, fmt.Errorf("a certificate signing request can only be signed by an issuer")
+		}
+		certPEM, err := helper.SignSelfSigned(template, priv)
+		if err != nil {
+			return nil, err
+		}
+		// The issuing certificate of a self-signed certificate is the certificate itself
+		return map[string][]byte{"tls.crt": certPEM, "ca.crt": certPEM}, nil
+	}
+
+	ca, err := loadIssuerCA(ctx, r.Client, request.Spec.IssuerRef.Name)
+	if err != nil {
+		return nil, err
+	}
+	if r.CRLBaseURL != "" {
+		template.CRLDistributionPoints = []string{crlURL(r.CRLBaseURL, request.Spec.IssuerRef.Name)}
+	}
+	if r.OCSPBaseURL != "" {
+		template.OCSPServer = []string{ocspURL(r.OCSPBaseURL, request.Spec.IssuerRef.Name)}
+	}
+	certPEM, err := helper.SignWithCA(template, csr.PublicKey, ca.cert, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	// The OCSP responder only vouches for certificates recorded by the Issuer
+	err = recordIssuedCertificate(ctx, r.Client, request.Spec.IssuerRef.Name, certPEM, certificate.Namespace+"/"+certificate.Name)
+	if err != nil {
+		return nil, err
+	}
+	return map[string][]byte{
+		"tls.crt": append(certPEM, ca.chain...),
+		"ca.crt":  ca.root,
+	}, nil
+}
+
+// cleanupRequests deletes the private key of the completed issuance and the
+// CertificateRequests beyond the history limit
+func (r *CertificateReconciler) cleanupRequests(ctx context.Context, certificate *certsv1.Certificate) error {
+	name := fmt.Sprintf("%s-%d", certificate.Name, certificate.Status.Revision)
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: privateKeySecretName(name), Namespace: certificate.Namespace}}
+	err := r.Delete(ctx, secret)
+	if client.IgnoreNotFound(err) != nil {
+		return err
+	}
+
+	requests := &certsv1.CertificateRequestList{}
+	err = r.List(ctx, requests, client.InNamespace(certificate.Namespace))
+	if err != nil {
+		return err
+	}
+	var owned []certsv1.CertificateRequest
+	for _, request := range requests.Items {
+		if metav1.IsControlledBy(&request, certificate) {
+			owned = append(owned, request)
+		}
+	}
+	// Requests are named after the revision they were created for, newest first
+	revision := func(request certsv1.CertificateRequest) int64 {
+		value, _ := strconv.ParseInt(strings.TrimPrefix(request.Name, certificate.Name+"-"), 10, 64)
+		return value
+	}
+	slices.SortFunc(owned, func(a, b certsv1.CertificateRequest) int {
+		return cmp.Compare(revision(b), revision(a))
+	})
+	for i := requestHistoryLimit; i < len(owned); i++ {
+		err = r.Delete(ctx, &owned[i])
+		if client.IgnoreNotFound(err) != nil {
+			return err
+		}
+	}
+	return nil
+}
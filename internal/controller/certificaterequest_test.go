@@ -0,0 +1,235 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"crypto/tls"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	admissionv1 "k8s.io/api/admission/v1"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+
+	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
+	"github.com/PNarode/k8c-certs-manager/internal/helper"
+	"github.com/PNarode/k8c-certs-manager/internal/validation"
+)
+
+var _ = Describe("Certificate Request", func() {
+	newScheme := func() *runtime.Scheme {
+		scheme := runtime.NewScheme()
+		utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+		utilruntime.Must(certsv1.AddToScheme(scheme))
+		return scheme
+	}
+
+	newCertificate := func(namespace string) *certsv1.Certificate {
+		certificate := &certsv1.Certificate{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: namespace, Generation: 1, UID: "web-uid"},
+			Spec: certsv1.CertificateSpec{
+				DNSName:   "web.k8c.io",
+				Validity:  "30d",
+				SecretRef: certsv1.SecretRef{Name: "web-tls"},
+			},
+		}
+		Expect(validation.DefaultCertificate(context.Background(), certificate)).To(Succeed())
+		return certificate
+	}
+
+	It("should approve and sign requests in namespaces without approval", func() {
+		ctx := context.Background()
+		certificate := newCertificate("default")
+		certificate.Spec.Usages = []certsv1.KeyUsage{certsv1.UsageServerAuth, certsv1.UsageKeyEncipherment}
+		fakeClient := fake.NewClientBuilder().WithScheme(newScheme()).
+			WithObjects(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}, certificate).
+			WithStatusSubresource(&certsv1.CertificateRequest{}, &certsv1.Issuer{}).Build()
+		r := &CertificateReconciler{Client: fakeClient, Scheme: fakeClient.Scheme()}
+
+		data, err := r.issue(ctx, certificate)
+		Expect(err).NotTo(HaveOccurred())
+		_, err = tls.X509KeyPair(data["tls.crt"], data["tls.key"])
+		Expect(err).NotTo(HaveOccurred())
+		issued, err := helper.ParseCertificatesPEM(data["tls.crt"])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(helper.SpecMismatches(*certificate, issued[0])).To(BeEmpty())
+
+		request := &certsv1.CertificateRequest{}
+		Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "web-1", Namespace: "default"}, request)).To(Succeed())
+		Expect(request.Spec.CertificateName).To(Equal("web"))
+		Expect(meta.IsStatusConditionTrue(request.Status.Conditions, certsv1.CertificateRequestApproved)).To(BeTrue())
+		Expect(meta.IsStatusConditionTrue(request.Status.Conditions, certsv1.CertificateRequestReady)).To(BeTrue())
+		Expect(request.Status.Certificate).To(Equal(data["tls.crt"]))
+	})
+
+	It("should block the signing until the request is approved", func() {
+		ctx := context.Background()
+		certificate := newCertificate("regulated")
+		namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+			Name:   "regulated",
+			Labels: map[string]string{certsv1.RequireApprovalLabel: "true"},
+		}}
+		fakeClient := fake.NewClientBuilder().WithScheme(newScheme()).
+			WithObjects(namespace, certificate).
+			WithStatusSubresource(&certsv1.CertificateRequest{}, &certsv1.Issuer{}).Build()
+		r := &CertificateReconciler{Client: fakeClient, Scheme: fakeClient.Scheme()}
+
+		_, err := r.issue(ctx, certificate)
+		Expect(err).To(MatchError(errIssuancePending))
+		request := &certsv1.CertificateRequest{}
+		key := types.NamespacedName{Name: "web-1", Namespace: "regulated"}
+		Expect(fakeClient.Get(ctx, key, request)).To(Succeed())
+		Expect(request.Status.Conditions).To(BeEmpty())
+		Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "web-1-private-key", Namespace: "regulated"}, &corev1.Secret{})).To(Succeed())
+
+		By("signing once approved")
+		meta.SetStatusCondition(&request.Status.Conditions, metav1.Condition{
+			Type: certsv1.CertificateRequestApproved, Status: metav1.ConditionTrue, Reason: "Reviewed",
+		})
+		Expect(fakeClient.Status().Update(ctx, request)).To(Succeed())
+		data, err := r.issue(ctx, certificate)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(HaveKey("tls.key"))
+
+		By("refusing a denied request")
+		certificate.Status.Revision = 1
+		_, err = r.issue(ctx, certificate)
+		Expect(err).To(MatchError(errIssuancePending))
+		Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "web-2", Namespace: "regulated"}, request)).To(Succeed())
+		meta.SetStatusCondition(&request.Status.Conditions, metav1.Condition{
+			Type: certsv1.CertificateRequestDenied, Status: metav1.ConditionTrue, Reason: "Rejected",
+		})
+		Expect(fakeClient.Status().Update(ctx, request)).To(Succeed())
+		_, err = r.issue(ctx, certificate)
+		Expect(err).To(MatchError(errIssuanceDenied))
+
+		By("replacing the request when the spec changes")
+		certificate.Generation = 2
+		_, err = r.issue(ctx, certificate)
+		Expect(err).To(MatchError(errIssuancePending))
+		Expect(apierrors.IsNotFound(fakeClient.Get(ctx, types.NamespacedName{Name: "web-2", Namespace: "regulated"}, request))).To(BeTrue())
+	})
+
+	It("should not sign in namespaces requiring an approval without the admission webhook", func() {
+		ctx := context.Background()
+		certificate := newCertificate("regulated")
+		namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+			Name:   "regulated",
+			Labels: map[string]string{certsv1.RequireApprovalLabel: "true"},
+		}}
+		fakeClient := fake.NewClientBuilder().WithScheme(newScheme()).
+			WithObjects(namespace, certificate).
+			WithStatusSubresource(&certsv1.CertificateRequest{}, &certsv1.Issuer{}).Build()
+		r := &CertificateReconciler{Client: fakeClient, Scheme: fakeClient.Scheme(), ApprovalUnenforced: true}
+
+		_, err := r.issue(ctx, certificate)
+		Expect(err).To(MatchError(errIssuancePending))
+		request := &certsv1.CertificateRequest{}
+		Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "web-1", Namespace: "regulated"}, request)).To(Succeed())
+		meta.SetStatusCondition(&request.Status.Conditions, metav1.Condition{
+			Type: certsv1.CertificateRequestApproved, Status: metav1.ConditionTrue, Reason: "Unchecked",
+		})
+		Expect(fakeClient.Status().Update(ctx, request)).To(Succeed())
+		data, err := r.issue(ctx, certificate)
+		Expect(err).To(MatchError(errApprovalUnenforced))
+		Expect(data).To(BeNil())
+	})
+
+	It("should not sign requests the Certificate does not own", func() {
+		ctx := context.Background()
+		certificate := newCertificate("default")
+		foreign := &certsv1.CertificateRequest{
+			ObjectMeta: metav1.ObjectMeta{Name: "web-1", Namespace: "default", Annotations: map[string]string{
+				certificateGenerationAnnotation: "1",
+			}},
+			Spec: certsv1.CertificateRequestSpec{CertificateName: "web"},
+			Status: certsv1.CertificateRequestStatus{Conditions: []metav1.Condition{{
+				Type: certsv1.CertificateRequestApproved, Status: metav1.ConditionTrue, Reason: "Planted",
+			}}},
+		}
+		fakeClient := fake.NewClientBuilder().WithScheme(newScheme()).
+			WithObjects(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}, certificate, foreign).
+			WithStatusSubresource(&certsv1.CertificateRequest{}, &certsv1.Issuer{}).Build()
+		r := &CertificateReconciler{Client: fakeClient, Scheme: fakeClient.Scheme()}
+
+		data, err := r.issue(ctx, certificate)
+		Expect(err).To(MatchError(ContainSubstring("is not managed by Certificate web")))
+		Expect(data).To(BeNil())
+	})
+
+	It("should only admit approvals from users allowed to approve", func() {
+		fakeClient := fake.NewClientBuilder().WithScheme(newScheme()).WithInterceptorFuncs(interceptor.Funcs{
+			Create: func(ctx context.Context, c client.WithWatch, obj client.Object, opts ...client.CreateOption) error {
+				if review, ok := obj.(*authorizationv1.SubjectAccessReview); ok {
+					attributes := review.Spec.ResourceAttributes
+					review.Status.Allowed = review.Spec.User == "security-officer" &&
+						attributes.Verb == "approve" && attributes.Resource == "certificaterequests"
+					return nil
+				}
+				return c.Create(ctx, obj, opts...)
+			},
+		}).Build()
+		validator := &CertificateRequestValidator{Client: fakeClient}
+		asUser := func(username string) context.Context {
+			return admission.NewContextWithRequest(context.Background(), admission.Request{AdmissionRequest: admissionv1.AdmissionRequest{
+				UserInfo: authenticationv1.UserInfo{Username: username},
+			}})
+		}
+
+		pending := &certsv1.CertificateRequest{ObjectMeta: metav1.ObjectMeta{Name: "web-1", Namespace: "regulated"}}
+		approved := pending.DeepCopy()
+		meta.SetStatusCondition(&approved.Status.Conditions, metav1.Condition{
+			Type: certsv1.CertificateRequestApproved, Status: metav1.ConditionTrue, Reason: "Reviewed",
+		})
+
+		_, err := validator.ValidateUpdate(asUser("developer"), pending, approved)
+		Expect(apierrors.IsForbidden(err)).To(BeTrue())
+		_, err = validator.ValidateUpdate(asUser("security-officer"), pending, approved)
+		Expect(err).NotTo(HaveOccurred())
+
+		By("allowing other status changes without the approve verb")
+		ready := approved.DeepCopy()
+		meta.SetStatusCondition(&ready.Status.Conditions, metav1.Condition{
+			Type: certsv1.CertificateRequestReady, Status: metav1.ConditionTrue, Reason: "Issued",
+		})
+		_, err = validator.ValidateUpdate(asUser("developer"), approved, ready)
+		Expect(err).NotTo(HaveOccurred())
+
+		By("rejecting changes to a decision")
+		denied := approved.DeepCopy()
+		meta.SetStatusCondition(&denied.Status.Conditions, metav1.Condition{
+			Type: certsv1.CertificateRequestDenied, Status: metav1.ConditionTrue, Reason: "Rejected",
+		})
+		_, err = validator.ValidateUpdate(asUser("security-officer"), approved, denied)
+		Expect(apierrors.IsInvalid(err)).To(BeTrue())
+		_, err = validator.ValidateUpdate(asUser("security-officer"), approved, pending)
+		Expect(apierrors.IsInvalid(err)).To(BeTrue())
+	})
+})
@@ -0,0 +1,313 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	certificatesv1 "k8s.io/api/certificates/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+
+	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
+	"github.com/PNarode/k8c-certs-manager/internal/helper"
+)
+
+const (
+	// selfSignedSignerName is the signer name, below the signer domain, signing
+	// with the self-signed CA of the manager
+	selfSignedSignerName = "self-signed"
+	// caSignerNamePrefix prefixes the name of the Issuer in the signer names
+	// signing with the CA of an Issuer, e.g. ca-internal
+	caSignerNamePrefix = "ca-"
+	// defaultCSRValidity is the validity of the certificates issued for
+	// CertificateSigningRequests without expirationSeconds
+	defaultCSRValidity = 365 * 24 * time.Hour
+	// selfSignedCAValidity is the validity of the self-signed CA of the manager
+	selfSignedCAValidity = 10 * 365 * 24 * time.Hour
+)
+
+// csrKeyUsages maps the key usages of the certificates.k8s.io API to their x509 encoding
+var csrKeyUsages = map[certificatesv1.KeyUsage]x509.KeyUsage{
+	certificatesv1.UsageSigning:           x509.KeyUsageDigitalSignature,
+	certificatesv1.UsageDigitalSignature:  x509.KeyUsageDigitalSignature,
+	certificatesv1.UsageContentCommitment: x509.KeyUsageContentCommitment,
+	certificatesv1.UsageKeyEncipherment:   x509.KeyUsageKeyEncipherment,
+	certificatesv1.UsageKeyAgreement:      x509.KeyUsageKeyAgreement,
+	certificatesv1.UsageDataEncipherment:  x509.KeyUsageDataEncipherment,
+	certificatesv1.UsageEncipherOnly:      x509.KeyUsageEncipherOnly,
+	certificatesv1.UsageDecipherOnly:      x509.KeyUsageDecipherOnly,
+}
+
+// csrExtKeyUsages maps the extended key usages of the certificates.k8s.io API to
+// their x509 encoding
+var csrExtKeyUsages = map[certificatesv1.KeyUsage]x509.ExtKeyUsage{
+	certificatesv1.UsageAny:             x509.ExtKeyUsageAny,
+	certificatesv1.UsageServerAuth:      x509.ExtKeyUsageServerAuth,
+	certificatesv1.UsageClientAuth:      x509.ExtKeyUsageClientAuth,
+	certificatesv1.UsageCodeSigning:     x509.ExtKeyUsageCodeSigning,
+	certificatesv1.UsageEmailProtection: x509.ExtKeyUsageEmailProtection,
+	certificatesv1.UsageSMIME:           x509.ExtKeyUsageEmailProtection,
+	certificatesv1.UsageIPsecEndSystem:  x509.ExtKeyUsageIPSECEndSystem,
+	certificatesv1.UsageIPsecTunnel:     x509.ExtKeyUsageIPSECTunnel,
+	certificatesv1.UsageIPsecUser:       x509.ExtKeyUsageIPSECUser,
+	certificatesv1.UsageTimestamping:    x509.ExtKeyUsageTimeStamping,
+	certificatesv1.UsageOCSPSigning:     x509.ExtKeyUsageOCSPSigning,
+	certificatesv1.UsageMicrosoftSGC:    x509.ExtKeyUsageMicrosoftServerGatedCrypto,
+	certificatesv1.UsageNetscapeSGC:     x509.ExtKeyUsageNetscapeServerGatedCrypto,
+}
+
+// csrFailure is a permanent failure to sign a CertificateSigningRequest, reported
+// through its Failed condition
+type csrFailure struct {
+	reason string
+	err    error
+}
+
+func (f *csrFailure) Error() string {
+	return f.err.Error()
+}
+
+// CertificateSigningRequestReconciler signs the approved CertificateSigningRequests
+// of the certificates.k8s.io API addressed to its signer names:
+// <domain>/self-signed and <domain>/ca-<issuer>.
+type CertificateSigningRequestReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+	// SignerDomain is the domain of the signer names handled, e.g. certs.k8c.io
+	SignerDomain string
+	// SelfSignedCA is the Secret storing the CA of the self-signed signer. It is
+	// created on first use.
+	SelfSignedCA types.NamespacedName
+	// CRLBaseURL is the URL of the CRL server embedded as CRL distribution point
+	// in the certificates signed by CA Issuers. None is embedded when empty.
+	CRLBaseURL string
+	// OCSPBaseURL is the URL of the OCSP responder embedded in the authority
+	// information access of the certificates signed by CA Issuers.
+	OCSPBaseURL string
+}
+
+// +kubebuilder:rbac:groups=certificates.k8s.io,resources=certificatesigningrequests,verbs=get;list;watch
+// +kubebuilder:rbac:groups=certificates.k8s.io,resources=certificatesigningrequests/status,verbs=update;patch
+// +kubebuilder:rbac:groups=certificates.k8s.io,resources=signers,resourceNames=certs.k8c.io/*,verbs=sign
+
+// Reconcile signs an approved CertificateSigningRequest and stores the issued
+// certificate in its status. Requests which can not be signed are marked Failed.
+func (r *CertificateSigningRequestReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+	csr := &certificatesv1.CertificateSigningRequest{}
+	err := r.Get(ctx, req.NamespacedName, csr)
+	if err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	if !r.handles(csr.Spec.SignerName) || len(csr.Status.Certificate) > 0 {
+		return ctrl.Result{}, nil
+	}
+	approved := false
+	for _, condition := range csr.Status.Conditions {
+		switch condition.Type {
+		case certificatesv1.CertificateApproved:
+			approved = condition.Status == corev1.ConditionTrue
+		case certificatesv1.CertificateDenied, certificatesv1.CertificateFailed:
+			return ctrl.Result{}, nil
+		}
+	}
+	if !approved {
+		return ctrl.Result{}, nil
+	}
+
+	logger.Info("Reconcile Event: Signing CertificateSigningRequest", "SignerName", csr.Spec.SignerName)
+	cert, err := r.sign(ctx, csr)
+	var failure *csrFailure
+	if errors.As(err, &failure) {
+		logger.Info("Reconcile Event: CertificateSigningRequest can not be signed", "Reason", failure.reason, "Error", failure.Error())
+		now := metav1.Now()
+		csr.Status.Conditions = append(csr.Status.Conditions, certificatesv1.CertificateSigningRequestCondition{
+			Type:               certificatesv1.CertificateFailed,
+			Status:             corev1.ConditionTrue,
+			Reason:             failure.reason,
+			Message:            failure.Error(),
+			LastUpdateTime:     now,
+			LastTransitionTime: now,
+		})
+		return ctrl.Result{}, r.Status().Update(ctx, csr)
+	}
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	csr.Status.Certificate = cert
+	err = r.Status().Update(ctx, csr)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	logger.Info("Reconcile Event: CertificateSigningRequest signed", "SignerName", csr.Spec.SignerName)
+	return ctrl.Result{}, nil
+}
+
+// handles reports whether the signer name is one of the signer names of the reconciler
+func (r *CertificateSigningRequestReconciler) handles(signerName string) bool {
+	name, found := strings.CutPrefix(signerName, r.SignerDomain+"/")
+	if !found {
+		return false
+	}
+	return name == selfSignedSignerName || len(name) > len(caSignerNamePrefix) && strings.HasPrefix(name, caSignerNamePrefix)
+}
+
+// sign issues the certificate requested by a CertificateSigningRequest with the CA
+// of its signer and returns it together with the intermediate CA, if any
+func (r *CertificateSigningRequestReconciler) sign(ctx context.Context, csr *certificatesv1.CertificateSigningRequest) ([]byte, error) {
+	request, err := helper.ParseCertificateRequestPEM(csr.Spec.Request)
+	if err != nil {
+		return nil, &csrFailure{reason: "InvalidRequest", err: fmt.Errorf("invalid certificate request: %w", err)}
+	}
+	validity := defaultCSRValidity
+	if csr.Spec.ExpirationSeconds != nil {
+		validity = time.Duration(*csr.Spec.ExpirationSeconds) * time.Second
+	}
+	template := helper.CSRTemplate(request, validity)
+	for _, usage := range csr.Spec.Usages {
+		keyUsage, isKeyUsage := csrKeyUsages[usage]
+		extKeyUsage, isExtKeyUsage := csrExtKeyUsages[usage]
+		switch {
+		case isKeyUsage:
+			template.KeyUsage |= keyUsage
+		case isExtKeyUsage:
+			template.ExtKeyUsage = append(template.ExtKeyUsage, extKeyUsage)
+		default:
+			return nil, &csrFailure{reason: "UnsupportedUsage", err: fmt.Errorf("usage %q is not supported", usage)}
+		}
+	}
+
+	name := strings.TrimPrefix(csr.Spec.SignerName, r.SignerDomain+"/")
+	var ca *issuerCA
+	var issuer string
+	if name == selfSignedSignerName {
+		ca, err = r.selfSignedCA(ctx)
+	} else {
+		issuer = strings.TrimPrefix(name, caSignerNamePrefix)
+		ca, err = loadIssuerCA(ctx, r.Client, issuer)
+		if r.CRLBaseURL != "" {
+			template.CRLDistributionPoints = []string{crlURL(r.CRLBaseURL, issuer)}
+		}
+		if r.OCSPBaseURL != "" {
+			template.OCSPServer = []string{ocspURL(r.OCSPBaseURL, issuer)}
+		}
+		// Errors of the API server are retried, except for a missing Issuer or Secret
+		var status apierrors.APIStatus
+		if err != nil && (apierrors.IsNotFound(err) || !errors.As(err, &status)) {
+			return nil, &csrFailure{reason: "IssuerNotReady", err: err}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	cert, err := helper.SignWithCA(template, request.PublicKey, ca.cert, ca.key)
+	if err != nil {
+		return nil, &csrFailure{reason: "SigningError", err: err}
+	}
+	if issuer != "" {
+		err = recordIssuedCertificate(ctx, r.Client, issuer, cert, "")
+		if err != nil {
+			return nil, err
+		}
+	}
+	return append(cert, ca.chain...), nil
+}
+
+// selfSignedCA returns the CA of the self-signed signer, creating it when it is
+// missing or expired
+func (r *CertificateSigningRequestReconciler) selfSignedCA(ctx context.Context) (*issuerCA, error) {
+	secret := &corev1.Secret{}
+	err := r.Get(ctx, r.SelfSignedCA, secret)
+	if client.IgnoreNotFound(err) != nil {
+		return nil, err
+	}
+	found := err == nil
+	if found {
+		cert, key, err := helper.ParseCA(secret.Data["tls.crt"], secret.Data["tls.key"])
+		if err == nil && time.Now().Before(cert.NotAfter) {
+			return &issuerCA{cert: cert, key: key, root: secret.Data["tls.crt"]}, nil
+		}
+	}
+
+	priv, keyPEM, err := helper.GeneratePrivateKey(certsv1.Certificate{})
+	if err != nil {
+		return nil, err
+	}
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	notBefore := time.Now()
+	certPEM, err := helper.SignSelfSigned(&x509.Certificate{
+		Subject:               pkix.Name{CommonName: r.SignerDomain + "/" + selfSignedSignerName},
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(selfSignedCAValidity),
+		SerialNumber:          serialNumber,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+	}, priv)
+	if err != nil {
+		return nil, err
+	}
+
+	secret.Name = r.SelfSignedCA.Name
+	secret.Namespace = r.SelfSignedCA.Namespace
+	secret.Type = corev1.SecretTypeTLS
+	secret.Data = helper.SecretData(certPEM, keyPEM)
+	if found {
+		err = r.Update(ctx, secret)
+	} else {
+		err = r.Create(ctx, secret)
+	}
+	if err != nil {
+		// Conflicts are retried with the CA created by the other writer
+		return nil, err
+	}
+	log.FromContext(ctx).Info("Self-signed signer CA created", "Secret", r.SelfSignedCA)
+	cert, err := helper.ParseCertificatesPEM(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	return &issuerCA{cert: cert[0], key: priv, root: certPEM}, nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *CertificateSigningRequestReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&certificatesv1.CertificateSigningRequest{}, builder.WithPredicates(predicate.NewPredicateFuncs(func(obj client.Object) bool {
+			return r.handles(obj.(*certificatesv1.CertificateSigningRequest).Spec.SignerName)
+		}))).
+		Complete(r)
+}
@@ -0,0 +1,128 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"crypto/x509"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	certificatesv1 "k8s.io/api/certificates/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
+	"github.com/PNarode/k8c-certs-manager/internal/helper"
+)
+
+var _ = Describe("CertificateSigningRequest Controller", func() {
+	newReconciler := func(objs ...client.Object) *CertificateSigningRequestReconciler {
+		scheme := runtime.NewScheme()
+		utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+		utilruntime.Must(certsv1.AddToScheme(scheme))
+		fakeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).
+			WithStatusSubresource(&certificatesv1.CertificateSigningRequest{}, &certsv1.Issuer{}).Build()
+		return &CertificateSigningRequestReconciler{
+			Client:       fakeClient,
+			Scheme:       scheme,
+			SignerDomain: "certs.k8c.io",
+			SelfSignedCA: types.NamespacedName{Name: "self-signed-ca", Namespace: "certs-system"},
+		}
+	}
+
+	newCSR := func(signerName string, approved bool) *certificatesv1.CertificateSigningRequest {
+		priv, _, err := helper.GeneratePrivateKey(certsv1.Certificate{})
+		Expect(err).NotTo(HaveOccurred())
+		request, err := helper.GenerateCertificateRequest(certsv1.Certificate{Spec: certsv1.CertificateSpec{DNSName: "node.k8c.io"}}, priv)
+		Expect(err).NotTo(HaveOccurred())
+		expirationSeconds := int32(3600)
+		csr := &certificatesv1.CertificateSigningRequest{
+			ObjectMeta: metav1.ObjectMeta{Name: "node"},
+			Spec: certificatesv1.CertificateSigningRequestSpec{
+				Request:           request,
+				SignerName:        signerName,
+				ExpirationSeconds: &expirationSeconds,
+				Usages:            []certificatesv1.KeyUsage{certificatesv1.UsageDigitalSignature, certificatesv1.UsageServerAuth},
+			},
+		}
+		if approved {
+			csr.Status.Conditions = []certificatesv1.CertificateSigningRequestCondition{{
+				Type: certificatesv1.CertificateApproved, Status: corev1.ConditionTrue, Reason: "Approved",
+			}}
+		}
+		return csr
+	}
+
+	signCSR := func(r *CertificateSigningRequestReconciler) *certificatesv1.CertificateSigningRequest {
+		ctx := context.Background()
+		_, err := r.Reconcile(ctx, reconcile.Request{NamespacedName: types.NamespacedName{Name: "node"}})
+		Expect(err).NotTo(HaveOccurred())
+		csr := &certificatesv1.CertificateSigningRequest{}
+		Expect(r.Get(ctx, types.NamespacedName{Name: "node"}, csr)).To(Succeed())
+		return csr
+	}
+
+	It("should only handle its signer names", func() {
+		r := newReconciler()
+		Expect(r.handles("certs.k8c.io/self-signed")).To(BeTrue())
+		Expect(r.handles("certs.k8c.io/ca-internal")).To(BeTrue())
+		Expect(r.handles("certs.k8c.io/ca-")).To(BeFalse())
+		Expect(r.handles("kubernetes.io/kube-apiserver-client")).To(BeFalse())
+	})
+
+	It("should sign approved requests with the self-signed CA", func() {
+		r := newReconciler(newCSR("certs.k8c.io/self-signed", true))
+		csr := signCSR(r)
+		Expect(csr.Status.Certificate).NotTo(BeEmpty())
+
+		secret := &corev1.Secret{}
+		Expect(r.Get(context.Background(), r.SelfSignedCA, secret)).To(Succeed())
+		roots, err := helper.ParseCertificatesPEM(secret.Data["ca.crt"])
+		Expect(err).NotTo(HaveOccurred())
+		issued, err := helper.ParseCertificatesPEM(csr.Status.Certificate)
+		Expect(err).NotTo(HaveOccurred())
+		pool := x509.NewCertPool()
+		pool.AddCert(roots[0])
+		_, err = issued[0].Verify(x509.VerifyOptions{Roots: pool, DNSName: "node.k8c.io"})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(issued[0].NotAfter.Sub(issued[0].NotBefore).Hours()).To(BeNumerically("~", 1, 0.1))
+		Expect(issued[0].ExtKeyUsage).To(Equal([]x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}))
+	})
+
+	It("should not sign requests which are not approved", func() {
+		csr := signCSR(newReconciler(newCSR("certs.k8c.io/self-signed", false)))
+		Expect(csr.Status.Certificate).To(BeEmpty())
+		Expect(csr.Status.Conditions).To(BeEmpty())
+	})
+
+	It("should mark requests for a missing Issuer as failed", func() {
+		csr := signCSR(newReconciler(newCSR("certs.k8c.io/ca-missing", true)))
+		Expect(csr.Status.Certificate).To(BeEmpty())
+		Expect(csr.Status.Conditions).To(ContainElement(And(
+			HaveField("Type", certificatesv1.CertificateFailed),
+			HaveField("Reason", "IssuerNotReady"),
+		)))
+	})
+})
@@ -0,0 +1,293 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
+	"github.com/PNarode/k8c-certs-manager/internal/helper"
+)
+
+const (
+	// CRLConfigMapKey is the key of the PEM encoded CRL in the ConfigMap of an Issuer
+	CRLConfigMapKey = "ca.crl"
+	// crlPathPrefix is the path the CRL server serves the CRLs of the Issuers under
+	crlPathPrefix = "/crl/"
+)
+
+// CRLReasonCodes maps the revocation reasons to their CRL reason codes
+var CRLReasonCodes = map[certsv1.RevocationReason]int{
+	"unspecified":          0,
+	"keyCompromise":        1,
+	"caCompromise":         2,
+	"affiliationChanged":   3,
+	"superseded":           4,
+	"cessationOfOperation": 5,
+	"privilegeWithdrawn":   9,
+}
+
+// crlConfigMapName returns the name of the ConfigMap the CRL of an Issuer is published to
+func crlConfigMapName(issuer string) string {
+	return issuer + "-crl"
+}
+
+// crlURL returns the URL the CRL server serves the CRL of an Issuer at
+func crlURL(baseURL, issuer string) string {
+	return strings.TrimSuffix(baseURL, "/") + crlPathPrefix + issuer + ".crl"
+}
+
+// serialNumber formats the serial number of a certificate as recorded by Issuers
+func serialNumber(cert *x509.Certificate) string {
+	return cert.SerialNumber.Text(16)
+}
+
+// buildCRL returns the PEM encoded CRL of the certificates revoked by a CA
+func buildCRL(ca *issuerCA, revoked []certsv1.RevokedCertificate, number *big.Int, validity time.Duration) ([]byte, error) {
+	now := time.Now()
+	template := &x509.RevocationList{
+		Number:     number,
+		ThisUpdate: now,
+		NextUpdate: now.Add(validity),
+	}
+	for _, entry := range revoked {
+		serial, ok := new(big.Int).SetString(entry.SerialNumber, 16)
+		if !ok {
+			return nil, fmt.Errorf("invalid serial number %s", entry.SerialNumber)
+		}
+		template.RevokedCertificateEntries = append(template.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   serial,
+			RevocationTime: entry.RevokedAt.Time,
+			ReasonCode:     CRLReasonCodes[entry.Reason],
+		})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, template, ca.cert, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der}), nil
+}
+
+// parseCRLPEM parses the first CRL of PEM data
+func parseCRLPEM(data []byte) (*x509.RevocationList, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "X509 CRL" {
+		return nil, fmt.Errorf("no CRL found")
+	}
+	return x509.ParseRevocationList(block.Bytes)
+}
+
+// crlUpToDate reports whether a CRL is signed by the CA and lists exactly the
+// revoked serial numbers
+func crlUpToDate(crl *x509.RevocationList, ca *x509.Certificate, revoked []certsv1.RevokedCertificate) bool {
+	if crl.CheckSignatureFrom(ca) != nil || len(crl.RevokedCertificateEntries) != len(revoked) {
+		return false
+	}
+	listed := map[string]bool{}
+	for _, entry := range crl.RevokedCertificateEntries {
+		listed[entry.SerialNumber.Text(16)] = true
+	}
+	for _, entry := range revoked {
+		if !listed[entry.SerialNumber] {
+			return false
+		}
+	}
+	return true
+}
+
+// pruneRevokedCertificates drops the revoked certificates which expired more than
+// a CRL validity ago. As CRLs are signed again after half of their validity, they
+// were listed on a CRL issued after their expiry, after which RFC 5280 (3.3)
+// allows to remove them.
+func pruneRevokedCertificates(revoked []certsv1.RevokedCertificate, validity time.Duration) []certsv1.RevokedCertificate {
+	expiredBefore := time.Now().Add(-validity)
+	current := []certsv1.RevokedCertificate{}
+	for _, entry := range revoked {
+		if entry.NotAfter == nil || entry.NotAfter.Time.After(expiredBefore) {
+			current = append(current, entry)
+		}
+	}
+	return current
+}
+
+// revokeCertificate records the current certificate of a Certificate annotated
+// with certs.k8c.io/revoke as revoked by its CA Issuer and removes the annotation.
+// Certificates of other issuers can not be revoked, their annotation is removed.
+func (r *CertificateReconciler) revokeCertificate(ctx context.Context, certificate *certsv1.Certificate, secret *corev1.Secret) error {
+	logger := log.FromContext(ctx)
+	reason := certsv1.RevocationReason(certificate.Annotations[certsv1.RevokeAnnotation])
+	if reason == "" {
+		reason = "unspecified"
+	}
+	issuer, leaf, err := r.issuerOfSecret(ctx, certificate, secret)
+	if err != nil {
+		return err
+	}
+	switch {
+	case issuer == nil || issuer.Spec.CA == nil:
+		logger.Info("Reconcile Event: Ignoring revocation, only certificates of CA issuers can be revoked")
+	case leaf == nil:
+		logger.Info("Reconcile Event: Ignoring revocation, the secret holds no certificate", "Secret", secret.Name)
+	default:
+		if _, found := CRLReasonCodes[reason]; !found {
+			logger.Info("Reconcile Event: Revoking with the unspecified reason instead of an unknown reason", "Reason", reason)
+			reason = "unspecified"
+		}
+		serial := serialNumber(leaf)
+		err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			err := r.Get(ctx, types.NamespacedName{Name: issuer.Name}, issuer)
+			if err != nil {
+				return err
+			}
+			if revokedBy(issuer, leaf) {
+				return nil
+			}
+			issuer.Status.RevokedCertificates = append(issuer.Status.RevokedCertificates, certsv1.RevokedCertificate{
+				SerialNumber: serial,
+				Reason:       reason,
+				RevokedAt:    metav1.NewTime(time.Now()),
+				NotAfter:     ptr.To(metav1.NewTime(leaf.NotAfter)),
+				Certificate:  certificate.Namespace + "/" + certificate.Name,
+			})
+			return r.Status().Update(ctx, issuer)
+		})
+		if err != nil {
+			return err
+		}
+		logger.Info("Reconcile Event: Certificate revoked", "Issuer", issuer.Name, "SerialNumber", serial, "Reason", reason)
+	}
+
+	patch := client.MergeFrom(certificate.DeepCopy())
+	delete(certificate.Annotations, certsv1.RevokeAnnotation)
+	return r.Patch(ctx, certificate, patch)
+}
+
+// certificateRevoked reports whether the current certificate of a Certificate
+// has been revoked by its CA Issuer
+func (r *CertificateReconciler) certificateRevoked(ctx context.Context, certificate *certsv1.Certificate, secret *corev1.Secret) (bool, error) {
+	issuer, leaf, err := r.issuerOfSecret(ctx, certificate, secret)
+	if err != nil || issuer == nil || leaf == nil {
+		return false, err
+	}
+	return revokedBy(issuer, leaf), nil
+}
+
+// issuerOfSecret returns the Issuer of a Certificate and the certificate stored
+// in its Secret. Both are nil for self-signed Certificates.
+func (r *CertificateReconciler) issuerOfSecret(ctx context.Context, certificate *certsv1.Certificate, secret *corev1.Secret) (*certsv1.Issuer, *x509.Certificate, error) {
+	if certificate.Spec.IssuerRef == nil {
+		return nil, nil, nil
+	}
+	issuer := &certsv1.Issuer{}
+	err := r.Get(ctx, types.NamespacedName{Name: certificate.Spec.IssuerRef.Name}, issuer)
+	if err != nil {
+		return nil, nil, client.IgnoreNotFound(err)
+	}
+	chain, err := helper.ParseCertificatesPEM(secret.Data["tls.crt"])
+	if err != nil || len(chain) == 0 {
+		return issuer, nil, nil
+	}
+	return issuer, chain[0], nil
+}
+
+// revokedBy reports whether an Issuer has revoked a certificate it signed
+func revokedBy(issuer *certsv1.Issuer, cert *x509.Certificate) bool {
+	serial := serialNumber(cert)
+	for _, entry := range issuer.Status.RevokedCertificates {
+		if entry.SerialNumber == serial {
+			return true
+		}
+	}
+	return false
+}
+
+// CRLServer serves the CRLs published by the Issuers of type ca over HTTP at
+// /crl/<issuer>.crl
+type CRLServer struct {
+	Client client.Reader
+	// BindAddress is the address the server listens on
+	BindAddress string
+}
+
+// Start serves the CRLs until the context is done
+func (s *CRLServer) Start(ctx context.Context) error {
+	server := &http.Server{Addr: s.BindAddress, Handler: s, ReadHeaderTimeout: 10 * time.Second}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.ListenAndServe()
+	}()
+	select {
+	case <-ctx.Done():
+		return server.Shutdown(context.Background())
+	case err := <-errCh:
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+		return err
+	}
+}
+
+// NeedLeaderElection returns false as every replica serves the CRLs
+func (s *CRLServer) NeedLeaderElection() bool {
+	return false
+}
+
+// ServeHTTP writes the DER encoded CRL of the Issuer of the request path
+func (s *CRLServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	name, found := strings.CutPrefix(req.URL.Path, crlPathPrefix)
+	name, isCRL := strings.CutSuffix(name, ".crl")
+	if !found || !isCRL || name == "" || req.Method != http.MethodGet {
+		http.NotFound(w, req)
+		return
+	}
+	issuer := &certsv1.Issuer{}
+	err := s.Client.Get(req.Context(), types.NamespacedName{Name: name}, issuer)
+	if err != nil || issuer.Spec.CA == nil {
+		http.NotFound(w, req)
+		return
+	}
+	configMap := &corev1.ConfigMap{}
+	err = s.Client.Get(req.Context(), types.NamespacedName{Name: crlConfigMapName(name), Namespace: issuer.Spec.CA.SecretRef.Namespace}, configMap)
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+	block, _ := pem.Decode([]byte(configMap.Data[CRLConfigMapKey]))
+	if block == nil {
+		http.NotFound(w, req)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pkix-crl")
+	_, _ = w.Write(block.Bytes)
+}
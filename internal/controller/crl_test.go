@@ -0,0 +1,196 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/utils/ptr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
+	"github.com/PNarode/k8c-certs-manager/internal/helper"
+	"github.com/PNarode/k8c-certs-manager/internal/validation"
+)
+
+var _ = Describe("Certificate revocation", func() {
+	newClient := func() client.Client {
+		scheme := runtime.NewScheme()
+		utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+		utilruntime.Must(certsv1.AddToScheme(scheme))
+
+		ca := certsv1.Certificate{Spec: certsv1.CertificateSpec{
+			DNSName: "ca.k8c.io", Validity: "1y", IsCA: true, SecretRef: certsv1.SecretRef{Name: "ca-tls"},
+		}}
+		Expect(validation.DefaultCertificate(context.Background(), &ca)).To(Succeed())
+		caCert, caKey, err := helper.GenerateSelfSignedCertificate(ca)
+		Expect(err).NotTo(HaveOccurred())
+
+		return fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}},
+			&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "ca-tls", Namespace: "certs-system"},
+				Data:       helper.SecretData(caCert, caKey),
+			},
+			&certsv1.Issuer{
+				ObjectMeta: metav1.ObjectMeta{Name: "internal-ca"},
+				Spec: certsv1.IssuerSpec{CA: &certsv1.CAIssuer{
+					SecretRef: certsv1.SecretReference{Name: "ca-tls", Namespace: "certs-system"},
+				}},
+			},
+		).WithStatusSubresource(&certsv1.Certificate{}, &certsv1.CertificateRequest{}, &certsv1.Issuer{}).Build()
+	}
+
+	leafOf := func(ctx context.Context, c client.Client) *x509.Certificate {
+		secret := &corev1.Secret{}
+		Expect(c.Get(ctx, types.NamespacedName{Name: "web-tls", Namespace: "default"}, secret)).To(Succeed())
+		chain, err := helper.ParseCertificatesPEM(secret.Data["tls.crt"])
+		Expect(err).NotTo(HaveOccurred())
+		return chain[0]
+	}
+
+	publishedCRL := func(ctx context.Context, c client.Client) *x509.RevocationList {
+		configMap := &corev1.ConfigMap{}
+		Expect(c.Get(ctx, types.NamespacedName{Name: "internal-ca-crl", Namespace: "certs-system"}, configMap)).To(Succeed())
+		crl, err := parseCRLPEM([]byte(configMap.Data[CRLConfigMapKey]))
+		Expect(err).NotTo(HaveOccurred())
+		return crl
+	}
+
+	It("should revoke the current certificate, list it in the CRL and reissue it", func() {
+		ctx := context.Background()
+		fakeClient := newClient()
+		certificate := &certsv1.Certificate{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+			Spec: certsv1.CertificateSpec{
+				DNSName:   "web.k8c.io",
+				Validity:  "30d",
+				SecretRef: certsv1.SecretRef{Name: "web-tls"},
+				IssuerRef: &certsv1.IssuerReference{Name: "internal-ca"},
+			},
+		}
+		Expect(validation.DefaultCertificate(ctx, certificate)).To(Succeed())
+		Expect(fakeClient.Create(ctx, certificate)).To(Succeed())
+		r := &CertificateReconciler{Client: fakeClient, Scheme: fakeClient.Scheme(), CRLBaseURL: "http://crl.k8c.io/"}
+		issuerReconciler := &IssuerReconciler{Client: fakeClient, Scheme: fakeClient.Scheme()}
+		certificateRequest := ctrl.Request{NamespacedName: types.NamespacedName{Name: "web", Namespace: "default"}}
+		issuerRequest := ctrl.Request{NamespacedName: types.NamespacedName{Name: "internal-ca"}}
+
+		By("issuing a certificate pointing to the CRL of its issuer")
+		_, err := r.Reconcile(ctx, certificateRequest)
+		Expect(err).NotTo(HaveOccurred())
+		revoked := leafOf(ctx, fakeClient)
+		Expect(revoked.CRLDistributionPoints).To(Equal([]string{"http://crl.k8c.io/crl/internal-ca.crl"}))
+		result, err := issuerReconciler.Reconcile(ctx, issuerRequest)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.RequeueAfter).To(Equal(DefaultCRLValidity / 2))
+		crl := publishedCRL(ctx, fakeClient)
+		Expect(crl.Number.Int64()).To(Equal(int64(1)))
+		Expect(crl.RevokedCertificateEntries).To(BeEmpty())
+
+		By("revoking and reissuing it once annotated")
+		Expect(fakeClient.Get(ctx, certificateRequest.NamespacedName, certificate)).To(Succeed())
+		certificate.Annotations[certsv1.RevokeAnnotation] = "keyCompromise"
+		Expect(fakeClient.Update(ctx, certificate)).To(Succeed())
+		_, err = r.Reconcile(ctx, certificateRequest)
+		Expect(err).NotTo(HaveOccurred())
+		issuer := &certsv1.Issuer{}
+		Expect(fakeClient.Get(ctx, issuerRequest.NamespacedName, issuer)).To(Succeed())
+		Expect(issuer.Status.RevokedCertificates).To(HaveLen(1))
+		Expect(issuer.Status.RevokedCertificates[0].SerialNumber).To(Equal(serialNumber(revoked)))
+		Expect(issuer.Status.RevokedCertificates[0].Reason).To(BeEquivalentTo("keyCompromise"))
+		Expect(issuer.Status.RevokedCertificates[0].Certificate).To(Equal("default/web"))
+		Expect(issuer.Status.RevokedCertificates[0].NotAfter.Time).To(BeTemporally("==", revoked.NotAfter))
+		Expect(fakeClient.Get(ctx, certificateRequest.NamespacedName, certificate)).To(Succeed())
+		Expect(certificate.Annotations).NotTo(HaveKey(certsv1.RevokeAnnotation))
+		reissued := leafOf(ctx, fakeClient)
+		Expect(reissued.SerialNumber).NotTo(Equal(revoked.SerialNumber))
+		Expect(reissued.PublicKey).NotTo(Equal(revoked.PublicKey))
+
+		By("signing the CRL again with the revoked serial number")
+		_, err = issuerReconciler.Reconcile(ctx, issuerRequest)
+		Expect(err).NotTo(HaveOccurred())
+		crl = publishedCRL(ctx, fakeClient)
+		Expect(crl.Number.Int64()).To(Equal(int64(2)))
+		Expect(crl.RevokedCertificateEntries).To(HaveLen(1))
+		Expect(crl.RevokedCertificateEntries[0].SerialNumber).To(Equal(revoked.SerialNumber))
+		Expect(crl.RevokedCertificateEntries[0].ReasonCode).To(Equal(1))
+
+		By("serving the CRL over HTTP")
+		server := httptest.NewServer(&CRLServer{Client: fakeClient})
+		defer server.Close()
+		resp, err := http.Get(server.URL + "/crl/internal-ca.crl")
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(resp.Header.Get("Content-Type")).To(Equal("application/pkix-crl"))
+		der, err := io.ReadAll(resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(der).To(Equal(crl.Raw))
+		missing, err := http.Get(server.URL + "/crl/unknown.crl")
+		Expect(err).NotTo(HaveOccurred())
+		defer missing.Body.Close()
+		Expect(missing.StatusCode).To(Equal(http.StatusNotFound))
+	})
+
+	It("should remove the revoked certificates which expired before the last CRL", func() {
+		ctx := context.Background()
+		fakeClient := newClient()
+		issuer := &certsv1.Issuer{}
+		Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "internal-ca"}, issuer)).To(Succeed())
+		now := time.Now()
+		issuer.Status.RevokedCertificates = []certsv1.RevokedCertificate{
+			{SerialNumber: "1", RevokedAt: metav1.NewTime(now.Add(-72 * time.Hour)), NotAfter: ptr.To(metav1.NewTime(now.Add(-48 * time.Hour)))},
+			{SerialNumber: "2", RevokedAt: metav1.NewTime(now.Add(-72 * time.Hour)), NotAfter: ptr.To(metav1.NewTime(now.Add(-time.Hour)))},
+			{SerialNumber: "3", RevokedAt: metav1.NewTime(now.Add(-72 * time.Hour))},
+		}
+		Expect(fakeClient.Status().Update(ctx, issuer)).To(Succeed())
+
+		issuerReconciler := &IssuerReconciler{Client: fakeClient, Scheme: fakeClient.Scheme()}
+		_, err := issuerReconciler.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: "internal-ca"}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "internal-ca"}, issuer)).To(Succeed())
+		Expect(issuer.Status.RevokedCertificates).To(ConsistOf(HaveField("SerialNumber", "2"), HaveField("SerialNumber", "3")))
+		Expect(publishedCRL(ctx, fakeClient).RevokedCertificateEntries).To(HaveLen(2))
+	})
+
+	It("should only accept known revocation reasons", func() {
+		certificate := &certsv1.Certificate{
+			ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{certsv1.RevokeAnnotation: "lostIt"}},
+			Spec:       certsv1.CertificateSpec{DNSName: "web.k8c.io", Validity: "30d"},
+		}
+		Expect(validation.DefaultCertificate(context.Background(), certificate)).To(Succeed())
+		Expect(validation.ValidateCertificate(certificate)).To(ContainElement(HaveField("Field", "metadata.annotations[certs.k8c.io/revoke]")))
+		certificate.Annotations[certsv1.RevokeAnnotation] = "superseded"
+		Expect(validation.ValidateCertificate(certificate)).To(BeEmpty())
+	})
+})
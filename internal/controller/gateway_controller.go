@@ -0,0 +1,172 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"slices"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
+)
+
+// GatewayGVK is the Gateway API kind watched by the GatewayReconciler. Gateways are
+// handled as unstructured objects so that the Gateway API CRDs are only required
+// when the controller is enabled.
+var GatewayGVK = schema.GroupVersionKind{Group: "gateway.networking.k8s.io", Version: "v1", Kind: "Gateway"}
+
+// gatewaySpec is the subset of the Gateway spec used to derive Certificates
+type gatewaySpec struct {
+	Listeners []gatewayListener `json:"listeners,omitempty"`
+}
+
+type gatewayListener struct {
+	Name     string              `json:"name"`
+	Hostname string              `json:"hostname,omitempty"`
+	Protocol string              `json:"protocol"`
+	TLS      *gatewayListenerTLS `json:"tls,omitempty"`
+}
+
+type gatewayListenerTLS struct {
+	CertificateRefs []gatewaySecretRef `json:"certificateRefs,omitempty"`
+}
+
+type gatewaySecretRef struct {
+	Group     *string `json:"group,omitempty"`
+	Kind      *string `json:"kind,omitempty"`
+	Name      string  `json:"name"`
+	Namespace *string `json:"namespace,omitempty"`
+}
+
+// GatewayReconciler creates Certificates for the HTTPS and TLS listeners of Gateways
+type GatewayReconciler struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+}
+
+// +kubebuilder:rbac:groups=gateway.networking.k8s.io,resources=gateways,verbs=get;list;watch
+
+// Reconcile creates or updates a Certificate owned by the Gateway for each Secret
+// referenced by its HTTPS and TLS listeners, with the listener hostnames as DNS
+// subject alternative names. Secrets which already exist without a Certificate of
+// the Gateway are left alone.
+func (r *GatewayReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+	logger.Info("Reconcile Event: Gateway Reconcilation Started")
+	gateway := &unstructured.Unstructured{}
+	gateway.SetGroupVersionKind(GatewayGVK)
+	err := r.Get(ctx, req.NamespacedName, gateway)
+	if err != nil {
+		// Owned Certificates are garbage collected with the Gateway
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	desired := map[string]certsv1.CertificateSpec{}
+	if gateway.GetDeletionTimestamp() == nil {
+		hosts, err := gatewaySecretHosts(gateway)
+		if err != nil {
+			logger.Error(err, "Reconcile Event: Failed to parse Gateway listeners")
+			return ctrl.Result{}, nil
+		}
+		for secretName, secretHosts := range hosts {
+			provisioned, err := provisionedElsewhere(ctx, r.Client, gateway, secretName)
+			if err != nil {
+				return ctrl.Result{}, err
+			}
+			if provisioned {
+				logger.Info("Reconcile Event: Skipping listener Secret not provisioned by a Gateway certificate", "Secret", secretName)
+				continue
+			}
+			desired[secretName] = shimCertificateSpec(gateway, secretHosts, secretName)
+		}
+	}
+
+	for name, spec := range desired {
+		err = applyOwnedCertificate(ctx, r.Client, r.Scheme, r.Recorder, gateway, name, spec)
+		if err != nil {
+			logger.Error(err, "Reconcile Event: Failed to apply Gateway certificate", "Certificate", name)
+			return ctrl.Result{}, err
+		}
+	}
+
+	err = deleteStaleCertificates(ctx, r.Client, gateway, desired)
+	if err != nil {
+		logger.Error(err, "Reconcile Event: Failed to delete stale Gateway certificates")
+		return ctrl.Result{}, err
+	}
+	logger.Info("Reconcile Event: Gateway Reconcilation Ended")
+	return ctrl.Result{}, nil
+}
+
+// gatewaySecretHosts maps each Secret in the Gateway namespace referenced by an
+// HTTPS or TLS listener to the hostnames of the listeners using it. Listeners
+// without a hostname are skipped as no DNS name can be derived from them.
+func gatewaySecretHosts(gateway *unstructured.Unstructured) (map[string][]string, error) {
+	spec := gatewaySpec{}
+	content, _, err := unstructured.NestedMap(gateway.Object, "spec")
+	if err != nil {
+		return nil, err
+	}
+	err = runtime.DefaultUnstructuredConverter.FromUnstructured(content, &spec)
+	if err != nil {
+		return nil, err
+	}
+
+	hosts := map[string][]string{}
+	for _, listener := range spec.Listeners {
+		if listener.Protocol != "HTTPS" && listener.Protocol != "TLS" {
+			continue
+		}
+		if listener.TLS == nil || listener.Hostname == "" {
+			continue
+		}
+		for _, ref := range listener.TLS.CertificateRefs {
+			if ref.Group != nil && *ref.Group != "" {
+				continue
+			}
+			if ref.Kind != nil && *ref.Kind != "Secret" {
+				continue
+			}
+			if ref.Namespace != nil && *ref.Namespace != gateway.GetNamespace() {
+				continue
+			}
+			if !slices.Contains(hosts[ref.Name], listener.Hostname) {
+				hosts[ref.Name] = append(hosts[ref.Name], listener.Hostname)
+			}
+		}
+	}
+	return hosts, nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *GatewayReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	gateway := &unstructured.Unstructured{}
+	gateway.SetGroupVersionKind(GatewayGVK)
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("gateway").
+		For(gateway).
+		Owns(&certsv1.Certificate{}).
+		Complete(r)
+}
@@ -0,0 +1,148 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
+)
+
+var _ = Describe("Gateway Controller", func() {
+	It("should map referenced Secrets to the listener hostnames", func() {
+		gateway := &unstructured.Unstructured{Object: map[string]interface{}{
+			"metadata": map[string]interface{}{"name": "test-gateway", "namespace": "default"},
+			"spec": map[string]interface{}{
+				"listeners": []interface{}{
+					map[string]interface{}{
+						"name": "https", "protocol": "HTTPS", "hostname": "example.k8c.io",
+						"tls": map[string]interface{}{"certificateRefs": []interface{}{
+							map[string]interface{}{"name": "example-tls"},
+						}},
+					},
+					map[string]interface{}{
+						"name": "https-www", "protocol": "HTTPS", "hostname": "www.example.k8c.io",
+						"tls": map[string]interface{}{"certificateRefs": []interface{}{
+							map[string]interface{}{"kind": "Secret", "name": "example-tls"},
+						}},
+					},
+					map[string]interface{}{
+						"name": "other-namespace", "protocol": "TLS", "hostname": "other.k8c.io",
+						"tls": map[string]interface{}{"certificateRefs": []interface{}{
+							map[string]interface{}{"name": "other-tls", "namespace": "other"},
+						}},
+					},
+					map[string]interface{}{"name": "http", "protocol": "HTTP", "hostname": "example.k8c.io"},
+				},
+			},
+		}}
+		gateway.SetGroupVersionKind(GatewayGVK)
+
+		hosts, err := gatewaySecretHosts(gateway)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(hosts).To(Equal(map[string][]string{
+			"example-tls": {"example.k8c.io", "www.example.k8c.io"},
+		}))
+	})
+
+	It("should manage the certificates of the listener Secrets", func() {
+		ctx := context.Background()
+		scheme := runtime.NewScheme()
+		utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+		utilruntime.Must(certsv1.AddToScheme(scheme))
+		listener := func(name, hostname, secretName string) interface{} {
+			return map[string]interface{}{
+				"name": name, "protocol": "HTTPS", "hostname": hostname,
+				"tls": map[string]interface{}{"certificateRefs": []interface{}{
+					map[string]interface{}{"name": secretName},
+				}},
+			}
+		}
+		gateway := &unstructured.Unstructured{Object: map[string]interface{}{
+			"spec": map[string]interface{}{"listeners": []interface{}{
+				listener("https", "shop.k8c.io", "shop-tls"),
+				listener("legacy", "legacy.k8c.io", "legacy-tls"),
+			}},
+		}}
+		gateway.SetGroupVersionKind(GatewayGVK)
+		gateway.SetName("public")
+		gateway.SetNamespace("shop")
+		gateway.SetUID("public-uid")
+		fakeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+			gateway,
+			&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "legacy-tls", Namespace: "shop"}},
+		).Build()
+		r := &GatewayReconciler{Client: fakeClient, Scheme: scheme, Recorder: record.NewFakeRecorder(10)}
+		request := ctrl.Request{NamespacedName: types.NamespacedName{Name: "public", Namespace: "shop"}}
+
+		By("creating a certificate for the listener Secret")
+		_, err := r.Reconcile(ctx, request)
+		Expect(err).NotTo(HaveOccurred())
+		certificate := &certsv1.Certificate{}
+		Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "shop-tls", Namespace: "shop"}, certificate)).To(Succeed())
+		Expect(certificate.Spec.DNSName).To(Equal("shop.k8c.io"))
+		Expect(certificate.Spec.SecretRef.Name).To(Equal("shop-tls"))
+		Expect(metav1.IsControlledBy(certificate, gateway)).To(BeTrue())
+
+		By("leaving Secrets provisioned elsewhere alone")
+		err = fakeClient.Get(ctx, types.NamespacedName{Name: "legacy-tls", Namespace: "shop"}, certificate)
+		Expect(errors.IsNotFound(err)).To(BeTrue())
+
+		By("keeping the certificate once its Secret is issued")
+		Expect(fakeClient.Create(ctx, &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "shop-tls", Namespace: "shop"}})).To(Succeed())
+		_, err = r.Reconcile(ctx, request)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "shop-tls", Namespace: "shop"}, certificate)).To(Succeed())
+		Expect(certificate.Spec.Subject.CommonName).To(Equal("shop.k8c.io"))
+
+		By("rewriting the subject together with the listener hostname")
+		Expect(fakeClient.Get(ctx, request.NamespacedName, gateway)).To(Succeed())
+		Expect(unstructured.SetNestedSlice(gateway.Object, []interface{}{
+			listener("https", "store.k8c.io", "shop-tls"),
+			listener("legacy", "legacy.k8c.io", "legacy-tls"),
+		}, "spec", "listeners")).To(Succeed())
+		Expect(fakeClient.Update(ctx, gateway)).To(Succeed())
+		_, err = r.Reconcile(ctx, request)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "shop-tls", Namespace: "shop"}, certificate)).To(Succeed())
+		Expect(certificate.Spec.DNSName).To(Equal("store.k8c.io"))
+		Expect(certificate.Spec.Subject.CommonName).To(Equal("store.k8c.io"))
+
+		By("deleting the certificate once the listener is removed")
+		Expect(fakeClient.Get(ctx, request.NamespacedName, gateway)).To(Succeed())
+		Expect(unstructured.SetNestedSlice(gateway.Object, []interface{}{listener("legacy", "legacy.k8c.io", "legacy-tls")}, "spec", "listeners")).To(Succeed())
+		Expect(fakeClient.Update(ctx, gateway)).To(Succeed())
+		_, err = r.Reconcile(ctx, request)
+		Expect(err).NotTo(HaveOccurred())
+		err = fakeClient.Get(ctx, types.NamespacedName{Name: "shop-tls", Namespace: "shop"}, certificate)
+		Expect(errors.IsNotFound(err)).To(BeTrue())
+	})
+})
@@ -0,0 +1,97 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
+)
+
+// IngressReconciler creates Certificates for the TLS blocks of annotated Ingresses
+type IngressReconciler struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+}
+
+// +kubebuilder:rbac:groups=networking.k8s.io,resources=ingresses,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+
+// Reconcile creates or updates a Certificate owned by the Ingress for each of its
+// TLS blocks, and deletes the owned Certificates which are no longer requested.
+// Secrets which already exist without a Certificate of the Ingress are left alone.
+func (r *IngressReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+	logger.Info("Reconcile Event: Ingress Reconcilation Started")
+	ingress := &networkingv1.Ingress{}
+	err := r.Get(ctx, req.NamespacedName, ingress)
+	if err != nil {
+		// Owned Certificates are garbage collected with the Ingress
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	desired := map[string]certsv1.CertificateSpec{}
+	if ingress.Annotations[IssueAnnotation] == "true" && ingress.DeletionTimestamp == nil {
+		for _, tls := range ingress.Spec.TLS {
+			if tls.SecretName == "" || len(tls.Hosts) == 0 {
+				logger.Info("Reconcile Event: Skipping TLS block without secretName or hosts")
+				continue
+			}
+			provisioned, err := provisionedElsewhere(ctx, r.Client, ingress, tls.SecretName)
+			if err != nil {
+				return ctrl.Result{}, err
+			}
+			if provisioned {
+				logger.Info("Reconcile Event: Skipping TLS Secret not provisioned by an Ingress certificate", "Secret", tls.SecretName)
+				continue
+			}
+			desired[tls.SecretName] = shimCertificateSpec(ingress, tls.Hosts, tls.SecretName)
+		}
+	}
+
+	for name, spec := range desired {
+		err = applyOwnedCertificate(ctx, r.Client, r.Scheme, r.Recorder, ingress, name, spec)
+		if err != nil {
+			logger.Error(err, "Reconcile Event: Failed to apply Ingress certificate", "Certificate", name)
+			return ctrl.Result{}, err
+		}
+	}
+
+	err = deleteStaleCertificates(ctx, r.Client, ingress, desired)
+	if err != nil {
+		logger.Error(err, "Reconcile Event: Failed to delete stale Ingress certificates")
+		return ctrl.Result{}, err
+	}
+	logger.Info("Reconcile Event: Ingress Reconcilation Ended")
+	return ctrl.Result{}, nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *IngressReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&networkingv1.Ingress{}).
+		Owns(&certsv1.Certificate{}).
+		Complete(r)
+}
@@ -0,0 +1,131 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	networkingv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
+)
+
+var _ = Describe("Ingress Controller", func() {
+	Context("When reconciling an annotated Ingress", func() {
+		const resourceName = "test-ingress"
+
+		ctx := context.Background()
+
+		typeNamespacedName := types.NamespacedName{
+			Name:      resourceName,
+			Namespace: "default",
+		}
+
+		BeforeEach(func() {
+			By("creating the Ingress with a TLS block")
+			ingress := &networkingv1.Ingress{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        resourceName,
+					Namespace:   "default",
+					Annotations: map[string]string{IssueAnnotation: "true"},
+				},
+				Spec: networkingv1.IngressSpec{
+					TLS: []networkingv1.IngressTLS{{
+						Hosts:      []string{"example.k8c.io", "www.example.k8c.io"},
+						SecretName: "test-ingress-secret",
+					}},
+				},
+			}
+			Expect(k8sClient.Create(ctx, ingress)).To(Succeed())
+		})
+
+		AfterEach(func() {
+			ingress := &networkingv1.Ingress{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, ingress)).To(Succeed())
+			By("Cleanup the Ingress and its Certificate")
+			Expect(k8sClient.Delete(ctx, ingress)).To(Succeed())
+			certificate := &certsv1.Certificate{}
+			err := k8sClient.Get(ctx, types.NamespacedName{Name: "test-ingress-secret", Namespace: "default"}, certificate)
+			if !errors.IsNotFound(err) {
+				Expect(k8sClient.Delete(ctx, certificate)).To(Succeed())
+			}
+		})
+
+		It("should create and clean up the owned Certificate", func() {
+			controllerReconciler := &IngressReconciler{
+				Client:   k8sClient,
+				Scheme:   k8sClient.Scheme(),
+				Recorder: record.NewFakeRecorder(10),
+			}
+
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+
+			certificate := &certsv1.Certificate{}
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Name: "test-ingress-secret", Namespace: "default"}, certificate)).To(Succeed())
+			Expect(certificate.Spec.DNSName).To(Equal("example.k8c.io"))
+			Expect(certificate.Spec.DNSNames).To(Equal([]string{"www.example.k8c.io"}))
+			Expect(certificate.Spec.SecretRef.Name).To(Equal("test-ingress-secret"))
+			Expect(certificate.OwnerReferences).To(HaveLen(1))
+
+			By("removing the issue annotation")
+			ingress := &networkingv1.Ingress{}
+			Expect(k8sClient.Get(ctx, typeNamespacedName, ingress)).To(Succeed())
+			delete(ingress.Annotations, IssueAnnotation)
+			Expect(k8sClient.Update(ctx, ingress)).To(Succeed())
+
+			_, err = controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+			err = k8sClient.Get(ctx, types.NamespacedName{Name: "test-ingress-secret", Namespace: "default"}, certificate)
+			Expect(errors.IsNotFound(err)).To(BeTrue())
+		})
+
+		It("should leave a Certificate it does not manage untouched", func() {
+			By("creating a Certificate for the TLS secret outside of the Ingress")
+			Expect(k8sClient.Create(ctx, &certsv1.Certificate{
+				ObjectMeta: metav1.ObjectMeta{Name: "test-ingress-secret", Namespace: "default"},
+				Spec: certsv1.CertificateSpec{
+					DNSName:   "admin.k8c.io",
+					Validity:  "1d",
+					SecretRef: certsv1.SecretRef{Name: "test-ingress-secret"},
+				},
+			})).To(Succeed())
+			recorder := record.NewFakeRecorder(10)
+			controllerReconciler := &IngressReconciler{
+				Client:   k8sClient,
+				Scheme:   k8sClient.Scheme(),
+				Recorder: recorder,
+			}
+
+			_, err := controllerReconciler.Reconcile(ctx, reconcile.Request{NamespacedName: typeNamespacedName})
+			Expect(err).NotTo(HaveOccurred())
+			Expect(recorder.Events).To(Receive(ContainSubstring("CertificateNotOwned")))
+
+			certificate := &certsv1.Certificate{}
+			Expect(k8sClient.Get(ctx, types.NamespacedName{Name: "test-ingress-secret", Namespace: "default"}, certificate)).To(Succeed())
+			Expect(certificate.Spec.DNSName).To(Equal("admin.k8c.io"))
+			Expect(certificate.OwnerReferences).To(BeEmpty())
+		})
+	})
+})
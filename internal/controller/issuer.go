@@ -0,0 +1,194 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
+	"github.com/PNarode/k8c-certs-manager/internal/helper"
+)
+
+// +kubebuilder:rbac:groups=certs.k8c.io,resources=issuers,verbs=get;list;watch
+
+const (
+	// issuedCertificateLabel marks the ConfigMaps recording a certificate signed
+	// by an Issuer of type ca
+	issuedCertificateLabel = "certs.k8c.io/issued-certificate"
+	// issuedCertificateNotAfterKey is the key of the expiry of the certificate
+	// in its record, in RFC 3339 format
+	issuedCertificateNotAfterKey = "notAfter"
+	// issuedCertificateCertificateKey is the key of the Certificate, as
+	// namespace/name, a certificate was issued for in its record. Empty for
+	// certificates signed for CertificateSigningRequests and WorkloadIdentities.
+	issuedCertificateCertificateKey = "certificate"
+)
+
+// issuerCA is the CA an Issuer of type ca signs with
+type issuerCA struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+	// chain is appended to the issued certificates when the CA is an intermediate
+	chain []byte
+	// root is the issuing certificate stored as ca.crt
+	root []byte
+}
+
+// loadIssuerCA loads the CA of an Issuer of type ca from its Secret
+func loadIssuerCA(ctx context.Context, c client.Reader, name string) (*issuerCA, error) {
+	issuer := &certsv1.Issuer{}
+	err := c.Get(ctx, types.NamespacedName{Name: name}, issuer)
+	if err != nil {
+		return nil, err
+	}
+	if issuer.Spec.CA == nil {
+		return nil, fmt.Errorf("issuer %s is not of type ca", name)
+	}
+	ref := issuer.Spec.CA.SecretRef
+	secret := &corev1.Secret{}
+	err = c.Get(ctx, types.NamespacedName{Name: ref.Name, Namespace: ref.Namespace}, secret)
+	if err != nil {
+		return nil, fmt.Errorf("issuer %s: %w", name, err)
+	}
+	cert, key, err := helper.ParseCA(secret.Data["tls.crt"], secret.Data["tls.key"])
+	if err != nil {
+		return nil, fmt.Errorf("issuer %s: secret %s/%s: %w", name, ref.Namespace, ref.Name, err)
+	}
+
+	ca := &issuerCA{cert: cert, key: key, root: secret.Data["tls.crt"]}
+	if !bytes.Equal(cert.RawIssuer, cert.RawSubject) {
+		ca.chain = secret.Data["tls.crt"]
+		if len(secret.Data["ca.crt"]) > 0 {
+			ca.root = secret.Data["ca.crt"]
+		}
+	}
+	return ca, nil
+}
+
+// issuedCertificateName returns the name of the ConfigMap recording a certificate
+// signed by an Issuer of type ca
+func issuedCertificateName(issuer, serial string) string {
+	return issuer + "-issued-" + serial
+}
+
+// recordIssuedCertificate records a certificate signed by an Issuer of type ca in
+// a ConfigMap of its own in the namespace of the CA Secret, which is deleted once
+// the certificate expired. Unlike a list in the Issuer status the records do not
+// grow the Issuer with every certificate it signs.
+func recordIssuedCertificate(ctx context.Context, c client.Client, name string, certPEM []byte, certificate string) error {
+	chain, err := helper.ParseCertificatesPEM(certPEM)
+	if err != nil {
+		return err
+	}
+	issuer := &certsv1.Issuer{}
+	err = c.Get(ctx, types.NamespacedName{Name: name}, issuer)
+	if err != nil {
+		return err
+	}
+	if issuer.Spec.CA == nil {
+		return fmt.Errorf("issuer %s is not of type ca", name)
+	}
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            issuedCertificateName(name, serialNumber(chain[0])),
+			Namespace:       issuer.Spec.CA.SecretRef.Namespace,
+			Labels:          map[string]string{issuedCertificateLabel: "true"},
+			OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(issuer, certsv1.GroupVersion.WithKind("Issuer"))},
+		},
+		Data: map[string]string{
+			issuedCertificateNotAfterKey:    chain[0].NotAfter.UTC().Format(time.RFC3339),
+			issuedCertificateCertificateKey: certificate,
+		},
+	}
+	return c.Create(ctx, configMap)
+}
+
+// issuedCertificate returns the record of a certificate signed by an Issuer of
+// type ca which has not expired yet, or nil
+func issuedCertificate(ctx context.Context, c client.Reader, issuer *certsv1.Issuer, serial string) (*corev1.ConfigMap, error) {
+	configMap := &corev1.ConfigMap{}
+	err := c.Get(ctx, types.NamespacedName{Name: issuedCertificateName(issuer.Name, serial), Namespace: issuer.Spec.CA.SecretRef.Namespace}, configMap)
+	if err != nil {
+		return nil, client.IgnoreNotFound(err)
+	}
+	if !metav1.IsControlledBy(configMap, issuer) || issuedCertificateExpired(configMap, time.Now()) {
+		return nil, nil
+	}
+	return configMap, nil
+}
+
+// issuedCertificateExpired reports whether the certificate of a record expired
+func issuedCertificateExpired(configMap *corev1.ConfigMap, now time.Time) bool {
+	notAfter, err := time.Parse(time.RFC3339, configMap.Data[issuedCertificateNotAfterKey])
+	return err != nil || !now.Before(notAfter)
+}
+
+// pruneIssuedCertificates deletes the records of the expired certificates signed
+// by an Issuer of type ca and returns the number of deleted records
+func pruneIssuedCertificates(ctx context.Context, c client.Client, issuer *certsv1.Issuer) (int, error) {
+	configMaps := &corev1.ConfigMapList{}
+	err := c.List(ctx, configMaps, client.InNamespace(issuer.Spec.CA.SecretRef.Namespace), client.MatchingLabels{issuedCertificateLabel: "true"})
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	deleted := 0
+	for i := range configMaps.Items {
+		configMap := &configMaps.Items[i]
+		if !metav1.IsControlledBy(configMap, issuer) || !issuedCertificateExpired(configMap, now) {
+			continue
+		}
+		err = c.Delete(ctx, configMap)
+		if client.IgnoreNotFound(err) != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// issuerHTTPClient returns an HTTP client for the server of an issuer trusting
+// the CA certificates of the bundle in addition to the system roots
+func issuerHTTPClient(caBundle []byte, timeout time.Duration) (*http.Client, error) {
+	httpClient := &http.Client{Timeout: timeout}
+	if len(caBundle) == 0 {
+		return httpClient, nil
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(caBundle) {
+		return nil, fmt.Errorf("caBundle holds no certificate")
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	httpClient.Transport = transport
+	return httpClient, nil
+}
@@ -0,0 +1,166 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"math/big"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
+)
+
+// DefaultCRLValidity is the default time between the updates of a CRL
+const DefaultCRLValidity = 24 * time.Hour
+
+// IssuerReconciler publishes the CRLs of the Issuers of type ca
+type IssuerReconciler struct {
+	client.Client
+	Scheme *runtime.Scheme
+	// CRLValidity is the time between the thisUpdate and nextUpdate of a CRL. A
+	// CRL is refreshed once half of it has passed.
+	CRLValidity time.Duration
+}
+
+// +kubebuilder:rbac:groups=certs.k8c.io,resources=issuers/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch;create;update;patch;delete
+
+// Reconcile signs the CRL of the certificates revoked by an Issuer of type ca
+// and writes it to the <issuer>-crl ConfigMap in the namespace of the CA Secret.
+// The CRL is signed again when the revoked certificates or the CA change, and
+// before it expires. Revoked certificates are removed some time after they expired,
+// the records of the issued certificates once they expired.
+func (r *IssuerReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+	issuer := &certsv1.Issuer{}
+	err := r.Get(ctx, req.NamespacedName, issuer)
+	if err != nil {
+		// Owned ConfigMaps are garbage collected with the Issuer
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	if issuer.Spec.CA == nil {
+		return ctrl.Result{}, nil
+	}
+	ca, err := loadIssuerCA(ctx, r.Client, issuer.Name)
+	if err != nil {
+		logger.Error(err, "Reconcile Event: Failed to load the issuer CA")
+		return ctrl.Result{}, err
+	}
+
+	revoked := pruneRevokedCertificates(issuer.Status.RevokedCertificates, r.crlValidity())
+	if len(revoked) != len(issuer.Status.RevokedCertificates) {
+		issuer.Status.RevokedCertificates = revoked
+		err = r.Status().Update(ctx, issuer)
+		if err != nil {
+			logger.Error(err, "Reconcile Event: Failed to remove the expired revoked certificates")
+			return ctrl.Result{}, err
+		}
+		logger.Info("Reconcile Event: Expired revoked certificates removed", "Revoked", len(revoked))
+	}
+
+	pruned, err := pruneIssuedCertificates(ctx, r.Client, issuer)
+	if err != nil {
+		logger.Error(err, "Reconcile Event: Failed to remove the records of expired certificates")
+		return ctrl.Result{}, err
+	}
+	if pruned > 0 {
+		logger.Info("Reconcile Event: Records of expired certificates removed", "Removed", pruned)
+	}
+
+	configMap := &corev1.ConfigMap{}
+	key := types.NamespacedName{Name: crlConfigMapName(issuer.Name), Namespace: issuer.Spec.CA.SecretRef.Namespace}
+	err = r.Get(ctx, key, configMap)
+	if client.IgnoreNotFound(err) != nil {
+		return ctrl.Result{}, err
+	}
+	number := big.NewInt(1)
+	if current, err := parseCRLPEM([]byte(configMap.Data[CRLConfigMapKey])); err == nil {
+		refreshAt := current.ThisUpdate.Add(current.NextUpdate.Sub(current.ThisUpdate) / 2)
+		if crlUpToDate(current, ca.cert, issuer.Status.RevokedCertificates) && time.Until(refreshAt) > 0 {
+			return ctrl.Result{RequeueAfter: time.Until(refreshAt)}, nil
+		}
+		if current.Number != nil {
+			number.Add(current.Number, big.NewInt(1))
+		}
+	}
+
+	crlPEM, err := buildCRL(ca, issuer.Status.RevokedCertificates, number, r.crlValidity())
+	if err != nil {
+		logger.Error(err, "Reconcile Event: Failed to sign the CRL")
+		return ctrl.Result{}, err
+	}
+	configMap = &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: key.Name, Namespace: key.Namespace}}
+	_, err = controllerutil.CreateOrUpdate(ctx, r.Client, configMap, func() error {
+		configMap.Data = map[string]string{CRLConfigMapKey: string(crlPEM)}
+		return controllerutil.SetControllerReference(issuer, configMap, r.Scheme)
+	})
+	if err != nil {
+		logger.Error(err, "Reconcile Event: Failed to publish the CRL")
+		return ctrl.Result{}, err
+	}
+	logger.Info("Reconcile Event: CRL published", "ConfigMap", key, "Number", number, "Revoked", len(issuer.Status.RevokedCertificates))
+	return ctrl.Result{RequeueAfter: r.crlValidity() / 2}, nil
+}
+
+func (r *IssuerReconciler) crlValidity() time.Duration {
+	if r.CRLValidity <= 0 {
+		return DefaultCRLValidity
+	}
+	return r.CRLValidity
+}
+
+// issuersOfSecret maps a Secret to the Issuers of type ca it stores the CA of
+func (r *IssuerReconciler) issuersOfSecret(ctx context.Context, obj client.Object) []reconcile.Request {
+	issuers := &certsv1.IssuerList{}
+	err := r.List(ctx, issuers)
+	if err != nil {
+		log.FromContext(ctx).Error(err, "Reconcile Event: Failed to list issuers")
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, issuer := range issuers.Items {
+		if issuer.Spec.CA != nil && issuer.Spec.CA.SecretRef.Name == obj.GetName() && issuer.Spec.CA.SecretRef.Namespace == obj.GetNamespace() {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: issuer.Name}})
+		}
+	}
+	return requests
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *IssuerReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&certsv1.Issuer{}).
+		// The records of issued certificates do not change the CRL
+		Owns(&corev1.ConfigMap{}, builder.WithPredicates(predicate.NewPredicateFuncs(func(obj client.Object) bool {
+			return obj.GetLabels()[issuedCertificateLabel] == ""
+		}))).
+		Watches(&corev1.Secret{}, handler.EnqueueRequestsFromMapFunc(r.issuersOfSecret)).
+		Complete(r)
+}
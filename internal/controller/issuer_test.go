@@ -0,0 +1,187 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"crypto/x509"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
+	"github.com/PNarode/k8c-certs-manager/internal/helper"
+	"github.com/PNarode/k8c-certs-manager/internal/validation"
+)
+
+var _ = Describe("Issuer", func() {
+	newClient := func() client.Client {
+		scheme := runtime.NewScheme()
+		utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+		utilruntime.Must(certsv1.AddToScheme(scheme))
+
+		ca := certsv1.Certificate{Spec: certsv1.CertificateSpec{
+			DNSName: "ca.k8c.io", Validity: "1y", IsCA: true, SecretRef: certsv1.SecretRef{Name: "ca-tls"},
+		}}
+		Expect(validation.DefaultCertificate(context.Background(), &ca)).To(Succeed())
+		caCert, caKey, err := helper.GenerateSelfSignedCertificate(ca)
+		Expect(err).NotTo(HaveOccurred())
+
+		return fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}},
+			&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "ca-tls", Namespace: "certs-system"},
+				Data:       helper.SecretData(caCert, caKey),
+			},
+			&certsv1.Issuer{
+				ObjectMeta: metav1.ObjectMeta{Name: "internal-ca"},
+				Spec: certsv1.IssuerSpec{CA: &certsv1.CAIssuer{
+					SecretRef: certsv1.SecretReference{Name: "ca-tls", Namespace: "certs-system"},
+				}},
+			},
+		).WithStatusSubresource(&certsv1.CertificateRequest{}, &certsv1.Issuer{}).Build()
+	}
+
+	newCertificate := func(spec certsv1.CertificateSpec) *certsv1.Certificate {
+		spec.Validity = "30d"
+		spec.SecretRef = certsv1.SecretRef{Name: "web-tls"}
+		spec.IssuerRef = &certsv1.IssuerReference{Name: "internal-ca"}
+		certificate := &certsv1.Certificate{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default", Generation: 1, UID: "web-uid"},
+			Spec:       spec,
+		}
+		Expect(validation.DefaultCertificate(context.Background(), certificate)).To(Succeed())
+		return certificate
+	}
+
+	verify := func(data map[string][]byte) *x509.Certificate {
+		issued, err := helper.ParseCertificatesPEM(data["tls.crt"])
+		Expect(err).NotTo(HaveOccurred())
+		roots, err := helper.ParseCertificatesPEM(data["ca.crt"])
+		Expect(err).NotTo(HaveOccurred())
+		pool := x509.NewCertPool()
+		pool.AddCert(roots[0])
+		_, err = issued[0].Verify(x509.VerifyOptions{Roots: pool, DNSName: "web.k8c.io"})
+		Expect(err).NotTo(HaveOccurred())
+		return issued[0]
+	}
+
+	It("should sign certificates with the CA of the Issuer", func() {
+		ctx := context.Background()
+		fakeClient := newClient()
+		certificate := newCertificate(certsv1.CertificateSpec{DNSName: "web.k8c.io"})
+		Expect(fakeClient.Create(ctx, certificate)).To(Succeed())
+		r := &CertificateReconciler{Client: fakeClient, Scheme: fakeClient.Scheme()}
+
+		data, err := r.issue(ctx, certificate)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).To(HaveKey("tls.key"))
+		Expect(helper.SpecMismatches(*certificate, verify(data))).To(BeEmpty())
+	})
+
+	It("should sign a supplied CSR without handling the private key", func() {
+		ctx := context.Background()
+		fakeClient := newClient()
+		priv, _, err := helper.GeneratePrivateKey(certsv1.Certificate{Spec: certsv1.CertificateSpec{KeySize: 2048}})
+		Expect(err).NotTo(HaveOccurred())
+		csr, err := helper.GenerateCertificateRequest(certsv1.Certificate{Spec: certsv1.CertificateSpec{DNSName: "web.k8c.io"}}, priv)
+		Expect(err).NotTo(HaveOccurred())
+
+		certificate := newCertificate(certsv1.CertificateSpec{
+			DNSName: "web.k8c.io",
+			CSR:     &certsv1.CSRSource{Request: string(csr)},
+		})
+		Expect(fakeClient.Create(ctx, certificate)).To(Succeed())
+		r := &CertificateReconciler{Client: fakeClient, Scheme: fakeClient.Scheme()}
+
+		data, err := r.issue(ctx, certificate)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data).NotTo(HaveKey("tls.key"))
+		issued := verify(data)
+		Expect(issued.PublicKey).To(Equal(priv.Public()))
+		Expect(helper.SpecMismatches(*certificate, issued)).To(BeEmpty())
+	})
+
+	It("should deny a CSR requesting names outside the spec", func() {
+		ctx := context.Background()
+		fakeClient := newClient()
+		priv, _, err := helper.GeneratePrivateKey(certsv1.Certificate{Spec: certsv1.CertificateSpec{KeySize: 2048}})
+		Expect(err).NotTo(HaveOccurred())
+		csr, err := helper.GenerateCertificateRequest(certsv1.Certificate{Spec: certsv1.CertificateSpec{DNSName: "admin.k8c.io"}}, priv)
+		Expect(err).NotTo(HaveOccurred())
+
+		certificate := newCertificate(certsv1.CertificateSpec{
+			DNSName: "web.k8c.io",
+			CSR:     &certsv1.CSRSource{Request: string(csr)},
+		})
+		Expect(fakeClient.Create(ctx, certificate)).To(Succeed())
+		r := &CertificateReconciler{Client: fakeClient, Scheme: fakeClient.Scheme()}
+
+		_, err = r.issue(ctx, certificate)
+		Expect(err).To(MatchError(errIssuanceDenied))
+		request := &certsv1.CertificateRequest{}
+		Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "web-1", Namespace: "default"}, request)).To(Succeed())
+		denied := meta.FindStatusCondition(request.Status.Conditions, certsv1.CertificateRequestDenied)
+		Expect(denied).NotTo(BeNil())
+		Expect(denied.Reason).To(Equal("InvalidRequest"))
+	})
+
+	It("should record issued certificates until they expire", func() {
+		ctx := context.Background()
+		fakeClient := newClient()
+		issuer := &certsv1.Issuer{}
+		Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "internal-ca"}, issuer)).To(Succeed())
+		record := func(serial string, notAfter time.Time) {
+			Expect(fakeClient.Create(ctx, &corev1.ConfigMap{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:            issuedCertificateName("internal-ca", serial),
+					Namespace:       "certs-system",
+					Labels:          map[string]string{issuedCertificateLabel: "true"},
+					OwnerReferences: []metav1.OwnerReference{*metav1.NewControllerRef(issuer, certsv1.GroupVersion.WithKind("Issuer"))},
+				},
+				Data: map[string]string{issuedCertificateNotAfterKey: notAfter.UTC().Format(time.RFC3339)},
+			})).To(Succeed())
+		}
+		record("1", time.Now().Add(-time.Hour))
+		record("2", time.Now().Add(time.Hour))
+
+		issued, err := issuedCertificate(ctx, fakeClient, issuer, "1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(issued).To(BeNil())
+		issued, err = issuedCertificate(ctx, fakeClient, issuer, "2")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(issued).NotTo(BeNil())
+
+		issuerReconciler := &IssuerReconciler{Client: fakeClient, Scheme: fakeClient.Scheme()}
+		_, err = issuerReconciler.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: "internal-ca"}})
+		Expect(err).NotTo(HaveOccurred())
+		records := &corev1.ConfigMapList{}
+		Expect(fakeClient.List(ctx, records, client.MatchingLabels{issuedCertificateLabel: "true"})).To(Succeed())
+		Expect(records.Items).To(ConsistOf(HaveField("Name", issuedCertificateName("internal-ca", "2"))))
+	})
+})
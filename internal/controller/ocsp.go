@@ -0,0 +1,313 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
+	"github.com/PNarode/k8c-certs-manager/internal/helper"
+)
+
+const (
+	// ocspPathPrefix is the path the OCSP responder answers the requests for the Issuers under
+	ocspPathPrefix = "/ocsp/"
+	// ocspResponseValidity is the time until the next update of an OCSP response
+	ocspResponseValidity = time.Hour
+	// ocspResponderValidity is the lifetime of the delegated responder certificates
+	ocspResponderValidity = 7 * 24 * time.Hour
+	// ocspMaxRequestSize limits the size of the OCSP requests read
+	ocspMaxRequestSize = 10 * 1024
+)
+
+// oidOCSPNoCheck marks a delegated responder certificate which is not checked for revocation (RFC 6960, 4.2.2.2.1)
+var oidOCSPNoCheck = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 5}
+
+// ocspURL returns the URL the OCSP responder answers the requests for an Issuer at
+func ocspURL(baseURL, issuer string) string {
+	return strings.TrimSuffix(baseURL, "/") + ocspPathPrefix + issuer
+}
+
+// ocspResponder is the delegated responder certificate of an Issuer
+type ocspResponder struct {
+	ca   *x509.Certificate
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+// ocspCachedResponse is a signed OCSP response and the status it was signed for
+type ocspCachedResponse struct {
+	ca        *x509.Certificate
+	status    int
+	revokedAt time.Time
+	reason    int
+	refreshAt time.Time
+	der       []byte
+}
+
+// OCSPServer is an OCSP responder (RFC 6960) for the certificates signed by the
+// Issuers of type ca, served at /ocsp/<issuer>. The responses are signed with a
+// delegated responder certificate issued by the CA of the Issuer.
+type OCSPServer struct {
+	Client client.Reader
+	// BindAddress is the address the server listens on
+	BindAddress string
+
+	mu         sync.Mutex
+	responders map[string]*ocspResponder
+	responses  map[string]*ocspCachedResponse
+}
+
+// Start serves the OCSP requests until the context is done
+func (s *OCSPServer) Start(ctx context.Context) error {
+	server := &http.Server{Addr: s.BindAddress, Handler: s, ReadHeaderTimeout: 10 * time.Second}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- server.ListenAndServe()
+	}()
+	select {
+	case <-ctx.Done():
+		return server.Shutdown(context.Background())
+	case err := <-errCh:
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+		return err
+	}
+}
+
+// NeedLeaderElection returns false as every replica answers OCSP requests
+func (s *OCSPServer) NeedLeaderElection() bool {
+	return false
+}
+
+// ServeHTTP answers the OCSP request sent with POST, or with GET as the base64
+// encoded last path segment
+func (s *OCSPServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	name, found := strings.CutPrefix(req.URL.Path, ocspPathPrefix)
+	if !found {
+		http.NotFound(w, req)
+		return
+	}
+	var der []byte
+	var err error
+	switch req.Method {
+	case http.MethodPost:
+		der, err = io.ReadAll(io.LimitReader(req.Body, ocspMaxRequestSize))
+	case http.MethodGet:
+		var encoded string
+		name, encoded, _ = strings.Cut(name, "/")
+		der, err = base64.StdEncoding.DecodeString(encoded)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	if err != nil {
+		_, _ = w.Write(ocsp.MalformedRequestErrorResponse)
+		return
+	}
+	request, err := ocsp.ParseRequest(der)
+	if err != nil {
+		_, _ = w.Write(ocsp.MalformedRequestErrorResponse)
+		return
+	}
+	response, err := s.respond(req.Context(), strings.TrimSuffix(name, "/"), request)
+	if err != nil {
+		log.FromContext(req.Context()).Error(err, "Failed to answer OCSP request", "Issuer", name)
+		_, _ = w.Write(ocsp.InternalErrorErrorResponse)
+		return
+	}
+	_, _ = w.Write(response)
+}
+
+// respond returns the signed response to an OCSP request for a certificate of an
+// Issuer, answered from the records of its issued certificates and the revoked
+// certificates of its status. Like the CRLs, a signed response is reused until
+// half of its validity elapsed, unless the status of the certificate changed.
+func (s *OCSPServer) respond(ctx context.Context, name string, request *ocsp.Request) ([]byte, error) {
+	issuer := &certsv1.Issuer{}
+	err := s.Client.Get(ctx, client.ObjectKey{Name: name}, issuer)
+	if client.IgnoreNotFound(err) != nil {
+		return nil, err
+	}
+	if err != nil || issuer.Spec.CA == nil {
+		return ocsp.UnauthorizedErrorResponse, nil
+	}
+
+	template := ocsp.Response{
+		Status:       ocsp.Unknown,
+		SerialNumber: request.SerialNumber,
+		IssuerHash:   request.HashAlgorithm,
+	}
+	serial := request.SerialNumber.Text(16)
+	issued, err := issuedCertificate(ctx, s.Client, issuer, serial)
+	if err != nil {
+		return nil, err
+	}
+	if issued != nil {
+		template.Status = ocsp.Good
+	}
+	for _, entry := range issuer.Status.RevokedCertificates {
+		if entry.SerialNumber == serial {
+			template.Status = ocsp.Revoked
+			template.RevokedAt = entry.RevokedAt.Time
+			template.RevocationReason = CRLReasonCodes[entry.Reason]
+		}
+	}
+	key := name + "/" + request.HashAlgorithm.String() + "/" + serial
+	if der := s.cachedResponse(key, request, template); der != nil {
+		return der, nil
+	}
+
+	responder, err := s.responder(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if !issuedBy(request, responder.ca) {
+		return ocsp.UnauthorizedErrorResponse, nil
+	}
+	now := time.Now()
+	template.ThisUpdate = now
+	template.NextUpdate = now.Add(ocspResponseValidity)
+	template.Certificate = responder.cert
+	der, err := ocsp.CreateResponse(responder.ca, responder.cert, template, responder.key)
+	if err != nil {
+		return nil, err
+	}
+	s.cacheResponse(key, responder.ca, template, der)
+	return der, nil
+}
+
+// cachedResponse returns the signed response cached for a request when it is not
+// due for a refresh and was signed for the current status of the certificate
+func (s *OCSPServer) cachedResponse(key string, request *ocsp.Request, template ocsp.Response) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cached := s.responses[key]
+	if cached == nil || !time.Now().Before(cached.refreshAt) || cached.status != template.Status ||
+		!cached.revokedAt.Equal(template.RevokedAt) || cached.reason != template.RevocationReason {
+		return nil
+	}
+	if !issuedBy(request, cached.ca) {
+		return nil
+	}
+	return cached.der
+}
+
+// cacheResponse caches a signed response and drops the responses due for a refresh
+func (s *OCSPServer) cacheResponse(key string, ca *x509.Certificate, response ocsp.Response, der []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for cachedKey, cached := range s.responses {
+		if !now.Before(cached.refreshAt) {
+			delete(s.responses, cachedKey)
+		}
+	}
+	if s.responses == nil {
+		s.responses = map[string]*ocspCachedResponse{}
+	}
+	s.responses[key] = &ocspCachedResponse{
+		ca:        ca,
+		status:    response.Status,
+		revokedAt: response.RevokedAt,
+		reason:    response.RevocationReason,
+		refreshAt: response.ThisUpdate.Add(ocspResponseValidity / 2),
+		der:       der,
+	}
+}
+
+// issuedBy reports whether an OCSP request is for a certificate of the CA
+func issuedBy(request *ocsp.Request, ca *x509.Certificate) bool {
+	if !request.HashAlgorithm.Available() {
+		return false
+	}
+	var publicKeyInfo struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(ca.RawSubjectPublicKeyInfo, &publicKeyInfo); err != nil {
+		return false
+	}
+	nameHash := request.HashAlgorithm.New()
+	nameHash.Write(ca.RawSubject)
+	keyHash := request.HashAlgorithm.New()
+	keyHash.Write(publicKeyInfo.PublicKey.RightAlign())
+	return bytes.Equal(nameHash.Sum(nil), request.IssuerNameHash) && bytes.Equal(keyHash.Sum(nil), request.IssuerKeyHash)
+}
+
+// responder returns the delegated responder certificate of an Issuer, issuing a
+// new one when the CA changed or a third of its lifetime is left
+func (s *OCSPServer) responder(ctx context.Context, name string) (*ocspResponder, error) {
+	ca, err := loadIssuerCA(ctx, s.Client, name)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	current := s.responders[name]
+	if current != nil && current.ca.Equal(ca.cert) && time.Until(current.cert.NotAfter) > ocspResponderValidity/3 {
+		return current, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		Subject:         pkix.Name{CommonName: name + " OCSP responder"},
+		NotBefore:       now.Add(-5 * time.Minute),
+		NotAfter:        now.Add(ocspResponderValidity),
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:     []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning},
+		ExtraExtensions: []pkix.Extension{{Id: oidOCSPNoCheck, Value: asn1.NullBytes}},
+	}
+	certPEM, err := helper.SignWithCA(template, key.Public(), ca.cert, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	chain, err := helper.ParseCertificatesPEM(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	if s.responders == nil {
+		s.responders = map[string]*ocspResponder{}
+	}
+	s.responders[name] = &ocspResponder{ca: ca.cert, cert: chain[0], key: key}
+	return s.responders[name], nil
+}
@@ -0,0 +1,155 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"golang.org/x/crypto/ocsp"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
+	"github.com/PNarode/k8c-certs-manager/internal/helper"
+	"github.com/PNarode/k8c-certs-manager/internal/validation"
+)
+
+var _ = Describe("OCSP responder", func() {
+	It("should answer good, revoked and unknown for the certificates of a CA issuer", func() {
+		ctx := context.Background()
+		scheme := runtime.NewScheme()
+		utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+		utilruntime.Must(certsv1.AddToScheme(scheme))
+		ca := certsv1.Certificate{Spec: certsv1.CertificateSpec{
+			DNSName: "ca.k8c.io", Validity: "1y", IsCA: true, SecretRef: certsv1.SecretRef{Name: "ca-tls"},
+		}}
+		Expect(validation.DefaultCertificate(ctx, &ca)).To(Succeed())
+		caPEM, caKey, err := helper.GenerateSelfSignedCertificate(ca)
+		Expect(err).NotTo(HaveOccurred())
+		caChain, err := helper.ParseCertificatesPEM(caPEM)
+		Expect(err).NotTo(HaveOccurred())
+		certificate := &certsv1.Certificate{
+			ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+			Spec: certsv1.CertificateSpec{
+				DNSName:   "web.k8c.io",
+				Validity:  "30d",
+				SecretRef: certsv1.SecretRef{Name: "web-tls"},
+				IssuerRef: &certsv1.IssuerReference{Name: "internal-ca"},
+			},
+		}
+		Expect(validation.DefaultCertificate(ctx, certificate)).To(Succeed())
+		fakeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}},
+			&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "ca-tls", Namespace: "certs-system"},
+				Data:       helper.SecretData(caPEM, caKey),
+			},
+			&certsv1.Issuer{
+				ObjectMeta: metav1.ObjectMeta{Name: "internal-ca"},
+				Spec: certsv1.IssuerSpec{CA: &certsv1.CAIssuer{
+					SecretRef: certsv1.SecretReference{Name: "ca-tls", Namespace: "certs-system"},
+				}},
+			},
+			certificate,
+		).WithStatusSubresource(&certsv1.Certificate{}, &certsv1.CertificateRequest{}, &certsv1.Issuer{}).Build()
+		r := &CertificateReconciler{Client: fakeClient, Scheme: scheme, OCSPBaseURL: "http://ocsp.k8c.io/"}
+		certificateRequest := ctrl.Request{NamespacedName: types.NamespacedName{Name: "web", Namespace: "default"}}
+		server := httptest.NewServer(&OCSPServer{Client: fakeClient})
+		defer server.Close()
+
+		query := func(leaf *x509.Certificate, get bool) *ocsp.Response {
+			der, err := ocsp.CreateRequest(leaf, caChain[0], nil)
+			Expect(err).NotTo(HaveOccurred())
+			var resp *http.Response
+			if get {
+				resp, err = http.Get(server.URL + "/ocsp/internal-ca/" + base64.StdEncoding.EncodeToString(der))
+			} else {
+				resp, err = http.Post(server.URL+"/ocsp/internal-ca", "application/ocsp-request", bytes.NewReader(der))
+			}
+			Expect(err).NotTo(HaveOccurred())
+			defer resp.Body.Close()
+			Expect(resp.Header.Get("Content-Type")).To(Equal("application/ocsp-response"))
+			body, err := io.ReadAll(resp.Body)
+			Expect(err).NotTo(HaveOccurred())
+			response, err := ocsp.ParseResponseForCert(body, leaf, caChain[0])
+			Expect(err).NotTo(HaveOccurred())
+			Expect(response.Certificate.ExtKeyUsage).To(ConsistOf(x509.ExtKeyUsageOCSPSigning))
+			return response
+		}
+
+		By("issuing a certificate pointing to the OCSP responder of its issuer")
+		_, err = r.Reconcile(ctx, certificateRequest)
+		Expect(err).NotTo(HaveOccurred())
+		secret := &corev1.Secret{}
+		Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "web-tls", Namespace: "default"}, secret)).To(Succeed())
+		chain, err := helper.ParseCertificatesPEM(secret.Data["tls.crt"])
+		Expect(err).NotTo(HaveOccurred())
+		leaf := chain[0]
+		Expect(leaf.OCSPServer).To(Equal([]string{"http://ocsp.k8c.io/ocsp/internal-ca"}))
+		issued := &corev1.ConfigMap{}
+		Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "internal-ca-issued-" + serialNumber(leaf), Namespace: "certs-system"}, issued)).To(Succeed())
+		Expect(issued.Data).To(HaveKeyWithValue(issuedCertificateCertificateKey, "default/web"))
+
+		By("answering good for the issued certificate")
+		good := query(leaf, false)
+		Expect(good.Status).To(Equal(ocsp.Good))
+		Expect(query(leaf, true).Status).To(Equal(ocsp.Good))
+
+		By("reusing the signed response")
+		Expect(query(leaf, true).Signature).To(Equal(good.Signature))
+
+		By("answering unknown for serial numbers the issuer did not record")
+		unknown := *leaf
+		unknown.SerialNumber = big.NewInt(42)
+		Expect(query(&unknown, false).Status).To(Equal(ocsp.Unknown))
+
+		By("answering revoked with the reason once revoked")
+		Expect(fakeClient.Get(ctx, certificateRequest.NamespacedName, certificate)).To(Succeed())
+		certificate.Annotations[certsv1.RevokeAnnotation] = "keyCompromise"
+		Expect(fakeClient.Update(ctx, certificate)).To(Succeed())
+		_, err = r.Reconcile(ctx, certificateRequest)
+		Expect(err).NotTo(HaveOccurred())
+		response := query(leaf, false)
+		Expect(response.Status).To(Equal(ocsp.Revoked))
+		Expect(response.RevocationReason).To(Equal(ocsp.KeyCompromise))
+
+		By("refusing requests for unknown issuers")
+		der, err := ocsp.CreateRequest(leaf, caChain[0], nil)
+		Expect(err).NotTo(HaveOccurred())
+		resp, err := http.Post(server.URL+"/ocsp/unknown", "application/ocsp-request", bytes.NewReader(der))
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(body).To(Equal(ocsp.UnauthorizedErrorResponse))
+	})
+})
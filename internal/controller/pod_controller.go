@@ -0,0 +1,217 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
+)
+
+// DefaultClusterDomain is the DNS domain of the cluster
+const DefaultClusterDomain = "cluster.local"
+
+// PodReconciler creates the Certificates of the Pods annotated with
+// certs.k8c.io/inject in the namespaces labeled certs.k8c.io/pod-injection=enabled
+type PodReconciler struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+	// ClusterDomain is the DNS domain of the cluster, defaults to cluster.local
+	ClusterDomain string
+}
+
+// +kubebuilder:rbac:groups="",resources=pods,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=services,verbs=get;list;watch
+
+// Reconcile creates or updates the Certificate owned by an injected Pod, named
+// after its certs.k8c.io/inject-secret-name annotation. The Certificate is
+// deleted once the Pod terminated, and garbage collected with the Pod. Like any
+// other Certificate it is subject to the certificate policies and approval.
+func (r *PodReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+	pod := &corev1.Pod{}
+	err := r.Get(ctx, req.NamespacedName, pod)
+	if err != nil {
+		// Owned Certificates are garbage collected with the Pod
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	desired := map[string]certsv1.CertificateSpec{}
+	secretName := pod.Annotations[InjectSecretAnnotation]
+	terminated := pod.DeletionTimestamp != nil || pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed
+	if pod.Annotations[InjectAnnotation] == "true" && !terminated {
+		if secretName == "" {
+			logger.Info("Reconcile Event: Skipping Pod not mutated by the injection webhook")
+			return ctrl.Result{}, nil
+		}
+		// The annotations of a Pod can be set without the webhook
+		namespace := &corev1.Namespace{}
+		err = r.Get(ctx, types.NamespacedName{Name: pod.Namespace}, namespace)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if namespace.Labels[PodInjectionLabel] != "enabled" {
+			logger.Info("Reconcile Event: Skipping Pod of a namespace without certificate injection")
+			r.Recorder.Eventf(pod, corev1.EventTypeWarning, "InjectionDisabled", "Namespace %s is not labeled %s=enabled", pod.Namespace, PodInjectionLabel)
+			return ctrl.Result{}, nil
+		}
+		hosts, err := r.podDNSNames(ctx, pod)
+		if err != nil {
+			logger.Error(err, "Reconcile Event: Failed to list Pod services")
+			return ctrl.Result{}, err
+		}
+		spec := shimCertificateSpec(pod, hosts, secretName)
+		if issuer := pod.Annotations[InjectIssuerAnnotation]; issuer != "" {
+			granted, err := issuerGrantedByPolicy(ctx, r.Client, pod.Namespace, issuer)
+			if err != nil {
+				return ctrl.Result{}, err
+			}
+			if !granted {
+				// The current Certificate is kept until the annotation is fixed
+				logger.Info("Reconcile Event: Pod certificate issuer not granted by a policy", "Issuer", issuer)
+				r.Recorder.Eventf(pod, corev1.EventTypeWarning, "IssuerNotAllowed",
+					"Issuer %s is not listed in the allowedIssuers of a certificate policy of the namespace", issuer)
+				return ctrl.Result{}, nil
+			}
+			spec.IssuerRef = &certsv1.IssuerReference{Name: issuer}
+		}
+		desired[secretName] = spec
+	}
+
+	for name, spec := range desired {
+		err = applyOwnedCertificate(ctx, r.Client, r.Scheme, r.Recorder, pod, name, spec)
+		if err != nil {
+			logger.Error(err, "Reconcile Event: Failed to apply Pod certificate", "Certificate", name)
+			return ctrl.Result{}, err
+		}
+	}
+
+	err = deleteStaleCertificates(ctx, r.Client, pod, desired)
+	if err != nil {
+		logger.Error(err, "Reconcile Event: Failed to delete stale Pod certificates")
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, nil
+}
+
+// podDNSNames returns the DNS names of a Pod: the names of its
+// certs.k8c.io/inject-dns-names annotation, the names of the Services selecting
+// it and the name of its ServiceAccount, <serviceaccount>.<namespace>.serviceaccount.<cluster-domain>.
+// The annotated names are checked by the certificate policies like the names of
+// any other Certificate.
+func (r *PodReconciler) podDNSNames(ctx context.Context, pod *corev1.Pod) ([]string, error) {
+	var hosts []string
+	for _, name := range strings.Split(pod.Annotations[InjectDNSNamesAnnotation], ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			hosts = append(hosts, name)
+		}
+	}
+
+	services := &corev1.ServiceList{}
+	err := r.List(ctx, services, client.InNamespace(pod.Namespace))
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(services.Items, func(i, j int) bool { return services.Items[i].Name < services.Items[j].Name })
+	for _, service := range services.Items {
+		if len(service.Spec.Selector) == 0 || !labels.SelectorFromSet(service.Spec.Selector).Matches(labels.Set(pod.Labels)) {
+			continue
+		}
+		hosts = append(hosts, serviceDNSNames(service.Name, pod.Namespace, r.clusterDomain())...)
+	}
+
+	serviceAccount := pod.Spec.ServiceAccountName
+	if serviceAccount == "" {
+		serviceAccount = "default"
+	}
+	hosts = append(hosts, serviceAccount+"."+pod.Namespace+".serviceaccount."+r.clusterDomain())
+
+	unique := []string{}
+	for _, host := range hosts {
+		if !slices.Contains(unique, host) {
+			unique = append(unique, host)
+		}
+	}
+	return unique, nil
+}
+
+func (r *PodReconciler) clusterDomain() string {
+	if r.ClusterDomain == "" {
+		return DefaultClusterDomain
+	}
+	return r.ClusterDomain
+}
+
+// serviceDNSNames returns the names a Service is resolved by inside the cluster
+func serviceDNSNames(service, namespace, clusterDomain string) []string {
+	return []string{
+		service,
+		service + "." + namespace,
+		service + "." + namespace + ".svc",
+		service + "." + namespace + ".svc." + clusterDomain,
+	}
+}
+
+// podsOfService maps a Service to the injected Pods it selects
+func (r *PodReconciler) podsOfService(ctx context.Context, obj client.Object) []reconcile.Request {
+	service, ok := obj.(*corev1.Service)
+	if !ok || len(service.Spec.Selector) == 0 {
+		return nil
+	}
+	pods := &corev1.PodList{}
+	err := r.List(ctx, pods, client.InNamespace(service.Namespace), client.MatchingLabels(service.Spec.Selector))
+	if err != nil {
+		log.FromContext(ctx).Error(err, "Reconcile Event: Failed to list pods")
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, pod := range pods.Items {
+		if pod.Annotations[InjectAnnotation] == "true" {
+			requests = append(requests, reconcile.Request{NamespacedName: types.NamespacedName{Name: pod.Name, Namespace: pod.Namespace}})
+		}
+	}
+	return requests
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *PodReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	injected := predicate.NewPredicateFuncs(func(obj client.Object) bool {
+		return obj.GetAnnotations()[InjectAnnotation] == "true"
+	})
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&corev1.Pod{}, builder.WithPredicates(injected)).
+		Owns(&certsv1.Certificate{}).
+		Watches(&corev1.Service{}, handler.EnqueueRequestsFromMapFunc(r.podsOfService)).
+		Complete(r)
+}
@@ -0,0 +1,183 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
+)
+
+var _ = Describe("Pod certificate injection", func() {
+	newPod := func() *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				GenerateName: "web-7d9f-",
+				Namespace:    "shop",
+				Labels:       map[string]string{"app": "web"},
+				Annotations: map[string]string{
+					InjectAnnotation:         "true",
+					InjectDNSNamesAnnotation: "web.k8c.io, ",
+					InjectIssuerAnnotation:   "internal-ca",
+				},
+			},
+			Spec: corev1.PodSpec{
+				ServiceAccountName: "web",
+				InitContainers:     []corev1.Container{{Name: "init"}},
+				Containers:         []corev1.Container{{Name: "web"}, {Name: "sidecar"}},
+			},
+		}
+	}
+
+	It("should mount the Secret of the Pod certificate", func() {
+		pod := newPod()
+		Expect((&PodInjector{}).Default(context.Background(), pod)).To(Succeed())
+		secretName := pod.Annotations[InjectSecretAnnotation]
+		Expect(secretName).To(MatchRegexp(`^web-7d9f-[a-z0-9]{5}-tls$`))
+		Expect(pod.Spec.Volumes).To(ConsistOf(corev1.Volume{
+			Name:         injectVolumeName,
+			VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: secretName}},
+		}))
+		for _, container := range append(pod.Spec.InitContainers, pod.Spec.Containers...) {
+			Expect(container.VolumeMounts).To(ConsistOf(corev1.VolumeMount{Name: injectVolumeName, MountPath: InjectMountPath, ReadOnly: true}))
+		}
+
+		By("keeping the volume and mounts when mutated again")
+		Expect((&PodInjector{}).Default(context.Background(), pod)).To(Succeed())
+		Expect(pod.Annotations[InjectSecretAnnotation]).To(Equal(secretName))
+		Expect(pod.Spec.Volumes).To(HaveLen(1))
+		Expect(pod.Spec.Containers[0].VolumeMounts).To(HaveLen(1))
+
+		By("ignoring Pods which are not annotated")
+		other := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "other"}, Spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "other"}}}}
+		Expect((&PodInjector{}).Default(context.Background(), other)).To(Succeed())
+		Expect(other.Spec.Volumes).To(BeEmpty())
+	})
+
+	It("should create the Pod certificate for its Services and ServiceAccount and delete it once terminated", func() {
+		ctx := context.Background()
+		scheme := runtime.NewScheme()
+		utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+		utilruntime.Must(certsv1.AddToScheme(scheme))
+		pod := newPod()
+		pod.Name = "web-7d9f-x8k2p"
+		pod.UID = "web-uid"
+		Expect((&PodInjector{}).Default(ctx, pod)).To(Succeed())
+		Expect(pod.Annotations[InjectSecretAnnotation]).To(Equal("web-7d9f-x8k2p-tls"))
+		fakeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "shop", Labels: map[string]string{PodInjectionLabel: "enabled"}}},
+			&certsv1.CertificatePolicy{
+				ObjectMeta: metav1.ObjectMeta{Name: "internal", Namespace: "shop"},
+				Spec:       certsv1.CertificatePolicySpec{AllowedIssuers: []string{"internal-*"}},
+			},
+			pod,
+			&corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "shop"},
+				Spec:       corev1.ServiceSpec{Selector: map[string]string{"app": "web"}},
+			},
+			&corev1.Service{
+				ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "shop"},
+				Spec:       corev1.ServiceSpec{Selector: map[string]string{"app": "api"}},
+			},
+		).WithStatusSubresource(&corev1.Pod{}).Build()
+		r := &PodReconciler{Client: fakeClient, Scheme: scheme, Recorder: record.NewFakeRecorder(10), ClusterDomain: "k8c.local"}
+		request := ctrl.Request{NamespacedName: types.NamespacedName{Name: "web-7d9f-x8k2p", Namespace: "shop"}}
+
+		_, err := r.Reconcile(ctx, request)
+		Expect(err).NotTo(HaveOccurred())
+		certificate := &certsv1.Certificate{}
+		key := types.NamespacedName{Name: "web-7d9f-x8k2p-tls", Namespace: "shop"}
+		Expect(fakeClient.Get(ctx, key, certificate)).To(Succeed())
+		Expect(certificate.Spec.DNSName).To(Equal("web.k8c.io"))
+		Expect(certificate.Spec.DNSNames).To(Equal([]string{
+			"web", "web.shop", "web.shop.svc", "web.shop.svc.k8c.local", "web.shop.serviceaccount.k8c.local",
+		}))
+		Expect(certificate.Spec.SecretRef.Name).To(Equal("web-7d9f-x8k2p-tls"))
+		Expect(certificate.Spec.IssuerRef).To(Equal(&certsv1.IssuerReference{Name: "internal-ca"}))
+		Expect(metav1.IsControlledBy(certificate, pod)).To(BeTrue())
+
+		By("enqueueing the Pod for the Services selecting it")
+		service := &corev1.Service{}
+		Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "web", Namespace: "shop"}, service)).To(Succeed())
+		Expect(r.podsOfService(ctx, service)).To(ConsistOf(request))
+
+		By("deleting the certificate once the Pod terminated")
+		Expect(fakeClient.Get(ctx, request.NamespacedName, pod)).To(Succeed())
+		pod.Status.Phase = corev1.PodSucceeded
+		Expect(fakeClient.Status().Update(ctx, pod)).To(Succeed())
+		_, err = r.Reconcile(ctx, request)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(errors.IsNotFound(fakeClient.Get(ctx, key, certificate))).To(BeTrue())
+	})
+
+	It("should only create Pod certificates in the namespaces opted into the injection", func() {
+		ctx := context.Background()
+		scheme := runtime.NewScheme()
+		utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+		utilruntime.Must(certsv1.AddToScheme(scheme))
+		pod := newPod()
+		pod.Name = "web-7d9f-x8k2p"
+		pod.Annotations[InjectSecretAnnotation] = "web-7d9f-x8k2p-tls"
+		fakeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "shop"}},
+			pod,
+		).Build()
+		recorder := record.NewFakeRecorder(10)
+		r := &PodReconciler{Client: fakeClient, Scheme: scheme, Recorder: recorder}
+
+		_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: "web-7d9f-x8k2p", Namespace: "shop"}})
+		Expect(err).NotTo(HaveOccurred())
+		err = fakeClient.Get(ctx, types.NamespacedName{Name: "web-7d9f-x8k2p-tls", Namespace: "shop"}, &certsv1.Certificate{})
+		Expect(errors.IsNotFound(err)).To(BeTrue())
+		Expect(recorder.Events).To(Receive(HavePrefix("Warning InjectionDisabled")))
+	})
+
+	It("should only sign Pod certificates with an Issuer granted by a policy", func() {
+		ctx := context.Background()
+		scheme := runtime.NewScheme()
+		utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+		utilruntime.Must(certsv1.AddToScheme(scheme))
+		pod := newPod()
+		pod.Name = "web-7d9f-x8k2p"
+		pod.Annotations[InjectSecretAnnotation] = "web-7d9f-x8k2p-tls"
+		fakeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "shop", Labels: map[string]string{PodInjectionLabel: "enabled"}}},
+			pod,
+		).Build()
+		recorder := record.NewFakeRecorder(10)
+		r := &PodReconciler{Client: fakeClient, Scheme: scheme, Recorder: recorder}
+
+		_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: "web-7d9f-x8k2p", Namespace: "shop"}})
+		Expect(err).NotTo(HaveOccurred())
+		err = fakeClient.Get(ctx, types.NamespacedName{Name: "web-7d9f-x8k2p-tls", Namespace: "shop"}, &certsv1.Certificate{})
+		Expect(errors.IsNotFound(err)).To(BeTrue())
+		Expect(recorder.Events).To(Receive(HavePrefix("Warning IssuerNotAllowed")))
+	})
+})
@@ -0,0 +1,113 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilrand "k8s.io/apimachinery/pkg/util/rand"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// Only the Pods of the namespaces labeled certs.k8c.io/pod-injection=enabled are
+// sent to this webhook, see config/webhook/pod_webhook_patch.yaml. It fails open
+// so that an unavailable manager does not block the Pods of these namespaces.
+// +kubebuilder:webhook:path=/mutate--v1-pod,mutating=true,failurePolicy=ignore,sideEffects=None,groups="",resources=pods,verbs=create,versions=v1,name=mpod.kb.io,admissionReviewVersions=v1
+
+const (
+	// InjectAnnotation opts a Pod into getting a Certificate mounted
+	InjectAnnotation = "certs.k8c.io/inject"
+	// InjectDNSNamesAnnotation lists additional comma separated DNS names of the
+	// Certificate of a Pod
+	InjectDNSNamesAnnotation = "certs.k8c.io/inject-dns-names"
+	// PodInjectionLabel opts the Pods of a namespace into the injection when set
+	// to enabled on the namespace
+	PodInjectionLabel = "certs.k8c.io/pod-injection"
+	// InjectIssuerAnnotation names the Issuer signing the Certificate of a Pod
+	InjectIssuerAnnotation = "certs.k8c.io/inject-issuer"
+	// InjectSecretAnnotation names the Certificate and Secret of a Pod. It is set
+	// by the webhook unless given.
+	InjectSecretAnnotation = "certs.k8c.io/inject-secret-name"
+	// InjectMountPath is the directory the Secret of a Pod is mounted at
+	InjectMountPath = "/var/run/secrets/certs.k8c.io"
+	// injectVolumeName is the name of the volume of the Secret of a Pod
+	injectVolumeName = "certs-k8c-io-tls"
+)
+
+// PodInjector mounts the Secret of a Certificate into the containers of Pods
+// annotated with certs.k8c.io/inject in the namespaces opted into the injection.
+// The Certificate is created by the PodReconciler once the Pod exists.
+type PodInjector struct{}
+
+func (i *PodInjector) Default(ctx context.Context, obj runtime.Object) error {
+	log := logf.FromContext(ctx)
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		return fmt.Errorf("expected a Pod but got a %T", obj)
+	}
+	if pod.Annotations[InjectAnnotation] != "true" {
+		return nil
+	}
+
+	secretName := pod.Annotations[InjectSecretAnnotation]
+	if secretName == "" {
+		// The name of Pods created with generateName is not known yet
+		secretName = pod.Name + "-tls"
+		if pod.Name == "" {
+			secretName = pod.GenerateName + utilrand.String(5) + "-tls"
+		}
+		pod.Annotations[InjectSecretAnnotation] = secretName
+	}
+	injectVolume(pod, secretName)
+	log.Info("Mounted Pod certificate", "Secret", secretName)
+	return nil
+}
+
+// injectVolume adds the volume of the Secret and mounts it read only into every
+// container of the Pod, keeping volumes and mounts already present
+func injectVolume(pod *corev1.Pod, secretName string) {
+	found := false
+	for _, volume := range pod.Spec.Volumes {
+		found = found || volume.Name == injectVolumeName
+	}
+	if !found {
+		pod.Spec.Volumes = append(pod.Spec.Volumes, corev1.Volume{
+			Name:         injectVolumeName,
+			VolumeSource: corev1.VolumeSource{Secret: &corev1.SecretVolumeSource{SecretName: secretName}},
+		})
+	}
+	mount := func(containers []corev1.Container) {
+		for i := range containers {
+			mounted := false
+			for _, volumeMount := range containers[i].VolumeMounts {
+				mounted = mounted || volumeMount.Name == injectVolumeName || volumeMount.MountPath == InjectMountPath
+			}
+			if !mounted {
+				containers[i].VolumeMounts = append(containers[i].VolumeMounts, corev1.VolumeMount{
+					Name:      injectVolumeName,
+					MountPath: InjectMountPath,
+					ReadOnly:  true,
+				})
+			}
+		}
+	}
+	mount(pod.Spec.InitContainers)
+	mount(pod.Spec.Containers)
+}
@@ -0,0 +1,238 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"slices"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
+	"github.com/PNarode/k8c-certs-manager/internal/helper"
+)
+
+const (
+	// RestartOnRenewAnnotation names the Certificate, in the namespace of the
+	// annotated Deployment, StatefulSet or DaemonSet, whose renewals restart its pods
+	RestartOnRenewAnnotation = "certs.k8c.io/restart-on-renew"
+	// RolloutLabel has to be set to enabled on the workloads annotated with
+	// certs.k8c.io/restart-on-renew. Only these workloads are cached by the
+	// manager, the Certificate is named by the annotation as label values are
+	// limited to 63 characters.
+	RolloutLabel = "certs.k8c.io/rollout"
+	// CertificateFingerprintAnnotation records in a pod template the SHA-256
+	// fingerprint of the certificate the pods were started with. On the workload
+	// itself it records the fingerprint current when the annotation was added,
+	// which does not restart the pods.
+	CertificateFingerprintAnnotation = "certs.k8c.io/certificate-fingerprint"
+)
+
+// RolloutCacheOptions restricts the cache of the manager to the Deployments,
+// StatefulSets and DaemonSets labeled with certs.k8c.io/rollout=enabled
+func RolloutCacheOptions() map[client.Object]cache.ByObject {
+	selector := cache.ByObject{Label: labels.SelectorFromSet(labels.Set{RolloutLabel: "enabled"})}
+	return map[client.Object]cache.ByObject{
+		&appsv1.Deployment{}:  selector,
+		&appsv1.StatefulSet{}: selector,
+		&appsv1.DaemonSet{}:   selector,
+	}
+}
+
+// RolloutReconciler restarts the workloads consuming a Certificate once it is
+// renewed, by updating an annotation of their pod template
+type RolloutReconciler struct {
+	client.Client
+}
+
+// +kubebuilder:rbac:groups=apps,resources=deployments;statefulsets;daemonsets,verbs=get;list;watch;patch
+// +kubebuilder:rbac:groups=certs.k8c.io,resources=certificates/status,verbs=get;update;patch
+
+// Reconcile sets the certs.k8c.io/certificate-fingerprint pod template annotation
+// of the workloads annotated with certs.k8c.io/restart-on-renew to the fingerprint
+// of the current certificate, which rolls out new pods whenever it changes. Newly
+// annotated workloads only record the current fingerprint and are restarted on the
+// next renewal. The restarted workloads are listed in the status of the Certificate.
+func (r *RolloutReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+	certificate := &certsv1.Certificate{}
+	err := r.Get(ctx, req.NamespacedName, certificate)
+	if err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	workloads, err := r.workloadsOf(ctx, req.NamespacedName)
+	if err != nil {
+		logger.Error(err, "Reconcile Event: Failed to list workloads")
+		return ctrl.Result{}, err
+	}
+	secret := &corev1.Secret{}
+	err = r.Get(ctx, types.NamespacedName{Name: certificate.Spec.SecretRef.Name, Namespace: certificate.Namespace}, secret)
+	if client.IgnoreNotFound(err) != nil {
+		return ctrl.Result{}, err
+	}
+	chain, err := helper.ParseCertificatesPEM(secret.Data["tls.crt"])
+	if err != nil || len(chain) == 0 {
+		// The workloads are restarted once the certificate is issued
+		return ctrl.Result{}, nil
+	}
+	sum := sha256.Sum256(chain[0].Raw)
+	fingerprint := hex.EncodeToString(sum[:])
+
+	restarted := []certsv1.RestartedWorkload{}
+	for _, workload := range workloads {
+		kind := workloadKind(workload)
+		entry := certsv1.RestartedWorkload{Kind: kind, Name: workload.GetName()}
+		if i := slices.IndexFunc(certificate.Status.RestartedWorkloads, func(w certsv1.RestartedWorkload) bool {
+			return w.Kind == kind && w.Name == workload.GetName()
+		}); i >= 0 {
+			entry = certificate.Status.RestartedWorkloads[i]
+		}
+		template := podTemplateOf(workload)
+		current := template.Annotations[CertificateFingerprintAnnotation]
+		if current == "" {
+			current = workload.GetAnnotations()[CertificateFingerprintAnnotation]
+		}
+		switch {
+		case current == "":
+			// The pods of a newly annotated workload already run with the current certificate
+			patch := client.MergeFrom(workload.DeepCopyObject().(client.Object))
+			annotations := workload.GetAnnotations()
+			if annotations == nil {
+				annotations = map[string]string{}
+			}
+			annotations[CertificateFingerprintAnnotation] = fingerprint
+			workload.SetAnnotations(annotations)
+			err = r.Patch(ctx, workload, patch)
+			if err != nil {
+				logger.Error(err, "Reconcile Event: Failed to record the certificate fingerprint", "Kind", kind, "Name", workload.GetName())
+				return ctrl.Result{}, err
+			}
+		case current != fingerprint:
+			patch := client.MergeFrom(workload.DeepCopyObject().(client.Object))
+			if template.Annotations == nil {
+				template.Annotations = map[string]string{}
+			}
+			template.Annotations[CertificateFingerprintAnnotation] = fingerprint
+			err = r.Patch(ctx, workload, patch)
+			if err != nil {
+				logger.Error(err, "Reconcile Event: Failed to restart workload", "Kind", kind, "Name", workload.GetName())
+				return ctrl.Result{}, err
+			}
+			entry.Fingerprint = fingerprint
+			entry.RestartedAt = metav1.NewTime(time.Now())
+			logger.Info("Reconcile Event: Workload restarted for the renewed certificate", "Kind", kind, "Name", workload.GetName())
+		}
+		if entry.Fingerprint != "" {
+			restarted = append(restarted, entry)
+		}
+	}
+
+	if len(restarted) == 0 && len(certificate.Status.RestartedWorkloads) == 0 || slices.Equal(restarted, certificate.Status.RestartedWorkloads) {
+		return ctrl.Result{}, nil
+	}
+	certificate.Status.RestartedWorkloads = restarted
+	return ctrl.Result{}, r.Status().Update(ctx, certificate)
+}
+
+// workloadsOf returns the Deployments, StatefulSets and DaemonSets restarted on
+// the renewals of a Certificate
+func (r *RolloutReconciler) workloadsOf(ctx context.Context, certificate types.NamespacedName) ([]client.Object, error) {
+	deployments := &appsv1.DeploymentList{}
+	statefulSets := &appsv1.StatefulSetList{}
+	daemonSets := &appsv1.DaemonSetList{}
+	for _, list := range []client.ObjectList{deployments, statefulSets, daemonSets} {
+		err := r.List(ctx, list, client.InNamespace(certificate.Namespace), client.MatchingLabels{RolloutLabel: "enabled"})
+		if err != nil {
+			return nil, err
+		}
+	}
+	var candidates []client.Object
+	for i := range deployments.Items {
+		candidates = append(candidates, &deployments.Items[i])
+	}
+	for i := range statefulSets.Items {
+		candidates = append(candidates, &statefulSets.Items[i])
+	}
+	for i := range daemonSets.Items {
+		candidates = append(candidates, &daemonSets.Items[i])
+	}
+	var workloads []client.Object
+	for _, workload := range candidates {
+		if workload.GetAnnotations()[RestartOnRenewAnnotation] == certificate.Name {
+			workloads = append(workloads, workload)
+		}
+	}
+	return workloads, nil
+}
+
+// workloadKind returns the kind of a workload
+func workloadKind(workload client.Object) string {
+	switch workload.(type) {
+	case *appsv1.Deployment:
+		return "Deployment"
+	case *appsv1.StatefulSet:
+		return "StatefulSet"
+	}
+	return "DaemonSet"
+}
+
+// podTemplateOf returns the pod template of a workload
+func podTemplateOf(workload client.Object) *corev1.PodTemplateSpec {
+	switch workload := workload.(type) {
+	case *appsv1.Deployment:
+		return &workload.Spec.Template
+	case *appsv1.StatefulSet:
+		return &workload.Spec.Template
+	case *appsv1.DaemonSet:
+		return &workload.Spec.Template
+	}
+	return nil
+}
+
+// certificateOfWorkload maps an annotated workload to the Certificate restarting it
+func certificateOfWorkload(_ context.Context, obj client.Object) []reconcile.Request {
+	name := obj.GetAnnotations()[RestartOnRenewAnnotation]
+	if name == "" {
+		return nil
+	}
+	return []reconcile.Request{{NamespacedName: types.NamespacedName{Name: name, Namespace: obj.GetNamespace()}}}
+}
+
+// SetupWithManager sets up the controller with the Manager. Renewals are picked up
+// from the status update of the Certificate which follows the write of its Secret.
+func (r *RolloutReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		Named("rollout").
+		For(&certsv1.Certificate{}).
+		Watches(&appsv1.Deployment{}, handler.EnqueueRequestsFromMapFunc(certificateOfWorkload)).
+		Watches(&appsv1.StatefulSet{}, handler.EnqueueRequestsFromMapFunc(certificateOfWorkload)).
+		Watches(&appsv1.DaemonSet{}, handler.EnqueueRequestsFromMapFunc(certificateOfWorkload)).
+		Complete(r)
+}
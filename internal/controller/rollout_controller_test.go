@@ -0,0 +1,142 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
+	"github.com/PNarode/k8c-certs-manager/internal/helper"
+	"github.com/PNarode/k8c-certs-manager/internal/validation"
+)
+
+var _ = Describe("Rollout Controller", func() {
+	It("should restart annotated workloads when the certificate is renewed", func() {
+		ctx := context.Background()
+		scheme := runtime.NewScheme()
+		utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+		utilruntime.Must(certsv1.AddToScheme(scheme))
+		certificate := certsv1.Certificate{
+			ObjectMeta: metav1.ObjectMeta{Name: "web-tls", Namespace: "shop"},
+			Spec: certsv1.CertificateSpec{
+				DNSName: "web.k8c.io", Validity: "30d", SecretRef: certsv1.SecretRef{Name: "web-tls"},
+			},
+		}
+		Expect(validation.DefaultCertificate(ctx, &certificate)).To(Succeed())
+		issue := func() (map[string][]byte, string) {
+			certPEM, keyPEM, err := helper.GenerateSelfSignedCertificate(certificate)
+			Expect(err).NotTo(HaveOccurred())
+			chain, err := helper.ParseCertificatesPEM(certPEM)
+			Expect(err).NotTo(HaveOccurred())
+			sum := sha256.Sum256(chain[0].Raw)
+			return helper.SecretData(certPEM, keyPEM), hex.EncodeToString(sum[:])
+		}
+		data, fingerprint := issue()
+		deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{
+			Name: "web", Namespace: "shop",
+			Labels:      map[string]string{RolloutLabel: "enabled"},
+			Annotations: map[string]string{RestartOnRenewAnnotation: "web-tls"},
+		}}
+		fakeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+			certificate.DeepCopy(),
+			&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "web-tls", Namespace: "shop"}, Data: data},
+			deployment,
+			&appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{
+				Name: "db", Namespace: "shop", Labels: map[string]string{RolloutLabel: "enabled"},
+			}},
+			&appsv1.DaemonSet{ObjectMeta: metav1.ObjectMeta{
+				Name: "agent", Namespace: "other",
+				Labels:      map[string]string{RolloutLabel: "enabled"},
+				Annotations: map[string]string{RestartOnRenewAnnotation: "web-tls"},
+			}},
+		).WithStatusSubresource(&certsv1.Certificate{}).Build()
+		r := &RolloutReconciler{Client: fakeClient}
+		request := ctrl.Request{NamespacedName: types.NamespacedName{Name: "web-tls", Namespace: "shop"}}
+
+		By("recording the fingerprint of a newly annotated workload without restarting it")
+		_, err := r.Reconcile(ctx, request)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "web", Namespace: "shop"}, deployment)).To(Succeed())
+		Expect(deployment.Annotations).To(HaveKeyWithValue(CertificateFingerprintAnnotation, fingerprint))
+		Expect(deployment.Spec.Template.Annotations).NotTo(HaveKey(CertificateFingerprintAnnotation))
+		current := &certsv1.Certificate{}
+		Expect(fakeClient.Get(ctx, request.NamespacedName, current)).To(Succeed())
+		Expect(current.Status.RestartedWorkloads).To(BeEmpty())
+
+		By("leaving workloads alone until the certificate is renewed")
+		_, err = r.Reconcile(ctx, request)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "web", Namespace: "shop"}, deployment)).To(Succeed())
+		Expect(deployment.Spec.Template.Annotations).NotTo(HaveKey(CertificateFingerprintAnnotation))
+
+		By("restarting them with the fingerprint of the renewed certificate")
+		data, renewed := issue()
+		Expect(renewed).NotTo(Equal(fingerprint))
+		Expect(fakeClient.Update(ctx, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "web-tls", Namespace: "shop"}, Data: data,
+		})).To(Succeed())
+		_, err = r.Reconcile(ctx, request)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "web", Namespace: "shop"}, deployment)).To(Succeed())
+		Expect(deployment.Spec.Template.Annotations).To(HaveKeyWithValue(CertificateFingerprintAnnotation, renewed))
+		Expect(fakeClient.Get(ctx, request.NamespacedName, current)).To(Succeed())
+		Expect(current.Status.RestartedWorkloads).To(HaveLen(1))
+		Expect(current.Status.RestartedWorkloads[0].Kind).To(Equal("Deployment"))
+		Expect(current.Status.RestartedWorkloads[0].Name).To(Equal("web"))
+		Expect(current.Status.RestartedWorkloads[0].Fingerprint).To(Equal(renewed))
+		restartedAt := current.Status.RestartedWorkloads[0].RestartedAt
+
+		By("not restarting them again for the same certificate")
+		_, err = r.Reconcile(ctx, request)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fakeClient.Get(ctx, request.NamespacedName, current)).To(Succeed())
+		Expect(current.Status.RestartedWorkloads[0].RestartedAt).To(Equal(restartedAt))
+
+		By("dropping workloads which no longer reference the certificate")
+		delete(deployment.Annotations, RestartOnRenewAnnotation)
+		Expect(fakeClient.Update(ctx, deployment)).To(Succeed())
+		_, err = r.Reconcile(ctx, request)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fakeClient.Get(ctx, request.NamespacedName, current)).To(Succeed())
+		Expect(current.Status.RestartedWorkloads).To(BeEmpty())
+	})
+
+	It("should map annotated workloads to Certificates with names longer than a label value", func() {
+		name := strings.Repeat("a", 64) + "-tls"
+		deployment := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{
+			Name: "web", Namespace: "shop", Annotations: map[string]string{RestartOnRenewAnnotation: name},
+		}}
+		Expect(certificateOfWorkload(context.Background(), deployment)).To(ConsistOf(
+			ctrl.Request{NamespacedName: types.NamespacedName{Name: name, Namespace: "shop"}},
+		))
+	})
+})
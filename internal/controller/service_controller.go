@@ -0,0 +1,128 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
+)
+
+const (
+	// ServingCertSecretAnnotation requests a serving Certificate for a Service,
+	// stored in the Secret it names
+	ServingCertSecretAnnotation = "certs.k8c.io/serving-cert-secret-name"
+	// ServingCertIssuerAnnotation names the Issuer signing the serving Certificate
+	// of a Service instead of the default one. It is only honoured for Issuers
+	// listed in the allowedIssuers of a policy applying to the namespace.
+	ServingCertIssuerAnnotation = "certs.k8c.io/serving-cert-issuer"
+)
+
+// ServiceReconciler creates the serving Certificates of annotated Services
+type ServiceReconciler struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+	// ClusterDomain is the DNS domain of the cluster, defaults to cluster.local
+	ClusterDomain string
+	// Issuer signs the serving Certificates of Services which do not name one.
+	// If empty, they are self-signed.
+	Issuer string
+}
+
+// +kubebuilder:rbac:groups="",resources=services,verbs=get;list;watch
+
+// Reconcile creates or updates the Certificate owned by a Service annotated with
+// certs.k8c.io/serving-cert-secret-name, named after the Secret, for the names the
+// Service is resolved by inside the cluster, signed by the default Issuer or the
+// one of the certs.k8c.io/serving-cert-issuer annotation. Certificates of a
+// previous Secret name are deleted.
+func (r *ServiceReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+	service := &corev1.Service{}
+	err := r.Get(ctx, req.NamespacedName, service)
+	if err != nil {
+		// Owned Certificates are garbage collected with the Service
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+
+	desired := map[string]certsv1.CertificateSpec{}
+	secretName := service.Annotations[ServingCertSecretAnnotation]
+	switch {
+	case secretName == "" || service.DeletionTimestamp != nil:
+	case service.Spec.Type == corev1.ServiceTypeExternalName:
+		logger.Info("Reconcile Event: Skipping serving certificate of an ExternalName Service")
+	default:
+		spec := shimCertificateSpec(service, serviceDNSNames(service.Name, service.Namespace, r.clusterDomain()), secretName)
+		issuer := r.Issuer
+		if override := service.Annotations[ServingCertIssuerAnnotation]; override != "" {
+			granted, err := issuerGrantedByPolicy(ctx, r.Client, service.Namespace, override)
+			if err != nil {
+				return ctrl.Result{}, err
+			}
+			if !granted {
+				// The current Certificate is kept until the annotation is fixed
+				logger.Info("Reconcile Event: Serving certificate issuer not granted by a policy", "Issuer", override)
+				r.Recorder.Eventf(service, corev1.EventTypeWarning, "IssuerNotAllowed",
+					"Issuer %s is not listed in the allowedIssuers of a certificate policy of the namespace", override)
+				return ctrl.Result{}, nil
+			}
+			issuer = override
+		}
+		if issuer != "" {
+			spec.IssuerRef = &certsv1.IssuerReference{Name: issuer}
+		}
+		desired[secretName] = spec
+	}
+
+	for name, spec := range desired {
+		err = applyOwnedCertificate(ctx, r.Client, r.Scheme, r.Recorder, service, name, spec)
+		if err != nil {
+			logger.Error(err, "Reconcile Event: Failed to apply Service serving certificate", "Certificate", name)
+			return ctrl.Result{}, err
+		}
+	}
+
+	err = deleteStaleCertificates(ctx, r.Client, service, desired)
+	if err != nil {
+		logger.Error(err, "Reconcile Event: Failed to delete stale Service certificates")
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{}, nil
+}
+
+func (r *ServiceReconciler) clusterDomain() string {
+	if r.ClusterDomain == "" {
+		return DefaultClusterDomain
+	}
+	return r.ClusterDomain
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *ServiceReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&corev1.Service{}).
+		Owns(&certsv1.Certificate{}).
+		Complete(r)
+}
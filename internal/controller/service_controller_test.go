@@ -0,0 +1,150 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
+)
+
+var _ = Describe("Service Controller", func() {
+	It("should manage the serving certificate of an annotated Service", func() {
+		ctx := context.Background()
+		scheme := runtime.NewScheme()
+		utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+		utilruntime.Must(certsv1.AddToScheme(scheme))
+		service := &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "web",
+				Namespace: "shop",
+				UID:       "web-uid",
+				Annotations: map[string]string{
+					ServingCertSecretAnnotation: "web-tls",
+					ServingCertIssuerAnnotation: "internal-ca",
+				},
+			},
+		}
+		policy := &certsv1.CertificatePolicy{
+			ObjectMeta: metav1.ObjectMeta{Name: "internal", Namespace: "shop"},
+			Spec:       certsv1.CertificatePolicySpec{AllowedIssuers: []string{"internal-*"}},
+		}
+		fakeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(service, policy).Build()
+		r := &ServiceReconciler{Client: fakeClient, Scheme: scheme, Recorder: record.NewFakeRecorder(10)}
+		request := ctrl.Request{NamespacedName: types.NamespacedName{Name: "web", Namespace: "shop"}}
+
+		_, err := r.Reconcile(ctx, request)
+		Expect(err).NotTo(HaveOccurred())
+		certificate := &certsv1.Certificate{}
+		Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "web-tls", Namespace: "shop"}, certificate)).To(Succeed())
+		Expect(certificate.Spec.DNSName).To(Equal("web"))
+		Expect(certificate.Spec.DNSNames).To(Equal([]string{"web.shop", "web.shop.svc", "web.shop.svc.cluster.local"}))
+		Expect(certificate.Spec.SecretRef.Name).To(Equal("web-tls"))
+		Expect(certificate.Spec.IssuerRef).To(Equal(&certsv1.IssuerReference{Name: "internal-ca"}))
+		Expect(metav1.IsControlledBy(certificate, service)).To(BeTrue())
+
+		By("updating the names when the cluster domain changes")
+		r.ClusterDomain = "k8c.local"
+		_, err = r.Reconcile(ctx, request)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "web-tls", Namespace: "shop"}, certificate)).To(Succeed())
+		Expect(certificate.Spec.DNSNames).To(ContainElement("web.shop.svc.k8c.local"))
+		Expect(certificate.Spec.DNSNames).NotTo(ContainElement("web.shop.svc.cluster.local"))
+
+		By("replacing the certificate when the Secret name changes")
+		Expect(fakeClient.Get(ctx, request.NamespacedName, service)).To(Succeed())
+		service.Annotations[ServingCertSecretAnnotation] = "web-serving"
+		Expect(fakeClient.Update(ctx, service)).To(Succeed())
+		_, err = r.Reconcile(ctx, request)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "web-serving", Namespace: "shop"}, certificate)).To(Succeed())
+		Expect(errors.IsNotFound(fakeClient.Get(ctx, types.NamespacedName{Name: "web-tls", Namespace: "shop"}, certificate))).To(BeTrue())
+
+		By("deleting the certificate once the annotation is removed")
+		Expect(fakeClient.Get(ctx, request.NamespacedName, service)).To(Succeed())
+		delete(service.Annotations, ServingCertSecretAnnotation)
+		Expect(fakeClient.Update(ctx, service)).To(Succeed())
+		_, err = r.Reconcile(ctx, request)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(errors.IsNotFound(fakeClient.Get(ctx, types.NamespacedName{Name: "web-serving", Namespace: "shop"}, certificate))).To(BeTrue())
+	})
+
+	It("should only let a Service name an Issuer granted by a policy", func() {
+		ctx := context.Background()
+		scheme := runtime.NewScheme()
+		utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+		utilruntime.Must(certsv1.AddToScheme(scheme))
+		service := &corev1.Service{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "web",
+				Namespace:   "shop",
+				UID:         "web-uid",
+				Annotations: map[string]string{ServingCertSecretAnnotation: "web-tls"},
+			},
+		}
+		fakeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(
+			service,
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "shop", Labels: map[string]string{"team": "shop"}}},
+		).Build()
+		recorder := record.NewFakeRecorder(10)
+		r := &ServiceReconciler{Client: fakeClient, Scheme: scheme, Recorder: recorder, Issuer: "serving-ca"}
+		request := ctrl.Request{NamespacedName: types.NamespacedName{Name: "web", Namespace: "shop"}}
+
+		By("signing with the default Issuer")
+		_, err := r.Reconcile(ctx, request)
+		Expect(err).NotTo(HaveOccurred())
+		certificate := &certsv1.Certificate{}
+		Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "web-tls", Namespace: "shop"}, certificate)).To(Succeed())
+		Expect(certificate.Spec.IssuerRef).To(Equal(&certsv1.IssuerReference{Name: "serving-ca"}))
+
+		By("refusing an Issuer no policy grants")
+		Expect(fakeClient.Get(ctx, request.NamespacedName, service)).To(Succeed())
+		service.Annotations[ServingCertIssuerAnnotation] = "root-ca"
+		Expect(fakeClient.Update(ctx, service)).To(Succeed())
+		_, err = r.Reconcile(ctx, request)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(recorder.Events).To(Receive(HavePrefix("Warning IssuerNotAllowed")))
+		Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "web-tls", Namespace: "shop"}, certificate)).To(Succeed())
+		Expect(certificate.Spec.IssuerRef).To(Equal(&certsv1.IssuerReference{Name: "serving-ca"}))
+
+		By("honouring an Issuer granted by a ClusterCertificatePolicy selecting the namespace")
+		Expect(fakeClient.Create(ctx, &certsv1.ClusterCertificatePolicy{
+			ObjectMeta: metav1.ObjectMeta{Name: "shop"},
+			Spec: certsv1.ClusterCertificatePolicySpec{
+				NamespaceSelector:     &metav1.LabelSelector{MatchLabels: map[string]string{"team": "shop"}},
+				CertificatePolicySpec: certsv1.CertificatePolicySpec{AllowedIssuers: []string{"root-ca"}},
+			},
+		})).To(Succeed())
+		_, err = r.Reconcile(ctx, request)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "web-tls", Namespace: "shop"}, certificate)).To(Succeed())
+		Expect(certificate.Spec.IssuerRef).To(Equal(&certsv1.IssuerReference{Name: "root-ca"}))
+	})
+})
@@ -4,16 +4,18 @@ import (
 	"context"
 	"fmt"
 	"github.com/PNarode/k8c-certs-manager/api/v1"
+	"github.com/PNarode/k8c-certs-manager/internal/validation"
 	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation/field"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	logf "sigs.k8s.io/controller-runtime/pkg/log"
 	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
-	"time"
 )
 
-// +kubebuilder:webhook:path=/validate-certs-k8c-io-v1-certificate,mutating=false,failurePolicy=fail,sideEffects=None,groups="certs.k8c.io",resources=certificates,verbs=create;update,versions=v1,name=vcertificate.kb.io,admissionReviewVersions=v1
+// +kubebuilder:webhook:path=/validate-certs-k8c-io-v1-certificate,mutating=false,failurePolicy=ignore,sideEffects=None,groups="certs.k8c.io",resources=certificates,verbs=create;update,versions=v1,name=vcertificate.kb.io,admissionReviewVersions=v1
 // +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;patch;delete
 
 // CertificateValidator validates Certificate Resource
@@ -21,7 +23,7 @@ type CertificateValidator struct {
 	client.Client
 }
 
-// validate admits a pod if a specific annotation exists.
+// validate admits a Certificate if its spec passes all the validation rules.
 func (v *CertificateValidator) validate(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
 	log := logf.FromContext(ctx)
 	// Check whether certificate mutation was triggered
@@ -30,24 +32,21 @@ func (v *CertificateValidator) validate(ctx context.Context, obj runtime.Object)
 		return nil, fmt.Errorf("expected a Certificate but got a %T", obj)
 	}
 
-	validityValue, found := cert.Annotations["validityInHours"]
-	if !found {
-		return nil, fmt.Errorf("no validity value annotations found")
+	allErrs := validation.ValidateCertificate(cert)
+	if len(allErrs) != 0 {
+		log.Info("Validation for Certificate Request Failed", "errors", allErrs.ToAggregate().Error())
+		return nil, apierrors.NewInvalid(v1.GroupVersion.WithKind("Certificate").GroupKind(), cert.Name, allErrs)
 	}
-	_, err := time.ParseDuration(validityValue)
+	violation, err := CheckCertificatePolicies(ctx, v.Client, cert)
 	if err != nil {
-		return nil, fmt.Errorf("invalid value %s for Validity field err: %s", validityValue, err.Error())
+		return nil, err
 	}
-
-	renewBefore, err := time.ParseDuration(cert.Spec.RenewBefore)
-	if err != nil {
-		return nil, fmt.Errorf("invalid value %s for RenewBefore field eg: 5m, 1d", cert.Spec.Validity)
-	}
-	if renewBefore < (5 * time.Minute) {
-		return nil, fmt.Errorf("invalid value %s for RenewBefore field minimum value should be 5m", cert.Spec.Validity)
+	if violation != nil {
+		log.Info("Certificate Request refused by policy", "policy", violation.Policy, "errors", violation.Errors.ToAggregate().Error())
+		return nil, apierrors.NewForbidden(v1.GroupVersion.WithResource("certificates").GroupResource(), cert.Name, violation)
 	}
 	log.Info("Validation for Certificate Request Completed")
-	return nil, nil
+	return validation.CertificateWarnings(cert), nil
 }
 
 func (v *CertificateValidator) ValidateCreate(ctx context.Context, obj runtime.Object) (admission.Warnings, error) {
@@ -61,7 +60,9 @@ func (v *CertificateValidator) ValidateCreate(ctx context.Context, obj runtime.O
 	err := v.Get(ctx, types.NamespacedName{Name: cert.Spec.SecretRef.Name, Namespace: cert.Namespace}, secret)
 	if err == nil {
 		logger.Info("TLS secret reference already exists", "Secret", cert.Spec.SecretRef)
-		return nil, fmt.Errorf("TLS secret reference already exists")
+		return nil, apierrors.NewInvalid(v1.GroupVersion.WithKind("Certificate").GroupKind(), cert.Name, field.ErrorList{
+			field.Invalid(field.NewPath("spec", "secretRef", "name"), cert.Spec.SecretRef.Name, "TLS secret reference already exists"),
+		})
 	}
 	return v.validate(ctx, obj)
 }
@@ -0,0 +1,269 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/ptr"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
+)
+
+// +kubebuilder:rbac:groups="",resources=serviceaccounts/token,verbs=create
+
+const (
+	// vaultTimeout limits the requests to a Vault server
+	vaultTimeout = 30 * time.Second
+	// vaultSecretIDKey is the key of the secret ID in the Secret of an AppRole
+	vaultSecretIDKey = "secret-id"
+	// vaultTokenExpiration is the lifetime of the ServiceAccount tokens requested
+	// for the Kubernetes auth method
+	vaultTokenExpiration = 10 * time.Minute
+)
+
+// vaultError is an error response of the Vault API
+type vaultError struct {
+	StatusCode int      `json:"-"`
+	Errors     []string `json:"errors"`
+}
+
+func (e *vaultError) Error() string {
+	if len(e.Errors) == 0 {
+		return fmt.Sprintf("vault responded with status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("vault responded with status %d: %s", e.StatusCode, strings.Join(e.Errors, "; "))
+}
+
+// vaultClient calls the Vault API, authenticated with the token of a login
+type vaultClient struct {
+	httpClient *http.Client
+	server     string
+	namespace  string
+	token      string
+}
+
+// write sends a request to a Vault API path and decodes the response into out
+func (c *vaultClient) write(ctx context.Context, path string, body, out any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	url := strings.TrimSuffix(c.server, "/") + "/v1/" + strings.TrimPrefix(path, "/")
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.token != "" {
+		req.Header.Set("X-Vault-Token", c.token)
+	}
+	if c.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", c.namespace)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("calling vault: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		verr := &vaultError{StatusCode: resp.StatusCode}
+		_ = json.NewDecoder(resp.Body).Decode(verr)
+		return verr
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// vaultLogin logs in to the Vault server of an issuer with its auth method. The
+// credentials are sent to the server of the issuer, they are therefore only taken
+// from the namespace of the manager.
+func (r *CertificateReconciler) vaultLogin(ctx context.Context, issuer *certsv1.VaultIssuer) (*vaultClient, error) {
+	httpClient, err := issuerHTTPClient(issuer.CABundle, vaultTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("vault issuer: %w", err)
+	}
+	c := &vaultClient{httpClient: httpClient, server: issuer.Server, namespace: issuer.Namespace}
+
+	var path string
+	var body map[string]string
+	switch {
+	case issuer.Auth.Kubernetes != nil:
+		auth := issuer.Auth.Kubernetes
+		ref := auth.ServiceAccountRef
+		if ref.Namespace != r.ManagerNamespace {
+			return nil, fmt.Errorf("service account %s/%s is not in the namespace of the manager", ref.Namespace, ref.Name)
+		}
+		serviceAccount := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: ref.Name, Namespace: ref.Namespace}}
+		tokenRequest := &authenticationv1.TokenRequest{Spec: authenticationv1.TokenRequestSpec{
+			Audiences:         auth.Audiences,
+			ExpirationSeconds: ptr.To(int64(vaultTokenExpiration.Seconds())),
+		}}
+		err = r.SubResource("token").Create(ctx, serviceAccount, tokenRequest)
+		if err != nil {
+			return nil, fmt.Errorf("requesting a token for service account %s/%s: %w", ref.Namespace, ref.Name, err)
+		}
+		path = vaultMountPath(auth.MountPath, "kubernetes")
+		body = map[string]string{"role": auth.Role, "jwt": tokenRequest.Status.Token}
+	case issuer.Auth.AppRole != nil:
+		auth := issuer.Auth.AppRole
+		ref := auth.SecretRef
+		if ref.Namespace != r.ManagerNamespace {
+			return nil, fmt.Errorf("secret %s/%s is not in the namespace of the manager", ref.Namespace, ref.Name)
+		}
+		secret := &corev1.Secret{}
+		err = r.Get(ctx, types.NamespacedName{Name: ref.Name, Namespace: ref.Namespace}, secret)
+		if err != nil {
+			return nil, err
+		}
+		if len(secret.Data[vaultSecretIDKey]) == 0 {
+			return nil, fmt.Errorf("secret %s/%s has no %s key", ref.Namespace, ref.Name, vaultSecretIDKey)
+		}
+		path = vaultMountPath(auth.MountPath, "approle")
+		body = map[string]string{"role_id": auth.RoleID, "secret_id": string(secret.Data[vaultSecretIDKey])}
+	default:
+		return nil, fmt.Errorf("vault issuer has no auth method")
+	}
+
+	var login struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}
+	err = c.write(ctx, "auth/"+path+"/login", body, &login)
+	if err != nil {
+		return nil, err
+	}
+	if login.Auth.ClientToken == "" {
+		return nil, fmt.Errorf("vault login returned no token")
+	}
+	c.token = login.Auth.ClientToken
+	return c, nil
+}
+
+// vaultMountPath returns the mount path of an auth method, or its default
+func vaultMountPath(mountPath, defaultPath string) string {
+	if mountPath == "" {
+		return defaultPath
+	}
+	return strings.Trim(mountPath, "/")
+}
+
+// signVault signs a CertificateRequest with the PKI role of a Vault issuer. The
+// errors of Vault are recorded in the conditions of the request and as events of
+// the Certificate: requests the role rejects are marked Failed, the other errors
+// are retried.
+func (r *CertificateReconciler) signVault(ctx context.Context, issuer *certsv1.Issuer, certificate *certsv1.Certificate, request *certsv1.CertificateRequest, csr *x509.CertificateRequest, validity time.Duration) (map[string][]byte, error) {
+	logger := log.FromContext(ctx)
+	c, err := r.vaultLogin(ctx, issuer.Spec.Vault)
+	if err != nil {
+		return nil, r.vaultNotReady(ctx, certificate, request, "AuthenticationFailed", err)
+	}
+
+	body := map[string]string{
+		"csr":         string(request.Spec.Request),
+		"common_name": csr.Subject.CommonName,
+		"alt_names":   strings.Join(append(slices.Clone(csr.DNSNames), csr.EmailAddresses...), ","),
+	}
+	if body["common_name"] == "" && len(csr.DNSNames) > 0 {
+		body["common_name"] = csr.DNSNames[0]
+	}
+	var ips, uris []string
+	for _, ip := range csr.IPAddresses {
+		ips = append(ips, ip.String())
+	}
+	for _, uri := range csr.URIs {
+		uris = append(uris, uri.String())
+	}
+	body["ip_sans"] = strings.Join(ips, ",")
+	body["uri_sans"] = strings.Join(uris, ",")
+	if validity > 0 {
+		body["ttl"] = fmt.Sprintf("%ds", int64(validity.Seconds()))
+	}
+
+	var signed struct {
+		Data struct {
+			Certificate string   `json:"certificate"`
+			IssuingCA   string   `json:"issuing_ca"`
+			CAChain     []string `json:"ca_chain"`
+		} `json:"data"`
+	}
+	err = c.write(ctx, issuer.Spec.Vault.Path, body, &signed)
+	var verr *vaultError
+	switch {
+	case errors.As(err, &verr) && verr.StatusCode == http.StatusBadRequest:
+		logger.Info("Reconcile Event: Vault rejected the CertificateRequest", "CertificateRequest", request.Name, "Reason", verr.Error())
+		r.Recorder.Eventf(certificate, corev1.EventTypeWarning, "InvalidRequest", "Vault rejected CertificateRequest %s: %s", request.Name, verr.Error())
+		err = decide(ctx, r.Client, request, certsv1.CertificateRequestFailed, "InvalidRequest", verr.Error())
+		if err != nil {
+			return nil, err
+		}
+		return nil, errIssuanceFailed
+	case errors.As(err, &verr) && verr.StatusCode == http.StatusForbidden:
+		return nil, r.vaultNotReady(ctx, certificate, request, "PermissionDenied", err)
+	case err != nil:
+		return nil, r.vaultNotReady(ctx, certificate, request, "VaultError", err)
+	}
+
+	chain := signed.Data.CAChain
+	if len(chain) == 0 && signed.Data.IssuingCA != "" {
+		chain = []string{signed.Data.IssuingCA}
+	}
+	if signed.Data.Certificate == "" || len(chain) == 0 {
+		return nil, r.vaultNotReady(ctx, certificate, request, "VaultError", fmt.Errorf("vault returned no certificate chain"))
+	}
+	certPEM := strings.TrimSpace(signed.Data.Certificate) + "\n"
+	for _, ca := range chain {
+		certPEM += strings.TrimSpace(ca) + "\n"
+	}
+	return map[string][]byte{
+		"tls.crt": []byte(certPEM),
+		"ca.crt":  []byte(strings.TrimSpace(chain[len(chain)-1]) + "\n"),
+	}, nil
+}
+
+// vaultNotReady records an error of Vault with the Ready condition of a
+// CertificateRequest and an event of its Certificate, and returns it to retry
+// the request
+func (r *CertificateReconciler) vaultNotReady(ctx context.Context, certificate *certsv1.Certificate, request *certsv1.CertificateRequest, reason string, err error) error {
+	r.Recorder.Eventf(certificate, corev1.EventTypeWarning, reason, "CertificateRequest %s: %v", request.Name, err)
+	meta.SetStatusCondition(&request.Status.Conditions, metav1.Condition{
+		Type:    certsv1.CertificateRequestReady,
+		Status:  metav1.ConditionFalse,
+		Reason:  reason,
+		Message: err.Error(),
+	})
+	updateErr := r.Status().Update(ctx, request)
+	if updateErr != nil {
+		return updateErr
+	}
+	return err
+}
@@ -0,0 +1,255 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+
+	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
+	"github.com/PNarode/k8c-certs-manager/internal/helper"
+	"github.com/PNarode/k8c-certs-manager/internal/validation"
+)
+
+// fakeVaultServer implements the login endpoints of the AppRole and Kubernetes
+// auth methods and the sign endpoint of a PKI role
+type fakeVaultServer struct {
+	*httptest.Server
+	mu         sync.Mutex
+	logins     []map[string]string
+	signed     map[string]string
+	signStatus int
+	caPEM      []byte
+	caCert     *x509.Certificate
+}
+
+func newFakeVaultServer() *fakeVaultServer {
+	ca := certsv1.Certificate{Spec: certsv1.CertificateSpec{DNSName: "vault.k8c.io", Validity: "1y", IsCA: true}}
+	Expect(validation.DefaultCertificate(context.Background(), &ca)).To(Succeed())
+	caPEM, caKeyPEM, err := helper.GenerateSelfSignedCertificate(ca)
+	Expect(err).NotTo(HaveOccurred())
+	caCert, caKey, err := helper.ParseCA(caPEM, caKeyPEM)
+	Expect(err).NotTo(HaveOccurred())
+
+	s := &fakeVaultServer{signStatus: http.StatusOK, caPEM: caPEM, caCert: caCert}
+	mux := http.NewServeMux()
+	s.Server = httptest.NewTLSServer(mux)
+	login := func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		Expect(json.NewDecoder(r.Body).Decode(&body)).To(Succeed())
+		s.mu.Lock()
+		s.logins = append(s.logins, body)
+		s.mu.Unlock()
+		_ = json.NewEncoder(w).Encode(map[string]any{"auth": map[string]string{"client_token": "s.token"}})
+	}
+	mux.HandleFunc("/v1/auth/approle/login", login)
+	mux.HandleFunc("/v1/auth/kubernetes/login", login)
+	mux.HandleFunc("/v1/pki/sign/web", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Vault-Token") != "s.token" {
+			w.WriteHeader(http.StatusForbidden)
+			_ = json.NewEncoder(w).Encode(map[string][]string{"errors": {"permission denied"}})
+			return
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.signStatus != http.StatusOK {
+			w.WriteHeader(s.signStatus)
+			_ = json.NewEncoder(w).Encode(map[string][]string{"errors": {"common name shop.k8c.io not allowed by this role"}})
+			return
+		}
+		Expect(json.NewDecoder(r.Body).Decode(&s.signed)).To(Succeed())
+		csr, err := helper.ParseCertificateRequestPEM([]byte(s.signed["csr"]))
+		Expect(err).NotTo(HaveOccurred())
+		leaf, err := helper.SignWithCA(helper.CSRTemplate(csr, 24*time.Hour), csr.PublicKey, caCert, caKey)
+		Expect(err).NotTo(HaveOccurred())
+		_ = json.NewEncoder(w).Encode(map[string]any{"data": map[string]any{
+			"certificate": strings.TrimSpace(string(leaf)),
+			"issuing_ca":  strings.TrimSpace(string(caPEM)),
+			"ca_chain":    []string{strings.TrimSpace(string(caPEM))},
+		}})
+	})
+	return s
+}
+
+var _ = Describe("Vault Issuer", func() {
+	var (
+		ctx         context.Context
+		server      *fakeVaultServer
+		scheme      *runtime.Scheme
+		issuer      *certsv1.Issuer
+		certificate *certsv1.Certificate
+		objects     []client.Object
+		recorder    *record.FakeRecorder
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		server = newFakeVaultServer()
+		DeferCleanup(server.Close)
+		scheme = runtime.NewScheme()
+		utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+		utilruntime.Must(certsv1.AddToScheme(scheme))
+		issuer = &certsv1.Issuer{
+			ObjectMeta: metav1.ObjectMeta{Name: "vault"},
+			Spec: certsv1.IssuerSpec{Vault: &certsv1.VaultIssuer{
+				Server:   server.URL,
+				Path:     "pki/sign/web",
+				CABundle: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}),
+				Auth: certsv1.VaultAuth{AppRole: &certsv1.VaultAppRoleAuth{
+					RoleID:    "role-id",
+					SecretRef: certsv1.SecretReference{Name: "vault-approle", Namespace: "certs-system"},
+				}},
+			}},
+		}
+		certificate = &certsv1.Certificate{
+			ObjectMeta: metav1.ObjectMeta{Name: "shop", Namespace: "default", Generation: 1, UID: "shop-uid"},
+			Spec: certsv1.CertificateSpec{
+				DNSName:   "shop.k8c.io",
+				DNSNames:  []string{"www.shop.k8c.io"},
+				Validity:  "30d",
+				SecretRef: certsv1.SecretRef{Name: "shop-tls"},
+				IssuerRef: &certsv1.IssuerReference{Name: "vault"},
+			},
+		}
+		Expect(validation.DefaultCertificate(ctx, certificate)).To(Succeed())
+		objects = []client.Object{
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}},
+			&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "vault-approle", Namespace: "certs-system"},
+				Data:       map[string][]byte{vaultSecretIDKey: []byte("secret-id")},
+			},
+			certificate,
+		}
+	})
+
+	newReconciler := func(funcs interceptor.Funcs) (*CertificateReconciler, client.Client) {
+		fakeClient := fake.NewClientBuilder().WithScheme(scheme).WithObjects(append(objects, issuer)...).
+			WithStatusSubresource(&certsv1.CertificateRequest{}).WithInterceptorFuncs(funcs).Build()
+		recorder = record.NewFakeRecorder(10)
+		return &CertificateReconciler{Client: fakeClient, Scheme: scheme, Recorder: recorder, ManagerNamespace: "certs-system"}, fakeClient
+	}
+
+	It("should sign the CSR with the PKI role after an AppRole login", func() {
+		r, fakeClient := newReconciler(interceptor.Funcs{})
+		data, err := r.issue(ctx, certificate)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(server.logins).To(ConsistOf(map[string]string{"role_id": "role-id", "secret_id": "secret-id"}))
+		Expect(server.signed).To(HaveKeyWithValue("common_name", "shop.k8c.io"))
+		Expect(server.signed).To(HaveKeyWithValue("alt_names", "shop.k8c.io,www.shop.k8c.io"))
+		Expect(server.signed).To(HaveKeyWithValue("ttl", "2592000s"))
+
+		Expect(data).To(HaveKey("tls.key"))
+		chain, err := helper.ParseCertificatesPEM(data["tls.crt"])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(chain).To(HaveLen(2))
+		Expect(chain[0].DNSNames).To(ConsistOf("shop.k8c.io", "www.shop.k8c.io"))
+		Expect(data["ca.crt"]).To(Equal(server.caPEM))
+		request := &certsv1.CertificateRequest{}
+		Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "shop-1", Namespace: "default"}, request)).To(Succeed())
+		Expect(meta.IsStatusConditionTrue(request.Status.Conditions, certsv1.CertificateRequestReady)).To(BeTrue())
+	})
+
+	It("should log in with a token requested for the ServiceAccount", func() {
+		issuer.Spec.Vault.Auth = certsv1.VaultAuth{Kubernetes: &certsv1.VaultKubernetesAuth{
+			Role:              "certs",
+			ServiceAccountRef: certsv1.ServiceAccountReference{Name: "vault-auth", Namespace: "certs-system"},
+			Audiences:         []string{"vault"},
+		}}
+		var requested *authenticationv1.TokenRequest
+		r, _ := newReconciler(interceptor.Funcs{
+			SubResourceCreate: func(_ context.Context, _ client.Client, subResource string, obj client.Object, sub client.Object, _ ...client.SubResourceCreateOption) error {
+				Expect(subResource).To(Equal("token"))
+				Expect(obj.GetName()).To(Equal("vault-auth"))
+				requested = sub.(*authenticationv1.TokenRequest)
+				requested.Status.Token = "jwt"
+				return nil
+			},
+		})
+		_, err := r.issue(ctx, certificate)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(requested.Spec.Audiences).To(Equal([]string{"vault"}))
+		Expect(server.logins).To(ConsistOf(map[string]string{"role": "certs", "jwt": "jwt"}))
+	})
+
+	It("should fail requests the role rejects and retry the other errors", func() {
+		r, fakeClient := newReconciler(interceptor.Funcs{})
+		server.signStatus = http.StatusInternalServerError
+		_, err := r.issue(ctx, certificate)
+		Expect(err).To(HaveOccurred())
+		Expect(issuanceBlocked(err)).To(BeFalse())
+		request := &certsv1.CertificateRequest{}
+		Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "shop-1", Namespace: "default"}, request)).To(Succeed())
+		ready := meta.FindStatusCondition(request.Status.Conditions, certsv1.CertificateRequestReady)
+		Expect(ready).NotTo(BeNil())
+		Expect(ready.Status).To(Equal(metav1.ConditionFalse))
+		Expect(ready.Reason).To(Equal("VaultError"))
+		Expect(recorder.Events).To(Receive(HavePrefix("Warning VaultError CertificateRequest shop-1: vault responded with status 500")))
+
+		server.signStatus = http.StatusBadRequest
+		_, err = r.issue(ctx, certificate)
+		Expect(err).To(MatchError(errIssuanceFailed))
+		Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "shop-1", Namespace: "default"}, request)).To(Succeed())
+		failed := meta.FindStatusCondition(request.Status.Conditions, certsv1.CertificateRequestFailed)
+		Expect(failed).NotTo(BeNil())
+		Expect(failed.Reason).To(Equal("InvalidRequest"))
+		Expect(failed.Message).To(ContainSubstring("not allowed by this role"))
+		_, err = r.issue(ctx, certificate)
+		Expect(err).To(MatchError(errIssuanceFailed))
+	})
+
+	It("should refuse credentials outside the namespace of the manager", func() {
+		issuer.Spec.Vault.Auth = certsv1.VaultAuth{Kubernetes: &certsv1.VaultKubernetesAuth{
+			Role:              "certs",
+			ServiceAccountRef: certsv1.ServiceAccountReference{Name: "default", Namespace: "team-a"},
+		}}
+		r, fakeClient := newReconciler(interceptor.Funcs{
+			SubResourceCreate: func(_ context.Context, _ client.Client, _ string, _ client.Object, _ client.Object, _ ...client.SubResourceCreateOption) error {
+				Fail("no token should be requested")
+				return nil
+			},
+		})
+		_, err := r.issue(ctx, certificate)
+		Expect(err).To(MatchError(ContainSubstring("service account team-a/default is not in the namespace of the manager")))
+		Expect(server.logins).To(BeEmpty())
+		request := &certsv1.CertificateRequest{}
+		Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "shop-1", Namespace: "default"}, request)).To(Succeed())
+		Expect(meta.FindStatusCondition(request.Status.Conditions, certsv1.CertificateRequestReady).Reason).To(Equal("AuthenticationFailed"))
+		Expect(recorder.Events).To(Receive(HavePrefix("Warning AuthenticationFailed")))
+	})
+})
@@ -0,0 +1,262 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
+	"github.com/PNarode/k8c-certs-manager/internal/helper"
+	"github.com/PNarode/k8c-certs-manager/internal/validation"
+)
+
+const (
+	// webhookCertValidity is the validity of the webhook serving certificate
+	webhookCertValidity = "365d"
+	// webhookCertRenewBefore is how long before its expiry the serving certificate is rotated
+	webhookCertRenewBefore = 30 * 24 * time.Hour
+	// webhookCertCheckInterval is how often the serving certificate and the caBundle fields are checked
+	webhookCertCheckInterval = 10 * time.Minute
+)
+
+// WebhookCertRotator provisions and rotates the serving certificate of the manager
+// webhook server. The certificate is stored in a Secret shared by all replicas,
+// written to the CertDir of the webhook server and trusted through the caBundle
+// fields of the manager webhook configurations.
+type WebhookCertRotator struct {
+	Client client.Client
+	// APIReader reads objects before the manager cache is started
+	APIReader client.Reader
+	// Secret storing the serving certificate
+	Secret types.NamespacedName
+	// Service in front of the webhook server
+	Service types.NamespacedName
+	// CertDir the webhook server loads tls.crt and tls.key from
+	CertDir                        string
+	MutatingWebhookConfiguration   string
+	ValidatingWebhookConfiguration string
+}
+
+// Start checks the serving certificate periodically until the context is done.
+func (r *WebhookCertRotator) Start(ctx context.Context) error {
+	logger := log.FromContext(ctx)
+	ticker := time.NewTicker(webhookCertCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if err := r.Ensure(ctx); err != nil {
+				logger.Error(err, "Failed to rotate webhook serving certificate")
+			}
+		}
+	}
+}
+
+// NeedLeaderElection returns false as every replica serves webhooks and has to
+// keep its CertDir up to date.
+func (r *WebhookCertRotator) NeedLeaderElection() bool {
+	return false
+}
+
+// Ensure makes sure that a serving certificate valid for the webhook Service is
+// stored, written to the CertDir and trusted by the API server.
+func (r *WebhookCertRotator) Ensure(ctx context.Context) error {
+	secret, err := r.ensureSecret(ctx)
+	if err != nil {
+		return err
+	}
+	err = writeWebhookCert(r.CertDir, secret)
+	if err != nil {
+		return err
+	}
+
+	ca, found := secret.Data["ca.crt"]
+	if !found {
+		ca = secret.Data["tls.crt"]
+	}
+	caBundle := base64.StdEncoding.EncodeToString(ca)
+	err = r.injectCABundle(ctx, mutatingWebhookTarget, r.MutatingWebhookConfiguration, caBundle)
+	if err != nil {
+		return err
+	}
+	return r.injectCABundle(ctx, validatingWebhookTarget, r.ValidatingWebhookConfiguration, caBundle)
+}
+
+// dnsNames returns the names the webhook Service is reached with
+func (r *WebhookCertRotator) dnsNames() []string {
+	service := r.Service.Name
+	namespace := r.Service.Namespace
+	return []string{
+		fmt.Sprintf("%s.%s.svc", service, namespace),
+		service,
+		fmt.Sprintf("%s.%s", service, namespace),
+		fmt.Sprintf("%s.%s.svc.cluster.local", service, namespace),
+	}
+}
+
+// ensureSecret returns the Secret storing the serving certificate, issuing a new
+// certificate when it is missing, about to expire or not valid for the Service.
+// The ca.crt key keeps trusting the previous certificate so that replicas which
+// have not reloaded it yet keep being reachable.
+func (r *WebhookCertRotator) ensureSecret(ctx context.Context) (*corev1.Secret, error) {
+	logger := log.FromContext(ctx)
+	secret := &corev1.Secret{}
+	err := r.APIReader.Get(ctx, r.Secret, secret)
+	if client.IgnoreNotFound(err) != nil {
+		return nil, err
+	}
+	found := err == nil
+	if found && !webhookCertNeedsRotation(secret.Data["tls.crt"], r.dnsNames(), time.Now()) {
+		return secret, nil
+	}
+
+	certificate := &certsv1.Certificate{
+		Spec: certsv1.CertificateSpec{
+			DNSName:  r.dnsNames()[0],
+			DNSNames: r.dnsNames()[1:],
+			Validity: webhookCertValidity,
+		},
+	}
+	err = validation.DefaultCertificate(ctx, certificate)
+	if err != nil {
+		return nil, err
+	}
+	cert, key, err := helper.GenerateSelfSignedCertificate(*certificate)
+	if err != nil {
+		return nil, err
+	}
+	caBundle := cert
+	if found {
+		previous, err := helper.ParseCertificatesPEM(secret.Data["tls.crt"])
+		if err == nil && len(previous) > 0 && time.Now().Before(previous[0].NotAfter) {
+			caBundle = append(slices.Clone(cert), helper.EncodeCertificatesPEM(previous[:1])...)
+		}
+	}
+
+	secret.Name = r.Secret.Name
+	secret.Namespace = r.Secret.Namespace
+	secret.Type = corev1.SecretTypeTLS
+	secret.Data = map[string][]byte{
+		"tls.crt": cert,
+		"tls.key": key,
+		"ca.crt":  caBundle,
+	}
+	if found {
+		err = r.Client.Update(ctx, secret)
+	} else {
+		err = r.Client.Create(ctx, secret)
+	}
+	if apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err) {
+		// Another replica issued a certificate first
+		secret = &corev1.Secret{}
+		return secret, r.APIReader.Get(ctx, r.Secret, secret)
+	}
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Webhook serving certificate issued", "Secret", r.Secret)
+	return secret, nil
+}
+
+// webhookCertNeedsRotation reports whether the PEM encoded certificate is invalid,
+// expires within the renewal window after now or does not cover the DNS names.
+func webhookCertNeedsRotation(certPEM []byte, dnsNames []string, now time.Time) bool {
+	certs, err := helper.ParseCertificatesPEM(certPEM)
+	if err != nil || len(certs) == 0 {
+		return true
+	}
+	if now.Add(webhookCertRenewBefore).After(certs[0].NotAfter) {
+		return true
+	}
+	for _, name := range dnsNames {
+		if !slices.Contains(certs[0].DNSNames, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeWebhookCert writes the serving certificate and key to the CertDir. Files
+// are replaced atomically so that the webhook server never loads a partial file.
+func writeWebhookCert(dir string, secret *corev1.Secret) error {
+	err := os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return err
+	}
+	for _, name := range []string{"tls.key", "tls.crt"} {
+		path := filepath.Join(dir, name)
+		current, err := os.ReadFile(path)
+		if err == nil && bytes.Equal(current, secret.Data[name]) {
+			continue
+		}
+		tmp, err := os.CreateTemp(dir, "."+name)
+		if err != nil {
+			return err
+		}
+		_, err = tmp.Write(secret.Data[name])
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), path)
+		}
+		if err != nil {
+			_ = os.Remove(tmp.Name())
+			return err
+		}
+	}
+	return nil
+}
+
+// injectCABundle writes the caBundle into the named object of the target kind.
+// Missing objects are skipped, e.g. when a webhook configuration is not deployed.
+func (r *WebhookCertRotator) injectCABundle(ctx context.Context, target CAInjectorTarget, name string, caBundle string) error {
+	if name == "" {
+		return nil
+	}
+	obj := &unstructured.Unstructured{}
+	obj.SetGroupVersionKind(target.GVK)
+	err := r.APIReader.Get(ctx, types.NamespacedName{Name: name}, obj)
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			log.FromContext(ctx).Info("Skipping webhook CA injection of a missing object", "Kind", target.GVK.Kind, "Name", name)
+			return nil
+		}
+		return err
+	}
+	changed, err := target.inject(obj, caBundle)
+	if err != nil || !changed {
+		return err
+	}
+	return r.Client.Update(ctx, obj)
+}
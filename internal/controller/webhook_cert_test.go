@@ -0,0 +1,97 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
+	"github.com/PNarode/k8c-certs-manager/internal/helper"
+)
+
+var _ = Describe("Webhook Serving Certificate", func() {
+	It("should issue the certificate and trust it in the webhook configurations", func() {
+		ctx := context.Background()
+		sideEffects := admissionregistrationv1.SideEffectClassNone
+		webhookConfiguration := &admissionregistrationv1.ValidatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{Name: "test-validating-webhook-configuration"},
+			Webhooks: []admissionregistrationv1.ValidatingWebhook{{
+				Name:                    "vcertificate.kb.io",
+				ClientConfig:            admissionregistrationv1.WebhookClientConfig{},
+				SideEffects:             &sideEffects,
+				AdmissionReviewVersions: []string{"v1"},
+			}},
+		}
+		fakeClient := fake.NewClientBuilder().WithScheme(clientgoscheme.Scheme).WithObjects(webhookConfiguration).Build()
+		rotator := &WebhookCertRotator{
+			Client:                         fakeClient,
+			APIReader:                      fakeClient,
+			Secret:                         types.NamespacedName{Name: "test-webhook-server-cert", Namespace: "test-system"},
+			Service:                        types.NamespacedName{Name: "test-webhook-service", Namespace: "test-system"},
+			CertDir:                        GinkgoT().TempDir(),
+			MutatingWebhookConfiguration:   "test-mutating-webhook-configuration",
+			ValidatingWebhookConfiguration: "test-validating-webhook-configuration",
+		}
+		Expect(rotator.Ensure(ctx)).To(Succeed())
+
+		secret := &corev1.Secret{}
+		Expect(fakeClient.Get(ctx, rotator.Secret, secret)).To(Succeed())
+		certs, err := helper.ParseCertificatesPEM(secret.Data["tls.crt"])
+		Expect(err).NotTo(HaveOccurred())
+		Expect(certs[0].DNSNames).To(ContainElements(
+			"test-webhook-service.test-system.svc",
+			"test-webhook-service.test-system.svc.cluster.local",
+		))
+		written, err := os.ReadFile(filepath.Join(rotator.CertDir, "tls.crt"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(written).To(Equal(secret.Data["tls.crt"]))
+
+		Expect(fakeClient.Get(ctx, types.NamespacedName{Name: webhookConfiguration.Name}, webhookConfiguration)).To(Succeed())
+		Expect(webhookConfiguration.Webhooks[0].ClientConfig.CABundle).To(Equal(secret.Data["ca.crt"]))
+
+		By("keeping a valid certificate")
+		Expect(rotator.Ensure(ctx)).To(Succeed())
+		current := &corev1.Secret{}
+		Expect(fakeClient.Get(ctx, rotator.Secret, current)).To(Succeed())
+		Expect(current.Data["tls.crt"]).To(Equal(secret.Data["tls.crt"]))
+	})
+
+	It("should rotate certificates close to their expiry", func() {
+		cert, _, err := helper.GenerateSelfSignedCertificate(certsv1.Certificate{
+			ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{"validityInHours": "8760h"}},
+			Spec:       certsv1.CertificateSpec{DNSName: "test-webhook-service.test-system.svc"},
+		})
+		Expect(err).NotTo(HaveOccurred())
+		names := []string{"test-webhook-service.test-system.svc"}
+		Expect(webhookCertNeedsRotation(cert, names, time.Now())).To(BeFalse())
+		Expect(webhookCertNeedsRotation(cert, append(names, "other.test-system.svc"), time.Now())).To(BeTrue())
+		Expect(webhookCertNeedsRotation(cert, names, time.Now().Add(365*24*time.Hour))).To(BeTrue())
+		Expect(webhookCertNeedsRotation(nil, names, time.Now())).To(BeTrue())
+	})
+})
@@ -0,0 +1,592 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"net/url"
+	"slices"
+	"sort"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+
+	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
+	"github.com/PNarode/k8c-certs-manager/internal/helper"
+	"github.com/PNarode/k8c-certs-manager/internal/validation"
+)
+
+const (
+	// DefaultTrustDomain is the SPIFFE trust domain of the SVIDs unless set with --trust-domain
+	DefaultTrustDomain = "cluster.local"
+	// TrustDomainLabel marks the trust bundle ConfigMaps with their trust domain
+	TrustDomainLabel = "certs.k8c.io/trust-domain"
+	// trustBundlePrefix is the name prefix of the trust bundle ConfigMap of a trust domain
+	trustBundlePrefix = "spiffe-bundle-"
+)
+
+// WorkloadIdentityReconciler issues X.509 SVIDs for ServiceAccounts and
+// distributes the trust bundle of their trust domain
+type WorkloadIdentityReconciler struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+	// TrustDomain is the trust domain of the SVIDs, defaults to cluster.local. It
+	// is not set per WorkloadIdentity, so that a namespace can not claim the
+	// identities of another trust domain.
+	TrustDomain string
+	// ApprovalUnenforced is set when the CertificateRequest admission webhook is not
+	// served. The SVIDs of namespaces requiring an approval are then not signed.
+	ApprovalUnenforced bool
+}
+
+// svidUsages are the key usages of an SVID
+var svidUsages = []certsv1.KeyUsage{
+	certsv1.UsageDigitalSignature, certsv1.UsageKeyEncipherment, certsv1.UsageServerAuth, certsv1.UsageClientAuth,
+}
+
+// +kubebuilder:rbac:groups=certs.k8c.io,resources=workloadidentities,verbs=get;list;watch
+// +kubebuilder:rbac:groups=certs.k8c.io,resources=workloadidentities/status,verbs=get;update;patch
+// +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=configmaps,verbs=get;list;watch;create;update;patch;delete
+// +kubebuilder:rbac:groups="",resources=serviceaccounts,verbs=get;list;watch
+
+// Reconcile signs an SVID with only the URI SAN spiffe://<trust-domain>/ns/<namespace>/sa/<serviceaccount>
+// with the CA of the Issuer and stores it in the Secret of the WorkloadIdentity.
+// The SVID is renewed once a third of its validity is left, or when the spec or
+// the CA changed. SVIDs are only issued for an existing ServiceAccount, once the
+// CertificateRequest of the generation of the WorkloadIdentity is admitted by the
+// CertificatePolicies and approved. The spiffe-bundle-<trust-domain> ConfigMap in
+// the namespace holds the CAs of all Issuers of WorkloadIdentities.
+func (r *WorkloadIdentityReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	logger := log.FromContext(ctx)
+	identity := &certsv1.WorkloadIdentity{}
+	err := r.Get(ctx, req.NamespacedName, identity)
+	if err != nil {
+		// The owned Secret and bundle ConfigMap are garbage collected
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	spiffeID := r.spiffeID(identity)
+	validity, err := validation.ParseValidity(identity.Spec.Validity)
+	if err != nil {
+		logger.Error(err, "Reconcile Event: Invalid workload identity validity")
+		return ctrl.Result{}, nil
+	}
+	ca, err := loadIssuerCA(ctx, r.Client, identity.Spec.IssuerRef.Name)
+	if err != nil {
+		logger.Error(err, "Reconcile Event: Failed to load the issuer CA")
+		return ctrl.Result{}, err
+	}
+
+	secret := &corev1.Secret{}
+	err = r.Get(ctx, types.NamespacedName{Name: identity.Spec.SecretRef.Name, Namespace: identity.Namespace}, secret)
+	if client.IgnoreNotFound(err) != nil {
+		return ctrl.Result{}, err
+	}
+	svid := currentSVID(secret, ca.cert, spiffeID)
+	if svid == nil || identity.Status.ObservedGeneration != identity.Generation || time.Now().After(svidRenewalTime(svid)) {
+		serviceAccount := &corev1.ServiceAccount{}
+		err = r.Get(ctx, types.NamespacedName{Name: identity.Spec.ServiceAccountName, Namespace: identity.Namespace}, serviceAccount)
+		if apierrors.IsNotFound(err) {
+			// The ServiceAccount watch reconciles the WorkloadIdentity once it is created
+			logger.Info("Reconcile Event: ServiceAccount of the workload identity not found", "ServiceAccount", identity.Spec.ServiceAccountName)
+			r.Recorder.Eventf(identity, corev1.EventTypeWarning, "ServiceAccountNotFound",
+				"ServiceAccount %s not found", identity.Spec.ServiceAccountName)
+			return ctrl.Result{}, nil
+		}
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		request, err := r.approveSVID(ctx, identity, spiffeID, validity)
+		if issuanceBlocked(err) {
+			// The CertificateRequest is owned, its approval triggers a reconcile
+			logger.Info("Reconcile Event: SVID issuance blocked", "SPIFFEID", spiffeID, "Reason", err.Error())
+			return ctrl.Result{}, nil
+		}
+		if err != nil {
+			logger.Error(err, "Reconcile Event: Failed to request SVID approval", "SPIFFEID", spiffeID)
+			return ctrl.Result{}, err
+		}
+		svid, err = r.issueSVID(ctx, identity, request, ca, spiffeID, validity)
+		if issuanceBlocked(err) {
+			logger.Info("Reconcile Event: SVID issuance blocked", "SPIFFEID", spiffeID, "Reason", err.Error())
+			return ctrl.Result{}, nil
+		}
+		if err != nil {
+			logger.Error(err, "Reconcile Event: Failed to issue SVID", "SPIFFEID", spiffeID)
+			return ctrl.Result{}, err
+		}
+		identity.Status = certsv1.WorkloadIdentityStatus{
+			ObservedGeneration: identity.Generation,
+			SPIFFEID:           spiffeID,
+			ExpiryDate:         metav1.NewTime(svid.NotAfter),
+			RenewedAt:          metav1.NewTime(time.Now()),
+		}
+		err = r.Status().Update(ctx, identity)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		logger.Info("Reconcile Event: SVID issued", "SPIFFEID", spiffeID, "Expiry", svid.NotAfter)
+	}
+
+	err = r.syncTrustBundle(ctx, identity)
+	if err != nil {
+		logger.Error(err, "Reconcile Event: Failed to write the trust bundle")
+		return ctrl.Result{}, err
+	}
+	return ctrl.Result{RequeueAfter: time.Until(svidRenewalTime(svid))}, nil
+}
+
+// spiffeID returns the SPIFFE ID of the ServiceAccount of a WorkloadIdentity
+func (r *WorkloadIdentityReconciler) spiffeID(identity *certsv1.WorkloadIdentity) string {
+	id := url.URL{
+		Scheme: "spiffe",
+		Host:   r.trustDomain(),
+		Path:   "/ns/" + identity.Namespace + "/sa/" + identity.Spec.ServiceAccountName,
+	}
+	return id.String()
+}
+
+func (r *WorkloadIdentityReconciler) trustDomain() string {
+	if r.TrustDomain == "" {
+		return DefaultTrustDomain
+	}
+	return r.TrustDomain
+}
+
+// currentSVID returns the SVID stored in a Secret when it is signed by the CA
+// for the SPIFFE ID
+func currentSVID(secret *corev1.Secret, ca *x509.Certificate, spiffeID string) *x509.Certificate {
+	chain, err := helper.ParseCertificatesPEM(secret.Data["tls.crt"])
+	if err != nil || len(chain) == 0 || chain[0].CheckSignatureFrom(ca) != nil {
+		return nil
+	}
+	if len(chain[0].URIs) != 1 || chain[0].URIs[0].String() != spiffeID {
+		return nil
+	}
+	return chain[0]
+}
+
+// svidRenewalTime returns the time a third of the validity of an SVID is left at
+func svidRenewalTime(svid *x509.Certificate) time.Time {
+	return svid.NotAfter.Add(-svid.NotAfter.Sub(svid.NotBefore) / 3)
+}
+
+// svidRequestName returns the name of the CertificateRequest approving the SVIDs
+// of the current generation of a WorkloadIdentity
+func svidRequestName(identity *certsv1.WorkloadIdentity) string {
+	return fmt.Sprintf("%s-svid-%d", identity.Name, identity.Generation)
+}
+
+// svidCertificate returns the Certificate the CertificatePolicies evaluate for the
+// SVIDs of a WorkloadIdentity
+func svidCertificate(identity *certsv1.WorkloadIdentity, validity time.Duration) *certsv1.Certificate {
+	issuerRef := identity.Spec.IssuerRef
+	return &certsv1.Certificate{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        identity.Name,
+			Namespace:   identity.Namespace,
+			Annotations: map[string]string{"validityInHours": validity.String()},
+		},
+		Spec: certsv1.CertificateSpec{
+			Validity:  identity.Spec.Validity,
+			Usages:    svidUsages,
+			IssuerRef: &issuerRef,
+			SecretRef: identity.Spec.SecretRef,
+		},
+	}
+}
+
+// approveSVID returns the approved CertificateRequest of the generation of a
+// WorkloadIdentity. The request is created for the SPIFFE ID with a private key
+// kept aside for the first SVID of the generation. Requests refused by a policy
+// are denied, other requests are approved by the controller in namespaces which
+// do not require an approval.
+func (r *WorkloadIdentityReconciler) approveSVID(ctx context.Context, identity *certsv1.WorkloadIdentity, spiffeID string, validity time.Duration) (*certsv1.CertificateRequest, error) {
+	logger := log.FromContext(ctx)
+	name := svidRequestName(identity)
+	request := &certsv1.CertificateRequest{}
+	err := r.Get(ctx, types.NamespacedName{Name: name, Namespace: identity.Namespace}, request)
+	if client.IgnoreNotFound(err) != nil {
+		return nil, err
+	}
+	if apierrors.IsNotFound(err) {
+		request, err = r.createSVIDRequest(ctx, identity, name, spiffeID, validity)
+		if err != nil {
+			return nil, err
+		}
+	} else if !metav1.IsControlledBy(request, identity) {
+		return nil, fmt.Errorf("CertificateRequest %s/%s is not managed by WorkloadIdentity %s", request.Namespace, request.Name, identity.Name)
+	}
+
+	approved := meta.IsStatusConditionTrue(request.Status.Conditions, certsv1.CertificateRequestApproved)
+	denied := meta.IsStatusConditionTrue(request.Status.Conditions, certsv1.CertificateRequestDenied)
+	if !approved && !denied {
+		violation, err := CheckCertificatePolicies(ctx, r.Client, svidCertificate(identity, validity))
+		if err != nil {
+			return nil, err
+		}
+		if violation != nil {
+			logger.Info("Reconcile Event: CertificateRequest refused by policy", "CertificateRequest", name, "Policy", violation.Policy)
+			r.Recorder.Eventf(identity, corev1.EventTypeWarning, "PolicyViolation", "CertificateRequest %s: %v", name, violation)
+			err = decide(ctx, r.Client, request, certsv1.CertificateRequestDenied, "PolicyViolation", violation.Error())
+			if err != nil {
+				return nil, err
+			}
+			return nil, errIssuanceDenied
+		}
+		required, err := approvalRequired(ctx, r.Client, identity.Namespace)
+		if err != nil {
+			return nil, err
+		}
+		if required {
+			return nil, errIssuancePending
+		}
+		err = decide(ctx, r.Client, request, certsv1.CertificateRequestApproved, "AutoApproved",
+			fmt.Sprintf("Namespace %s does not require an approval", identity.Namespace))
+		if err != nil {
+			return nil, err
+		}
+	}
+	if denied {
+		return nil, errIssuanceDenied
+	}
+	err = refuseUnenforcedApproval(ctx, r.Client, identity.Namespace, r.ApprovalUnenforced)
+	if err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// createSVIDRequest generates the private key of the first SVID of a generation,
+// keeps it in a Secret and records its CSR in a new CertificateRequest. Both are
+// owned by the WorkloadIdentity.
+func (r *WorkloadIdentityReconciler) createSVIDRequest(ctx context.Context, identity *certsv1.WorkloadIdentity, name, spiffeID string, validity time.Duration) (*certsv1.CertificateRequest, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	id, err := url.Parse(spiffeID)
+	if err != nil {
+		return nil, err
+	}
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{URIs: []*url.URL{id}}, key)
+	if err != nil {
+		return nil, err
+	}
+
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: privateKeySecretName(name), Namespace: identity.Namespace},
+	}
+	_, err = controllerutil.CreateOrUpdate(ctx, r.Client, secret, func() error {
+		if !secret.CreationTimestamp.IsZero() && !metav1.IsControlledBy(secret, identity) {
+			return fmt.Errorf("secret %s/%s is not managed by WorkloadIdentity %s", secret.Namespace, secret.Name, identity.Name)
+		}
+		secret.Data = map[string][]byte{"tls.key": pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})}
+		return controllerutil.SetControllerReference(identity, secret, r.Scheme)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	issuerRef := identity.Spec.IssuerRef
+	request := &certsv1.CertificateRequest{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: identity.Namespace},
+		Spec: certsv1.CertificateRequestSpec{
+			CertificateName: identity.Name,
+			Request:         pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDER}),
+			Duration:        &metav1.Duration{Duration: validity},
+			Usages:          svidUsages,
+			IssuerRef:       &issuerRef,
+		},
+	}
+	err = controllerutil.SetControllerReference(identity, request, r.Scheme)
+	if err != nil {
+		return nil, err
+	}
+	err = r.Create(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	log.FromContext(ctx).Info("Reconcile Event: CertificateRequest created", "CertificateRequest", name)
+	return request, nil
+}
+
+// svidKey returns the private key of the next SVID: the key of the CSR of the
+// request for the first SVID of a generation, a fresh key for its renewals
+func (r *WorkloadIdentityReconciler) svidKey(ctx context.Context, request *certsv1.CertificateRequest) (*ecdsa.PrivateKey, error) {
+	if meta.IsStatusConditionTrue(request.Status.Conditions, certsv1.CertificateRequestReady) {
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	csr, err := helper.ParseCertificateRequestPEM(request.Spec.Request)
+	if err != nil {
+		return nil, err
+	}
+	secret := &corev1.Secret{}
+	err = r.Get(ctx, types.NamespacedName{Name: privateKeySecretName(request.Name), Namespace: request.Namespace}, secret)
+	if client.IgnoreNotFound(err) != nil {
+		return nil, err
+	}
+	var key *ecdsa.PrivateKey
+	if err == nil {
+		key, err = parseECPrivateKeyPEM(secret.Data["tls.key"])
+	}
+	if err == nil && !key.PublicKey.Equal(csr.PublicKey) {
+		err = fmt.Errorf("private key does not match the certificate request")
+	}
+	if err != nil {
+		// The request can not be completed without its private key, start over
+		log.FromContext(ctx).Info("Reconcile Event: Replacing CertificateRequest without a usable private key", "CertificateRequest", request.Name, "Reason", err.Error())
+		err = r.Delete(ctx, request)
+		if client.IgnoreNotFound(err) != nil {
+			return nil, err
+		}
+		return nil, errIssuancePending
+	}
+	return key, nil
+}
+
+// parseECPrivateKeyPEM parses a PEM encoded PKCS#8 ECDSA private key
+func parseECPrivateKeyPEM(keyPEM []byte) (*ecdsa.PrivateKey, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM encoded private key found")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("expected an ECDSA private key but got a %T", parsed)
+	}
+	return key, nil
+}
+
+// issueSVID signs a new SVID for an approved CertificateRequest and writes it to
+// the Secret owned by the WorkloadIdentity
+func (r *WorkloadIdentityReconciler) issueSVID(ctx context.Context, identity *certsv1.WorkloadIdentity, request *certsv1.CertificateRequest, ca *issuerCA, spiffeID string, validity time.Duration) (*x509.Certificate, error) {
+	key, err := r.svidKey(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	id, err := url.Parse(spiffeID)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		NotBefore:             now.Add(-5 * time.Minute),
+		NotAfter:              now.Add(validity),
+		URIs:                  []*url.URL{id},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	certPEM, err := helper.SignWithCA(template, key.Public(), ca.cert, ca.key)
+	if err != nil {
+		return nil, err
+	}
+	err = recordIssuedCertificate(ctx, r.Client, identity.Spec.IssuerRef.Name, certPEM, "")
+	if err != nil {
+		return nil, err
+	}
+
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: identity.Spec.SecretRef.Name, Namespace: identity.Namespace}}
+	_, err = controllerutil.CreateOrUpdate(ctx, r.Client, secret, func() error {
+		if !secret.CreationTimestamp.IsZero() && !metav1.IsControlledBy(secret, identity) {
+			return fmt.Errorf("secret %s/%s is not managed by WorkloadIdentity %s", secret.Namespace, secret.Name, identity.Name)
+		}
+		secret.Type = corev1.SecretTypeTLS
+		secret.Data = map[string][]byte{
+			"tls.crt": append(certPEM, ca.chain...),
+			"tls.key": pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}),
+			"ca.crt":  ca.root,
+		}
+		return controllerutil.SetControllerReference(identity, secret, r.Scheme)
+	})
+	if err != nil {
+		return nil, err
+	}
+	err = r.completeSVIDRequest(ctx, identity, request, certPEM)
+	if err != nil {
+		return nil, err
+	}
+	chain, err := helper.ParseCertificatesPEM(certPEM)
+	if err != nil {
+		return nil, err
+	}
+	return chain[0], nil
+}
+
+// completeSVIDRequest records the first SVID of a generation in its
+// CertificateRequest, deletes the private key kept aside for it and the requests
+// of earlier generations
+func (r *WorkloadIdentityReconciler) completeSVIDRequest(ctx context.Context, identity *certsv1.WorkloadIdentity, request *certsv1.CertificateRequest, certPEM []byte) error {
+	if meta.IsStatusConditionTrue(request.Status.Conditions, certsv1.CertificateRequestReady) {
+		return nil
+	}
+	request.Status.Certificate = certPEM
+	meta.SetStatusCondition(&request.Status.Conditions, metav1.Condition{
+		Type:    certsv1.CertificateRequestReady,
+		Status:  metav1.ConditionTrue,
+		Reason:  "Issued",
+		Message: "Certificate has been signed",
+	})
+	err := r.Status().Update(ctx, request)
+	if err != nil {
+		return err
+	}
+	secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: privateKeySecretName(request.Name), Namespace: request.Namespace}}
+	err = r.Delete(ctx, secret)
+	if client.IgnoreNotFound(err) != nil {
+		return err
+	}
+
+	requests := &certsv1.CertificateRequestList{}
+	err = r.List(ctx, requests, client.InNamespace(identity.Namespace))
+	if err != nil {
+		return err
+	}
+	for i := range requests.Items {
+		item := &requests.Items[i]
+		if item.Name == request.Name || !metav1.IsControlledBy(item, identity) {
+			continue
+		}
+		err = r.Delete(ctx, item)
+		if client.IgnoreNotFound(err) != nil {
+			return err
+		}
+		secret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: privateKeySecretName(item.Name), Namespace: item.Namespace}}
+		err = r.Delete(ctx, secret)
+		if client.IgnoreNotFound(err) != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncTrustBundle writes the CAs of the Issuers of all WorkloadIdentities to the
+// spiffe-bundle-<trust-domain> ConfigMap in the namespace of the WorkloadIdentity.
+// The ConfigMap is owned by the WorkloadIdentities of the namespace.
+func (r *WorkloadIdentityReconciler) syncTrustBundle(ctx context.Context, identity *certsv1.WorkloadIdentity) error {
+	trustDomain := r.trustDomain()
+	identities := &certsv1.WorkloadIdentityList{}
+	err := r.List(ctx, identities)
+	if err != nil {
+		return err
+	}
+	var issuers []string
+	var owners []*certsv1.WorkloadIdentity
+	for i := range identities.Items {
+		item := &identities.Items[i]
+		if !slices.Contains(issuers, item.Spec.IssuerRef.Name) {
+			issuers = append(issuers, item.Spec.IssuerRef.Name)
+		}
+		if item.Namespace == identity.Namespace {
+			owners = append(owners, item)
+		}
+	}
+	sort.Strings(issuers)
+	var roots []*x509.Certificate
+	for _, issuer := range issuers {
+		ca, err := loadIssuerCA(ctx, r.Client, issuer)
+		if err != nil {
+			log.FromContext(ctx).Info("Reconcile Event: Leaving the CA of an issuer out of the trust bundle", "Issuer", issuer, "Error", err.Error())
+			continue
+		}
+		certs, err := helper.ParseCertificatesPEM(ca.root)
+		if err != nil {
+			return err
+		}
+		for _, cert := range certs {
+			if !slices.ContainsFunc(roots, cert.Equal) {
+				roots = append(roots, cert)
+			}
+		}
+	}
+
+	configMap := &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: trustBundlePrefix + trustDomain, Namespace: identity.Namespace}}
+	_, err = controllerutil.CreateOrUpdate(ctx, r.Client, configMap, func() error {
+		if configMap.Labels == nil {
+			configMap.Labels = map[string]string{}
+		}
+		configMap.Labels[TrustDomainLabel] = trustDomain
+		configMap.Data = map[string]string{bundlePEMKey: string(helper.EncodeCertificatesPEM(roots))}
+		for _, owner := range owners {
+			err := controllerutil.SetOwnerReference(owner, configMap, r.Scheme)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return err
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *WorkloadIdentityReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&certsv1.WorkloadIdentity{}).
+		Owns(&corev1.Secret{}).
+		Owns(&certsv1.CertificateRequest{}).
+		Watches(&corev1.ServiceAccount{}, handler.EnqueueRequestsFromMapFunc(r.identitiesOfServiceAccount)).
+		Complete(r)
+}
+
+// identitiesOfServiceAccount returns the WorkloadIdentities of a ServiceAccount
+func (r *WorkloadIdentityReconciler) identitiesOfServiceAccount(ctx context.Context, obj client.Object) []reconcile.Request {
+	identities := &certsv1.WorkloadIdentityList{}
+	err := r.List(ctx, identities, client.InNamespace(obj.GetNamespace()))
+	if err != nil {
+		log.FromContext(ctx).Error(err, "Reconcile Event: Failed to list workload identities", "ServiceAccount", obj.GetName())
+		return nil
+	}
+	var requests []reconcile.Request
+	for _, identity := range identities.Items {
+		if identity.Spec.ServiceAccountName == obj.GetName() {
+			requests = append(requests, reconcile.Request{NamespacedName: client.ObjectKeyFromObject(&identity)})
+		}
+	}
+	return requests
+}
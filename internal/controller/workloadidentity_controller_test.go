@@ -0,0 +1,233 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controller
+
+import (
+	"context"
+	"crypto/x509"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
+	"github.com/PNarode/k8c-certs-manager/internal/helper"
+	"github.com/PNarode/k8c-certs-manager/internal/validation"
+)
+
+var _ = Describe("WorkloadIdentity Controller", func() {
+	var (
+		ctx    context.Context
+		scheme *runtime.Scheme
+		caPEM  []byte
+		caKey  []byte
+	)
+
+	BeforeEach(func() {
+		ctx = context.Background()
+		scheme = runtime.NewScheme()
+		utilruntime.Must(clientgoscheme.AddToScheme(scheme))
+		utilruntime.Must(certsv1.AddToScheme(scheme))
+		ca := certsv1.Certificate{Spec: certsv1.CertificateSpec{
+			DNSName: "ca.k8c.io", Validity: "1y", IsCA: true, SecretRef: certsv1.SecretRef{Name: "ca-tls"},
+		}}
+		Expect(validation.DefaultCertificate(ctx, &ca)).To(Succeed())
+		var err error
+		caPEM, caKey, err = helper.GenerateSelfSignedCertificate(ca)
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	newIdentity := func(name, namespace string) *certsv1.WorkloadIdentity {
+		return &certsv1.WorkloadIdentity{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, Generation: 1, UID: types.UID(namespace + "-" + name)},
+			Spec: certsv1.WorkloadIdentitySpec{
+				ServiceAccountName: name,
+				Validity:           "1h",
+				IssuerRef:          certsv1.IssuerReference{Name: "internal-ca"},
+				SecretRef:          certsv1.SecretRef{Name: name + "-svid"},
+			},
+		}
+	}
+	newClient := func(objects ...client.Object) client.Client {
+		objects = append(objects,
+			&corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: "ca-tls", Namespace: "certs-system"},
+				Data:       helper.SecretData(caPEM, caKey),
+			},
+			&certsv1.Issuer{
+				ObjectMeta: metav1.ObjectMeta{Name: "internal-ca"},
+				Spec: certsv1.IssuerSpec{CA: &certsv1.CAIssuer{
+					SecretRef: certsv1.SecretReference{Name: "ca-tls", Namespace: "certs-system"},
+				}},
+			},
+		)
+		return fake.NewClientBuilder().WithScheme(scheme).WithObjects(objects...).
+			WithStatusSubresource(&certsv1.WorkloadIdentity{}, &certsv1.Issuer{}, &certsv1.CertificateRequest{}).Build()
+	}
+	serviceAccount := func(name, namespace string) *corev1.ServiceAccount {
+		return &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace}}
+	}
+
+	It("should issue short-lived SVIDs and distribute the trust bundle of the trust domain", func() {
+		fakeClient := newClient(
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "shop"}},
+			serviceAccount("web", "shop"),
+			serviceAccount("frontend", "shop"),
+			newIdentity("web", "shop"),
+			newIdentity("api", "shop"),
+		)
+		r := &WorkloadIdentityReconciler{Client: fakeClient, Scheme: scheme, Recorder: record.NewFakeRecorder(10), TrustDomain: "prod.k8c.io"}
+		request := ctrl.Request{NamespacedName: types.NamespacedName{Name: "web", Namespace: "shop"}}
+		svidOf := func() *x509.Certificate {
+			secret := &corev1.Secret{}
+			Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "web-svid", Namespace: "shop"}, secret)).To(Succeed())
+			Expect(secret.Data).To(HaveKey("tls.key"))
+			Expect(secret.Data["ca.crt"]).To(Equal(caPEM))
+			chain, err := helper.ParseCertificatesPEM(secret.Data["tls.crt"])
+			Expect(err).NotTo(HaveOccurred())
+			return chain[0]
+		}
+
+		By("issuing an SVID with only the URI SAN of the ServiceAccount")
+		result, err := r.Reconcile(ctx, request)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(result.RequeueAfter).To(BeNumerically("~", 38*time.Minute, time.Minute))
+		svid := svidOf()
+		Expect(svid.URIs).To(HaveLen(1))
+		Expect(svid.URIs[0].String()).To(Equal("spiffe://prod.k8c.io/ns/shop/sa/web"))
+		Expect(svid.DNSNames).To(BeEmpty())
+		Expect(svid.IsCA).To(BeFalse())
+		Expect(svid.ExtKeyUsage).To(ConsistOf(x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth))
+		Expect(svid.NotAfter.Sub(svid.NotBefore)).To(Equal(time.Hour + 5*time.Minute))
+		identity := &certsv1.WorkloadIdentity{}
+		Expect(fakeClient.Get(ctx, request.NamespacedName, identity)).To(Succeed())
+		Expect(identity.Status.SPIFFEID).To(Equal("spiffe://prod.k8c.io/ns/shop/sa/web"))
+		Expect(identity.Status.ObservedGeneration).To(Equal(int64(1)))
+
+		By("recording the SVID in the auto-approved CertificateRequest of the generation")
+		svidRequest := &certsv1.CertificateRequest{}
+		Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "web-svid-1", Namespace: "shop"}, svidRequest)).To(Succeed())
+		Expect(meta.IsStatusConditionTrue(svidRequest.Status.Conditions, certsv1.CertificateRequestApproved)).To(BeTrue())
+		Expect(meta.IsStatusConditionTrue(svidRequest.Status.Conditions, certsv1.CertificateRequestReady)).To(BeTrue())
+		csr, err := helper.ParseCertificateRequestPEM(svidRequest.Spec.Request)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(csr.URIs[0].String()).To(Equal("spiffe://prod.k8c.io/ns/shop/sa/web"))
+		Expect(svid.PublicKey).To(Equal(csr.PublicKey))
+		Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "web-svid-1-private-key", Namespace: "shop"}, &corev1.Secret{})).NotTo(Succeed())
+
+		By("writing the trust bundle of the trust domain")
+		bundle := &corev1.ConfigMap{}
+		Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "spiffe-bundle-prod.k8c.io", Namespace: "shop"}, bundle)).To(Succeed())
+		Expect(bundle.Labels).To(HaveKeyWithValue(TrustDomainLabel, "prod.k8c.io"))
+		roots, err := helper.ParseCertificatesPEM([]byte(bundle.Data[bundlePEMKey]))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(roots).To(HaveLen(1))
+		Expect(svid.CheckSignatureFrom(roots[0])).To(Succeed())
+		Expect(bundle.OwnerReferences).To(ConsistOf(HaveField("Name", "web"), HaveField("Name", "api")))
+
+		By("keeping the SVID until it is due for renewal")
+		_, err = r.Reconcile(ctx, request)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(svidOf().SerialNumber).To(Equal(svid.SerialNumber))
+
+		By("reissuing it once the spec changed")
+		Expect(fakeClient.Get(ctx, request.NamespacedName, identity)).To(Succeed())
+		identity.Spec.ServiceAccountName = "frontend"
+		identity.Generation = 2
+		Expect(fakeClient.Update(ctx, identity)).To(Succeed())
+		_, err = r.Reconcile(ctx, request)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(svidOf().URIs[0].String()).To(Equal("spiffe://prod.k8c.io/ns/shop/sa/frontend"))
+		issued := &corev1.ConfigMapList{}
+		Expect(fakeClient.List(ctx, issued, client.MatchingLabels{issuedCertificateLabel: "true"})).To(Succeed())
+		Expect(issued.Items).To(HaveLen(2))
+		requests := &certsv1.CertificateRequestList{}
+		Expect(fakeClient.List(ctx, requests, client.InNamespace("shop"))).To(Succeed())
+		Expect(requests.Items).To(ConsistOf(HaveField("Name", "web-svid-2")))
+	})
+
+	It("should not issue an SVID for a missing ServiceAccount", func() {
+		fakeClient := newClient(
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "shop"}},
+			newIdentity("web", "shop"),
+		)
+		recorder := record.NewFakeRecorder(10)
+		r := &WorkloadIdentityReconciler{Client: fakeClient, Scheme: scheme, Recorder: recorder}
+		_, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: types.NamespacedName{Name: "web", Namespace: "shop"}})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(recorder.Events).To(Receive(HavePrefix("Warning ServiceAccountNotFound")))
+		Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "web-svid", Namespace: "shop"}, &corev1.Secret{})).NotTo(Succeed())
+		Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "web-svid-1", Namespace: "shop"}, &certsv1.CertificateRequest{})).NotTo(Succeed())
+	})
+
+	It("should only issue SVIDs admitted by the policies and approved", func() {
+		fakeClient := newClient(
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "shop", Labels: map[string]string{certsv1.RequireApprovalLabel: "true"}}},
+			&certsv1.CertificatePolicy{
+				ObjectMeta: metav1.ObjectMeta{Name: "short-lived", Namespace: "shop"},
+				Spec:       certsv1.CertificatePolicySpec{MaxValidity: "1d", AllowedDNSNames: []string{"*.shop.svc"}},
+			},
+			serviceAccount("web", "shop"),
+			newIdentity("web", "shop"),
+		)
+		recorder := record.NewFakeRecorder(10)
+		r := &WorkloadIdentityReconciler{Client: fakeClient, Scheme: scheme, Recorder: recorder}
+		request := ctrl.Request{NamespacedName: types.NamespacedName{Name: "web", Namespace: "shop"}}
+		svidRequest := &certsv1.CertificateRequest{}
+
+		By("waiting for the approval of the CertificateRequest")
+		_, err := r.Reconcile(ctx, request)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "web-svid-1", Namespace: "shop"}, svidRequest)).To(Succeed())
+		Expect(svidRequest.Status.Conditions).To(BeEmpty())
+		Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "web-svid", Namespace: "shop"}, &corev1.Secret{})).NotTo(Succeed())
+
+		By("issuing the SVID once approved")
+		meta.SetStatusCondition(&svidRequest.Status.Conditions, metav1.Condition{
+			Type: certsv1.CertificateRequestApproved, Status: metav1.ConditionTrue, Reason: "Approved", Message: "approved",
+		})
+		Expect(fakeClient.Status().Update(ctx, svidRequest)).To(Succeed())
+		_, err = r.Reconcile(ctx, request)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "web-svid", Namespace: "shop"}, &corev1.Secret{})).To(Succeed())
+
+		By("denying a validity refused by the policy")
+		identity := &certsv1.WorkloadIdentity{}
+		Expect(fakeClient.Get(ctx, request.NamespacedName, identity)).To(Succeed())
+		identity.Spec.Validity = "7d"
+		identity.Generation = 2
+		Expect(fakeClient.Update(ctx, identity)).To(Succeed())
+		_, err = r.Reconcile(ctx, request)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fakeClient.Get(ctx, types.NamespacedName{Name: "web-svid-2", Namespace: "shop"}, svidRequest)).To(Succeed())
+		Expect(meta.FindStatusCondition(svidRequest.Status.Conditions, certsv1.CertificateRequestDenied)).To(HaveField("Reason", "PolicyViolation"))
+		Expect(recorder.Events).To(Receive(HavePrefix("Warning PolicyViolation")))
+		Expect(fakeClient.Get(ctx, request.NamespacedName, identity)).To(Succeed())
+		Expect(identity.Status.ObservedGeneration).To(Equal(int64(1)))
+	})
+})
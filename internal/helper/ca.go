@@ -0,0 +1,94 @@
+package helper
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// ParseSignerPEM parses a PEM encoded RSA or ECDSA private key in its PKCS#1,
+// SEC 1 or PKCS#8 encoding
+func ParseSignerPEM(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no private key found")
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		return x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("unsupported private key type %T", key)
+		}
+		return signer, nil
+	}
+	return nil, fmt.Errorf("unsupported private key type %s", block.Type)
+}
+
+// ParseCA parses the PEM encoded certificate and private key of a CA
+func ParseCA(certPEM, keyPEM []byte) (*x509.Certificate, crypto.Signer, error) {
+	certs, err := ParseCertificatesPEM(certPEM)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(certs) == 0 {
+		return nil, nil, fmt.Errorf("no CA certificate found")
+	}
+	caCert := certs[0]
+	if !caCert.IsCA {
+		return nil, nil, fmt.Errorf("certificate %s is not a CA", caCert.Subject)
+	}
+	caKey, err := ParseSignerPEM(keyPEM)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !caKey.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(caCert.PublicKey) {
+		return nil, nil, fmt.Errorf("private key does not match the CA certificate %s", caCert.Subject)
+	}
+	return caCert, caKey, nil
+}
+
+// SignWithCA signs a certificate template for the public key with a CA. The
+// serial number is random and the validity ends with the validity of the CA.
+func SignWithCA(template *x509.Certificate, publicKey crypto.PublicKey, caCert *x509.Certificate, caKey crypto.Signer) ([]byte, error) {
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	template.SerialNumber = serialNumber
+	if template.NotAfter.After(caCert.NotAfter) {
+		template.NotAfter = caCert.NotAfter
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, caCert, publicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), nil
+}
+
+// CSRTemplate returns the template of a certificate carrying the subject and the
+// subject alternative names requested by a CSR, valid from now on for the validity
+func CSRTemplate(csr *x509.CertificateRequest, validity time.Duration) *x509.Certificate {
+	notBefore := time.Now()
+	return &x509.Certificate{
+		Subject:               csr.Subject,
+		DNSNames:              csr.DNSNames,
+		EmailAddresses:        csr.EmailAddresses,
+		IPAddresses:           csr.IPAddresses,
+		URIs:                  csr.URIs,
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(validity),
+		BasicConstraintsValid: true,
+	}
+}
@@ -1,61 +1,316 @@
 package helper
 
 import (
+	"crypto/ecdsa"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"fmt"
 	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
 	"math/big"
+	"slices"
 	"time"
 )
 
+// DefaultKeySize is the RSA key size used when a Certificate does not request one
+const DefaultKeySize = 2048
+
+// keyUsages maps the key usages of a Certificate to their x509 encoding
+var keyUsages = map[certsv1.KeyUsage]x509.KeyUsage{
+	certsv1.UsageDigitalSignature: x509.KeyUsageDigitalSignature,
+	certsv1.UsageKeyEncipherment:  x509.KeyUsageKeyEncipherment,
+}
+
+// extKeyUsages maps the extended key usages of a Certificate to their x509 encoding
+var extKeyUsages = map[certsv1.KeyUsage]x509.ExtKeyUsage{
+	certsv1.UsageServerAuth:      x509.ExtKeyUsageServerAuth,
+	certsv1.UsageClientAuth:      x509.ExtKeyUsageClientAuth,
+	certsv1.UsageCodeSigning:     x509.ExtKeyUsageCodeSigning,
+	certsv1.UsageEmailProtection: x509.ExtKeyUsageEmailProtection,
+}
+
+// setUsages adds the requested key usages and extended key usages to a template
+func setUsages(template *x509.Certificate, usages []certsv1.KeyUsage) {
+	for _, usage := range usages {
+		if keyUsage, found := keyUsages[usage]; found {
+			template.KeyUsage |= keyUsage
+		}
+		if extKeyUsage, found := extKeyUsages[usage]; found {
+			template.ExtKeyUsage = append(template.ExtKeyUsage, extKeyUsage)
+		}
+	}
+}
+
+// usagesOf returns the key usages and extended key usages of an issued certificate
+func usagesOf(cert *x509.Certificate) []string {
+	var usages []string
+	for usage, keyUsage := range keyUsages {
+		if cert.KeyUsage&keyUsage != 0 {
+			usages = append(usages, string(usage))
+		}
+	}
+	for usage, extKeyUsage := range extKeyUsages {
+		if slices.Contains(cert.ExtKeyUsage, extKeyUsage) {
+			usages = append(usages, string(usage))
+		}
+	}
+	return usages
+}
+
 // GenerateSelfSignedCertificate generates a new self-signed certificate
 func GenerateSelfSignedCertificate(cert certsv1.Certificate) ([]byte, []byte, error) {
-	// Create a new private key
-	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	priv, keyPEM, err := GeneratePrivateKey(cert)
 	if err != nil {
 		return nil, nil, err
 	}
-
-	// Create a template for the certificate
-	notBefore := time.Now()
 	validity, _ := time.ParseDuration(cert.Annotations["validityInHours"])
-	notAfter := notBefore.Add(validity)
-
-	details := cert.Spec
-	commonName := details.DNSName
-	if details.Subject.CommonName != "" {
-		commonName = details.Subject.CommonName
-	}
-	subject := pkix.Name{
-		Country:            details.Subject.Country,
-		Organization:       details.Subject.Organization,
-		OrganizationalUnit: details.Subject.OrganizationalUnit,
-		SerialNumber:       details.Subject.SerialNumber,
+	certPEM, err := SignSelfSigned(CertificateTemplate(cert, validity), priv)
+	if err != nil {
+		return nil, nil, err
+	}
+	return certPEM, keyPEM, nil
+}
+
+// GeneratePrivateKey generates the RSA private key of a Certificate and returns
+// it together with its PEM encoding
+func GeneratePrivateKey(cert certsv1.Certificate) (*rsa.PrivateKey, []byte, error) {
+	keySize := cert.Spec.KeySize
+	if keySize == 0 {
+		keySize = DefaultKeySize
+	}
+	priv, err := rsa.GenerateKey(rand.Reader, keySize)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})
+	return priv, keyPEM, nil
+}
+
+// ParsePrivateKeyPEM parses a PEM encoded RSA private key
+func ParsePrivateKeyPEM(data []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "RSA PRIVATE KEY" {
+		return nil, fmt.Errorf("no RSA private key found")
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
+
+// subjectOf returns the distinguished name requested by a Certificate
+func subjectOf(cert certsv1.Certificate) pkix.Name {
+	requested := certsv1.X509PkixSubject{}
+	if cert.Spec.Subject != nil {
+		requested = *cert.Spec.Subject
+	}
+	commonName := cert.Spec.DNSName
+	if requested.CommonName != "" {
+		commonName = requested.CommonName
+	}
+	return pkix.Name{
+		Country:            nonEmpty(requested.Country),
+		Organization:       nonEmpty(requested.Organization),
+		OrganizationalUnit: nonEmpty(requested.OrganizationalUnit),
+		SerialNumber:       requested.SerialNumber,
 		CommonName:         commonName,
 	}
-	template := x509.Certificate{
-		DNSNames:              []string{details.DNSName},
-		EmailAddresses:        details.EmailAddresses,
-		Subject:               subject,
+}
+
+// GenerateCertificateRequest creates the PEM encoded CSR requesting the subject
+// and subject alternative names of a Certificate, signed with its private key
+func GenerateCertificateRequest(cert certsv1.Certificate, priv *rsa.PrivateKey) ([]byte, error) {
+	template := x509.CertificateRequest{
+		Subject:        subjectOf(cert),
+		DNSNames:       DNSNames(cert),
+		EmailAddresses: cert.Spec.EmailAddresses,
+	}
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, &template, priv)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDER}), nil
+}
+
+// ParseCertificateRequestPEM parses a PEM encoded CSR and verifies its signature
+func ParseCertificateRequestPEM(data []byte) (*x509.CertificateRequest, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE REQUEST" {
+		return nil, fmt.Errorf("no certificate request found")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return csr, csr.CheckSignature()
+}
+
+// CertificateTemplate returns the template of the certificate requested by a
+// Certificate, valid from now on for the given validity. The serial number of the
+// subject is only an attribute of the distinguished name, the serial number of
+// the certificate is chosen randomly when it is signed.
+func CertificateTemplate(cert certsv1.Certificate, validity time.Duration) *x509.Certificate {
+	notBefore := time.Now()
+	template := &x509.Certificate{
+		DNSNames:              DNSNames(cert),
+		EmailAddresses:        cert.Spec.EmailAddresses,
+		Subject:               subjectOf(cert),
 		NotBefore:             notBefore,
-		NotAfter:              notAfter,
-		SerialNumber:          new(big.Int),
-		IsCA:                  false,
+		NotAfter:              notBefore.Add(validity),
+		IsCA:                  cert.Spec.IsCA,
 		BasicConstraintsValid: true,
 	}
-	template.SerialNumber.SetString(details.Subject.SerialNumber, 10)
-	// Create a certificate
-	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	setUsages(template, cert.Spec.Usages)
+	if cert.Spec.IsCA {
+		template.KeyUsage |= x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+	}
+	return template
+}
+
+// SignSelfSigned signs a certificate template with its own private key and a
+// random serial number unless the template sets one
+func SignSelfSigned(template *x509.Certificate, priv *rsa.PrivateKey) ([]byte, error) {
+	if template.SerialNumber == nil || template.SerialNumber.Sign() == 0 {
+		serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+		if err != nil {
+			return nil, err
+		}
+		template.SerialNumber = serialNumber
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}), nil
+}
 
-	// Encode the certificate and key in PEM format
-	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
-	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})
+// CSRMismatches lists the requests of a CSR which the spec of a Certificate does
+// not cover. The certificate issued for the CSR carries the names of the spec.
+func CSRMismatches(cert certsv1.Certificate, csr *x509.CertificateRequest) []string {
+	var mismatches []string
+	dnsNames := DNSNames(cert)
+	for _, name := range csr.DNSNames {
+		if !slices.Contains(dnsNames, name) {
+			mismatches = append(mismatches, fmt.Sprintf("dnsNames: %s is not requested by the Certificate", name))
+		}
+	}
+	for _, email := range csr.EmailAddresses {
+		if !slices.Contains(cert.Spec.EmailAddresses, email) {
+			mismatches = append(mismatches, fmt.Sprintf("emailAddresses: %s is not requested by the Certificate", email))
+		}
+	}
+	if len(csr.IPAddresses) > 0 || len(csr.URIs) > 0 {
+		mismatches = append(mismatches, "ipAddresses and uris are not supported")
+	}
+	commonName := subjectOf(cert).CommonName
+	if csr.Subject.CommonName != "" && csr.Subject.CommonName != commonName && !slices.Contains(dnsNames, csr.Subject.CommonName) {
+		mismatches = append(mismatches, fmt.Sprintf("subject.commonName: %s is not requested by the Certificate", csr.Subject.CommonName))
+	}
 
-	return certPEM, keyPEM, nil
+	keySize := cert.Spec.KeySize
+	if keySize == 0 {
+		keySize = DefaultKeySize
+	}
+	switch key := csr.PublicKey.(type) {
+	case *rsa.PublicKey:
+		if key.N.BitLen() < keySize {
+			mismatches = append(mismatches, fmt.Sprintf("keySize: expected at least %d, got %d", keySize, key.N.BitLen()))
+		}
+	case *ecdsa.PublicKey:
+	default:
+		mismatches = append(mismatches, fmt.Sprintf("publicKey: %s keys are not supported", csr.PublicKeyAlgorithm))
+	}
+	return mismatches
+}
+
+// SecretData returns the data of the Secret storing an issued certificate. The
+// issuing certificate of a self-signed certificate is the certificate itself.
+func SecretData(cert, key []byte) map[string][]byte {
+	return map[string][]byte{
+		"tls.crt": cert,
+		"tls.key": key,
+		"ca.crt":  cert,
+	}
+}
+
+// DNSNames returns the DNS subject alternative names requested by a Certificate
+func DNSNames(cert certsv1.Certificate) []string {
+	names := []string{cert.Spec.DNSName}
+	for _, name := range cert.Spec.DNSNames {
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// nonEmpty drops empty values so that they are not encoded as empty RDNs
+func nonEmpty(values []string) []string {
+	var result []string
+	for _, value := range values {
+		if value != "" {
+			result = append(result, value)
+		}
+	}
+	return result
+}
+
+// SpecMismatches lists the differences between the spec of a Certificate and the
+// certificate issued for it
+func SpecMismatches(cert certsv1.Certificate, issued *x509.Certificate) []string {
+	var mismatches []string
+	compare := func(field string, expected, actual []string) {
+		expected = slices.Clone(expected)
+		actual = slices.Clone(actual)
+		slices.Sort(expected)
+		slices.Sort(actual)
+		if !slices.Equal(expected, actual) {
+			mismatches = append(mismatches, fmt.Sprintf("%s: expected %v, got %v", field, expected, actual))
+		}
+	}
+
+	compare("dnsNames", DNSNames(cert), issued.DNSNames)
+	compare("emailAddresses", cert.Spec.EmailAddresses, issued.EmailAddresses)
+
+	commonName := cert.Spec.DNSName
+	if cert.Spec.Subject != nil {
+		if cert.Spec.Subject.CommonName != "" {
+			commonName = cert.Spec.Subject.CommonName
+		}
+		compare("subject.country", nonEmpty(cert.Spec.Subject.Country), issued.Subject.Country)
+		compare("subject.organization", nonEmpty(cert.Spec.Subject.Organization), issued.Subject.Organization)
+		compare("subject.organizationalUnit", nonEmpty(cert.Spec.Subject.OrganizationalUnit), issued.Subject.OrganizationalUnit)
+	}
+	if issued.Subject.CommonName != commonName {
+		mismatches = append(mismatches, fmt.Sprintf("subject.commonName: expected %q, got %q", commonName, issued.Subject.CommonName))
+	}
+
+	if len(cert.Spec.Usages) > 0 {
+		var usages []string
+		for _, usage := range cert.Spec.Usages {
+			usages = append(usages, string(usage))
+		}
+		compare("usages", usages, usagesOf(issued))
+	}
+
+	keySize := cert.Spec.KeySize
+	if keySize == 0 {
+		keySize = DefaultKeySize
+	}
+	// The key of a CSR generated outside the cluster is checked when it is signed
+	key, isRSA := issued.PublicKey.(*rsa.PublicKey)
+	switch {
+	case cert.Spec.CSR != nil:
+	case !isRSA:
+		mismatches = append(mismatches, "keySize: expected an RSA key")
+	case key.N.BitLen() != keySize:
+		mismatches = append(mismatches, fmt.Sprintf("keySize: expected %d, got %d", keySize, key.N.BitLen()))
+	}
+
+	if validity, err := time.ParseDuration(cert.Annotations["validityInHours"]); err == nil {
+		issuedValidity := issued.NotAfter.Sub(issued.NotBefore)
+		if (issuedValidity - validity).Abs() > time.Minute {
+			mismatches = append(mismatches, fmt.Sprintf("validity: expected %v, got %v", validity, issuedValidity.Round(time.Minute)))
+		}
+	}
+	return mismatches
 }
@@ -0,0 +1,89 @@
+package helper
+
+import (
+	"crypto/x509"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
+)
+
+var _ = Describe("SpecMismatches", func() {
+	newCertificate := func() certsv1.Certificate {
+		return certsv1.Certificate{
+			ObjectMeta: metav1.ObjectMeta{Annotations: map[string]string{"validityInHours": "24h"}},
+			Spec: certsv1.CertificateSpec{
+				DNSName:        "web.k8c.io",
+				DNSNames:       []string{"www.k8c.io"},
+				EmailAddresses: []string{"admin@k8c.io"},
+				Validity:       "1d",
+				Subject: &certsv1.X509PkixSubject{
+					CommonName:   "web",
+					Organization: []string{"k8c"},
+				},
+				Usages: []certsv1.KeyUsage{certsv1.UsageDigitalSignature, certsv1.UsageServerAuth},
+			},
+		}
+	}
+	var issued *x509.Certificate
+	BeforeEach(func() {
+		if issued != nil {
+			return
+		}
+		certPEM, _, err := GenerateSelfSignedCertificate(newCertificate())
+		Expect(err).NotTo(HaveOccurred())
+		chain, err := ParseCertificatesPEM(certPEM)
+		Expect(err).NotTo(HaveOccurred())
+		issued = chain[0]
+	})
+
+	DescribeTable("comparing the issued certificate with the spec",
+		func(modify func(*certsv1.Certificate), expected ...string) {
+			cert := newCertificate()
+			modify(&cert)
+			Expect(SpecMismatches(cert, issued)).To(ConsistOf(expected))
+		},
+		Entry("matching", func(*certsv1.Certificate) {}),
+		Entry("reordered DNS names", func(cert *certsv1.Certificate) {
+			cert.Spec.DNSName, cert.Spec.DNSNames = "www.k8c.io", []string{"web.k8c.io"}
+			cert.Spec.Subject.CommonName = "web"
+		}),
+		Entry("added DNS name", func(cert *certsv1.Certificate) {
+			cert.Spec.DNSNames = append(cert.Spec.DNSNames, "api.k8c.io")
+		}, "dnsNames: expected [api.k8c.io web.k8c.io www.k8c.io], got [web.k8c.io www.k8c.io]"),
+		Entry("removed email address", func(cert *certsv1.Certificate) {
+			cert.Spec.EmailAddresses = nil
+		}, "emailAddresses: expected [], got [admin@k8c.io]"),
+		Entry("changed organization", func(cert *certsv1.Certificate) {
+			cert.Spec.Subject.Organization = []string{"other"}
+		}, "subject.organization: expected [other], got [k8c]"),
+		Entry("empty subject entries are ignored", func(cert *certsv1.Certificate) {
+			cert.Spec.Subject.Country = []string{""}
+		}),
+		Entry("changed common name", func(cert *certsv1.Certificate) {
+			cert.Spec.Subject.CommonName = ""
+		}, `subject.commonName: expected "web.k8c.io", got "web"`),
+		Entry("changed usages", func(cert *certsv1.Certificate) {
+			cert.Spec.Usages = []certsv1.KeyUsage{certsv1.UsageServerAuth}
+		}, "usages: expected [server auth], got [digital signature server auth]"),
+		Entry("changed key size", func(cert *certsv1.Certificate) {
+			cert.Spec.KeySize = 4096
+		}, "keySize: expected 4096, got 2048"),
+		Entry("key size of a supplied CSR is not checked", func(cert *certsv1.Certificate) {
+			cert.Spec.KeySize = 4096
+			cert.Spec.CSR = &certsv1.CSRSource{Request: "csr"}
+		}),
+		Entry("changed validity", func(cert *certsv1.Certificate) {
+			cert.Annotations["validityInHours"] = "48h"
+		}, "validity: expected 48h0m0s, got 24h0m0s"),
+	)
+
+	It("should expect an RSA key", func() {
+		ecdsa := *issued
+		ecdsa.PublicKey = nil
+		ecdsa.PublicKeyAlgorithm = x509.ECDSA
+		Expect(SpecMismatches(newCertificate(), &ecdsa)).To(Equal([]string{"keySize: expected an RSA key"}))
+	})
+})
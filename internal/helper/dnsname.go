@@ -0,0 +1,25 @@
+package helper
+
+import (
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// WildcardPrefix is the only wildcard form accepted in a DNS name
+const WildcardPrefix = "*."
+
+// NormalizeDNSName converts an internationalized DNS name into its lower case
+// punycode (A-label) form. A leading wildcard label is preserved as is.
+func NormalizeDNSName(name string) (string, error) {
+	prefix := ""
+	if strings.HasPrefix(name, WildcardPrefix) {
+		prefix = WildcardPrefix
+		name = strings.TrimPrefix(name, WildcardPrefix)
+	}
+	ascii, err := idna.Lookup.ToASCII(name)
+	if err != nil {
+		return "", err
+	}
+	return prefix + strings.ToLower(ascii), nil
+}
@@ -0,0 +1,102 @@
+package helper
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"unicode/utf16"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// DefaultKeystorePassword is the password of trust stores which do not request one
+const DefaultKeystorePassword = "changeit"
+
+const (
+	jksMagic          = 0xFEEDFEED
+	jksVersion        = 2
+	jksTrustedCertTag = 2
+	// jksDigestWhitener is mixed into the JKS integrity digest by the Java keytool
+	jksDigestWhitener = "Mighty Aphrodite"
+)
+
+// ParseCertificatesPEM decodes all the CERTIFICATE blocks of a PEM document
+func ParseCertificatesPEM(data []byte) ([]*x509.Certificate, error) {
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// EncodeCertificatesPEM encodes certificates into a PEM document
+func EncodeCertificatesPEM(certs []*x509.Certificate) []byte {
+	var buf bytes.Buffer
+	for _, cert := range certs {
+		_ = pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	}
+	return buf.Bytes()
+}
+
+// EncodePKCS12TrustStore encodes certificates into a PKCS#12 trust store
+func EncodePKCS12TrustStore(certs []*x509.Certificate, password string) ([]byte, error) {
+	return pkcs12.Modern2023.EncodeTrustStore(certs, password)
+}
+
+// EncodeJKSTrustStore encodes certificates into a JKS trust store. The entries
+// are dated with the NotBefore of their certificate so that the output is stable
+// for the same input.
+func EncodeJKSTrustStore(certs []*x509.Certificate, password string) ([]byte, error) {
+	var buf bytes.Buffer
+	write := func(value interface{}) {
+		_ = binary.Write(&buf, binary.BigEndian, value)
+	}
+	writeUTF := func(value string) error {
+		if len(value) > 0xFFFF {
+			return fmt.Errorf("value %q is too long for a JKS trust store", value)
+		}
+		write(uint16(len(value)))
+		buf.WriteString(value)
+		return nil
+	}
+
+	write(uint32(jksMagic))
+	write(uint32(jksVersion))
+	write(uint32(len(certs)))
+	for i, cert := range certs {
+		write(uint32(jksTrustedCertTag))
+		if err := writeUTF(fmt.Sprintf("ca-%d", i)); err != nil {
+			return nil, err
+		}
+		write(cert.NotBefore.UnixMilli())
+		if err := writeUTF("X.509"); err != nil {
+			return nil, err
+		}
+		write(uint32(len(cert.Raw)))
+		buf.Write(cert.Raw)
+	}
+
+	digest := sha1.New()
+	for _, char := range utf16.Encode([]rune(password)) {
+		digest.Write([]byte{byte(char >> 8), byte(char)})
+	}
+	digest.Write([]byte(jksDigestWhitener))
+	digest.Write(buf.Bytes())
+	buf.Write(digest.Sum(nil))
+	return buf.Bytes(), nil
+}
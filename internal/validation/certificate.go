@@ -0,0 +1,198 @@
+package validation
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"net/mail"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	utilvalidation "k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+
+	"github.com/PNarode/k8c-certs-manager/api/v1"
+	"github.com/PNarode/k8c-certs-manager/internal/helper"
+)
+
+const (
+	// minValidity is the shortest lifetime accepted for a Certificate
+	minValidity = time.Hour
+	// maxValidity is the longest lifetime accepted for a Certificate
+	maxValidity = 10 * 365 * 24 * time.Hour
+	// minRenewBefore is the smallest renewal window accepted for a Certificate
+	minRenewBefore = 5 * time.Minute
+	// maxServerValidity is the longest lifetime browsers accept for server certificates
+	maxServerValidity = 398 * 24 * time.Hour
+)
+
+// CertificateWarnings reports configurations which are allowed but discouraged
+func CertificateWarnings(cert *v1.Certificate) []string {
+	warnings := []string{}
+	validity, _ := time.ParseDuration(cert.Annotations["validityInHours"])
+	if validity > maxServerValidity && slices.Contains(cert.Spec.Usages, v1.UsageServerAuth) {
+		warnings = append(warnings, fmt.Sprintf("spec.validity: %s is above %d days and will not be trusted by browsers for server certificates", cert.Spec.Validity, maxServerValidity/(24*time.Hour)))
+	}
+	// Generated keys are at least DefaultKeySize bits, only a provided CSR may carry a weaker one
+	if cert.Spec.CSR != nil && cert.Spec.CSR.Request != "" {
+		if csr, err := helper.ParseCertificateRequestPEM([]byte(cert.Spec.CSR.Request)); err == nil {
+			if key, ok := csr.PublicKey.(*rsa.PublicKey); ok && key.N.BitLen() < helper.DefaultKeySize {
+				warnings = append(warnings, fmt.Sprintf("spec.csr.request: RSA keys under %d bits are considered weak", helper.DefaultKeySize))
+			}
+		}
+	}
+	renewBefore, err := time.ParseDuration(cert.Spec.RenewBefore)
+	if err == nil && validity != 0 && renewBefore > validity/2 {
+		warnings = append(warnings, fmt.Sprintf("spec.renewBefore: %s is more than half of the certificate lifetime and will cause frequent renewals", cert.Spec.RenewBefore))
+	}
+	if cert.Spec.Subject != nil && cert.Spec.Subject.CommonName != "" && !hasSubjectAltName(cert, cert.Spec.Subject.CommonName) {
+		warnings = append(warnings, fmt.Sprintf("spec.subject.commonName: %s is not present in the subject alternative names and is ignored by most clients", cert.Spec.Subject.CommonName))
+	}
+	if strings.HasPrefix(cert.Spec.DNSName, helper.WildcardPrefix) {
+		warnings = append(warnings, fmt.Sprintf("spec.dnsName: wildcard certificate %s is valid for every host under the domain", cert.Spec.DNSName))
+	}
+	for i, name := range cert.Spec.DNSNames {
+		if strings.HasPrefix(name, helper.WildcardPrefix) {
+			warnings = append(warnings, fmt.Sprintf("spec.dnsNames[%d]: wildcard certificate %s is valid for every host under the domain", i, name))
+		}
+	}
+	if len(warnings) == 0 {
+		return nil
+	}
+	return warnings
+}
+
+// hasSubjectAltName reports whether the name is requested as a DNS or email subject alternative name
+func hasSubjectAltName(cert *v1.Certificate, name string) bool {
+	normalized, err := helper.NormalizeDNSName(name)
+	if err == nil {
+		for _, dnsName := range helper.DNSNames(*cert) {
+			if normalized == dnsName {
+				return true
+			}
+		}
+	}
+	for _, email := range cert.Spec.EmailAddresses {
+		if email == name {
+			return true
+		}
+	}
+	return strings.EqualFold(name, cert.Spec.DNSName)
+}
+
+// ValidateCertificate collects all the validation failures for a Certificate
+func ValidateCertificate(cert *v1.Certificate) field.ErrorList {
+	allErrs := field.ErrorList{}
+	specPath := field.NewPath("spec")
+
+	allErrs = append(allErrs, validateDNSName(specPath.Child("dnsName"), cert.Spec.DNSName)...)
+	for i, name := range cert.Spec.DNSNames {
+		allErrs = append(allErrs, validateDNSName(specPath.Child("dnsNames").Index(i), name)...)
+	}
+	for i, email := range cert.Spec.EmailAddresses {
+		allErrs = append(allErrs, validateEmailAddress(specPath.Child("emailAddresses").Index(i), email)...)
+	}
+	allErrs = append(allErrs, validateSubject(specPath.Child("subject"), cert.Spec.Subject)...)
+
+	validityPath := specPath.Child("validity")
+	validity := time.Duration(0)
+	validityValue, found := cert.Annotations["validityInHours"]
+	if !found {
+		allErrs = append(allErrs, field.Invalid(validityPath, cert.Spec.Validity, "no validity value annotations found"))
+	} else if parsed, err := time.ParseDuration(validityValue); err != nil {
+		allErrs = append(allErrs, field.Invalid(validityPath, cert.Spec.Validity, err.Error()))
+	} else if parsed < minValidity {
+		allErrs = append(allErrs, field.Invalid(validityPath, cert.Spec.Validity, fmt.Sprintf("minimum value should be %s", minValidity)))
+	} else if parsed > maxValidity {
+		allErrs = append(allErrs, field.Invalid(validityPath, cert.Spec.Validity, fmt.Sprintf("maximum value should be %s", maxValidity)))
+	} else {
+		validity = parsed
+	}
+
+	renewBeforePath := specPath.Child("renewBefore")
+	renewBefore, err := time.ParseDuration(cert.Spec.RenewBefore)
+	if err != nil {
+		allErrs = append(allErrs, field.Invalid(renewBeforePath, cert.Spec.RenewBefore, "should be a duration eg: 5m, 1h"))
+	} else if renewBefore < minRenewBefore {
+		allErrs = append(allErrs, field.Invalid(renewBeforePath, cert.Spec.RenewBefore, fmt.Sprintf("minimum value should be %s", minRenewBefore)))
+	} else if validity != 0 && renewBefore >= validity {
+		allErrs = append(allErrs, field.Invalid(renewBeforePath, cert.Spec.RenewBefore, fmt.Sprintf("should be less than validity %s", cert.Spec.Validity)))
+	}
+
+	if reason, found := cert.Annotations[v1.RevokeAnnotation]; found && reason != "" {
+		if !slices.Contains(v1.RevocationReasons, v1.RevocationReason(reason)) {
+			reasons := make([]string, 0, len(v1.RevocationReasons))
+			for _, code := range v1.RevocationReasons {
+				reasons = append(reasons, string(code))
+			}
+			sort.Strings(reasons)
+			allErrs = append(allErrs, field.NotSupported(field.NewPath("metadata", "annotations").Key(v1.RevokeAnnotation), reason, reasons))
+		}
+	}
+	return allErrs
+}
+
+// validateDNSName checks that a DNS name is an RFC 1123 subdomain once converted
+// to punycode, and that a wildcard is only used as the complete leftmost label.
+func validateDNSName(fldPath *field.Path, name string) field.ErrorList {
+	allErrs := field.ErrorList{}
+	if strings.Contains(strings.TrimPrefix(name, helper.WildcardPrefix), "*") {
+		return append(allErrs, field.Invalid(fldPath, name, "wildcard is only allowed as the complete leftmost label"))
+	}
+	normalized, err := helper.NormalizeDNSName(name)
+	if err != nil {
+		return append(allErrs, field.Invalid(fldPath, name, fmt.Sprintf("should be a valid internationalized domain name: %s", err.Error())))
+	}
+	labels := strings.TrimPrefix(normalized, helper.WildcardPrefix)
+	if labels != normalized && !strings.Contains(labels, ".") {
+		return append(allErrs, field.Invalid(fldPath, name, "wildcard should be followed by at least two labels"))
+	}
+	for _, msg := range utilvalidation.IsDNS1123Subdomain(labels) {
+		allErrs = append(allErrs, field.Invalid(fldPath, name, msg))
+	}
+	return allErrs
+}
+
+// validateEmailAddress checks that an email address is a bare RFC 5322 address
+// with a valid domain part.
+func validateEmailAddress(fldPath *field.Path, email string) field.ErrorList {
+	allErrs := field.ErrorList{}
+	address, err := mail.ParseAddress(email)
+	if err != nil {
+		return append(allErrs, field.Invalid(fldPath, email, fmt.Sprintf("should be a valid email address: %s", err.Error())))
+	}
+	if address.Name != "" || address.Address != email {
+		return append(allErrs, field.Invalid(fldPath, email, "should be a bare email address without a display name"))
+	}
+	domain := email[strings.LastIndex(email, "@")+1:]
+	if strings.HasPrefix(domain, helper.WildcardPrefix) {
+		return append(allErrs, field.Invalid(fldPath, email, "wildcard is not allowed in email addresses"))
+	}
+	return append(allErrs, validateDNSName(fldPath, domain)...)
+}
+
+// validateSubject rejects empty entries in the subject attribute lists as they
+// would be encoded as empty RDNs which some parsers refuse.
+func validateSubject(fldPath *field.Path, subject *v1.X509PkixSubject) field.ErrorList {
+	allErrs := field.ErrorList{}
+	if subject == nil {
+		return allErrs
+	}
+	attributes := []struct {
+		name   string
+		values []string
+	}{
+		{"country", subject.Country},
+		{"organization", subject.Organization},
+		{"organizationalUnit", subject.OrganizationalUnit},
+	}
+	for _, attribute := range attributes {
+		for i, value := range attribute.values {
+			if value == "" {
+				allErrs = append(allErrs, field.Invalid(fldPath.Child(attribute.name).Index(i), value, "empty entries are not allowed"))
+			}
+		}
+	}
+	return allErrs
+}
@@ -0,0 +1,132 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package validation
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+
+	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
+)
+
+var _ = Describe("Certificate Validation", func() {
+	newCertificate := func() *certsv1.Certificate {
+		return &certsv1.Certificate{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "test-resource",
+				Namespace:   "default",
+				Annotations: map[string]string{"validityInHours": "24h"},
+			},
+			Spec: certsv1.CertificateSpec{
+				DNSName:     "example.k8c.io",
+				Validity:    "1d",
+				RenewBefore: "5m",
+				SecretRef:   certsv1.SecretRef{Name: "test-secret"},
+			},
+		}
+	}
+	fieldPaths := func(errs field.ErrorList) []string {
+		paths := []string{}
+		for _, err := range errs {
+			paths = append(paths, err.Field)
+		}
+		return paths
+	}
+
+	It("should accept a valid certificate", func() {
+		Expect(ValidateCertificate(newCertificate())).To(BeEmpty())
+	})
+
+	It("should only accept a wildcard as the leftmost label", func() {
+		cert := newCertificate()
+		cert.Spec.DNSName = "*.k8c.io"
+		Expect(ValidateCertificate(cert)).To(BeEmpty())
+
+		cert.Spec.DNSName = "api.*.k8c.io"
+		Expect(fieldPaths(ValidateCertificate(cert))).To(ConsistOf("spec.dnsName"))
+
+		cert.Spec.DNSName = "*.io"
+		Expect(fieldPaths(ValidateCertificate(cert))).To(ConsistOf("spec.dnsName"))
+	})
+
+	It("should accept internationalized DNS names", func() {
+		cert := newCertificate()
+		cert.Spec.DNSName = "bücher.k8c.io"
+		Expect(ValidateCertificate(cert)).To(BeEmpty())
+	})
+
+	It("should reject invalid email addresses", func() {
+		cert := newCertificate()
+		cert.Spec.EmailAddresses = []string{"dev@k8c.io", "Dev <dev@k8c.io>", "dev"}
+		Expect(fieldPaths(ValidateCertificate(cert))).To(ConsistOf("spec.emailAddresses[1]", "spec.emailAddresses[2]"))
+	})
+
+	It("should reject empty subject entries", func() {
+		cert := newCertificate()
+		cert.Spec.Subject = &certsv1.X509PkixSubject{Country: []string{"IN", ""}}
+		Expect(fieldPaths(ValidateCertificate(cert))).To(ConsistOf("spec.subject.country[1]"))
+	})
+
+	It("should reject validity and renewBefore out of bounds", func() {
+		cert := newCertificate()
+		cert.Annotations["validityInHours"] = "30m"
+		Expect(fieldPaths(ValidateCertificate(cert))).To(ConsistOf("spec.validity"))
+
+		cert.Annotations["validityInHours"] = "1h"
+		cert.Spec.RenewBefore = "2h"
+		Expect(fieldPaths(ValidateCertificate(cert))).To(ConsistOf("spec.renewBefore"))
+
+		cert.Spec.RenewBefore = "1m"
+		Expect(fieldPaths(ValidateCertificate(cert))).To(ConsistOf("spec.renewBefore"))
+	})
+
+	It("should warn about weak or discouraged configurations", func() {
+		cert := newCertificate()
+		Expect(CertificateWarnings(cert)).To(BeEmpty())
+
+		By("only warning about the validity of server certificates")
+		cert.Annotations["validityInHours"] = "9600h"
+		cert.Spec.Validity = "400d"
+		Expect(CertificateWarnings(cert)).To(BeEmpty())
+		cert.Spec.Usages = []certsv1.KeyUsage{certsv1.UsageServerAuth}
+		Expect(CertificateWarnings(cert)).To(ConsistOf(HavePrefix("spec.validity")))
+
+		cert.Spec.RenewBefore = "5000h"
+		cert.Spec.DNSName = "*.k8c.io"
+		cert.Spec.Subject = &certsv1.X509PkixSubject{CommonName: "other.k8c.io"}
+		Expect(CertificateWarnings(cert)).To(HaveLen(4))
+
+		cert.Spec.Subject.CommonName = "*.k8c.io"
+		Expect(CertificateWarnings(cert)).To(HaveLen(3))
+
+		By("warning about a weak key in a provided CSR")
+		priv, err := rsa.GenerateKey(rand.Reader, 1024)
+		Expect(err).NotTo(HaveOccurred())
+		csrDER, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{DNSNames: []string{"*.k8c.io"}}, priv)
+		Expect(err).NotTo(HaveOccurred())
+		cert.Spec.CSR = &certsv1.CSRSource{Request: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDER}))}
+		Expect(CertificateWarnings(cert)).To(ContainElement(HavePrefix("spec.csr.request")))
+	})
+})
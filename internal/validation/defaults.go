@@ -0,0 +1,79 @@
+package validation
+
+import (
+	"context"
+	"fmt"
+	"github.com/PNarode/k8c-certs-manager/api/v1"
+	"github.com/PNarode/k8c-certs-manager/internal/helper"
+	logf "sigs.k8s.io/controller-runtime/pkg/log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultCertificate applies the default values to a Certificate. It is shared by
+// the mutating webhook, the reconciler and certsctl so that Certificates are
+// handled the same way when the admission webhooks are disabled or offline.
+func DefaultCertificate(ctx context.Context, cert *v1.Certificate) error {
+	log := logf.FromContext(ctx)
+
+	if cert.Annotations == nil {
+		cert.Annotations = map[string]string{}
+	}
+
+	// Internationalized DNS names are stored in their punycode form, invalid
+	// names are left untouched to be reported by the validation.
+	if dnsName, err := helper.NormalizeDNSName(cert.Spec.DNSName); err == nil {
+		cert.Spec.DNSName = dnsName
+	}
+	for i, name := range cert.Spec.DNSNames {
+		if dnsName, err := helper.NormalizeDNSName(name); err == nil {
+			cert.Spec.DNSNames[i] = dnsName
+		}
+	}
+
+	if cert.Spec.Subject == nil {
+		// Only the CommonName is defaulted so that the issued certificate carries a
+		// minimal valid distinguished name without empty RDNs. The serial number of
+		// the certificate is chosen randomly when it is signed.
+		cert.Spec.Subject = &v1.X509PkixSubject{
+			CommonName: cert.Spec.DNSName,
+		}
+	}
+
+	validity, err := ParseValidity(cert.Spec.Validity)
+	if err != nil {
+		log.Error(err, "failed to parse validity value for certificate")
+		return err
+	}
+	cert.Annotations["validityInHours"] = fmt.Sprintf("%vh", int64(validity/time.Hour))
+
+	if cert.Spec.RenewBefore == "" {
+		cert.Spec.RenewBefore = "5m"
+	}
+	return nil
+}
+
+// ParseValidity converts a validity value ending with `h`(hours), `d`(days) or
+// `y`(years) into a duration
+func ParseValidity(validityValue string) (time.Duration, error) {
+	invalid := fmt.Errorf("invalid value %s for Validity field, should end with `h`(hours), `d`(days) or `y`(years) e:g 1y, 20d", validityValue)
+	if validityValue == "" {
+		return 0, invalid
+	}
+	unit := time.Hour
+	switch validityValue[len(validityValue)-1:] {
+	case "d":
+		unit = 24 * time.Hour
+	case "y":
+		unit = 365 * 24 * time.Hour
+	case "h":
+	default:
+		return 0, invalid
+	}
+	value, err := strconv.Atoi(strings.TrimSuffix(validityValue, validityValue[len(validityValue)-1:]))
+	if err != nil {
+		return 0, invalid
+	}
+	return time.Duration(value) * unit, nil
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2024 PNarode.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package validation
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	certsv1 "github.com/PNarode/k8c-certs-manager/api/v1"
+	"github.com/PNarode/k8c-certs-manager/internal/helper"
+)
+
+var _ = Describe("Certificate Defaults", func() {
+	It("should default a minimal certificate", func() {
+		cert := &certsv1.Certificate{
+			Spec: certsv1.CertificateSpec{
+				DNSName:   "bücher.k8c.io",
+				Validity:  "2d",
+				SecretRef: certsv1.SecretRef{Name: "test-secret"},
+			},
+		}
+		Expect(DefaultCertificate(context.Background(), cert)).To(Succeed())
+		Expect(cert.Spec.DNSName).To(Equal("xn--bcher-kva.k8c.io"))
+		Expect(cert.Spec.Subject).NotTo(BeNil())
+		Expect(cert.Spec.Subject.CommonName).To(Equal("xn--bcher-kva.k8c.io"))
+		Expect(cert.Spec.Subject.Country).To(BeEmpty())
+		Expect(cert.Spec.Subject.Organization).To(BeEmpty())
+		Expect(cert.Spec.Subject.OrganizationalUnit).To(BeEmpty())
+		Expect(cert.Spec.Subject.SerialNumber).To(BeEmpty())
+		Expect(cert.Spec.RenewBefore).To(Equal("5m"))
+		Expect(cert.Annotations).To(HaveKeyWithValue("validityInHours", "48h"))
+	})
+
+	It("should issue a CommonName only subject with a random serial number", func() {
+		cert := &certsv1.Certificate{
+			Spec: certsv1.CertificateSpec{
+				DNSName:   "k8c.io",
+				Validity:  "1d",
+				SecretRef: certsv1.SecretRef{Name: "test-secret"},
+			},
+		}
+		Expect(DefaultCertificate(context.Background(), cert)).To(Succeed())
+		priv, err := rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).NotTo(HaveOccurred())
+		certPEM, err := helper.SignSelfSigned(helper.CertificateTemplate(*cert, 24*time.Hour), priv)
+		Expect(err).NotTo(HaveOccurred())
+		chain, err := helper.ParseCertificatesPEM(certPEM)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(chain).To(HaveLen(1))
+		issued := chain[0]
+		Expect(issued.Subject.Names).To(HaveLen(1))
+		Expect(issued.Subject.CommonName).To(Equal("k8c.io"))
+		Expect(issued.SerialNumber.Sign()).To(Equal(1))
+	})
+
+	It("should not reuse the subject serial number as the certificate serial number", func() {
+		cert := &certsv1.Certificate{
+			Spec: certsv1.CertificateSpec{
+				DNSName:   "k8c.io",
+				Validity:  "1d",
+				SecretRef: certsv1.SecretRef{Name: "test-secret"},
+				Subject:   &certsv1.X509PkixSubject{SerialNumber: "42"},
+			},
+		}
+		Expect(DefaultCertificate(context.Background(), cert)).To(Succeed())
+		priv, err := rsa.GenerateKey(rand.Reader, 2048)
+		Expect(err).NotTo(HaveOccurred())
+		issue := func() *x509.Certificate {
+			certPEM, err := helper.SignSelfSigned(helper.CertificateTemplate(*cert, 24*time.Hour), priv)
+			Expect(err).NotTo(HaveOccurred())
+			chain, err := helper.ParseCertificatesPEM(certPEM)
+			Expect(err).NotTo(HaveOccurred())
+			return chain[0]
+		}
+		issued, reissued := issue(), issue()
+		Expect(issued.Subject.SerialNumber).To(Equal("42"))
+		Expect(issued.SerialNumber.String()).NotTo(Equal("42"))
+		Expect(reissued.SerialNumber).NotTo(Equal(issued.SerialNumber))
+	})
+
+	It("should reject an unknown validity unit", func() {
+		cert := &certsv1.Certificate{Spec: certsv1.CertificateSpec{DNSName: "k8c.io", Validity: "2w"}}
+		Expect(DefaultCertificate(context.Background(), cert)).NotTo(Succeed())
+	})
+})